@@ -0,0 +1,152 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ambientRetryDelay is how long to wait before starting the ambient sound again after it failed.
+const ambientRetryDelay = time.Minute
+
+// ambientCommand creates the command that loops the ambient sound, and is replaced for testing.
+var ambientCommand = exec.Command
+
+// AmbientConfig sets a sound to loop quietly between lures, masking the noise the device makes.
+type AmbientConfig struct {
+	// File is the sound to loop.  No ambient sound is played if it isn't set.
+	File string `yaml:"file"`
+	// Volume is the schedule volume, from 1 to 10, to play it at.  It is 1 if it isn't set.
+	Volume int `yaml:"volume"`
+}
+
+// Validate checks the volume is one a schedule could use.
+func (conf AmbientConfig) Validate() error {
+	if conf.Volume < 0 || conf.Volume > 10 {
+		return fmt.Errorf("ambient volume must be from 1 to 10")
+	}
+	return nil
+}
+
+// NewAmbientLoop creates the configured ambient sound to play on player, or nil if there isn't one.
+func (conf AmbientConfig) NewAmbientLoop(player SoundCardPlayer) *AmbientLoop {
+	if conf.File == "" {
+		return nil
+	}
+	volume := conf.Volume
+	if volume == 0 {
+		volume = 1
+	}
+	return NewAmbientLoop(player, conf.File, volume)
+}
+
+// AmbientLoop plays a sound over and over in the background, pausing while the lures play so it
+// doesn't change how they sound, then starting again from the beginning once they have finished.
+type AmbientLoop struct {
+	player SoundCardPlayer
+	file   string
+	volume int
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	// paused counts the sounds playing that the loop is paused for.
+	paused int
+	cmd    *exec.Cmd
+	done   chan struct{}
+}
+
+// NewAmbientLoop creates a loop of file played at volume on player.  It doesn't play until started.
+func NewAmbientLoop(player SoundCardPlayer, file string, volume int) *AmbientLoop {
+	ambient := &AmbientLoop{player: player, file: file, volume: volume}
+	ambient.resumed = sync.NewCond(&ambient.mu)
+	return ambient
+}
+
+// Start plays the ambient sound in the background for as long as audiobait runs.
+func (ambient *AmbientLoop) Start() {
+	log.Printf("Playing ambient sound %s", ambient.file)
+	go ambient.run()
+}
+
+func (ambient *AmbientLoop) run() {
+	for {
+		ambient.mu.Lock()
+		for ambient.paused > 0 {
+			ambient.resumed.Wait()
+		}
+		if _, err := os.Stat(ambient.file); err != nil {
+			ambient.mu.Unlock()
+			log.Printf("Not playing ambient sound: %v", err)
+			time.Sleep(ambientRetryDelay)
+			continue
+		}
+		volumeArgs := ambient.player.applyVolume(ambient.volume)
+		args := append([]string{"-q", ambient.file}, volumeArgs...)
+		cmd := ambientCommand("play", append(args, "repeat", "-")...)
+		if ambient.player.device != "" {
+			cmd.Env = append(os.Environ(), "AUDIODRIVER=alsa", "AUDIODEV="+ambient.player.device)
+		}
+		if err := cmd.Start(); err != nil {
+			ambient.mu.Unlock()
+			log.Printf("Could not play ambient sound: %v", err)
+			time.Sleep(ambientRetryDelay)
+			continue
+		}
+		done := make(chan struct{})
+		ambient.cmd, ambient.done = cmd, done
+		ambient.mu.Unlock()
+
+		err := cmd.Wait()
+		close(done)
+		ambient.mu.Lock()
+		ambient.cmd = nil
+		stopped := ambient.paused > 0
+		ambient.mu.Unlock()
+		if !stopped {
+			log.Printf("Ambient sound stopped: %v", err)
+			time.Sleep(ambientRetryDelay)
+		}
+	}
+}
+
+// Pause stops the ambient sound until Resume is called, waiting for it to stop so a lure can play.
+// Each Pause must be followed by a Resume, and the sound only starts again once every sound it was
+// paused for has finished.  It does nothing to a nil loop.
+func (ambient *AmbientLoop) Pause() {
+	if ambient == nil {
+		return
+	}
+	ambient.mu.Lock()
+	ambient.paused++
+	cmd, done := ambient.cmd, ambient.done
+	ambient.mu.Unlock()
+	if cmd != nil {
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// Resume starts the ambient sound again after Pause.  It does nothing to a nil loop.
+func (ambient *AmbientLoop) Resume() {
+	if ambient == nil {
+		return
+	}
+	ambient.mu.Lock()
+	defer ambient.mu.Unlock()
+	ambient.paused--
+	ambient.resumed.Broadcast()
+}
+
+// playing checks whether the ambient sound is playing.
+func (ambient *AmbientLoop) playing() bool {
+	ambient.mu.Lock()
+	defer ambient.mu.Unlock()
+	return ambient.cmd != nil
+}
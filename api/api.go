@@ -20,83 +20,377 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const httpTimeout = 60 * time.Second
 
+// Default transport timeouts. These catch dead connections quickly
+// without limiting how long a large download may take.
+const (
+	defaultDialTimeout           = 30 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = httpTimeout
+)
+
+const millisecondRFC3339 = "2006-01-02T15:04:05.000Z07:00"
+
+// Option configures optional behaviour of a CacophonyAPI.
+type Option func(*CacophonyAPI)
+
+// WithLocalTimestamps reports event times in the device's local time
+// zone instead of UTC.
+func WithLocalTimestamps() Option {
+	return func(api *CacophonyAPI) {
+		api.localTimestamps = true
+	}
+}
+
+// WithMillisecondTimestamps reports event times with millisecond
+// precision instead of whole seconds.
+func WithMillisecondTimestamps() Option {
+	return func(api *CacophonyAPI) {
+		api.millisecondTimestamps = true
+	}
+}
+
+// WithEventsDisabled turns ReportEvent into a no-op which only logs the
+// event locally. This keeps test and commissioning events out of the
+// server's data.
+func WithEventsDisabled() Option {
+	return func(api *CacophonyAPI) {
+		api.eventsDisabled = true
+	}
+}
+
+// WithEventDefaults adds the given fields to the details of every event
+// reported, such as site or experiment identifiers. Fields already in an
+// event's details are not overridden.
+func WithEventDefaults(defaults map[string]interface{}) Option {
+	return func(api *CacophonyAPI) {
+		api.eventDefaults = defaults
+	}
+}
+
+// WithTransportTimeouts sets how long to wait to connect to the server,
+// to complete the TLS handshake and to receive response headers. API
+// requests are always limited to httpTimeout overall but file downloads
+// may take as long as they need once the response has started. A zero
+// timeout leaves that timeout as it was.
+func WithTransportTimeouts(dial, tlsHandshake, responseHeader time.Duration) Option {
+	return func(api *CacophonyAPI) {
+		if dial != 0 {
+			api.dialTimeout = dial
+		}
+		if tlsHandshake != 0 {
+			api.tlsHandshakeTimeout = tlsHandshake
+		}
+		if responseHeader != 0 {
+			api.responseHeaderTimeout = responseHeader
+		}
+	}
+}
+
+// WithFileServer downloads files from a separate server, such as a
+// mirror on the local network, instead of the API server. The API server
+// is used if the file server can't be reached.
+func WithFileServer(fileServerURL string) Option {
+	return func(api *CacophonyAPI) {
+		api.fileServerURL = fileServerURL
+	}
+}
+
+// WithHeaders adds static headers, such as API keys required by a
+// gateway, to every request sent. Authorization and Content-Type can't be
+// set this way as the client sets them itself.
+func WithHeaders(headers map[string]string) Option {
+	return func(api *CacophonyAPI) {
+		api.headers = make(map[string]string)
+		for key, value := range headers {
+			key = http.CanonicalHeaderKey(key)
+			if key == "Authorization" || key == "Content-Type" {
+				continue
+			}
+			api.headers[key] = value
+		}
+	}
+}
+
+// ErrReadOnly is returned by methods that would change state on the
+// server when the client was created with WithReadOnly.
+var ErrReadOnly = &Error{message: "not allowed by a read-only client", permanent: true}
+
+// WithReadOnly creates an observer client, for monitoring tools, that
+// can fetch schedules and files but never changes state on the server.
+// ReportEvent and ChangePassword return ErrReadOnly, as does NewAPI if
+// the device would have to be registered. Authenticating with an
+// existing password is still allowed.
+func WithReadOnly() Option {
+	return func(api *CacophonyAPI) {
+		api.readOnly = true
+	}
+}
+
 // NewAPI creates a CacophonyAPI instance and obtains a fresh JSON Web
 // Token. If no password is given then the device is registered.
-func NewAPI(serverURL, group, deviceName, password string) (*CacophonyAPI, error) {
-	api := &CacophonyAPI{
-		serverURL:  serverURL,
-		group:      group,
-		deviceName: deviceName,
-		password:   password,
-	}
-	err := api.newToken()
+func NewAPI(serverURL, group, deviceName, password string, opts ...Option) (*CacophonyAPI, error) {
+	api := NewUnauthenticatedAPI(serverURL, group, deviceName, password, opts...)
+	err := api.newToken(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	return api, nil
 }
 
+// NewUnauthenticatedAPI creates a CacophonyAPI instance without getting
+// a token or registering the device, for use with VerifyCredentials.
+func NewUnauthenticatedAPI(serverURL, group, deviceName, password string, opts ...Option) *CacophonyAPI {
+	api := &CacophonyAPI{
+		serverURL:             serverURL,
+		group:                 group,
+		deviceName:            deviceName,
+		password:              password,
+		dialTimeout:           defaultDialTimeout,
+		tlsHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		responseHeaderTimeout: defaultResponseHeaderTimeout,
+		breaker:               newCircuitBreaker(defaultBreakerThreshold, defaultBreakerCooldown),
+	}
+	for _, opt := range opts {
+		opt(api)
+	}
+	api.createClients()
+	return api
+}
+
 type CacophonyAPI struct {
-	serverURL      string
-	group          string
-	deviceName     string
-	password       string
-	token          string
-	justRegistered bool
+	serverURL             string
+	group                 string
+	deviceName            string
+	password              string
+	tokenMu               sync.RWMutex
+	token                 string
+	justRegistered        bool
+	localTimestamps       bool
+	millisecondTimestamps bool
+	eventsDisabled        bool
+	eventDefaults         map[string]interface{}
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	// client is used for API requests and downloadClient for file
+	// downloads, which have no overall time limit.
+	client         *http.Client
+	downloadClient *http.Client
+	breaker        *circuitBreaker
+	fileServerURL  string
+	readOnly       bool
+	headers        map[string]string
+	fileCache      FileCache
+	maxFileBytes   int64
+	scheduleMu     sync.Mutex
+	scheduleHash   string
+	throughput     throughputMeter
+	certPins       map[string]bool
+	eventReporters []EventReporter
+	tags           []string
+	scheduleChoice ScheduleChoice
+
+	signingKey      []byte
+	signedURLHeader bool
+
+	requestLogger *log.Logger
+
+	locationMu sync.Mutex
+	location   *Location
+
+	// partials has the validator, an ETag or Last-Modified date, of
+	// each partly downloaded file, keyed by the partial file's path.
+	partialMu sync.Mutex
+	partials  map[string]string
+}
+
+// createClients creates the HTTP clients used to talk to the server.
+func (api *CacophonyAPI) createClients() {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   api.dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   api.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: api.responseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       api.tlsConfig(),
+	}
+	var roundTripper http.RoundTripper = transport
+	if api.requestLogger != nil {
+		roundTripper = &loggingTransport{transport: transport, logger: api.requestLogger}
+	}
+	api.client = &http.Client{Transport: roundTripper, Timeout: httpTimeout}
+	api.downloadClient = &http.Client{Transport: roundTripper}
 }
 
 func (api *CacophonyAPI) Password() string {
 	return api.password
 }
 
+// DeviceName gets the name of the device the API is connected as.
+func (api *CacophonyAPI) DeviceName() string {
+	return api.deviceName
+}
+
 func (api *CacophonyAPI) JustRegistered() bool {
 	return api.justRegistered
 }
 
-func (api *CacophonyAPI) newToken() error {
+// RefreshToken obtains a fresh JSON Web Token from the server. Calling
+// this before the current token expires avoids a delay, or a failed
+// call, when the token next needs to be used.
+func (api *CacophonyAPI) RefreshToken(ctx context.Context) error {
+	return api.newToken(ctx)
+}
+
+// StartTokenRefresher renews the token in the background whenever it is
+// within window of expiring, until ctx is done. Tokens with no readable
+// expiry are never renewed early.
+func (api *CacophonyAPI) StartTokenRefresher(ctx context.Context, window time.Duration) {
+	go func() {
+		for {
+			claims, ok := parseTokenClaims(api.getToken())
+			if !ok || claims.expiry.IsZero() {
+				if !sleepContext(ctx, time.Hour) {
+					return
+				}
+				continue
+			}
+			if wait := time.Until(claims.expiry.Add(-window)); wait > 0 {
+				// Check again afterwards in case the token has been
+				// refreshed in the meantime.
+				if !sleepContext(ctx, wait) {
+					return
+				}
+				continue
+			}
+
+			if err := api.RefreshToken(ctx); err != nil {
+				log.Printf("Failed to refresh token: %v", err)
+			}
+			// Don't hammer the server if the new token is also close to
+			// expiring, or the refresh failed.
+			if !sleepContext(ctx, time.Minute) {
+				return
+			}
+		}
+	}()
+}
+
+// sleepContext sleeps for the duration, returning false if ctx is done
+// first.
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-time.After(duration):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (api *CacophonyAPI) getToken() string {
+	api.tokenMu.RLock()
+	defer api.tokenMu.RUnlock()
+	return api.token
+}
+
+func (api *CacophonyAPI) newToken(ctx context.Context) error {
+	if api.password == "" && api.readOnly {
+		return ErrReadOnly
+	}
 	if api.password == "" {
 		return errors.New("no password set")
 	}
+	token, err := api.authenticate(ctx)
+	if apiErr, ok := err.(*Error); ok && apiErr.kind == KindNetwork {
+		// Not being able to reach the server when getting a token has
+		// always been treated as permanent here. An unreachable server
+		// isn't, as that is expected while the network comes up.
+		apiErr.permanent = true
+		return apiErr
+	} else if err != nil {
+		return err
+	}
+	api.tokenMu.Lock()
+	api.token = token
+	api.tokenMu.Unlock()
+	return nil
+}
+
+// VerifyCredentials checks that the server accepts the device name and
+// password, without keeping the token or changing anything on the
+// server. The device is never registered, even when there is no
+// password. A permanent error of kind KindAuth is returned if the
+// credentials are rejected, and a temporary one of kind KindNetwork if
+// the server couldn't be reached.
+func (api *CacophonyAPI) VerifyCredentials(ctx context.Context) error {
+	if api.password == "" {
+		return &Error{message: "no password set", permanent: true, kind: KindAuth}
+	}
+	_, err := api.authenticate(ctx)
+	return err
+}
+
+// authenticate gets a token for the device's name and password.
+func (api *CacophonyAPI) authenticate(ctx context.Context) (string, error) {
 	payload, err := json.Marshal(map[string]string{
 		"devicename": api.deviceName,
 		"password":   api.password,
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	postResp, err := http.Post(
-		api.serverURL+"/authenticate_device",
-		"application/json",
-		bytes.NewReader(payload),
-	)
+	req, err := api.newServerRequest("POST", api.serverURL+"/authenticate_device", bytes.NewReader(payload))
 	if err != nil {
-		return err
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	postResp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", temporaryError(err)
 	}
 	defer postResp.Body.Close()
 
 	var resp tokenResponse
 	d := json.NewDecoder(postResp.Body)
 	if err := d.Decode(&resp); err != nil {
-		return fmt.Errorf("decode: %v", err)
+		return "", decodeError(err)
 	}
 	if !resp.Success {
-		return fmt.Errorf("registration failed: %v", resp.message())
+		return "", &Error{message: fmt.Sprintf("authentication failed: %v", resp.message()), permanent: true, kind: KindAuth}
 	}
-	api.token = resp.Token
-	return nil
+	if resp.Token == "" {
+		// Keeping an empty token would make every later call fail, so
+		// treat it as the server having a problem that may clear up.
+		log.Printf("Authentication succeeded for %s but the server gave no token", api.deviceName)
+		return "", &Error{message: "authentication gave no token", kind: KindServer}
+	}
+	return resp.Token, nil
 }
 
 type tokenResponse struct {
@@ -112,138 +406,782 @@ func (r *tokenResponse) message() string {
 	return "unknown"
 }
 
-func (api *CacophonyAPI) getFileFromJWT(jwt, path string) error {
-	// Create the file
+// fileServers gets the servers to try, in order, for file requests.
+func (api *CacophonyAPI) fileServers() []string {
+	if api.fileServerURL == "" || api.fileServerURL == api.serverURL {
+		return []string{api.serverURL}
+	}
+	return []string{api.fileServerURL, api.serverURL}
+}
 
-	out, err := os.Create(path)
-	if err != nil {
-		return err
+// doFileRequest sends a request for path to each file server in turn
+// until one of them can be reached. The Authorization header is only sent
+// if authorization is given, along with any other headers in header.
+// Tokens in path are masked in the errors returned and logged.
+func (api *CacophonyAPI) doFileRequest(ctx context.Context, client *http.Client, path string, authorization string, header http.Header) (*http.Response, error) {
+	var lastErr error
+	for _, server := range api.fileServers() {
+		req, err := api.newServerRequest("GET", server+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+
+		resp, err := client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		err = redactURLError(err)
+		log.Printf("Could not reach file server %s: %v", server, err)
+		lastErr = err
+	}
+	return nil, temporaryError(lastErr)
+}
+
+// PartialFileExt is added to the name of a file while it is being
+// downloaded. The file is renamed once it is complete.
+const PartialFileExt = ".part"
+
+// getFileFromJWT downloads a file from its signed URL. If conditional is
+// set and the file cache has an ETag for the file then the file is only
+// downloaded if it has changed. If resume is set and an earlier attempt
+// was cut short, only the rest of the file is asked for, if it is still
+// the same file that was started, and the download starts again from the
+// beginning if the server sends anything else. A download that is cut
+// short keeps what it got so that it can be resumed. It returns whether
+// the file was written.
+func (api *CacophonyAPI) getFileFromJWT(ctx context.Context, jwt, path string, fileID int, conditional, resume bool) (bool, error) {
+	header := http.Header{}
+	etag := ""
+	if conditional && api.fileCache != nil && fileID != 0 {
+		etag, _ = api.fileCache.ETag(fileID)
+	}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+
+	// Write the body to a temporary file first so that a failed or
+	// cancelled download never leaves a partial file at path.
+	tmpPath := path + PartialFileExt
+	var offset int64
+	validator := api.partialValidator(tmpPath)
+	if info, err := os.Stat(tmpPath); resume && err == nil && validator != "" {
+		offset = info.Size()
+	} else {
+		api.removePartial(tmpPath)
+	}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// Only the rest of the same file is wanted, otherwise the
+		// server sends all of the new one.
+		header.Set("If-Range", validator)
 	}
-	defer out.Close()
 
 	// Get the data
-	resp, err := http.Get(api.serverURL + "/api/v1/signedUrl?jwt=" + jwt)
+	signedURL, authorization := api.signedURLRequest(jwt)
+	resp, err := api.doFileRequest(ctx, api.downloadClient, signedURL, authorization, header)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer resp.Body.Close()
 
 	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		api.removePartial(tmpPath)
+		return false, nil
+	}
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp); !ok || start != offset {
+			log.Printf("Server resumed file %d from the wrong place (%q), starting again", fileID, resp.Header.Get("Content-Range"))
+			resp.Body.Close()
+			api.removePartial(tmpPath)
+			return api.getFileFromJWT(ctx, jwt, path, fileID, conditional, false)
+		}
+		log.Printf("Resuming download of file %d from byte %d", fileID, offset)
+	case resp.StatusCode == http.StatusOK:
+		// The server sent the whole file, so start again.
+		offset = 0
+	default:
+		return false, statusError(fmt.Sprintf("bad status: %s", resp.Status), resp)
 	}
 
-	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+	if api.maxFileBytes > 0 && offset+resp.ContentLength > api.maxFileBytes {
+		api.removePartial(tmpPath)
+		return false, fileTooLargeError(offset+resp.ContentLength, api.maxFileBytes)
 	}
 
-	return nil
+	api.setPartialValidator(tmpPath, responseValidator(resp))
+	if err := api.writeFile(tmpPath, offset, resp.Body); err != nil {
+		if ctx.Err() != nil {
+			api.removePartial(tmpPath)
+			return false, ctx.Err()
+		}
+		if IsPermanentError(err) {
+			api.removePartial(tmpPath)
+		}
+		return false, err
+	}
+	api.setPartialValidator(tmpPath, "")
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return false, diskError(err)
+	}
+
+	if newETag := resp.Header.Get("ETag"); newETag != "" && api.fileCache != nil && fileID != 0 {
+		api.fileCache.SetETag(fileID, newETag)
+	}
+	return true, nil
+}
+
+// contentRangeStart gets the first byte of a partial response from its
+// Content-Range header.
+func contentRangeStart(resp *http.Response) (int64, bool) {
+	var start, end int64
+	var size string
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// responseValidator gets what identifies the version of the file a
+// response has, for asking for the rest of it with If-Range. Weak ETags
+// can't be used for that, so the Last-Modified date is used instead.
+func responseValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// partialValidator gets the validator of the partly downloaded file at
+// tmpPath, or "" if it isn't known and so the download can't be resumed.
+func (api *CacophonyAPI) partialValidator(tmpPath string) string {
+	api.partialMu.Lock()
+	defer api.partialMu.Unlock()
+	return api.partials[tmpPath]
+}
+
+// setPartialValidator records the validator of the file being downloaded
+// to tmpPath, or forgets it if validator is "".
+func (api *CacophonyAPI) setPartialValidator(tmpPath, validator string) {
+	api.partialMu.Lock()
+	defer api.partialMu.Unlock()
+	if validator == "" {
+		delete(api.partials, tmpPath)
+		return
+	}
+	if api.partials == nil {
+		api.partials = make(map[string]string)
+	}
+	api.partials[tmpPath] = validator
+}
+
+// removePartial removes a partly downloaded file so that it isn't
+// resumed.
+func (api *CacophonyAPI) removePartial(tmpPath string) {
+	api.setPartialValidator(tmpPath, "")
+	os.Remove(tmpPath)
 }
 
 // GetFileDetails will download the file details from the files api.  This can then be parsed into
 // DownloadFile to download the file
-func (api *CacophonyAPI) GetFileDetails(fileID int) (*FileResponse, error) {
-	buf := new(bytes.Buffer)
-
-	req, err := http.NewRequest("GET", api.serverURL+"/api/v1/files/"+strconv.Itoa(fileID), buf)
-	req.Header.Set("Authorization", api.token)
-	client := new(http.Client)
+func (api *CacophonyAPI) GetFileDetails(fileID int) (_ *FileResponse, err error) {
+	if err := api.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { api.breaker.record(err) }()
+	return api.getFileDetails(fileID)
+}
 
-	resp, err := client.Do(req)
+// getFileDetails gets the file details without going through the
+// circuit breaker, for calls already let through it, so that a call
+// probing the server isn't stopped by its own probe.
+func (api *CacophonyAPI) getFileDetails(fileID int) (*FileResponse, error) {
+	resp, err := api.doFileRequest(context.Background(), api.client, "/api/v1/files/"+strconv.Itoa(fileID), api.getToken(), nil)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	var fr FileResponse
+	if !isHTTPSuccess(resp.StatusCode) {
+		return nil, statusError(fmt.Sprintf("file details request failed (%d)", resp.StatusCode), resp)
+	}
+
+	fr := FileResponse{fileID: fileID}
 	d := json.NewDecoder(resp.Body)
 	if err := d.Decode(&fr); err != nil {
-		return &fr, err
+		return &fr, decodeError(err)
 	}
 	return &fr, nil
 }
 
 // DownloadFile will take the file details from GetFileDetails and download the file to a specified path
 func (api *CacophonyAPI) DownloadFile(fileResponse *FileResponse, filePath string) error {
+	return api.DownloadFileContext(context.Background(), fileResponse, filePath)
+}
+
+// DownloadFileContext downloads a file as DownloadFile does, stopping if
+// ctx is done. A cancelled download leaves nothing behind at filePath or
+// in its temporary file, and returns ctx's error.
+func (api *CacophonyAPI) DownloadFileContext(ctx context.Context, fileResponse *FileResponse, filePath string) error {
 	if _, err := os.Stat(filePath); err == nil {
 		return err
 	}
 
-	return api.getFileFromJWT(fileResponse.Jwt, filePath)
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	_, err := api.getFileWithRetries(ctx, fileResponse, filePath, false)
+	api.breaker.recordUnlessCancelled(ctx, err)
+	return err
+}
+
+// DownloadFileToDir downloads the file with the given ID into dir, named
+// as FileDetails.FileName names it, and returns the path it was saved to.
+// As with DownloadFile, a file already at that path is kept.
+func (api *CacophonyAPI) DownloadFileToDir(dir string, fileID int) (string, error) {
+	fileResponse, err := api.GetFileDetails(fileID)
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(dir, fileResponse.File.Details.FileName(fileID))
+	if err := api.DownloadFile(fileResponse, filePath); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// writeFile saves a download, enforcing the file size limit however the
+// response is sent.
+func (api *CacophonyAPI) writeFile(path string, offset int64, body io.Reader) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	out, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return diskError(err)
+	}
+	defer out.Close()
+
+	if api.maxFileBytes > 0 {
+		body = io.LimitReader(body, api.maxFileBytes-offset+1)
+	}
+	start := time.Now()
+	written, err := io.Copy(out, body)
+	if err != nil {
+		return temporaryError(err)
+	}
+	api.throughput.record(written, time.Since(start), time.Now())
+	if api.maxFileBytes > 0 && offset+written > api.maxFileBytes {
+		return fileTooLargeError(offset+written, api.maxFileBytes)
+	}
+	return out.Close()
+}
+
+// WithMaxFileBytes limits the size of file downloads. A larger file is
+// abandoned with a permanent error so that one bad file can't fill the
+// device's storage. Zero means no limit.
+func WithMaxFileBytes(maxBytes int64) Option {
+	return func(api *CacophonyAPI) {
+		api.maxFileBytes = maxBytes
+	}
+}
+
+func fileTooLargeError(size, maxBytes int64) *Error {
+	return &Error{message: fmt.Sprintf("file is too large (at least %d bytes, limit is %d)", size, maxBytes), permanent: true}
+}
+
+// FileCache records the ETags of downloaded files so that RefreshFile
+// only downloads files that have changed.
+type FileCache interface {
+	ETag(fileID int) (string, bool)
+	SetETag(fileID int, etag string)
+}
+
+// WithFileCache records the ETags of downloaded files in cache.
+func WithFileCache(cache FileCache) Option {
+	return func(api *CacophonyAPI) {
+		api.fileCache = cache
+	}
+}
+
+// RefreshFile makes sure the file at filePath is the current version,
+// downloading it again if it has changed or isn't there. When the file
+// cache has its ETag and the file is on disk the server is asked to only
+// send it if it has changed, so an unchanged file costs one small
+// request. It returns whether the file was written.
+func (api *CacophonyAPI) RefreshFile(fileResponse *FileResponse, filePath string) (bool, error) {
+	_, statErr := os.Stat(filePath)
+	return api.RefreshFileAt(fileResponse, filePath, statErr == nil)
+}
+
+// RefreshFileAt downloads the file to filePath if it has changed, as
+// RefreshFile does, for when the copy the caller has isn't kept at
+// filePath, such as when it has been converted to another format.
+// haveCopy says whether the caller has the last version downloaded; if
+// not the file is always downloaded.
+func (api *CacophonyAPI) RefreshFileAt(fileResponse *FileResponse, filePath string, haveCopy bool) (bool, error) {
+	if err := api.breaker.allow(); err != nil {
+		return false, err
+	}
+	written, err := api.getFileWithRetries(context.Background(), fileResponse, filePath, haveCopy)
+	api.breaker.record(err)
+	return written, err
+}
+
+// signedURLAttempts is how many times a file download from its signed
+// URL is tried, and signedURLRetryWait how long to wait after the first
+// temporary failure. The wait doubles after each failure.
+const signedURLAttempts = 4
+
+// signedURLRefreshes is the most new signed URLs requested for one file.
+const signedURLRefreshes = 2
+
+var signedURLRetryWait = 2 * time.Second
+
+// getFileWithRetries downloads a file from its signed URL. If the signed
+// URL has expired a new one is requested, and if the storage behind it
+// has a temporary problem the download is just tried again. A download
+// cut short is resumed from where it got to, with a new signed URL
+// straight away if the one it was using has expired since it started.
+func (api *CacophonyAPI) getFileWithRetries(ctx context.Context, fileResponse *FileResponse, filePath string, conditional bool) (_ bool, err error) {
+	defer func() {
+		if err != nil {
+			os.Remove(filePath + PartialFileExt)
+		}
+	}()
+	jwt := fileResponse.Jwt
+	wait := signedURLRetryWait
+	refreshes := 0
+	for attempt := 1; ; attempt++ {
+		written, err := api.getFileFromJWT(ctx, jwt, filePath, fileResponse.fileID, conditional, attempt > 1)
+		if err == nil || err == ctx.Err() || attempt == signedURLAttempts {
+			return written, err
+		}
+
+		expired := isSignedURLExpired(err) || cutShort(filePath) && signedURLHasExpired(jwt)
+		switch {
+		case expired && fileResponse.fileID != 0 && refreshes < signedURLRefreshes:
+			log.Printf("Signed URL for file %d expired, requesting a new one", fileResponse.fileID)
+			refreshes++
+			// The download has already been let through the breaker,
+			// which is half-open while it probes the server.
+			fresh, err := api.getFileDetails(fileResponse.fileID)
+			if err != nil {
+				return false, err
+			}
+			jwt = fresh.Jwt
+		case !IsPermanentError(err):
+			delay := wait
+			if retryAfter, ok := RetryAfter(err); ok {
+				delay = retryAfter
+			}
+			log.Printf("Download of file failed, trying again in %s: %v", delay, err)
+			if !sleepContext(ctx, delay) {
+				return false, ctx.Err()
+			}
+			wait *= 2
+		default:
+			return false, err
+		}
+	}
+}
+
+// cutShort checks whether a download of filePath failed part way
+// through, keeping the part it got so that it can be resumed.
+func cutShort(filePath string) bool {
+	info, err := os.Stat(filePath + PartialFileExt)
+	return err == nil && info.Size() > 0
+}
+
+// signedURLHasExpired checks whether the token for a signed URL says it
+// has expired. Tokens that can't be read are taken not to have.
+func signedURLHasExpired(jwt string) bool {
+	claims, ok := parseTokenClaims(jwt)
+	return ok && !claims.expiry.IsZero() && time.Now().After(claims.expiry)
+}
+
+// isSignedURLExpired checks whether a download failed because its
+// signed URL was no longer accepted.
+func isSignedURLExpired(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && (apiErr.statusCode == http.StatusUnauthorized || apiErr.statusCode == http.StatusForbidden)
+}
+
+// filesPageSize is how many files are asked for in each request when
+// listing files.
+const filesPageSize = 100
+
+// ListAudioFiles gets the IDs of all the audio bait files available to
+// the device's group.
+func (api *CacophonyAPI) ListAudioFiles(ctx context.Context) (_ []int, err error) {
+	if err := api.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	where := url.QueryEscape(`{"type":"audioBait"}`)
+	var fileIDs []int
+	for offset := 0; ; offset += filesPageSize {
+		path := fmt.Sprintf("/api/v1/files?where=%s&limit=%d&offset=%d", where, filesPageSize, offset)
+		req, err := api.newRequest("GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := api.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, temporaryError(err)
+		}
+
+		var page filesResponse
+		if !isHTTPSuccess(resp.StatusCode) {
+			err = responseError(resp)
+		} else if decodeErr := json.NewDecoder(resp.Body).Decode(&page); decodeErr != nil {
+			err = decodeError(decodeErr)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range page.Rows {
+			fileIDs = append(fileIDs, row.ID)
+		}
+		if len(page.Rows) < filesPageSize || len(fileIDs) >= page.Count {
+			return fileIDs, nil
+		}
+	}
+}
+
+type filesResponse struct {
+	Count int `json:"count"`
+	Rows  []struct {
+		ID int `json:"id"`
+	} `json:"rows"`
 }
 
 type FileResponse struct {
-	File FileInfo
-	Jwt  string
+	File FileInfo `json:"file"`
+	Jwt  string   `json:"jwt"`
+	// fileID is the ID the details were requested for, so that a new
+	// signed URL can be requested if needed.
+	fileID int
 }
 
 type FileInfo struct {
-	Details FileDetails
-	Type    string
+	Details FileDetails `json:"details"`
+	Type    string      `json:"type"`
 }
 
 type FileDetails struct {
-	Name         string
-	OriginalName string
+	Name         string `json:"name"`
+	OriginalName string `json:"originalName"`
+	// GainDB is how much the server says to adjust the file's level by
+	// when it is played. Zero means no adjustment.
+	GainDB float64 `json:"gainDb"`
+	// TargetLUFS is the loudness the server says the file should be
+	// played at, if no gain is given. Zero means no target.
+	TargetLUFS float64 `json:"targetLUFS"`
 }
 
+// FileName gets the name a file is saved as by default: its name followed
+// by its ID, with the extension of its original name.
+func (details FileDetails) FileName(fileID int) string {
+	fileNameParts := strings.Split(details.OriginalName, ".")
+	fileExt := ""
+	if len(fileNameParts) > 1 {
+		fileExt = "." + fileNameParts[len(fileNameParts)-1]
+	}
+	return details.Name + "-" + strconv.Itoa(fileID) + fileExt
+}
+
+// ReportEvent reports an event with a new idempotency key.
 func (api *CacophonyAPI) ReportEvent(jsonDetails []byte, times []time.Time) error {
-	// Deserialise the JSON event details into a map.
-	var details map[string]interface{}
-	err := json.Unmarshal(jsonDetails, &details)
+	return api.ReportEventWithKey(jsonDetails, times, NewIdempotencyKey())
+}
+
+// ReportEventWithKey reports an event, sending the idempotency key so
+// that the server can ignore the event if it already has it. Use the
+// same key, from NewIdempotencyKey, each time the event is sent.
+func (api *CacophonyAPI) ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) (err error) {
+	if api.readOnly {
+		return ErrReadOnly
+	}
+	if api.eventsDisabled {
+		log.Printf("event reporting disabled, not reporting: %s", jsonDetails)
+		return nil
+	}
+	api.reportToSecondaries(jsonDetails, times, key)
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { api.breaker.record(err) }()
+
+	jsonAll, err := api.eventJSON(jsonDetails, times)
+	if err != nil {
+		return err
+	}
+
+	// Prepare request.
+	req, err := api.newRequest("POST", "/api/v1/events", bytes.NewReader(jsonAll))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, key)
+	api.signEvent(req, jsonAll)
+
+	// Send.
+	return api.sendEvent(api.client, req)
+}
+
+// ReportEventWithFile reports an event, as ReportEvent does, along with
+// a file such as a recording of what was played. The file is streamed
+// as part of a multipart request so it is never held in memory, and the
+// request has no overall time limit so that large files can be sent.
+func (api *CacophonyAPI) ReportEventWithFile(jsonDetails []byte, times []time.Time, filePath string) (err error) {
+	if api.readOnly {
+		return ErrReadOnly
+	}
+	if api.eventsDisabled {
+		log.Printf("event reporting disabled, not reporting: %s with %s", jsonDetails, filePath)
+		return nil
+	}
+
+	jsonAll, err := api.eventJSON(jsonDetails, times)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return diskError(err)
+	}
+	defer file.Close()
+
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { api.breaker.record(err) }()
+
+	body, bodyWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(bodyWriter)
+	go func() {
+		bodyWriter.CloseWithError(writeEventParts(multipartWriter, jsonAll, file))
+	}()
+	defer body.Close()
+
+	req, err := api.newRequest("POST", "/api/v1/events", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header.Set(idempotencyKeyHeader, NewIdempotencyKey())
+	api.signEvent(req, jsonAll)
+
+	return api.sendEvent(api.downloadClient, req)
+}
+
+// writeEventParts writes the event details and then the file as the
+// parts of a multipart request.
+func writeEventParts(w *multipart.Writer, jsonAll []byte, file *os.File) error {
+	if err := w.WriteField("data", string(jsonAll)); err != nil {
+		return err
+	}
+	part, err := w.CreateFormFile("file", filepath.Base(file.Name()))
 	if err != nil {
 		return err
 	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// eventJSON creates the JSON to send for an event from its details and
+// the times it happened.
+func (api *CacophonyAPI) eventJSON(jsonDetails []byte, times []time.Time) ([]byte, error) {
+	// Deserialise the JSON event details into a map.
+	var details map[string]interface{}
+	if err := json.Unmarshal(jsonDetails, &details); err != nil {
+		return nil, err
+	}
+
+	api.addEventDefaults(details)
 
 	// Convert the event times for sending and add to the map to send.
 	dateTimes := make([]string, 0, len(times))
 	for _, t := range times {
-		dateTimes = append(dateTimes, formatTimestamp(t))
+		dateTimes = append(dateTimes, api.formatTimestamp(t))
 	}
 	details["dateTimes"] = dateTimes
 
 	// Serialise the map back to JSON for sending.
-	jsonAll, err := json.Marshal(details)
+	return json.Marshal(details)
+}
+
+// sendEvent sends an event request and checks the response.
+func (api *CacophonyAPI) sendEvent(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return temporaryError(err)
+	}
+	defer resp.Body.Close()
+
+	if !isHTTPSuccess(resp.StatusCode) {
+		return responseError(resp)
+	}
+	return nil
+}
+
+// addEventDefaults merges the configured event defaults into the
+// "details" of an event's "description".
+func (api *CacophonyAPI) addEventDefaults(event map[string]interface{}) {
+	if len(api.eventDefaults) == 0 {
+		return
+	}
+	description, ok := event["description"].(map[string]interface{})
+	if !ok {
+		description = make(map[string]interface{})
+		event["description"] = description
+	}
+	details, ok := description["details"].(map[string]interface{})
+	if !ok {
+		details = make(map[string]interface{})
+		description["details"] = details
+	}
+	for key, value := range api.eventDefaults {
+		if _, exists := details[key]; !exists {
+			details[key] = value
+		}
+	}
+}
+
+// ChangePassword changes the device's password on the server and then
+// re-authenticates using it. The server has no call for only changing a
+// password, so the device is re-registered under its current name and
+// group with the new password. On success the new password is returned
+// by Password() so that the caller can save it.
+func (api *CacophonyAPI) ChangePassword(newPassword string) error {
+	if api.readOnly {
+		return ErrReadOnly
+	}
+	if newPassword == "" {
+		return &Error{message: "new password is empty", permanent: true}
+	}
+	payload, err := json.Marshal(map[string]string{
+		"newName":     api.deviceName,
+		"newGroup":    api.group,
+		"newPassword": newPassword,
+	})
 	if err != nil {
 		return err
 	}
 
-	// Prepare request.
-	req, err := http.NewRequest("POST", api.serverURL+"/api/v1/events", bytes.NewReader(jsonAll))
+	req, err := api.newRequest("POST", "/api/v1/devices/reregister", bytes.NewReader(payload))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", api.token)
 
-	// Send.
-	client := &http.Client{Timeout: httpTimeout}
-	resp, err := client.Do(req)
+	resp, err := api.client.Do(req)
 	if err != nil {
 		return temporaryError(err)
 	}
 	defer resp.Body.Close()
 
 	if !isHTTPSuccess(resp.StatusCode) {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return temporaryError(fmt.Errorf("request failed (%d) and body read failed: %v", resp.StatusCode, err))
-		}
-		return &Error{
-			message:   fmt.Sprintf("HTTP request failed (%d): %s", resp.StatusCode, body),
-			permanent: isHTTPClientError(resp.StatusCode),
-		}
+		return responseError(resp)
 	}
-	return nil
+	var result tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return decodeError(err)
+	}
+	if !result.Success {
+		return &Error{message: fmt.Sprintf("password change failed: %v", result.message()), permanent: true, kind: KindAuth}
+	}
+
+	api.password = newPassword
+	return api.newToken(context.Background())
+}
+
+// newRequest creates a request to the API server, authorised with the
+// device's token.
+func (api *CacophonyAPI) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := api.newServerRequest(method, api.serverURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", api.getToken())
+	return req, nil
+}
+
+// newServerRequest creates a request to the given URL with the headers
+// configured by WithHeaders. Every request this client makes is created
+// by it.
+func (api *CacophonyAPI) newServerRequest(method, rawURL string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range api.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// responseError creates an *Error describing an unsuccessful HTTP
+// response. Client errors are permanent.
+func responseError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return temporaryError(fmt.Errorf("request failed (%d) and body read failed: %v", resp.StatusCode, err))
+	}
+	return statusError(fmt.Sprintf("HTTP request failed (%d): %s", resp.StatusCode, body), resp)
+}
+
+// statusError creates the error for an unsuccessful response. Client
+// errors are permanent, apart from being rate limited.
+func statusError(message string, resp *http.Response) *Error {
+	err := &Error{
+		message:    message,
+		permanent:  isHTTPClientError(resp.StatusCode),
+		statusCode: resp.StatusCode,
+		kind:       statusKind(resp.StatusCode),
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		err.permanent = false
+		err.retryAfter, _ = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return err
 }
 
 // Error is returned by API calling methods. As well as an error
-// message, it includes whether the error is permanent or not.
+// message, it includes whether the error is permanent or not and what
+// kind of failure it was.
 type Error struct {
 	message   string
 	permanent bool
+	// statusCode is the HTTP status of the response that caused the
+	// error, if there was one.
+	statusCode int
+	// retryAfter is how long the server asked us to wait before trying
+	// again, if it did.
+	retryAfter time.Duration
+	kind       ErrorKind
+	// err is the error that caused this one, if there was one.
+	err error
 }
 
 // Error implemented the error interface.
@@ -278,25 +1216,286 @@ func isHTTPClientError(code int) bool {
 	return code >= 400 && code < 500
 }
 
+// temporaryError creates the error for a failure talking to the
+// server, which may work if tried again. A server that failed the
+// certificate pins won't, so gets ErrCertificatePin instead.
 func temporaryError(err error) *Error {
-	return &Error{message: err.Error(), permanent: false}
+	if isPinMismatch(err) {
+		return ErrCertificatePin
+	}
+	return &Error{message: err.Error(), permanent: false, kind: networkKind(err), err: err}
 }
 
-func formatTimestamp(t time.Time) string {
-	return t.UTC().Format(time.RFC3339)
+func (api *CacophonyAPI) formatTimestamp(t time.Time) string {
+	if api.localTimestamps {
+		t = t.Local()
+	} else {
+		t = t.UTC()
+	}
+	if api.millisecondTimestamps {
+		return t.Format(millisecondRFC3339)
+	}
+	return t.Format(time.RFC3339)
 }
 
-// GetSchedule will get the audio schedule
-func (api *CacophonyAPI) GetSchedule() ([]byte, error) {
-	req, err := http.NewRequest("GET", api.serverURL+"/api/v1/schedules", nil)
-	req.Header.Set("Authorization", api.token)
-	client := new(http.Client)
+// GetSchedule will get the audio schedule as the raw JSON response, for
+// callers that need the bytes themselves, such as to save a copy. The
+// whole response is held in memory; use DecodeSchedule to avoid that.
+func (api *CacophonyAPI) GetSchedule() (_ []byte, err error) {
+	if err := api.breaker.allow(); err != nil {
+		return []byte{}, err
+	}
+	defer func() { api.breaker.record(err) }()
 
-	resp, err := client.Do(req)
+	resp, err := api.getSchedule(context.Background())
 	if err != nil {
 		return []byte{}, err
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, temporaryError(err)
+	}
+	body, rawSchedule := api.selectSchedule(body)
+	if rawSchedule == nil {
+		return []byte{}, ErrNoSchedule
+	}
+	api.setScheduleHash(hashSchedule(rawSchedule))
+	return body, nil
+}
+
+// GetScheduleByID gets the schedule with the given ID rather than the
+// device's current one, such as to preview a schedule or roll back to
+// an earlier version. The response has the same form as GetSchedule's.
+// Fetching it doesn't change which schedule is acknowledged.
+func (api *CacophonyAPI) GetScheduleByID(ctx context.Context, id int) (_ []byte, err error) {
+	if id <= 0 {
+		return []byte{}, scheduleNotFoundError(id)
+	}
+	if err := api.breaker.allow(); err != nil {
+		return []byte{}, err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	req, err := api.newRequest("GET", "/api/v1/schedules/"+strconv.Itoa(id), nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	resp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return []byte{}, temporaryError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []byte{}, scheduleNotFoundError(id)
+	}
+	if !isHTTPSuccess(resp.StatusCode) {
+		return []byte{}, responseError(resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return []byte{}, temporaryError(err)
+	}
+	if getRawSchedule(body) == nil {
+		return []byte{}, scheduleNotFoundError(id)
+	}
+	return body, nil
+}
+
+// scheduleNotFoundError creates the error for a schedule ID the server
+// doesn't have.
+func scheduleNotFoundError(id int) *Error {
+	return &Error{message: fmt.Sprintf("schedule %d not found", id), permanent: true, kind: KindNotFound}
+}
+
+// DecodeSchedule gets the audio schedule and decodes it into schedule,
+// which must be a pointer, straight from the response body. Only the
+// JSON for the schedule itself is buffered while it is decoded, and it
+// isn't kept afterwards, so this suits very large schedules on devices
+// with little memory.
+func (api *CacophonyAPI) DecodeSchedule(schedule interface{}) error {
+	return api.DecodeScheduleContext(context.Background(), schedule)
+}
+
+// DecodeScheduleContext decodes the audio schedule as DecodeSchedule
+// does, stopping if ctx is done.
+func (api *CacophonyAPI) DecodeScheduleContext(ctx context.Context, schedule interface{}) (err error) {
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	resp, err := api.getSchedule(ctx)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	target := &scheduleTarget{schedule: schedule}
+	sr := struct {
+		Schedule   *scheduleTarget
+		ScheduleID int `json:"scheduleId"`
+		// Schedules are only buffered, not decoded, until one is chosen.
+		Schedules []scheduleCandidate
+	}{Schedule: target}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		if err == io.EOF {
+			return ErrNoSchedule
+		}
+		return decodeError(err)
+	}
+	if len(sr.Schedules) > 0 && (len(api.tags) > 0 || !target.found) {
+		if candidate, matched := api.chooseSchedule(sr.Schedules); candidate != nil {
+			resetSchedule(schedule)
+			if err := target.UnmarshalJSON(candidate.Schedule); err != nil {
+				return decodeError(err)
+			}
+			api.setScheduleChoice(ScheduleChoice{ID: candidate.ID, Tags: candidate.Tags, Matched: matched})
+			api.setScheduleHash(target.hash)
+			return nil
+		}
+	}
+	if !target.found {
+		return ErrNoSchedule
+	}
+	api.setScheduleChoice(ScheduleChoice{ID: sr.ScheduleID})
+	api.setScheduleHash(target.hash)
+	return nil
+}
+
+// getSchedule requests the schedule, leaving the caller to read and
+// close the response body.
+func (api *CacophonyAPI) getSchedule(ctx context.Context) (*http.Response, error) {
+	path := "/api/v1/schedules"
+	if len(api.tags) > 0 {
+		path += "?tags=" + url.QueryEscape(strings.Join(api.tags, ","))
+	}
+	req, err := api.newRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, temporaryError(err)
+	}
+	if !isHTTPSuccess(resp.StatusCode) {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// scheduleTarget decodes the schedule in a response into the caller's
+// value, noting whether there was one.
+type scheduleTarget struct {
+	schedule interface{}
+	found    bool
+	hash     string
+}
+
+func (t *scheduleTarget) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	t.found = true
+	t.hash = hashSchedule(data)
+	return json.Unmarshal(data, t.schedule)
+}
+
+// ErrNoSchedule is returned by GetSchedule when the server's response
+// doesn't contain a schedule, so that callers can carry on with the
+// schedule they already have rather than replace it with an empty one.
+var ErrNoSchedule = &Error{message: "server returned no schedule", permanent: true, kind: KindNotFound}
+
+// getRawSchedule gets the JSON of the schedule in a response, or nil if
+// the response is empty, "{}" or has a null schedule. A response that
+// can't be parsed is returned whole, leaving it to the caller to report.
+func getRawSchedule(body []byte) json.RawMessage {
+	var sr struct {
+		Schedule json.RawMessage
+	}
+	if err := json.Unmarshal(body, &sr); err != nil {
+		if len(bytes.TrimSpace(body)) == 0 {
+			return nil
+		}
+		return body
+	}
+	if len(sr.Schedule) == 0 || string(sr.Schedule) == "null" {
+		return nil
+	}
+	return sr.Schedule
+}
+
+// hashSchedule gets the SHA-256 hash of a schedule's JSON, ignoring how
+// it is laid out.
+func hashSchedule(rawSchedule []byte) string {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, rawSchedule); err != nil {
+		compacted.Reset()
+		compacted.Write(rawSchedule)
+	}
+	sum := sha256.Sum256(compacted.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func (api *CacophonyAPI) setScheduleHash(hash string) {
+	api.scheduleMu.Lock()
+	defer api.scheduleMu.Unlock()
+	api.scheduleHash = hash
+}
+
+// ScheduleHash gets the hash of the schedule last fetched from the
+// server, or "" if none has been.
+func (api *CacophonyAPI) ScheduleHash() string {
+	api.scheduleMu.Lock()
+	defer api.scheduleMu.Unlock()
+	return api.scheduleHash
+}
+
+// AckSchedule tells the server that the device has received the given
+// schedule and is ready to play it. It should be called once the
+// schedule has been validated and its files downloaded. The hash of the
+// schedule last fetched is included so that the server can check which
+// version of the schedule the device has.
+func (api *CacophonyAPI) AckSchedule(ctx context.Context, scheduleID int) (err error) {
+	if api.readOnly {
+		return ErrReadOnly
+	}
+	jsonDetails, err := json.Marshal(map[string]interface{}{
+		"description": map[string]interface{}{
+			"type": "audioBaitScheduleAck",
+			"details": map[string]interface{}{
+				"scheduleId":   scheduleID,
+				"scheduleHash": api.ScheduleHash(),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if api.eventsDisabled {
+		log.Printf("event reporting disabled, not acknowledging schedule: %s", jsonDetails)
+		return nil
+	}
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	jsonAll, err := api.eventJSON(jsonDetails, []time.Time{time.Now()})
+	if err != nil {
+		return err
+	}
+	req, err := api.newRequest("POST", "/api/v1/events", bytes.NewReader(jsonAll))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	api.signEvent(req, jsonAll)
+
+	return api.sendEvent(api.client, req)
 }
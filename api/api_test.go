@@ -0,0 +1,1055 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var eventTime = time.Date(2018, time.November, 5, 21, 30, 15, 123456789, time.FixedZone("NZDT", 13*60*60))
+
+func TestDefaultTimestampFormatIsUTCSeconds(t *testing.T) {
+	api := &CacophonyAPI{}
+	assert.Equal(t, eventTime.UTC().Format(time.RFC3339), api.formatTimestamp(eventTime))
+	assert.Equal(t, "2018-11-05T08:30:15Z", api.formatTimestamp(eventTime))
+}
+
+func TestMillisecondTimestamps(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithMillisecondTimestamps()(api)
+	assert.Equal(t, "2018-11-05T08:30:15.123Z", api.formatTimestamp(eventTime))
+}
+
+func TestLocalTimestamps(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithLocalTimestamps()(api)
+	assert.Equal(t, eventTime.Local().Format(time.RFC3339), api.formatTimestamp(eventTime))
+}
+
+func TestEventDefaultsDontOverrideEventDetails(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithEventDefaults(map[string]interface{}{"site": "north", "volume": 1})(api)
+
+	var event map[string]interface{}
+	err := json.Unmarshal([]byte(`{"description": {"type": "audioBait", "details": {"volume": 7}}}`), &event)
+	assert.Nil(t, err)
+	api.addEventDefaults(event)
+
+	details := event["description"].(map[string]interface{})["details"]
+	assert.Equal(t, map[string]interface{}{"site": "north", "volume": float64(7)}, details)
+}
+
+func TestReadOnlyBlocksWrites(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithReadOnly()(api)
+
+	assert.Equal(t, ErrReadOnly, api.ReportEvent([]byte(`{}`), []time.Time{eventTime}))
+	assert.Equal(t, ErrReadOnly, api.ChangePassword("secret"))
+	assert.Equal(t, ErrReadOnly, api.newToken(context.Background()))
+	assert.True(t, IsPermanentError(ErrReadOnly))
+}
+
+// newTestAPI creates a client for a test server running the given handler.
+func newTestAPI(t *testing.T, handler http.HandlerFunc) *CacophonyAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	api := &CacophonyAPI{serverURL: server.URL}
+	api.createClients()
+	return api
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	var paths []string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		var creds map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&creds))
+		if creds["password"] == "secret" {
+			fmt.Fprint(w, `{"success": true, "token": "JWT abc"}`)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"success": false, "messages": ["wrong password"]}`)
+		}
+	})
+	api.deviceName = "dev"
+
+	api.password = "secret"
+	assert.Nil(t, api.VerifyCredentials(context.Background()))
+	assert.Equal(t, "", api.getToken())
+
+	api.password = "guess"
+	err := api.VerifyCredentials(context.Background())
+	assert.True(t, IsPermanentError(err))
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	api.password = ""
+	err = api.VerifyCredentials(context.Background())
+	assert.True(t, IsPermanentError(err))
+	assert.False(t, api.JustRegistered())
+	assert.Equal(t, []string{"/authenticate_device", "/authenticate_device"}, paths)
+}
+
+func TestChangePasswordReregistersWithTheNewPassword(t *testing.T) {
+	password := "old"
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		switch r.URL.Path {
+		case "/api/v1/devices/reregister":
+			assert.Equal(t, "JWT old", r.Header.Get("Authorization"))
+			assert.Equal(t, map[string]string{"newName": "dev", "newGroup": "north", "newPassword": "new"}, body)
+			password = body["newPassword"]
+			fmt.Fprint(w, `{"success": true, "id": 3, "token": "JWT reregistered"}`)
+		case "/authenticate_device":
+			if body["password"] == password {
+				fmt.Fprint(w, `{"success": true, "token": "JWT new"}`)
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"success": false, "messages": ["wrong password"]}`)
+			}
+		}
+	})
+	api.deviceName = "dev"
+	api.group = "north"
+	api.password = "old"
+	api.token = "JWT old"
+
+	assert.Nil(t, api.ChangePassword("new"))
+	assert.Equal(t, "new", api.Password())
+	assert.Equal(t, "JWT new", api.getToken())
+}
+
+func TestRejectedPasswordChangesArePermanent(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, `{"success": false, "messages": ["password too short"]}`)
+	})
+	api.password = "old"
+
+	err := api.ChangePassword("new")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "old", api.Password())
+
+	assert.True(t, IsPermanentError(api.ChangePassword("")))
+}
+
+func TestVerifyCredentialsNetworkFailureIsTemporary(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {})
+	api.serverURL = "http://127.0.0.1:1"
+	api.password = "secret"
+	err := api.VerifyCredentials(context.Background())
+	assert.False(t, IsPermanentError(err))
+	assert.True(t, errors.Is(err, ErrNetwork))
+}
+
+func TestSuccessWithEmptyTokenIsTemporary(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"success": true, "token": ""}`)
+	})
+	api.deviceName = "dev"
+	api.password = "secret"
+	api.token = "JWT old"
+
+	err := api.newToken(context.Background())
+	assert.False(t, IsPermanentError(err))
+	assert.True(t, errors.Is(err, ErrServer))
+	assert.Equal(t, "JWT old", api.getToken())
+}
+
+func TestGetScheduleWithNoSchedule(t *testing.T) {
+	for _, body := range []string{"", "{}", `{"schedule":null}`} {
+		api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		_, err := api.GetSchedule()
+		assert.Equal(t, ErrNoSchedule, err, "body %q", body)
+	}
+}
+
+func TestGetSchedule(t *testing.T) {
+	body := `{"schedule":{"playNights":1,"combos":[]}}`
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/schedules", r.URL.Path)
+		fmt.Fprint(w, body)
+	})
+	jsonData, err := api.GetSchedule()
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(jsonData))
+}
+
+func TestGetScheduleByID(t *testing.T) {
+	body := `{"schedule":{"playNights":1,"combos":[]},"scheduleId":7}`
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/schedules/7", r.URL.Path)
+		fmt.Fprint(w, body)
+	})
+	jsonData, err := api.GetScheduleByID(context.Background(), 7)
+	assert.Nil(t, err)
+	assert.Equal(t, body, string(jsonData))
+	assert.Equal(t, "", api.ScheduleHash())
+}
+
+func TestGetScheduleByIDNotFound(t *testing.T) {
+	requests := 0
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/api/v1/schedules/8" {
+			fmt.Fprint(w, `{"schedule":null}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	for _, id := range []int{0, -3, 8, 9} {
+		_, err := api.GetScheduleByID(context.Background(), id)
+		assert.EqualError(t, err, fmt.Sprintf("schedule %d not found", id))
+		assert.True(t, errors.Is(err, ErrNotFound))
+		assert.True(t, IsPermanentError(err))
+	}
+	assert.Equal(t, 2, requests)
+}
+
+func TestDecodeSchedule(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"schedule":{"playNights":2,"combos":[{"every":60}]}}`)
+	})
+	var schedule testSchedule
+	assert.Nil(t, api.DecodeSchedule(&schedule))
+	assert.Equal(t, 2, schedule.PlayNights)
+	assert.Equal(t, 1, len(schedule.Combos))
+}
+
+func TestDecodeScheduleWithNoSchedule(t *testing.T) {
+	for _, body := range []string{"", "{}", `{"schedule":null}`} {
+		api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		})
+		var schedule testSchedule
+		assert.Equal(t, ErrNoSchedule, api.DecodeSchedule(&schedule), "body %q", body)
+	}
+}
+
+func TestAckScheduleIncludesScheduleHash(t *testing.T) {
+	var ack map[string]interface{}
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/schedules" {
+			fmt.Fprint(w, `{"schedule": {"playNights": 1}}`)
+			return
+		}
+		assert.Equal(t, "/api/v1/events", r.URL.Path)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&ack))
+	})
+	var schedule testSchedule
+	assert.Nil(t, api.DecodeSchedule(&schedule))
+	decodedHash := api.ScheduleHash()
+	_, err := api.GetSchedule()
+	assert.Nil(t, err)
+	assert.Equal(t, decodedHash, api.ScheduleHash())
+	assert.Equal(t, hashSchedule([]byte(`{"playNights":1}`)), decodedHash)
+
+	assert.Nil(t, api.AckSchedule(context.Background(), 42))
+	description := ack["description"].(map[string]interface{})
+	assert.Equal(t, "audioBaitScheduleAck", description["type"])
+	assert.Equal(t, map[string]interface{}{"scheduleId": 42.0, "scheduleHash": decodedHash}, description["details"])
+}
+
+type testSchedule struct {
+	PlayNights int
+	Combos     []struct {
+		From    string
+		Until   string
+		Every   int
+		Waits   []int
+		Volumes []int
+		Sounds  []string
+	}
+}
+
+// largeScheduleResponse creates a schedule response with many combos.
+func largeScheduleResponse() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"schedule":{"playNights":1,"combos":[`)
+	for i := 0; i < 20000; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"from":"21:00","until":"22:00","every":%d,"waits":[0,5,10],"volumes":[5,6,7],"sounds":["random","%d","same"]}`, i, i)
+	}
+	buf.WriteString(`]}}`)
+	return buf.Bytes()
+}
+
+func newLargeScheduleAPI(b *testing.B) *CacophonyAPI {
+	body := largeScheduleResponse()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	b.Cleanup(server.Close)
+	api := &CacophonyAPI{serverURL: server.URL}
+	api.createClients()
+	return api
+}
+
+func BenchmarkGetScheduleAndUnmarshal(b *testing.B) {
+	api := newLargeScheduleAPI(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		jsonData, err := api.GetSchedule()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var sr struct{ Schedule testSchedule }
+		if err := json.Unmarshal(jsonData, &sr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeSchedule(b *testing.B) {
+	api := newLargeScheduleAPI(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var schedule testSchedule
+		if err := api.DecodeSchedule(&schedule); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReportEventSendsIdempotencyKey(t *testing.T) {
+	var keys []string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+	})
+
+	key := NewIdempotencyKey()
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, key)
+	assert.Nil(t, api.ReportEventWithKey([]byte(`{}`), []time.Time{eventTime}, key))
+	assert.Nil(t, api.ReportEventWithKey([]byte(`{}`), []time.Time{eventTime}, key))
+	assert.Nil(t, api.ReportEvent([]byte(`{}`), []time.Time{eventTime}))
+	assert.Nil(t, api.ReportEvent([]byte(`{}`), []time.Time{eventTime}))
+
+	assert.Equal(t, []string{key, key}, keys[:2])
+	assert.NotEmpty(t, keys[2])
+	assert.NotEqual(t, keys[2], keys[3])
+	assert.NotEqual(t, key, keys[2])
+}
+
+func TestSignedEventsKeepTheirSignatureWhenRetried(t *testing.T) {
+	var signatures []string
+	calls := 0
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		signature := r.Header.Get(eventSignatureHeader)
+		assert.Equal(t, eventSignature([]byte("secret"), body), signature)
+		signatures = append(signatures, signature)
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	WithEventSigning([]byte("secret"))(api)
+	WithEventDefaults(map[string]interface{}{"device": "dev", "zone": "north"})(api)
+
+	details := []byte(`{"description": {"type": "audioBait", "details": {"fileId": 3, "volume": 8}}}`)
+	key := NewIdempotencyKey()
+	assert.NotNil(t, api.ReportEventWithKey(details, []time.Time{eventTime}, key))
+	assert.Nil(t, api.ReportEventWithKey(details, []time.Time{eventTime}, key))
+
+	assert.Len(t, signatures, 2)
+	assert.Regexp(t, `^sha256=[0-9a-f]{64}$`, signatures[0])
+	assert.Equal(t, signatures[0], signatures[1])
+}
+
+func TestEventsAreUnsignedByDefault(t *testing.T) {
+	var signature string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(eventSignatureHeader)
+	})
+
+	assert.Nil(t, api.ReportEvent([]byte(`{}`), []time.Time{eventTime}))
+	assert.Equal(t, "", signature)
+}
+
+type testReporter struct {
+	keys []string
+	err  error
+}
+
+func (r *testReporter) ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) error {
+	r.keys = append(r.keys, key)
+	return r.err
+}
+
+func TestEventReportersGetEventsAsWell(t *testing.T) {
+	status := http.StatusOK
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	failing := &testReporter{err: errors.New("disk full")}
+	working := &testReporter{}
+	WithEventReporters(failing, working)(api)
+
+	assert.Nil(t, api.ReportEventWithKey([]byte(`{}`), []time.Time{eventTime}, "key-1"))
+	status = http.StatusBadRequest
+	assert.NotNil(t, api.ReportEventWithKey([]byte(`{}`), []time.Time{eventTime}, "key-2"))
+
+	assert.Equal(t, []string{"key-1", "key-2"}, failing.keys)
+	assert.Equal(t, []string{"key-1", "key-2"}, working.keys)
+}
+
+func TestReportEventWithFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "played.wav")
+	assert.Nil(t, ioutil.WriteFile(filePath, []byte("RIFF audio"), 0644))
+
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/events", r.URL.Path)
+		file, header, err := r.FormFile("file")
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer file.Close()
+		contents, _ := ioutil.ReadAll(file)
+		assert.Equal(t, "played.wav", header.Filename)
+		assert.Equal(t, "RIFF audio", string(contents))
+
+		var event map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(r.FormValue("data")), &event))
+		assert.Equal(t, []interface{}{"2018-11-05T08:30:15Z"}, event["dateTimes"])
+	})
+	err := api.ReportEventWithFile([]byte(`{"description": {"type": "audioBait"}}`), []time.Time{eventTime}, filePath)
+	assert.Nil(t, err)
+}
+
+func TestReportEventWithMissingFile(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not be sent")
+	})
+	err := api.ReportEventWithFile([]byte(`{}`), []time.Time{eventTime}, filepath.Join(t.TempDir(), "missing.wav"))
+	assert.True(t, IsPermanentError(err))
+}
+
+func TestListAudioFilesPages(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/files", r.URL.Path)
+		assert.Equal(t, `{"type":"audioBait"}`, r.URL.Query().Get("where"))
+		var rows []string
+		if r.URL.Query().Get("offset") == "0" {
+			for i := 1; i <= filesPageSize; i++ {
+				rows = append(rows, fmt.Sprintf(`{"id":%d}`, i))
+			}
+		} else {
+			rows = append(rows, fmt.Sprintf(`{"id":%d}`, filesPageSize+1))
+		}
+		fmt.Fprintf(w, `{"count":%d,"rows":[%s]}`, filesPageSize+1, strings.Join(rows, ","))
+	})
+	fileIDs, err := api.ListAudioFiles(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, filesPageSize+1, len(fileIDs))
+	assert.Equal(t, filesPageSize+1, fileIDs[filesPageSize])
+}
+
+func TestDownloadFileRequestsNewSignedURLWhenExpired(t *testing.T) {
+	signedURLRetryWait = time.Millisecond
+	var detailRequests, downloads int
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			detailRequests++
+			fmt.Fprintf(w, `{"jwt":"fresh%d"}`, detailRequests)
+		case "/api/v1/signedUrl":
+			downloads++
+			if r.URL.Query().Get("jwt") == "stale" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	fileResponse.Jwt = "stale"
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Equal(t, 2, detailRequests)
+	assert.Equal(t, 2, downloads)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio", string(contents))
+}
+
+func TestDownloadFileRequestsNewSignedURLWhileProbingTheServer(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"fresh"}`)
+		case "/api/v1/signedUrl":
+			if r.URL.Query().Get("jwt") == "stale" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	fileResponse.Jwt = "stale"
+	// The breaker has been open long enough for the download to probe the server.
+	api.breaker = newCircuitBreaker(1, time.Minute)
+	api.breaker.state = BreakerOpen
+	api.breaker.openedAt = time.Now().Add(-time.Hour)
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	state, _ := api.breaker.status()
+	assert.Equal(t, BreakerClosed, state)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio", string(contents))
+}
+
+func TestDownloadResumesWithNewSignedURLWhenItExpiresPartWay(t *testing.T) {
+	signedURLRetryWait = time.Millisecond
+	expired := strings.TrimPrefix(makeToken(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(-time.Second).Unix())), "JWT ")
+	var detailRequests int
+	var ranges, ifRanges []string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			detailRequests++
+			if detailRequests == 1 {
+				fmt.Fprintf(w, `{"jwt":"%s"}`, expired)
+				return
+			}
+			fmt.Fprint(w, `{"jwt":"fresh"}`)
+		case "/api/v1/signedUrl":
+			ranges = append(ranges, r.Header.Get("Range"))
+			ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+			w.Header().Set("ETag", `"v1"`)
+			if r.URL.Query().Get("jwt") != "fresh" {
+				// Send part of the file then drop the connection.
+				w.Header().Set("Content-Length", "10")
+				fmt.Fprint(w, "audio")
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			if r.Header.Get("Range") != "bytes=5-" {
+				fmt.Fprint(w, "audio-file")
+				return
+			}
+			w.Header().Set("Content-Range", "bytes 5-9/10")
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, "-file")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Equal(t, 2, detailRequests)
+	assert.Equal(t, []string{"", "bytes=5-"}, ranges)
+	assert.Equal(t, []string{"", `"v1"`}, ifRanges)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio-file", string(contents))
+	_, err = os.Stat(filePath + PartialFileExt)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// resumeTestServer sends half of the file and drops the connection the first time it is asked for
+// it, and then answers the request to resume it with resumed.
+func resumeTestServer(t *testing.T, firstHeaders map[string]string, resumed func(w http.ResponseWriter, r *http.Request)) (*CacophonyAPI, *[]string) {
+	var ranges []string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			ranges = append(ranges, r.Header.Get("Range"))
+			if len(ranges) == 1 {
+				for name, value := range firstHeaders {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Content-Length", "10")
+				fmt.Fprint(w, "audio")
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			resumed(w, r)
+		}
+	})
+	return api, &ranges
+}
+
+func TestDownloadStartsAgainWhenResumedFromTheWrongPlace(t *testing.T) {
+	api, ranges := resumeTestServer(t, map[string]string{"ETag": `"v1"`}, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			fmt.Fprint(w, "audio-file")
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 3-9/10")
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "io-file")
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Equal(t, []string{"", "bytes=5-", ""}, *ranges)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio-file", string(contents))
+}
+
+func TestDownloadResumesWithTheLastModifiedDateForWeakETags(t *testing.T) {
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+	var ifRange string
+	api, _ := resumeTestServer(t, map[string]string{"ETag": `W/"v1"`, "Last-Modified": lastModified}, func(w http.ResponseWriter, r *http.Request) {
+		ifRange = r.Header.Get("If-Range")
+		w.Header().Set("Content-Range", "bytes 5-9/10")
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "-file")
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Equal(t, lastModified, ifRange)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio-file", string(contents))
+}
+
+func TestDownloadWithoutAValidatorIsNotResumed(t *testing.T) {
+	api, ranges := resumeTestServer(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "audio-file")
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Equal(t, []string{"", ""}, *ranges)
+}
+
+func TestSignedURLSendsTokenInQueryByDefault(t *testing.T) {
+	var queryJWT, authorization string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			queryJWT = r.URL.Query().Get("jwt")
+			authorization = r.Header.Get("Authorization")
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	assert.Nil(t, api.DownloadFile(fileResponse, filepath.Join(t.TempDir(), "7.wav")))
+	assert.Equal(t, "signed", queryJWT)
+	assert.Equal(t, "", authorization)
+}
+
+func TestSignedURLCanSendTokenInHeader(t *testing.T) {
+	var rawQuery, authorization string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			rawQuery = r.URL.RawQuery
+			authorization = r.Header.Get("Authorization")
+			fmt.Fprint(w, "audio")
+		}
+	})
+	WithSignedURLAuthHeader()(api)
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	assert.Nil(t, api.DownloadFile(fileResponse, filepath.Join(t.TempDir(), "7.wav")))
+	assert.Equal(t, "", rawQuery)
+	assert.Equal(t, "JWT signed", authorization)
+}
+
+func TestSignedURLErrorsMaskTheToken(t *testing.T) {
+	for _, header := range []bool{false, true} {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		api := &CacophonyAPI{serverURL: server.URL, signedURLHeader: header}
+		api.createClients()
+
+		_, err := api.getFileFromJWT(context.Background(), "secret-token", filepath.Join(t.TempDir(), "7.wav"), 7, false, false)
+		assert.NotNil(t, err)
+		assert.NotContains(t, err.Error(), "secret-token")
+	}
+}
+
+func TestRequestLoggingRedactsTokens(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed-secret"}`)
+		case "/api/v1/signedUrl":
+			fmt.Fprint(w, "audio")
+		}
+	})
+	var logged bytes.Buffer
+	WithRequestLogging(log.New(&logged, "", 0))(api)
+	api.createClients()
+	api.token = "JWT device-secret"
+
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	assert.Nil(t, api.DownloadFile(fileResponse, filepath.Join(t.TempDir(), "7.wav")))
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "GET "+api.serverURL+"/api/v1/files/7 [Authorization: REDACTED]: 200 OK in ")
+	assert.Contains(t, lines[1], "GET "+api.serverURL+"/api/v1/signedUrl?jwt=REDACTED: 200 OK in ")
+	assert.NotContains(t, logged.String(), "secret")
+}
+
+func TestCancelledDownloadLeavesNoFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			w.Header().Set("Content-Length", "1000")
+			fmt.Fprint(w, "part of the audio")
+			w.(http.Flusher).Flush()
+			cancel()
+			<-r.Context().Done()
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	err = api.DownloadFileContext(ctx, fileResponse, filepath.Join(dir, "7.wav"))
+	assert.Equal(t, context.Canceled, err)
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDownloadFileRetriesStorageFailures(t *testing.T) {
+	signedURLRetryWait = time.Millisecond
+	var detailRequests, downloads int
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			detailRequests++
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			downloads++
+			if downloads < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+
+	assert.Nil(t, api.DownloadFile(fileResponse, filepath.Join(t.TempDir(), "7.wav")))
+	assert.Equal(t, 1, detailRequests)
+	assert.Equal(t, 3, downloads)
+}
+
+func TestDownloadFileToDir(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed","file":{"details":{"name":"possum","originalName":"possum call.wav"}}}`)
+		case "/api/v1/signedUrl":
+			fmt.Fprint(w, "audio")
+		}
+	})
+
+	dir := t.TempDir()
+	filePath, err := api.DownloadFileToDir(dir, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "possum-7.wav"), filePath)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio", string(contents))
+}
+
+func TestCustomHeadersOnAllRequests(t *testing.T) {
+	paths := make(map[string]bool)
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		paths[r.URL.Path] = true
+		assert.Equal(t, "tenant-1", r.Header.Get("X-Tenant-Id"), r.URL.Path)
+		assert.NotEqual(t, "text/plain", r.Header.Get("Content-Type"), r.URL.Path)
+		assert.NotEqual(t, "key", r.Header.Get("Authorization"), r.URL.Path)
+		switch r.URL.Path {
+		case "/api/v1/schedules":
+			fmt.Fprint(w, `{"schedule":{}}`)
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			fmt.Fprint(w, "audio")
+		}
+	})
+	WithHeaders(map[string]string{"x-tenant-id": "tenant-1", "content-type": "text/plain", "Authorization": "key"})(api)
+	api.token = "JWT token"
+
+	_, err := api.GetSchedule()
+	assert.Nil(t, err)
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	assert.Nil(t, api.DownloadFile(fileResponse, filepath.Join(t.TempDir(), "7.wav")))
+	assert.Nil(t, api.ReportEvent([]byte(`{}`), []time.Time{eventTime}))
+
+	for _, path := range []string{"/api/v1/schedules", "/api/v1/files/7", "/api/v1/signedUrl", "/api/v1/events"} {
+		assert.True(t, paths[path], path)
+	}
+}
+
+type testFileCache map[int]string
+
+func (c testFileCache) ETag(fileID int) (string, bool) {
+	etag, ok := c[fileID]
+	return etag, ok
+}
+
+func (c testFileCache) SetETag(fileID int, etag string) {
+	c[fileID] = etag
+}
+
+func TestRefreshFileSkipsUnchangedFiles(t *testing.T) {
+	content := "audio"
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+		case "/api/v1/signedUrl":
+			etag := `"` + content + `"`
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			fmt.Fprint(w, content)
+		}
+	})
+	cache := testFileCache{}
+	WithFileCache(cache)(api)
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+
+	written, err := api.RefreshFile(fileResponse, filePath)
+	assert.Nil(t, err)
+	assert.True(t, written)
+	assert.Equal(t, `"audio"`, cache[7])
+
+	written, err = api.RefreshFile(fileResponse, filePath)
+	assert.Nil(t, err)
+	assert.False(t, written)
+
+	content = "new audio"
+	written, err = api.RefreshFile(fileResponse, filePath)
+	assert.Nil(t, err)
+	assert.True(t, written)
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "new audio", string(contents))
+}
+
+func TestDownloadFileTooLarge(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/files/7":
+				fmt.Fprint(w, `{"jwt":"signed"}`)
+			case "/api/v1/signedUrl":
+				if chunked {
+					w.(http.Flusher).Flush()
+				}
+				fmt.Fprint(w, strings.Repeat("a", 100))
+			}
+		})
+		WithMaxFileBytes(10)(api)
+		fileResponse, err := api.GetFileDetails(7)
+		assert.Nil(t, err)
+
+		dir := t.TempDir()
+		err = api.DownloadFile(fileResponse, filepath.Join(dir, "7.wav"))
+		assert.True(t, IsPermanentError(err), "chunked %v", chunked)
+		files, _ := ioutil.ReadDir(dir)
+		assert.Equal(t, 0, len(files), "chunked %v", chunked)
+	}
+}
+
+func TestTokenRefresherRenewsTokensAboutToExpire(t *testing.T) {
+	fresh := makeToken(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(24*time.Hour).Unix()))
+	refreshed := make(chan struct{}, 1)
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/authenticate_device", r.URL.Path)
+		fmt.Fprintf(w, `{"success": true, "token": "%s"}`, fresh)
+		refreshed <- struct{}{}
+	})
+	api.password = "secret"
+	api.token = makeToken(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(2*time.Second).Unix()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api.StartTokenRefresher(ctx, time.Minute)
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the token wasn't refreshed")
+	}
+	for deadline := time.Now().Add(time.Second); api.getToken() != fresh && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, fresh, api.getToken())
+}
+
+func TestTransportTimeoutsAreSetOnTheTransport(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithTransportTimeouts(time.Second, 2*time.Second, 3*time.Second)(api)
+	api.createClients()
+
+	transport := api.client.Transport.(*http.Transport)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 3*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, httpTimeout, api.client.Timeout)
+	assert.Equal(t, time.Duration(0), api.downloadClient.Timeout)
+}
+
+func TestZeroTransportTimeoutsKeepTheirDefaults(t *testing.T) {
+	api := NewUnauthenticatedAPI("http://localhost", "north", "device", "secret", WithTransportTimeouts(0, 0, 5*time.Second))
+
+	transport := api.client.Transport.(*http.Transport)
+	assert.Equal(t, defaultTLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 5*time.Second, transport.ResponseHeaderTimeout)
+	assert.Equal(t, defaultDialTimeout, api.dialTimeout)
+}
+
+func TestResponseHeaderTimeoutCatchesAServerThatDoesntAnswer(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	api := &CacophonyAPI{serverURL: server.URL}
+	WithTransportTimeouts(time.Second, time.Second, 50*time.Millisecond)(api)
+	api.createClients()
+
+	_, err := api.GetFileDetails(7)
+	assert.NotNil(t, err)
+	assert.False(t, IsPermanentError(err))
+}
+
+func TestSlowDownloadsArentLimitedByTheResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "audio")
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "-file")
+	}))
+	defer server.Close()
+	api := &CacophonyAPI{serverURL: server.URL}
+	WithTransportTimeouts(time.Second, time.Second, 50*time.Millisecond)(api)
+	api.createClients()
+
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(&FileResponse{Jwt: "signed"}, filePath))
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio-file", string(contents))
+}
+
+func TestFilesAreDownloadedFromTheFileServer(t *testing.T) {
+	var mainPaths, mirrorPaths []string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		mainPaths = append(mainPaths, r.URL.Path)
+	})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorPaths = append(mirrorPaths, r.URL.Path)
+		if r.URL.Path == "/api/v1/files/7" {
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+			return
+		}
+		fmt.Fprint(w, "audio")
+	}))
+	defer mirror.Close()
+	WithFileServer(mirror.URL)(api)
+
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	assert.Nil(t, api.ReportEvent([]byte(`{"description": {"type": "audioBait"}}`), []time.Time{eventTime}))
+
+	assert.Equal(t, []string{"/api/v1/files/7", "/api/v1/signedUrl"}, mirrorPaths)
+	assert.Equal(t, []string{"/api/v1/events"}, mainPaths)
+}
+
+func TestFilesAreDownloadedFromTheServerIfTheFileServerIsDown(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/files/7" {
+			fmt.Fprint(w, `{"jwt":"signed"}`)
+			return
+		}
+		fmt.Fprint(w, "audio")
+	})
+	mirror := httptest.NewServer(http.NotFoundHandler())
+	mirror.Close()
+	WithFileServer(mirror.URL)(api)
+
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	filePath := filepath.Join(t.TempDir(), "7.wav")
+	assert.Nil(t, api.DownloadFile(fileResponse, filePath))
+	contents, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "audio", string(contents))
+}
+
+func TestFileServerIsReadFromTheConfig(t *testing.T) {
+	conf, err := ParseConfig([]byte("server-url: https://api.cacophony.org.nz\nfile-server-url: http://10.0.0.2\ngroup: north\ndevice-name: device\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "http://10.0.0.2", conf.FileServerURL)
+
+	api := NewUnauthenticatedAPI(conf.ServerURL, conf.Group, conf.DeviceName, "secret", WithFileServer(conf.FileServerURL))
+	assert.Equal(t, []string{"http://10.0.0.2", "https://api.cacophony.org.nz"}, api.fileServers())
+	WithFileServer(conf.ServerURL)(api)
+	assert.Equal(t, []string{"https://api.cacophony.org.nz"}, api.fileServers())
+}
@@ -0,0 +1,183 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 5 * time.Minute
+)
+
+// ErrCircuitOpen is returned, without contacting the server, while the
+// circuit breaker is open because the server appears to be down.
+var ErrCircuitOpen = &Error{message: "server unavailable (circuit breaker open)", permanent: false, kind: KindNetwork}
+
+// BreakerState is the state of the circuit breaker protecting calls to
+// the server.
+type BreakerState int
+
+const (
+	// BreakerClosed means calls are made as normal.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means calls fail fast with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen means a single call is being allowed through to
+	// see if the server has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// WithCircuitBreaker sets how many consecutive temporary failures open
+// the circuit breaker and how long it stays open before a call is allowed
+// through to probe the server again. A threshold of zero disables it.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(api *CacophonyAPI) {
+		if threshold <= 0 {
+			api.breaker = nil
+			return
+		}
+		api.breaker = newCircuitBreaker(threshold, cooldown)
+	}
+}
+
+// circuitBreaker stops a device wasting power retrying a server which
+// is down. A nil *circuitBreaker allows every call.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow returns ErrCircuitOpen if a call shouldn't be made to the server
+// right now.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return ErrCircuitOpen
+		}
+		cb.state = BreakerHalfOpen
+		return nil
+	case BreakerHalfOpen:
+		// Only one probe at a time.
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the result of a call. Only temporary
+// errors count as failures as any other result means the server is up.
+func (cb *circuitBreaker) record(err error) {
+	if cb == nil || err == ErrCircuitOpen {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil || IsPermanentError(err) {
+		cb.state = BreakerClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == BreakerHalfOpen || cb.failures >= cb.threshold {
+		cb.state = BreakerOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// recordUnlessCancelled records the result of a call made with ctx, as
+// record does, unless ctx is done. Being cancelled says nothing about the
+// server, so a cancelled call only gives up its probe, if it was one.
+func (cb *circuitBreaker) recordUnlessCancelled(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		cb.abandon()
+		return
+	}
+	cb.record(err)
+}
+
+// abandon gives up a half-open probe without counting it as a failure,
+// so that the next call is let through to probe the server instead.
+func (cb *circuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == BreakerHalfOpen {
+		cb.state = BreakerOpen
+	}
+}
+
+func (cb *circuitBreaker) status() (BreakerState, int) {
+	if cb == nil {
+		return BreakerClosed, 0
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state, cb.failures
+}
+
+// Status describes the health of the client's connection to the server.
+type Status struct {
+	Breaker             BreakerState
+	ConsecutiveFailures int
+	// TokenExpiry is when the current token expires, or zero if that
+	// isn't known.
+	TokenExpiry time.Time
+}
+
+// Status gets the current state of the connection to the server, for
+// monitoring.
+func (api *CacophonyAPI) Status() Status {
+	state, failures := api.breaker.status()
+	expiry, _ := api.TokenExpiry()
+	return Status{Breaker: state, ConsecutiveFailures: failures, TokenExpiry: expiry}
+}
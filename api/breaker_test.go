@@ -0,0 +1,111 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	cb := newCircuitBreaker(2, time.Minute)
+	cb.now = func() time.Time { return now }
+	temporary := temporaryError(errors.New("connection refused"))
+
+	assert.Nil(t, cb.allow())
+	cb.record(temporary)
+	assert.Nil(t, cb.allow())
+	cb.record(temporary)
+	assert.Equal(t, ErrCircuitOpen, cb.allow())
+
+	// After the cooldown a single probe is let through.
+	now = now.Add(time.Minute)
+	assert.Nil(t, cb.allow())
+	assert.Equal(t, ErrCircuitOpen, cb.allow())
+
+	// A failed probe opens the breaker again straight away.
+	cb.record(temporary)
+	assert.Equal(t, ErrCircuitOpen, cb.allow())
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, cb.allow())
+	cb.record(&Error{message: "not found", permanent: true})
+	state, failures := cb.status()
+	assert.Equal(t, BreakerClosed, state)
+	assert.Equal(t, 0, failures)
+}
+
+func TestNilCircuitBreakerAllowsEverything(t *testing.T) {
+	api := &CacophonyAPI{}
+	WithCircuitBreaker(0, time.Minute)(api)
+	assert.Nil(t, api.breaker.allow())
+	api.breaker.record(temporaryError(errors.New("timeout")))
+	assert.Equal(t, Status{Breaker: BreakerClosed}, api.Status())
+}
+
+func TestCancelledProbeLetsTheNextCallProbe(t *testing.T) {
+	now := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	cb := newCircuitBreaker(1, time.Minute)
+	cb.now = func() time.Time { return now }
+	cb.record(temporaryError(errors.New("connection refused")))
+	now = now.Add(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Nil(t, cb.allow())
+	cb.recordUnlessCancelled(ctx, ctx.Err())
+	state, failures := cb.status()
+	assert.Equal(t, BreakerOpen, state)
+	assert.Equal(t, 1, failures)
+
+	assert.Nil(t, cb.allow())
+}
+
+func TestCancelledCallsArentServerFailures(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	now := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+	api.breaker = newCircuitBreaker(1, time.Minute)
+	api.breaker.now = func() time.Time { return now }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := api.ListAudioFiles(ctx)
+	assert.NotNil(t, err)
+	_, err = api.GetScheduleByID(ctx, 3)
+	assert.NotNil(t, err)
+	assert.NotNil(t, api.ReportLocation(ctx, -43.5, 172.6))
+	assert.NotNil(t, api.AckSchedule(ctx, 3))
+	assert.Equal(t, Status{Breaker: BreakerClosed}, api.Status())
+
+	// A cancelled download probing the server doesn't leave the breaker half-open.
+	api.breaker.record(temporaryError(errors.New("connection refused")))
+	now = now.Add(time.Minute)
+	err = api.DownloadFileContext(ctx, &FileResponse{Jwt: "signed"}, filepath.Join(t.TempDir(), "beep.wav"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, api.breaker.allow())
+}
@@ -27,10 +27,11 @@ import (
 )
 
 type Config struct {
-	ServerURL  string `yaml:"server-url"`
-	Group      string `yaml:"group"`
-	DeviceName string `yaml:"device-name"`
-	Directory  string `yaml:"directory"`
+	ServerURL     string `yaml:"server-url"`
+	FileServerURL string `yaml:"file-server-url"`
+	Group         string `yaml:"group"`
+	DeviceName    string `yaml:"device-name"`
+	Directory     string `yaml:"directory"`
 }
 
 func (conf *Config) Validate() error {
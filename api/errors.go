@@ -0,0 +1,157 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrorKind is the category of failure an *Error describes. Each kind
+// is also an error so that callers can branch on it with errors.Is,
+// for example errors.Is(err, ErrAuth).
+type ErrorKind int
+
+const (
+	// KindOther is any failure that doesn't fit another kind.
+	KindOther ErrorKind = iota
+	// KindAuth means the server didn't accept the device's credentials.
+	KindAuth
+	// KindNotFound means what was asked for doesn't exist on the server.
+	KindNotFound
+	// KindNetwork means the server couldn't be reached or the connection failed.
+	KindNetwork
+	// KindRateLimited means the server asked the client to slow down.
+	KindRateLimited
+	// KindServer means the server had an internal problem.
+	KindServer
+	// KindDecode means the server's response couldn't be understood.
+	KindDecode
+	// KindDisk means a local file couldn't be read or written.
+	KindDisk
+	// KindCertificate means the server's certificate wasn't trusted.
+	KindCertificate
+	// KindUnreachable means the server's name couldn't be looked up or
+	// the connection to it was refused, as happens while the network is
+	// still coming up. It is also a KindNetwork error.
+	KindUnreachable
+)
+
+// Sentinels for each kind of error, for use with errors.Is.
+var (
+	ErrAuth        error = KindAuth
+	ErrNotFound    error = KindNotFound
+	ErrNetwork     error = KindNetwork
+	ErrRateLimited error = KindRateLimited
+	ErrServer      error = KindServer
+	ErrDecode      error = KindDecode
+	ErrDisk        error = KindDisk
+	ErrCertificate error = KindCertificate
+	ErrUnreachable error = KindUnreachable
+)
+
+func (k ErrorKind) Error() string {
+	switch k {
+	case KindAuth:
+		return "authentication failed"
+	case KindNotFound:
+		return "not found"
+	case KindNetwork:
+		return "network error"
+	case KindRateLimited:
+		return "rate limited"
+	case KindServer:
+		return "server error"
+	case KindDecode:
+		return "could not decode response"
+	case KindDisk:
+		return "disk error"
+	case KindCertificate:
+		return "certificate not trusted"
+	case KindUnreachable:
+		return "server unreachable"
+	default:
+		return "error"
+	}
+}
+
+// Kind gets the category of the error.
+func (e *Error) Kind() ErrorKind {
+	return e.kind
+}
+
+// Is reports whether the error is of the given kind, so that
+// errors.Is(err, ErrNotFound) works. An unreachable server is also a
+// network error.
+func (e *Error) Is(target error) bool {
+	kind, ok := target.(ErrorKind)
+	if !ok || kind == KindOther {
+		return false
+	}
+	return kind == e.kind || (kind == KindNetwork && e.kind == KindUnreachable)
+}
+
+// Unwrap gets the error that caused this one, if there was one.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// statusKind works out the kind of error for an unsuccessful response.
+func statusKind(code int) ErrorKind {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return KindAuth
+	case code == http.StatusNotFound:
+		return KindNotFound
+	case code == http.StatusTooManyRequests:
+		return KindRateLimited
+	case code >= 500:
+		return KindServer
+	}
+	return KindOther
+}
+
+// networkKind works out the kind of error for a failure talking to the
+// server. Failing to look up the server or dial it is KindUnreachable,
+// and anything else, such as the connection dropping, is KindNetwork.
+func networkKind(err error) ErrorKind {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr),
+		errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EHOSTUNREACH):
+		return KindUnreachable
+	}
+	return KindNetwork
+}
+
+// decodeError creates the error for a response that couldn't be decoded.
+func decodeError(err error) *Error {
+	return &Error{message: "decode: " + err.Error(), permanent: true, kind: KindDecode, err: err}
+}
+
+// diskError creates the error for a local file that couldn't be used.
+func diskError(err error) *Error {
+	return &Error{message: err.Error(), permanent: true, kind: KindDisk, err: err}
+}
@@ -0,0 +1,141 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKindsFromStatus(t *testing.T) {
+	for status, kind := range map[int]error{
+		http.StatusUnauthorized:        ErrAuth,
+		http.StatusNotFound:            ErrNotFound,
+		http.StatusTooManyRequests:     ErrRateLimited,
+		http.StatusInternalServerError: ErrServer,
+	} {
+		api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		_, err := api.GetFileDetails(7)
+		assert.True(t, errors.Is(err, kind), "status %d", status)
+		assert.False(t, errors.Is(err, ErrDecode), "status %d", status)
+	}
+}
+
+func TestErrorKindsKeepPermanence(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not json")
+	})
+	_, err := api.GetFileDetails(7)
+	assert.True(t, errors.Is(err, ErrDecode))
+	assert.True(t, IsPermanentError(err))
+
+	netErr := temporaryError(&net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	assert.True(t, errors.Is(netErr, ErrNetwork))
+	assert.False(t, IsPermanentError(netErr))
+	var opErr *net.OpError
+	assert.True(t, errors.As(netErr, &opErr))
+
+	diskErr := diskError(&os.PathError{Op: "open", Path: "/missing", Err: os.ErrNotExist})
+	assert.True(t, errors.Is(diskErr, ErrDisk))
+	assert.True(t, errors.Is(diskErr, os.ErrNotExist))
+}
+
+func TestSentinelErrorsHaveKinds(t *testing.T) {
+	assert.True(t, errors.Is(ErrNoSchedule, ErrNotFound))
+	assert.True(t, errors.Is(ErrCircuitOpen, ErrNetwork))
+	assert.False(t, errors.Is(&Error{message: "other"}, KindOther))
+}
+
+func TestRefusedConnectionIsUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	api := &CacophonyAPI{serverURL: server.URL}
+	api.createClients()
+
+	_, err := api.GetFileDetails(7)
+	assert.True(t, errors.Is(err, ErrUnreachable))
+	assert.True(t, errors.Is(err, ErrNetwork))
+	assert.False(t, IsPermanentError(err))
+
+	dropped := temporaryError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")})
+	assert.False(t, errors.Is(dropped, ErrUnreachable))
+	assert.True(t, errors.Is(dropped, ErrNetwork))
+}
+
+func TestRetryUnreachableWaitsForServerToStart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	started := make(chan *httptest.Server, 1)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"success": true, "token": "JWT abc"}`)
+		}))
+		server.Listener.Close()
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			started <- nil
+			return
+		}
+		server.Listener = listener
+		server.Start()
+		started <- server
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	attempts := 0
+	var api *CacophonyAPI
+	err = RetryUnreachable(ctx, Backoff{Initial: 50 * time.Millisecond, Max: 100 * time.Millisecond}, func() error {
+		attempts++
+		var err error
+		api, err = NewAPI("http://"+addr, "group", "device", "secret")
+		return err
+	})
+	if server := <-started; server != nil {
+		defer server.Close()
+	}
+	assert.Nil(t, err)
+	assert.True(t, attempts > 1)
+	assert.Equal(t, "JWT abc", api.getToken())
+}
+
+func TestRetryUnreachableGivesUpOnOtherErrors(t *testing.T) {
+	attempts := 0
+	err := RetryUnreachable(context.Background(), BootBackoff, func() error {
+		attempts++
+		return &Error{message: "authentication failed", permanent: true, kind: KindAuth}
+	})
+	assert.True(t, errors.Is(err, ErrAuth))
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,39 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import "encoding/json"
+
+// Event is an event to report, in the form the server's events API
+// describes events. Its times are given when it is reported.
+type Event struct {
+	Type    string
+	Details map[string]interface{}
+}
+
+// JSON gets the event as the JSON details that ReportEventWithKey and
+// the event reporters take.
+func (event Event) JSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"description": map[string]interface{}{
+			"type":    event.Type,
+			"details": event.Details,
+		},
+	})
+}
@@ -0,0 +1,70 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+)
+
+// GroupInfo is what the server knows about the device's group. The
+// timezone and location are empty if the group doesn't have them.
+type GroupInfo struct {
+	Name string `json:"groupname"`
+	// Timezone is the IANA name, e.g. "Pacific/Auckland", of the timezone
+	// the group's devices are in.
+	Timezone  string   `json:"timezone"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+type groupsResponse struct {
+	Groups []GroupInfo
+}
+
+// GetGroupInfo gets the device's group from the server.
+func (api *CacophonyAPI) GetGroupInfo(ctx context.Context) (_ GroupInfo, err error) {
+	if err := api.breaker.allow(); err != nil {
+		return GroupInfo{}, err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	req, err := api.newRequest("GET", "/api/v1/groups/"+url.PathEscape(api.group), nil)
+	if err != nil {
+		return GroupInfo{}, err
+	}
+	resp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return GroupInfo{}, temporaryError(err)
+	}
+	defer resp.Body.Close()
+
+	if !isHTTPSuccess(resp.StatusCode) {
+		return GroupInfo{}, responseError(resp)
+	}
+	var groups groupsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return GroupInfo{}, decodeError(err)
+	}
+	if len(groups.Groups) == 0 {
+		return GroupInfo{}, &Error{message: "group " + api.group + " not found", permanent: true, kind: KindNotFound}
+	}
+	return groups.Groups[0], nil
+}
@@ -0,0 +1,68 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGroupInfo(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/groups/north ridge", r.URL.Path)
+		fmt.Fprint(w, `{"groups": [{"groupname": "north ridge", "timezone": "Pacific/Auckland", "latitude": -43.5, "longitude": 172.6}]}`)
+	})
+	api.group = "north ridge"
+
+	info, err := api.GetGroupInfo(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "north ridge", info.Name)
+	assert.Equal(t, "Pacific/Auckland", info.Timezone)
+	if assert.NotNil(t, info.Latitude) && assert.NotNil(t, info.Longitude) {
+		assert.Equal(t, -43.5, *info.Latitude)
+		assert.Equal(t, 172.6, *info.Longitude)
+	}
+}
+
+func TestGetGroupInfoWithoutLocation(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"groups": [{"groupname": "north"}]}`)
+	})
+	api.group = "north"
+
+	info, err := api.GetGroupInfo(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, GroupInfo{Name: "north"}, info)
+}
+
+func TestGetGroupInfoForUnknownGroup(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"groups": []}`)
+	})
+	api.group = "north"
+
+	_, err := api.GetGroupInfo(context.Background())
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.True(t, IsPermanentError(err))
+}
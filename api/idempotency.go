@@ -0,0 +1,41 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// idempotencyKeyHeader carries the key the server uses to recognise an
+// event it has already received.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// NewIdempotencyKey creates a random (version 4) UUID to identify an
+// event, so that sending it again, such as after a retry, doesn't
+// record it twice.
+func NewIdempotencyKey() string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %v", err))
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
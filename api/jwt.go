@@ -0,0 +1,77 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// tokenClaims are the claims read from a JSON Web Token that the client
+// cares about.
+type tokenClaims struct {
+	expiry   time.Time
+	issuedAt time.Time
+}
+
+// parseTokenClaims reads the claims from a JSON Web Token. The signature
+// isn't verified, that is the server's job. The token may be prefixed
+// with "JWT " as the server sends it.
+func parseTokenClaims(token string) (tokenClaims, bool) {
+	token = strings.TrimPrefix(token, "JWT ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return tokenClaims{}, false
+	}
+
+	var claims struct {
+		Exp float64 `json:"exp"`
+		Iat float64 `json:"iat"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, false
+	}
+	return tokenClaims{
+		expiry:   unixSeconds(claims.Exp),
+		issuedAt: unixSeconds(claims.Iat),
+	}, true
+}
+
+func unixSeconds(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(seconds), 0)
+}
+
+// TokenExpiry gets when the current token expires. ok is false if the
+// token is missing, malformed or has no expiry.
+func (api *CacophonyAPI) TokenExpiry() (expiry time.Time, ok bool) {
+	claims, ok := parseTokenClaims(api.getToken())
+	if !ok || claims.expiry.IsZero() {
+		return time.Time{}, false
+	}
+	return claims.expiry, true
+}
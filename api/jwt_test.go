@@ -0,0 +1,59 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeToken(payload string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return "JWT " + encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestTokenExpiry(t *testing.T) {
+	api := &CacophonyAPI{token: makeToken(`{"_type":"device","id":12,"iat":1530403200,"exp":1530489600}`)}
+
+	expiry, ok := api.TokenExpiry()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1530489600, 0), expiry)
+	assert.Equal(t, expiry, api.Status().TokenExpiry)
+
+	claims, ok := parseTokenClaims(api.token)
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1530403200, 0), claims.issuedAt)
+}
+
+func TestTokenExpiryOfMalformedTokens(t *testing.T) {
+	for _, token := range []string{
+		"",
+		"JWT not-a-token",
+		"JWT a.!!!.c",
+		makeToken(`not json`),
+		makeToken(`{"id":12}`),
+	} {
+		api := &CacophonyAPI{token: token}
+		_, ok := api.TokenExpiry()
+		assert.False(t, ok, token)
+	}
+}
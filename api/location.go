@@ -0,0 +1,95 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Location is where a device is, as reported to the server.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// validateLocation checks the coordinates are on the Earth.
+func validateLocation(lat, lon float64) error {
+	if lat < -90 || lat > 90 {
+		return &Error{message: fmt.Sprintf("latitude %v outside -90 to 90", lat), permanent: true}
+	}
+	if lon < -180 || lon > 180 {
+		return &Error{message: fmt.Sprintf("longitude %v outside -180 to 180", lon), permanent: true}
+	}
+	return nil
+}
+
+// ReportLocation tells the server the device has moved to the given
+// latitude and longitude, in degrees. Once the server has it the
+// location is also returned by ReportedLocation, for working out sun
+// times locally.
+func (api *CacophonyAPI) ReportLocation(ctx context.Context, lat, lon float64) (err error) {
+	if api.readOnly {
+		return ErrReadOnly
+	}
+	if err := validateLocation(lat, lon); err != nil {
+		return err
+	}
+	location := Location{Latitude: lat, Longitude: lon}
+	payload, err := json.Marshal(location)
+	if err != nil {
+		return err
+	}
+	if err := api.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	req, err := api.newRequest("POST", "/api/v1/devices/location", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := api.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return temporaryError(err)
+	}
+	defer resp.Body.Close()
+
+	if !isHTTPSuccess(resp.StatusCode) {
+		return responseError(resp)
+	}
+	api.locationMu.Lock()
+	api.location = &location
+	api.locationMu.Unlock()
+	return nil
+}
+
+// ReportedLocation gets the location last reported with ReportLocation,
+// or false if none has been.
+func (api *CacophonyAPI) ReportedLocation() (Location, bool) {
+	api.locationMu.Lock()
+	defer api.locationMu.Unlock()
+	if api.location == nil {
+		return Location{}, false
+	}
+	return *api.location, true
+}
@@ -0,0 +1,70 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportLocation(t *testing.T) {
+	var reported Location
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/api/v1/devices/location", r.URL.Path)
+		assert.Equal(t, "JWT abc", r.Header.Get("Authorization"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&reported))
+	})
+	api.token = "JWT abc"
+
+	_, ok := api.ReportedLocation()
+	assert.False(t, ok)
+	assert.Nil(t, api.ReportLocation(context.Background(), -43.5, 172.6))
+	assert.Equal(t, Location{Latitude: -43.5, Longitude: 172.6}, reported)
+	location, ok := api.ReportedLocation()
+	assert.True(t, ok)
+	assert.Equal(t, reported, location)
+}
+
+func TestReportLocationChecksCoordinates(t *testing.T) {
+	requests := 0
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	err := api.ReportLocation(context.Background(), -91, 172.6)
+	assert.EqualError(t, err, "latitude -91 outside -90 to 90")
+	assert.True(t, IsPermanentError(err))
+	assert.EqualError(t, api.ReportLocation(context.Background(), -43.5, 180.5), "longitude 180.5 outside -180 to 180")
+	assert.Equal(t, 0, requests)
+}
+
+func TestReportLocationIsNotCachedWhenRejected(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+
+	assert.NotNil(t, api.ReportLocation(context.Background(), -43.5, 172.6))
+	_, ok := api.ReportedLocation()
+	assert.False(t, ok)
+}
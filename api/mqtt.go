@@ -0,0 +1,293 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 packet types, in the top four bits of a packet's first
+// byte.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttDisconnect = 14
+)
+
+const (
+	mqttKeepAlive  = 60 * time.Second
+	mqttTimeout    = 30 * time.Second
+	mqttClientName = "audiobait"
+)
+
+// MQTTReporter is an event reporter that publishes events to a topic on
+// an MQTT broker instead of sending them to the server. The payload is
+// the same JSON the server is sent. Events are published at QoS 1, so
+// an event only counts as sent once the broker has acknowledged it.
+// Failing to reach the broker is a temporary error, so callers can
+// spool the event to try again later.
+type MQTTReporter struct {
+	broker   *url.URL
+	topic    string
+	username string
+	password string
+	clientID string
+	// format holds the options that affect how events are formatted.
+	format *CacophonyAPI
+
+	mu       sync.Mutex
+	conn     net.Conn
+	reader   *bufio.Reader
+	packetID uint16
+}
+
+// NewMQTTReporter creates a reporter that publishes to the topic on the
+// broker, given as a URL such as "tcp://localhost:1883", or "ssl://" to
+// use TLS. The options are those used for the API, of which the ones
+// about events, such as WithEventDefaults and WithLocalTimestamps,
+// format events in the same way, and WithEventReporters also mirrors
+// them.
+func NewMQTTReporter(broker, topic, username, password string, opts ...Option) (*MQTTReporter, error) {
+	brokerURL, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT broker: %v", err)
+	}
+	switch brokerURL.Scheme {
+	case "tcp", "ssl":
+	default:
+		return nil, fmt.Errorf("invalid MQTT broker: unsupported scheme %q", brokerURL.Scheme)
+	}
+	if brokerURL.Port() == "" {
+		port := "1883"
+		if brokerURL.Scheme == "ssl" {
+			port = "8883"
+		}
+		brokerURL.Host = net.JoinHostPort(brokerURL.Hostname(), port)
+	}
+	if topic == "" {
+		return nil, errors.New("no MQTT topic given")
+	}
+
+	format := &CacophonyAPI{}
+	for _, opt := range opts {
+		opt(format)
+	}
+	return &MQTTReporter{
+		broker:   brokerURL,
+		topic:    topic,
+		username: username,
+		password: password,
+		clientID: mqttClientName + "-" + randString(8),
+		format:   format,
+	}, nil
+}
+
+// ReportEventWithKey publishes an event. The idempotency key isn't
+// sent, as MQTT 3.1.1 messages have nowhere to put it apart from the
+// payload.
+func (r *MQTTReporter) ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) error {
+	if r.format.eventsDisabled {
+		log.Printf("event reporting disabled, not publishing: %s", jsonDetails)
+		return nil
+	}
+	r.format.reportToSecondaries(jsonDetails, times, key)
+	payload, err := r.format.eventJSON(jsonDetails, times)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = r.publish(payload)
+	if err != nil && r.conn != nil {
+		// The broker may have dropped an idle connection, so try again
+		// on a new one.
+		r.close()
+		err = r.publish(payload)
+	}
+	if err != nil {
+		r.close()
+		return temporaryError(err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (r *MQTTReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	r.conn.Write([]byte{mqttDisconnect << 4, 0})
+	r.close()
+	return nil
+}
+
+func (r *MQTTReporter) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+		r.reader = nil
+	}
+}
+
+// publish sends the payload and waits for the broker to acknowledge it.
+func (r *MQTTReporter) publish(payload []byte) error {
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return err
+		}
+	}
+	r.packetID++
+	if r.packetID == 0 {
+		r.packetID = 1
+	}
+	body := append(mqttString(r.topic), byte(r.packetID>>8), byte(r.packetID))
+	body = append(body, payload...)
+	if err := r.writePacket(mqttPublish<<4|0x02, body); err != nil {
+		return err
+	}
+	for {
+		packetType, body, err := r.readPacket()
+		if err != nil {
+			return err
+		}
+		if packetType == mqttPuback && len(body) >= 2 && binary.BigEndian.Uint16(body) == r.packetID {
+			return nil
+		}
+	}
+}
+
+// connect connects and logs in to the broker.
+func (r *MQTTReporter) connect() error {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var conn net.Conn
+	var err error
+	if r.broker.Scheme == "ssl" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.broker.Host, &tls.Config{ServerName: r.broker.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", r.broker.Host)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.reader = bufio.NewReader(conn)
+
+	flags := byte(0x02) // Clean session.
+	payload := mqttString(r.clientID)
+	if r.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(r.username)...)
+	}
+	if r.password != "" {
+		flags |= 0x40
+		payload = append(payload, mqttString(r.password)...)
+	}
+	keepAlive := uint16(mqttKeepAlive / time.Second)
+	body := append(mqttString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, payload...)
+	if err := r.writePacket(mqttConnect<<4, body); err != nil {
+		r.close()
+		return err
+	}
+
+	packetType, ack, err := r.readPacket()
+	if err == nil && (packetType != mqttConnack || len(ack) < 2) {
+		err = errors.New("MQTT broker didn't acknowledge the connection")
+	} else if err == nil && ack[1] != 0 {
+		err = fmt.Errorf("MQTT broker refused the connection (code %d)", ack[1])
+	}
+	if err != nil {
+		r.close()
+	}
+	return err
+}
+
+func (r *MQTTReporter) writePacket(header byte, body []byte) error {
+	packet := append([]byte{header}, mqttRemainingLength(len(body))...)
+	packet = append(packet, body...)
+	r.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	_, err := r.conn.Write(packet)
+	return err
+}
+
+// readPacket reads a packet, returning its type and what follows its
+// fixed header.
+func (r *MQTTReporter) readPacket() (byte, []byte, error) {
+	r.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	header, err := r.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for multiplier := 1; ; multiplier *= 128 {
+		digit, err := r.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if multiplier > 128*128*128 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// mqttString encodes a string as MQTT does, prefixed by its length.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttRemainingLength encodes a packet's length as MQTT does, seven
+// bits at a time.
+func mqttRemainingLength(length int) []byte {
+	var encoded []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker accepts one MQTT connection and acknowledges what it is
+// sent, passing on the published messages.
+func fakeBroker(t *testing.T, messages chan<- []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reporter := &MQTTReporter{conn: conn, reader: bufio.NewReader(conn)}
+		for {
+			packetType, body, err := reporter.readPacket()
+			if err != nil {
+				return
+			}
+			switch packetType {
+			case mqttConnect:
+				reporter.writePacket(mqttConnack<<4, []byte{0, 0})
+			case mqttPublish:
+				topicLength := int(binary.BigEndian.Uint16(body))
+				packetID := body[2+topicLength : 4+topicLength]
+				messages <- append([]byte(string(body[2:2+topicLength])+" "), body[4+topicLength:]...)
+				reporter.writePacket(mqttPuback<<4, packetID)
+			}
+		}
+	}()
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestMQTTReporterPublishesEvents(t *testing.T) {
+	messages := make(chan []byte, 2)
+	reporter, err := NewMQTTReporter(fakeBroker(t, messages), "audiobait/events", "user", "secret", WithMillisecondTimestamps())
+	assert.Nil(t, err)
+	defer reporter.Close()
+
+	assert.Nil(t, reporter.ReportEventWithKey([]byte(`{"description":{"type":"test"}}`), []time.Time{eventTime}, "key"))
+	assert.Nil(t, reporter.ReportEventWithKey([]byte(`{"description":{"type":"test"}}`), []time.Time{eventTime}, "key"))
+
+	message := <-messages
+	topic, payload := string(message[:len("audiobait/events")]), message[len("audiobait/events")+1:]
+	assert.Equal(t, "audiobait/events", topic)
+	var event map[string]interface{}
+	assert.Nil(t, json.Unmarshal(payload, &event))
+	assert.Equal(t, []interface{}{"2018-11-05T08:30:15.123Z"}, event["dateTimes"])
+	assert.Len(t, messages, 1)
+}
+
+func TestMQTTReporterBrokerDownIsTemporary(t *testing.T) {
+	reporter, err := NewMQTTReporter("tcp://127.0.0.1:1", "audiobait/events", "", "")
+	assert.Nil(t, err)
+	err = reporter.ReportEventWithKey([]byte(`{}`), []time.Time{eventTime}, "key")
+	assert.NotNil(t, err)
+	assert.False(t, IsPermanentError(err))
+}
+
+func TestMQTTRemainingLength(t *testing.T) {
+	assert.Equal(t, []byte{0}, mqttRemainingLength(0))
+	assert.Equal(t, []byte{127}, mqttRemainingLength(127))
+	assert.Equal(t, []byte{0x80, 0x01}, mqttRemainingLength(128))
+	assert.Equal(t, []byte{0xff, 0x7f}, mqttRemainingLength(16383))
+}
@@ -19,26 +19,65 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func Open(configFile string) (*CacophonyAPI, error) {
-	// TODO(mjs) - much of this is copied straight from
-	// thermal-uploader and should be extracted.
-	conf, err := ParseConfigFile(configFile)
-	if err != nil {
-		return nil, fmt.Errorf("configuration error: %v", err)
+// Backoff is how long to wait between attempts to reach the server,
+// starting at Initial and doubling after each attempt up to Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// BootBackoff is the backoff for reaching the server when the device
+// starts, which is slow to back off as the network often comes up some
+// seconds after the device does.
+var BootBackoff = Backoff{Initial: 2 * time.Second, Max: 30 * time.Second}
+
+// RetryUnreachable calls attempt until it doesn't fail with
+// ErrUnreachable, waiting between attempts as backoff says. It gives up
+// when ctx is done, returning the last error.
+func RetryUnreachable(ctx context.Context, backoff Backoff, attempt func() error) error {
+	wait := backoff.Initial
+	for {
+		err := attempt()
+		if !errors.Is(err, ErrUnreachable) {
+			return err
+		}
+		log.Printf("Server unreachable, trying again in %v: %v", wait, err)
+		if !sleepContext(ctx, wait) {
+			return err
+		}
+		if wait *= 2; wait > backoff.Max {
+			wait = backoff.Max
+		}
 	}
-	privConfigFilename := privConfigFilename(configFile)
-	password, err := ReadPassword(privConfigFilename)
+}
+
+// OpenAtBoot opens the API as Open does, trying again while the server
+// is unreachable until ctx is done.
+func OpenAtBoot(ctx context.Context, configFile string, backoff Backoff, opts ...Option) (*CacophonyAPI, error) {
+	var api *CacophonyAPI
+	err := RetryUnreachable(ctx, backoff, func() error {
+		var err error
+		api, err = Open(configFile, opts...)
+		return err
+	})
+	return api, err
+}
+
+func Open(configFile string, opts ...Option) (*CacophonyAPI, error) {
+	api, err := OpenUnauthenticated(configFile, opts...)
 	if err != nil {
 		return nil, err
 	}
-
-	api, err := NewAPI(conf.ServerURL, conf.Group, conf.DeviceName, password)
-	if err != nil {
+	if err := api.newToken(context.Background()); err != nil {
 		return nil, err
 	}
 
@@ -46,7 +85,7 @@ func Open(configFile string) (*CacophonyAPI, error) {
 	// event-reporter register at about the same time. Extract this to
 	// a library which does locking.
 	if api.JustRegistered() {
-		err := WritePassword(privConfigFilename, api.Password())
+		err := WritePassword(privConfigFilename(configFile), api.Password())
 		if err != nil {
 			return nil, err
 		}
@@ -55,6 +94,27 @@ func Open(configFile string) (*CacophonyAPI, error) {
 	return api, nil
 }
 
+// OpenUnauthenticated creates an API client from the configuration file
+// without authenticating or registering the device, for checking the
+// configured credentials with VerifyCredentials.
+func OpenUnauthenticated(configFile string, opts ...Option) (*CacophonyAPI, error) {
+	// TODO(mjs) - much of this is copied straight from
+	// thermal-uploader and should be extracted.
+	conf, err := ParseConfigFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("configuration error: %v", err)
+	}
+	password, err := ReadPassword(privConfigFilename(configFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.FileServerURL != "" {
+		opts = append([]Option{WithFileServer(conf.FileServerURL)}, opts...)
+	}
+	return NewUnauthenticatedAPI(conf.ServerURL, conf.Group, conf.DeviceName, password, opts...), nil
+}
+
 func privConfigFilename(configFile string) string {
 	dirname, filename := filepath.Split(configFile)
 	bareFilename := strings.TrimSuffix(filename, ".yaml")
@@ -0,0 +1,81 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrCertificatePin is returned when none of the server's certificates
+// match the pinned certificates, which may mean the connection has been
+// intercepted.
+var ErrCertificatePin = &Error{message: "server certificate doesn't match any pinned certificate", permanent: true, kind: KindCertificate}
+
+// errPinMismatch is returned from the TLS handshake and replaced by
+// ErrCertificatePin once the request has failed.
+var errPinMismatch = errors.New("certificate pin mismatch")
+
+// WithPinnedCertSHA256 only allows connections to servers that present
+// a certificate, either the leaf or an intermediate, whose SHA-256
+// fingerprint is one of pins. Fingerprints are hex, with or without
+// colons between the bytes. The usual certificate checks still apply.
+func WithPinnedCertSHA256(pins ...string) Option {
+	return func(api *CacophonyAPI) {
+		api.certPins = make(map[string]bool, len(pins))
+		for _, pin := range pins {
+			api.certPins[normalisePin(pin)] = true
+		}
+	}
+}
+
+func normalisePin(pin string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+}
+
+// tlsConfig gets the TLS configuration for connecting to the servers,
+// or nil for the default.
+func (api *CacophonyAPI) tlsConfig() *tls.Config {
+	if len(api.certPins) == 0 {
+		return nil
+	}
+	return &tls.Config{VerifyPeerCertificate: api.verifyPins}
+}
+
+// verifyPins checks that one of the certificates the server presented
+// is pinned.
+func (api *CacophonyAPI) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, cert := range rawCerts {
+		sum := sha256.Sum256(cert)
+		if api.certPins[hex.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return errPinMismatch
+}
+
+// isPinMismatch checks whether a request failed because of the
+// certificate pins.
+func isPinMismatch(err error) bool {
+	return errors.Is(err, errPinMismatch)
+}
@@ -0,0 +1,70 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newPinnedTestAPI creates a client pinned to pins for a TLS test server,
+// trusting the server's self-signed certificate.
+func newPinnedTestAPI(t *testing.T, pins ...string) (*CacophonyAPI, *httptest.Server) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"schedule":{"playNights":1}}`)
+	}))
+	t.Cleanup(server.Close)
+
+	api := &CacophonyAPI{serverURL: server.URL}
+	WithPinnedCertSHA256(pins...)(api)
+	api.createClients()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	api.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+	return api, server
+}
+
+func TestPinnedCertificateIsAccepted(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	sum := sha256.Sum256(server.Certificate().Raw)
+	server.Close()
+	pin := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// The test server always presents the same certificate.
+	api, _ := newPinnedTestAPI(t, "00", pin)
+	_, err := api.GetSchedule()
+	assert.Nil(t, err)
+}
+
+func TestUnpinnedCertificateIsRejected(t *testing.T) {
+	api, _ := newPinnedTestAPI(t, "00:11:22")
+	_, err := api.GetSchedule()
+	assert.Equal(t, ErrCertificatePin, err)
+	assert.True(t, IsPermanentError(err))
+	assert.True(t, errors.Is(err, ErrCertificate))
+}
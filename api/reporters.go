@@ -0,0 +1,53 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"log"
+	"time"
+)
+
+// EventReporter is somewhere events can be sent, such as a local file
+// or message bus as well as the server. CacophonyAPI is one itself.
+type EventReporter interface {
+	// ReportEventWithKey sends an event, with the idempotency key that
+	// identifies it.
+	ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) error
+}
+
+// WithEventReporters also sends every event reported to the server to
+// the given reporters. Delivering to them is best effort: their
+// failures are logged but don't make reporting the event fail. They are
+// sent the event each time it is reported, including when it is sent
+// again after failing to reach the server, so they should use the
+// idempotency key to ignore repeats.
+func WithEventReporters(reporters ...EventReporter) Option {
+	return func(api *CacophonyAPI) {
+		api.eventReporters = append(api.eventReporters, reporters...)
+	}
+}
+
+// reportToSecondaries sends an event to the extra event reporters.
+func (api *CacophonyAPI) reportToSecondaries(jsonDetails []byte, times []time.Time, key string) {
+	for _, reporter := range api.eventReporters {
+		if err := reporter.ReportEventWithKey(jsonDetails, times, key); err != nil {
+			log.Printf("Could not send event to secondary reporter: %v", err)
+		}
+	}
+}
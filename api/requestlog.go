@@ -0,0 +1,76 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WithRequestLogging logs the method, URL, headers, status and timing
+// of every request sent to the servers, for diagnosing problems talking
+// to them. The Authorization header and the "jwt" query parameter are
+// redacted. Bodies aren't logged, so passwords sent in them aren't
+// either.
+func WithRequestLogging(logger *log.Logger) Option {
+	return func(api *CacophonyAPI) {
+		api.requestLogger = logger
+	}
+}
+
+// loggingTransport logs each request passed through it to the wrapped
+// transport.
+type loggingTransport struct {
+	transport http.RoundTripper
+	logger    *log.Logger
+}
+
+func (lt *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := lt.transport.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	request := req.Method + " " + redactURL(req.URL.String())
+	if headers := redactedHeaders(req.Header); headers != "" {
+		request += " [" + headers + "]"
+	}
+	if err != nil {
+		lt.logger.Printf("%s failed after %v: %v", request, elapsed, redactURLError(err))
+		return resp, err
+	}
+	lt.logger.Printf("%s: %s in %v", request, resp.Status, elapsed)
+	return resp, nil
+}
+
+// redactedHeaders formats the headers, in order, with the value of the
+// Authorization header replaced.
+func redactedHeaders(header http.Header) string {
+	var headers []string
+	for key, values := range header {
+		value := strings.Join(values, ", ")
+		if key == "Authorization" {
+			value = "REDACTED"
+		}
+		headers = append(headers, key+": "+value)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, "; ")
+}
@@ -0,0 +1,58 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	wait, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = parseRetryAfter("Fri, 01 Jun 2018 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("-5", now)
+	assert.False(t, ok)
+}
+
+func TestRateLimitedIsTemporary(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "90")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	_, err := api.GetSchedule()
+	assert.False(t, IsPermanentError(err))
+	wait, ok := RetryAfter(err)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Second, wait)
+}
@@ -0,0 +1,65 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"net/url"
+)
+
+// WithSignedURLAuthHeader sends the token for downloading a file from
+// its signed URL in the Authorization header instead of the URL's "jwt"
+// query parameter, so that it doesn't end up in URLs and the logs of
+// anything in between.
+func WithSignedURLAuthHeader() Option {
+	return func(api *CacophonyAPI) {
+		api.signedURLHeader = true
+	}
+}
+
+// signedURLRequest gets the path and Authorization header to download a
+// file from its signed URL with the given token.
+func (api *CacophonyAPI) signedURLRequest(jwt string) (path, authorization string) {
+	if api.signedURLHeader {
+		return "/api/v1/signedUrl", "JWT " + jwt
+	}
+	return "/api/v1/signedUrl?jwt=" + url.QueryEscape(jwt), ""
+}
+
+// redactURLError masks the token in the URL of a failed request, which
+// the error's message includes, so it can be logged.
+func redactURLError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	redacted := *urlErr
+	redacted.URL = redactURL(urlErr.URL)
+	return &redacted
+}
+
+// redactURL masks the "jwt" query parameter of rawURL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Query().Get("jwt") == "" {
+		return rawURL
+	}
+	query := u.Query()
+	query.Set("jwt", "REDACTED")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,56 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// eventSignatureHeader carries the HMAC-SHA256 of an event, hex encoded
+// and prefixed with "sha256=".
+const eventSignatureHeader = "X-Event-Signature"
+
+// WithEventSigning signs every event sent to the server with an
+// HMAC-SHA256 of its JSON using the device's secret key, so the server
+// can check the event came from the device. The signature is of the
+// exact bytes sent. For an event with a file it is of the event's JSON
+// in the "data" part, as the file is streamed and can't be signed in
+// advance.
+func WithEventSigning(key []byte) Option {
+	return func(api *CacophonyAPI) {
+		api.signingKey = append([]byte(nil), key...)
+	}
+}
+
+// signEvent adds the signature of an event's JSON to its request, if
+// events are being signed.
+func (api *CacophonyAPI) signEvent(req *http.Request, jsonAll []byte) {
+	if len(api.signingKey) == 0 {
+		return
+	}
+	req.Header.Set(eventSignatureHeader, eventSignature(api.signingKey, jsonAll))
+}
+
+func eventSignature(key, jsonAll []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(jsonAll)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,88 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+)
+
+// StreamFile opens a file from its signed URL to be read as it downloads,
+// instead of saving it first. If the signed URL has expired a new one is
+// requested. A stream longer than the file size limit fails once it
+// passes the limit. The caller must close the stream.
+func (api *CacophonyAPI) StreamFile(ctx context.Context, fileResponse *FileResponse) (_ io.ReadCloser, err error) {
+	if err := api.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { api.breaker.recordUnlessCancelled(ctx, err) }()
+
+	body, err := api.openFileStream(ctx, fileResponse.Jwt)
+	if isSignedURLExpired(err) && fileResponse.fileID != 0 {
+		log.Printf("Signed URL for file %d expired, requesting a new one", fileResponse.fileID)
+		fresh, freshErr := api.getFileDetails(fileResponse.fileID)
+		if freshErr != nil {
+			return nil, freshErr
+		}
+		body, err = api.openFileStream(ctx, fresh.Jwt)
+	}
+	return body, err
+}
+
+func (api *CacophonyAPI) openFileStream(ctx context.Context, jwt string) (io.ReadCloser, error) {
+	signedURL, authorization := api.signedURLRequest(jwt)
+	resp, err := api.doFileRequest(ctx, api.downloadClient, signedURL, authorization, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, statusError("bad status: "+resp.Status, resp)
+	}
+	if api.maxFileBytes > 0 && resp.ContentLength > api.maxFileBytes {
+		resp.Body.Close()
+		return nil, fileTooLargeError(resp.ContentLength, api.maxFileBytes)
+	}
+	return &fileStream{body: resp.Body, maxBytes: api.maxFileBytes}, nil
+}
+
+// fileStream is the body of a streamed file, which fails with a
+// temporary error if reading it fails part way through.
+type fileStream struct {
+	body     io.ReadCloser
+	maxBytes int64
+	read     int64
+}
+
+func (stream *fileStream) Read(p []byte) (int, error) {
+	n, err := stream.body.Read(p)
+	stream.read += int64(n)
+	if stream.maxBytes > 0 && stream.read > stream.maxBytes {
+		return n, fileTooLargeError(stream.read, stream.maxBytes)
+	}
+	if err != nil && err != io.EOF {
+		err = temporaryError(err)
+	}
+	return n, err
+}
+
+func (stream *fileStream) Close() error {
+	return stream.body.Close()
+}
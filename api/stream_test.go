@@ -0,0 +1,96 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package api
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamFileRequestsNewSignedURLWhenExpired(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"fresh"}`)
+		case "/api/v1/signedUrl":
+			if r.URL.Query().Get("jwt") == "stale" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	fileResponse.Jwt = "stale"
+
+	stream, err := api.StreamFile(context.Background(), fileResponse)
+	assert.Nil(t, err)
+	defer stream.Close()
+	contents, err := ioutil.ReadAll(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "audio", string(contents))
+}
+
+func TestStreamFileFailsWhenCutShort(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, "part of the audio")
+	})
+
+	stream, err := api.StreamFile(context.Background(), &FileResponse{Jwt: "signed"})
+	assert.Nil(t, err)
+	defer stream.Close()
+	_, err = ioutil.ReadAll(stream)
+	assert.Error(t, err)
+	assert.False(t, IsPermanentError(err))
+}
+
+func TestStreamFileRequestsNewSignedURLWhileProbingTheServer(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/files/7":
+			fmt.Fprint(w, `{"jwt":"fresh"}`)
+		case "/api/v1/signedUrl":
+			if r.URL.Query().Get("jwt") == "stale" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "audio")
+		}
+	})
+	fileResponse, err := api.GetFileDetails(7)
+	assert.Nil(t, err)
+	fileResponse.Jwt = "stale"
+	// The breaker has been open long enough for the stream to probe the server.
+	api.breaker = newCircuitBreaker(1, time.Minute)
+	api.breaker.state = BreakerOpen
+	api.breaker.openedAt = time.Now().Add(-time.Hour)
+
+	stream, err := api.StreamFile(context.Background(), fileResponse)
+	assert.Nil(t, err)
+	defer stream.Close()
+	state, _ := api.breaker.status()
+	assert.Equal(t, BreakerClosed, state)
+}
@@ -0,0 +1,126 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// WithTags sets the device's tags, such as its role or location, which
+// are sent when getting the schedule. When the server offers several
+// schedules the one whose tags best match the device's is chosen.
+func WithTags(tags ...string) Option {
+	return func(api *CacophonyAPI) {
+		api.tags = append(api.tags, tags...)
+	}
+}
+
+// ScheduleChoice identifies the schedule last fetched from the server.
+type ScheduleChoice struct {
+	// ID is the schedule's ID, or zero if the server didn't give one.
+	ID int
+	// Tags are the tags of the schedule chosen from several, and Matched
+	// how many of them the device has.
+	Tags    []string
+	Matched int
+}
+
+// ScheduleChoice gets which schedule was last fetched from the server.
+func (api *CacophonyAPI) ScheduleChoice() ScheduleChoice {
+	api.scheduleMu.Lock()
+	defer api.scheduleMu.Unlock()
+	return api.scheduleChoice
+}
+
+func (api *CacophonyAPI) setScheduleChoice(choice ScheduleChoice) {
+	api.scheduleMu.Lock()
+	defer api.scheduleMu.Unlock()
+	api.scheduleChoice = choice
+}
+
+// scheduleCandidate is one of several schedules the server offers.
+type scheduleCandidate struct {
+	ID       int             `json:"id"`
+	Tags     []string        `json:"tags"`
+	Schedule json.RawMessage `json:"schedule"`
+}
+
+// chooseSchedule picks the candidate with the most tags in common with
+// the device, preferring the first of those that match equally. nil is
+// returned if there are no candidates.
+func (api *CacophonyAPI) chooseSchedule(candidates []scheduleCandidate) (*scheduleCandidate, int) {
+	deviceTags := make(map[string]bool, len(api.tags))
+	for _, tag := range api.tags {
+		deviceTags[tag] = true
+	}
+	var best *scheduleCandidate
+	bestMatched := -1
+	for i, candidate := range candidates {
+		if len(candidate.Schedule) == 0 || string(candidate.Schedule) == "null" {
+			continue
+		}
+		matched := 0
+		for _, tag := range candidate.Tags {
+			if deviceTags[tag] {
+				matched++
+			}
+		}
+		if matched > bestMatched {
+			best, bestMatched = &candidates[i], matched
+		}
+	}
+	return best, bestMatched
+}
+
+// selectSchedule finds the schedule in a response body. If the server
+// offers several schedules, and either the device has tags or there is
+// no single schedule, one is chosen and the body rewritten to hold just
+// that schedule, as if it was the only one. It returns the body and the
+// schedule's JSON, which is nil if there is no schedule.
+func (api *CacophonyAPI) selectSchedule(body []byte) ([]byte, json.RawMessage) {
+	var sr struct {
+		Schedule   json.RawMessage
+		ScheduleID int `json:"scheduleId"`
+		Schedules  []scheduleCandidate
+	}
+	if err := json.Unmarshal(body, &sr); err == nil && len(sr.Schedules) > 0 &&
+		(len(api.tags) > 0 || getRawSchedule(body) == nil) {
+		if candidate, matched := api.chooseSchedule(sr.Schedules); candidate != nil {
+			api.setScheduleChoice(ScheduleChoice{ID: candidate.ID, Tags: candidate.Tags, Matched: matched})
+			chosen, err := json.Marshal(map[string]interface{}{
+				"schedule":   candidate.Schedule,
+				"scheduleId": candidate.ID,
+			})
+			if err == nil {
+				return chosen, candidate.Schedule
+			}
+		}
+	}
+	api.setScheduleChoice(ScheduleChoice{ID: sr.ScheduleID})
+	return body, getRawSchedule(body)
+}
+
+// resetSchedule clears a schedule that may already have had another
+// schedule decoded into it.
+func resetSchedule(schedule interface{}) {
+	if value := reflect.ValueOf(schedule); value.Kind() == reflect.Ptr && !value.IsNil() {
+		value.Elem().Set(reflect.Zero(value.Elem().Type()))
+	}
+}
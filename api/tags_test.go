@@ -0,0 +1,71 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const candidateSchedules = `{
+	"schedule": {"playNights": 1},
+	"schedules": [
+		{"id": 3, "tags": ["south"], "schedule": {"playNights": 3}},
+		{"id": 4, "tags": ["north", "ridge"], "schedule": {"playNights": 4}},
+		{"id": 5, "tags": ["north"], "schedule": {"playNights": 5}}
+	]
+}`
+
+func TestScheduleIsChosenByTags(t *testing.T) {
+	var query string
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("tags")
+		fmt.Fprint(w, candidateSchedules)
+	})
+	WithTags("north", "ridge")(api)
+
+	var schedule testSchedule
+	assert.Nil(t, api.DecodeSchedule(&schedule))
+	assert.Equal(t, "north,ridge", query)
+	assert.Equal(t, 4, schedule.PlayNights)
+	assert.Equal(t, ScheduleChoice{ID: 4, Tags: []string{"north", "ridge"}, Matched: 2}, api.ScheduleChoice())
+
+	body, err := api.GetSchedule()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"scheduleId": 4, "schedule": {"playNights": 4}}`, string(body))
+	assert.Equal(t, hashSchedule([]byte(`{"playNights": 4}`)), api.ScheduleHash())
+}
+
+func TestScheduleWithoutTagsIsTheSingleSchedule(t *testing.T) {
+	api := newTestAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.URL.RawQuery)
+		fmt.Fprint(w, candidateSchedules)
+	})
+
+	var schedule testSchedule
+	assert.Nil(t, api.DecodeSchedule(&schedule))
+	assert.Equal(t, 1, schedule.PlayNights)
+	body, err := api.GetSchedule()
+	assert.Nil(t, err)
+	assert.JSONEq(t, candidateSchedules, string(body))
+	assert.Equal(t, ScheduleChoice{}, api.ScheduleChoice())
+}
@@ -0,0 +1,84 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// throughputAlpha is how much each download changes the average.
+	throughputAlpha = 0.3
+	// throughputHalfLife is how long it takes, with no downloads, for the
+	// average to lose half of its weight against the next download.
+	throughputHalfLife = 30 * time.Minute
+	// throughputExpiry is how long without a download before the average
+	// is forgotten.
+	throughputExpiry = 6 * time.Hour
+)
+
+// throughputMeter keeps an exponential moving average of how fast files
+// download. The zero value is ready to use.
+type throughputMeter struct {
+	mu   sync.Mutex
+	rate float64
+	last time.Time
+}
+
+// record adds a download of size bytes that took duration and finished
+// at the given time.
+func (m *throughputMeter) record(bytes int64, duration time.Duration, at time.Time) {
+	if bytes <= 0 || duration <= 0 {
+		return
+	}
+	sample := float64(bytes) / duration.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() || at.Sub(m.last) >= throughputExpiry {
+		m.rate = sample
+	} else {
+		// The longer since the last download the less the average so
+		// far counts for.
+		idle := at.Sub(m.last).Seconds()
+		oldWeight := (1 - throughputAlpha) * math.Pow(0.5, idle/throughputHalfLife.Seconds())
+		m.rate = oldWeight*m.rate + (1-oldWeight)*sample
+	}
+	m.last = at
+}
+
+// bytesPerSecond gets the average at the given time, or zero if there
+// hasn't been a download recently enough to know.
+func (m *throughputMeter) bytesPerSecond(at time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.last.IsZero() || at.Sub(m.last) >= throughputExpiry {
+		return 0
+	}
+	return m.rate
+}
+
+// DownloadThroughput gets a moving average, in bytes per second, of how
+// fast recent files have downloaded. It is zero if no file has been
+// downloaded for a while, as the link may have changed since.
+func (api *CacophonyAPI) DownloadThroughput() float64 {
+	return api.throughput.bytesPerSecond(time.Now())
+}
@@ -0,0 +1,53 @@
+/*
+audiobait - play sounds to lure animals for The Cacophony Project API.
+Copyright (C) 2018, The Cacophony Project
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThroughputIsAMovingAverage(t *testing.T) {
+	var meter throughputMeter
+	start := time.Date(2018, time.November, 5, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0.0, meter.bytesPerSecond(start))
+
+	meter.record(1000, time.Second, start)
+	assert.Equal(t, 1000.0, meter.bytesPerSecond(start))
+
+	meter.record(2000, time.Second, start)
+	assert.InDelta(t, 1300.0, meter.bytesPerSecond(start), 0.001)
+}
+
+func TestThroughputDecaysWhileIdle(t *testing.T) {
+	var meter throughputMeter
+	start := time.Date(2018, time.November, 5, 12, 0, 0, 0, time.UTC)
+	meter.record(1000, time.Second, start)
+
+	// After one half life the old average has half its usual weight.
+	meter.record(2000, time.Second, start.Add(throughputHalfLife))
+	assert.InDelta(t, 1650.0, meter.bytesPerSecond(start.Add(throughputHalfLife)), 0.001)
+
+	later := start.Add(throughputHalfLife + throughputExpiry)
+	assert.Equal(t, 0.0, meter.bytesPerSecond(later))
+	meter.record(500, time.Second, later)
+	assert.Equal(t, 500.0, meter.bytesPerSecond(later))
+}
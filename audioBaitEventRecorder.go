@@ -5,43 +5,167 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
 	"github.com/godbus/dbus"
 )
 
 // AudioBaitEventRecorder uses the event api to record that audioBait was played at a particular time.
 type AudioBaitEventRecorder struct {
+	// Disabled stops any events being reported.  They are only logged locally instead.
+	Disabled bool
+	// Defaults are added to the details of every event, unless the event already has them.
+	Defaults map[string]interface{}
+	// Power, if set, has its readings added to the details of every event.
+	Power PowerSource
+	// History, if set, has every sound that was due to play added to it, even when events are disabled.
+	History *PlayHistory
+	// Transport, if set, is what the events are sent with, such as the downloader when events go to an
+	// MQTT broker, instead of the event-reporter service.
+	Transport eventTransport
+}
+
+// eventTransport sends events for AudioBaitEventRecorder.
+type eventTransport interface {
+	reportEventAt(ts time.Time, event api.Event) error
 }
 
 func (er AudioBaitEventRecorder) OnAudioBaitPlayed(ts time.Time, fileId int, volume int) {
-	eventDetails := map[string]interface{}{
-		"description": map[string]interface{}{
-			"type": "audioBait",
-			"details": map[string]interface{}{
-				"fileId": fileId,
-				"volume": volume,
-			},
-		},
+	details := map[string]interface{}{
+		"fileId": fileId,
+		"volume": volume,
 	}
-	detailsJSON, err := json.Marshal(&eventDetails)
-	if err != nil {
+	if err := er.queueEvent(ts, "audioBait", details); err != nil {
 		log.Printf("Could not log audiobait played: %s", err)
+	}
+}
+
+// playbackFailureEvents stops a persistently broken file flooding the server with failure events.
+var playbackFailureEvents = newEventRateLimiter(time.Hour)
+
+// maxFailureOutput is how much of the end of the player's output is reported with a failure.
+const maxFailureOutput = 500
+
+func (er AudioBaitEventRecorder) OnAudioBaitFailed(ts time.Time, fileId int, volume int, err error) {
+	details := map[string]interface{}{
+		"fileId": fileId,
+		"volume": volume,
+		"error":  err.Error(),
+		"kind":   PlaybackOther,
+	}
+	var playbackErr *PlaybackError
+	if errors.As(err, &playbackErr) {
+		details["error"] = playbackErr.Err.Error()
+		details["kind"] = playbackErr.Kind
+		if output := playbackErr.Output; output != "" {
+			if len(output) > maxFailureOutput {
+				output = output[len(output)-maxFailureOutput:]
+			}
+			details["stderr"] = output
+		}
+	} else if err == playlist.ErrSoundNotAvailable {
+		details["kind"] = PlaybackMissingFile
+	}
+
+	if !playbackFailureEvents.Allow(fmt.Sprintf("%d/%s", fileId, details["kind"]), ts) {
 		return
 	}
+	if err := er.queueEvent(ts, "audioBaitFailed", details); err != nil {
+		log.Printf("Could not log audiobait failure: %s", err)
+	}
+}
+
+// skippedEvents stops a sound that is skipped every time it comes due, such as all through quiet hours,
+// flooding the server with skipped events.  Each sound is limited for each reason on its own, so every
+// sound skipped, and why, is still reported.
+var skippedEvents = newEventRateLimiter(10 * time.Minute)
+
+// OnPlaySkipped reports a sound that was due to play but didn't as an audioBaitSkipped event, which has
+// the window the sound was to play in as well as what a played event has.
+func (er AudioBaitEventRecorder) OnPlaySkipped(skip playlist.SkippedPlay) {
+	if er.History != nil {
+		er.History.recordPlaySkipped(skip)
+	}
+	if !skippedEvents.Allow(fmt.Sprintf("%d/%s", skip.FileId, skip.Reason), skip.Time) {
+		return
+	}
+	details := map[string]interface{}{
+		"fileId": skip.FileId,
+		"volume": skip.Volume,
+		"reason": skip.Reason,
+		"window": map[string]interface{}{
+			"from":  skip.From.Format("15:04"),
+			"until": skip.Until.Format("15:04"),
+		},
+	}
+	if err := er.queueEvent(skip.Time, "audioBaitSkipped", details); err != nil {
+		log.Printf("Could not log audiobait skipped: %s", err)
+	}
+}
+
+// OnPlayFinished adds the sound to the play history, if there is one.  The event for it is reported by
+// OnAudioBaitPlayed or OnAudioBaitFailed.
+func (er AudioBaitEventRecorder) OnPlayFinished(play playlist.PlayInfo) {
+	if er.History != nil {
+		er.History.recordPlayFinished(play)
+	}
+}
+
+func (er AudioBaitEventRecorder) OnScheduleMuted(ts time.Time) {
+	details := map[string]interface{}{
+		"reason": "muted by schedule",
+	}
+	if err := er.queueEvent(ts, "audioBaitMuted", details); err != nil {
+		log.Printf("Could not log audiobait muted: %s", err)
+	}
+}
+
+func (er AudioBaitEventRecorder) OnPlayerPaused(ts time.Time) {
+	if err := er.queueEvent(ts, "audioBaitPaused", map[string]interface{}{}); err != nil {
+		log.Printf("Could not log audiobait paused: %s", err)
+	}
+}
+
+func (er AudioBaitEventRecorder) OnPlayerResumed(ts time.Time) {
+	if err := er.queueEvent(ts, "audioBaitResumed", map[string]interface{}{}); err != nil {
+		log.Printf("Could not log audiobait resumed: %s", err)
+	}
+}
+
+// queueEvent queues an event with the event-reporter service, or sends it with the transport if there is
+// one.
+func (er AudioBaitEventRecorder) queueEvent(ts time.Time, eventType string, details map[string]interface{}) error {
+	if er.Disabled {
+		log.Printf("Event reporting disabled, not reporting %s event: %v", eventType, details)
+		return nil
+	}
+
+	for key, value := range er.Defaults {
+		if _, exists := details[key]; !exists {
+			details[key] = value
+		}
+	}
+	addPowerDetails(er.Power, details)
+	event := api.Event{Type: eventType, Details: details}
+	if er.Transport != nil {
+		return er.Transport.reportEventAt(ts, event)
+	}
+	detailsJSON, err := event.JSON()
+	if err != nil {
+		return err
+	}
 
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		log.Printf("Could not log audiobait played: %s", err)
-		return
+		return err
 	}
 
 	obj := conn.Object("org.cacophony.Events", "/org/cacophony/Events")
 	call := obj.Call("org.cacophony.Events.Queue", 0, detailsJSON, ts.UnixNano())
-	if call.Err != nil {
-		log.Printf("Could not log audiobait played: %s", call.Err)
-		return
-	}
+	return call.Err
 }
@@ -0,0 +1,50 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingFileIsReportedAsAFailure(t *testing.T) {
+	transport := &testTransport{}
+	recorder := AudioBaitEventRecorder{Transport: newTestDownloader(transport)}
+	due := time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC)
+
+	recorder.OnAudioBaitFailed(due, 1101, 7, playlist.ErrSoundNotAvailable)
+	recorder.OnPlaySkipped(playlist.SkippedPlay{Time: due, FileId: 1101, Volume: 7, Reason: playlist.SkippedMissingFile})
+
+	assert.Len(t, transport.events, 2)
+	assert.Equal(t, "audioBaitFailed", transport.events[0]["type"])
+	assert.Equal(t, PlaybackMissingFile, transport.events[0]["details"].(map[string]interface{})["kind"])
+	assert.Equal(t, "audioBaitSkipped", transport.events[1]["type"])
+}
+
+func TestSkippedEventsAreLimitedForEachSoundAndReason(t *testing.T) {
+	transport := &testTransport{}
+	recorder := AudioBaitEventRecorder{Transport: newTestDownloader(transport)}
+	due := time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC)
+	skip := func(at time.Duration, fileId int, reason string) {
+		recorder.OnPlaySkipped(playlist.SkippedPlay{Time: due.Add(at), FileId: fileId, Reason: reason})
+	}
+
+	skip(0, 1201, playlist.SkippedQuietHours)
+	skip(0, 1202, playlist.SkippedQuietHours)
+	skip(time.Minute, 1201, playlist.SkippedQuietHours)
+	skip(time.Minute, 1201, playlist.SkippedPaused)
+	skip(10*time.Minute, 1201, playlist.SkippedQuietHours)
+
+	var skipped []string
+	for _, event := range transport.events {
+		details := event["details"].(map[string]interface{})
+		skipped = append(skipped, details["reason"].(string))
+	}
+	assert.Equal(t, []string{"quietHours", "quietHours", "paused", "quietHours"}, skipped)
+	assert.Equal(t, 1202.0, transport.events[1]["details"].(map[string]interface{})["fileId"])
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrNoAudioSubsystem is returned when the device has no ALSA, so there are no outputs to play on.
+var ErrNoAudioSubsystem = errors.New("no audio subsystem, check ALSA and alsa-utils are installed")
+
+// AudioDevice is an output that sounds can be played on.
+type AudioDevice struct {
+	Card   int `json:"card"`
+	Device int `json:"device"`
+	// ID is the ALSA device to use in the device setting, e.g. "hw:1,0".
+	ID string `json:"id"`
+	// CardName and Name are the names ALSA gives the sound card and the output on it.
+	CardName string `json:"cardName"`
+	Name     string `json:"name"`
+}
+
+// aplayDeviceLine matches each output listed by aplay -l, e.g.
+// "card 0: Headphones [bcm2835 Headphones], device 0: bcm2835 Headphones [bcm2835 Headphones]".
+var aplayDeviceLine = regexp.MustCompile(`^card (\d+): \S+ \[(.*)\], device (\d+): .* \[(.*)\]$`)
+
+// ListAudioDevices gets the outputs ALSA can play on, using aplay.
+func ListAudioDevices() ([]AudioDevice, error) {
+	if _, err := lookPath("aplay"); err != nil {
+		if _, statErr := os.Stat("/proc/asound"); statErr != nil {
+			return nil, ErrNoAudioSubsystem
+		}
+		return nil, fmt.Errorf("aplay isn't installed, install alsa-utils: %v", err)
+	}
+	out, err := exec.Command("aplay", "-l").CombinedOutput()
+	if strings.Contains(string(out), "no soundcards found") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list audio devices: %v\noutput:\n%s", err, out)
+	}
+	return parseAplayList(string(out)), nil
+}
+
+// parseAplayList reads the outputs from what aplay -l prints, ignoring the other lines.
+func parseAplayList(out string) []AudioDevice {
+	var devices []AudioDevice
+	for _, line := range strings.Split(out, "\n") {
+		match := aplayDeviceLine.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		card, _ := strconv.Atoi(match[1])
+		device, _ := strconv.Atoi(match[3])
+		devices = append(devices, AudioDevice{
+			Card:     card,
+			Device:   device,
+			ID:       fmt.Sprintf("hw:%d,%d", card, device),
+			CardName: match[2],
+			Name:     match[4],
+		})
+	}
+	return devices
+}
+
+// findOutputDevice checks a device setting, such as "hw:1,0" or "plughw:1", names one of the devices.
+// ALSA names that aren't for a card and device, such as "default", can't be checked so are accepted.
+func findOutputDevice(devices []AudioDevice, setting string) error {
+	parts := strings.SplitN(setting, ":", 2)
+	if len(parts) != 2 || !strings.HasSuffix(parts[0], "hw") {
+		return nil
+	}
+	address := strings.Split(parts[1], ",")
+	card, err := strconv.Atoi(address[0])
+	if err != nil {
+		return nil
+	}
+	device := 0
+	if len(address) > 1 {
+		if device, err = strconv.Atoi(address[1]); err != nil {
+			return nil
+		}
+	}
+	for _, found := range devices {
+		if found.Card == card && found.Device == device {
+			return nil
+		}
+	}
+	return fmt.Errorf("audio device %s not found", setting)
+}
+
+// ValidateOutputDevices checks the sound cards and devices the sounds are played on exist.
+func (conf *AudioConfig) ValidateOutputDevices(devices []AudioDevice) error {
+	cards := make(map[int]bool)
+	for _, device := range devices {
+		cards[device.Card] = true
+	}
+	if len(conf.Zones) == 0 && !cards[conf.Card] {
+		return fmt.Errorf("sound card %d has no audio devices", conf.Card)
+	}
+	for _, zone := range conf.Zones {
+		if !cards[zone.Card] {
+			return fmt.Errorf("zone %s: sound card %d has no audio devices", zone.Name, zone.Card)
+		}
+		if err := findOutputDevice(devices, zone.Device); err != nil {
+			return fmt.Errorf("zone %s: %v", zone.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkOutputDevices warns if the configured outputs can't be found.  Sounds are still tried, as the
+// sound card may be connected later.
+func checkOutputDevices(conf *AudioConfig) {
+	devices, err := ListAudioDevices()
+	if err != nil {
+		log.Printf("Could not check the audio devices: %v", err)
+		return
+	}
+	if err := conf.ValidateOutputDevices(devices); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// printAudioDevices prints the outputs that can be played on as JSON.
+func printAudioDevices() error {
+	devices, err := ListAudioDevices()
+	if err != nil {
+		return err
+	}
+	if devices == nil {
+		devices = []AudioDevice{}
+	}
+	jsonData, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonData))
+	return nil
+}
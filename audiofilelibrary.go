@@ -6,32 +6,32 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"log"
-	"os"
 	"strings"
 )
 
 type AudioFileLibrary struct {
-	filePath  string
+	store     Store
 	FilesById map[string]string
 }
 
-func OpenLibrary(filePath string) *AudioFileLibrary {
-	return (&AudioFileLibrary{}).openLibrary(filePath)
+func OpenLibrary(store Store) *AudioFileLibrary {
+	return (&AudioFileLibrary{}).openLibrary(store)
 }
 
-func (library *AudioFileLibrary) openLibrary(filePath string) *AudioFileLibrary {
-	library.filePath = filePath
+func (library *AudioFileLibrary) openLibrary(store Store) *AudioFileLibrary {
+	library.store = store
 	library.FilesById = make(map[string]string)
 
-	// Open the file and scan it.
-	f, err := os.Open(filePath)
+	// Read the library and scan it.
+	data, err := store.Get(libraryFilename)
 	if err != nil {
 		log.Printf("Error loading audio library %s", err)
 		return library
 	}
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -50,29 +50,32 @@ func (library *AudioFileLibrary) openLibrary(filePath string) *AudioFileLibrary
 	return library
 }
 
+const libraryHeader = "\n#  This is a the list of all the audio files downloaded indexed by id of file"
+
 func (library *AudioFileLibrary) AddFile(fileId, filename string) error {
 	firstItem := len(library.FilesById) == 0
 
 	library.FilesById[fileId] = filename
 
-	f, err := os.OpenFile(library.filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
+	text := "\n" + fileId + ": " + filename
 	if firstItem {
-		_, _ = f.WriteString("\n#  This is a the list of all the audio files downloaded indexed by id of file")
+		text = libraryHeader + text
 	}
-
-	text := "\n" + fileId + ": " + filename
-	_, err = f.WriteString(text)
-
-	return err
+	return appendToStore(library.store, libraryFilename, []byte(text))
 }
 
 func (library *AudioFileLibrary) GetFileNameOnDisk(fileId string) (string, bool) {
 	filename, exists := library.FilesById[fileId]
 	return filename, exists
 }
+
+// RemoveFile removes a file from the library and rewrites the library without it.
+func (library *AudioFileLibrary) RemoveFile(fileId string) error {
+	delete(library.FilesById, fileId)
+
+	text := libraryHeader
+	for id, filename := range library.FilesById {
+		text += "\n" + id + ": " + filename
+	}
+	return library.store.Put(libraryFilename, []byte(text))
+}
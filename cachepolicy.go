@@ -0,0 +1,147 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+const verifiedFilename = "verified.json"
+
+// VerifiedTimes records in the store when each audio file was last checked against the server, either
+// by downloading it or by finding it unchanged.
+type VerifiedTimes struct {
+	mu    sync.Mutex
+	store Store
+	times map[string]time.Time
+}
+
+// OpenVerifiedTimes loads the times kept in the store.  Missing or unreadable times are treated as
+// never verified.
+func OpenVerifiedTimes(store Store) *VerifiedTimes {
+	verified := &VerifiedTimes{store: store, times: make(map[string]time.Time)}
+
+	jsonData, err := store.Get(verifiedFilename)
+	if os.IsNotExist(err) {
+		return verified
+	} else if err != nil {
+		log.Printf("Error loading file verification times %s", err)
+		return verified
+	}
+	if err := json.Unmarshal(jsonData, &verified.times); err != nil {
+		log.Printf("File verification times are corrupt and will be rebuilt: %s", err)
+		verified.times = make(map[string]time.Time)
+	}
+	return verified
+}
+
+// Verified gets when a file was last verified, or false if it never has been.
+func (verified *VerifiedTimes) Verified(fileId int) (time.Time, bool) {
+	verified.mu.Lock()
+	defer verified.mu.Unlock()
+	at, exists := verified.times[strconv.Itoa(fileId)]
+	return at, exists
+}
+
+// SetVerified records that a file was verified at the given time and saves the times.
+func (verified *VerifiedTimes) SetVerified(fileId int, at time.Time) {
+	verified.mu.Lock()
+	defer verified.mu.Unlock()
+	verified.times[strconv.Itoa(fileId)] = at
+
+	jsonData, err := json.Marshal(verified.times)
+	if err == nil {
+		err = verified.store.Put(verifiedFilename, jsonData)
+	}
+	if err != nil {
+		log.Printf("Error saving file verification times %s", err)
+	}
+}
+
+// All gets when every file that has been verified was last verified, keyed by file ID.
+func (verified *VerifiedTimes) All() map[int]time.Time {
+	verified.mu.Lock()
+	defer verified.mu.Unlock()
+	times := make(map[int]time.Time, len(verified.times))
+	for key, at := range verified.times {
+		if fileId, err := strconv.Atoi(key); err == nil {
+			times[fileId] = at
+		}
+	}
+	return times
+}
+
+// SetCacheTTL makes files on disk that haven't been verified against the server for longer than ttl
+// be checked again when they are next needed.  The check asks the server to only send the file if it
+// has changed.  Zero, the default, trusts files on disk for ever.
+func (dl *Downloader) SetCacheTTL(ttl time.Duration) {
+	dl.cacheTTL = ttl
+}
+
+// LastVerified gets when each audio file was last verified against the server, keyed by file ID.
+func (dl *Downloader) LastVerified() map[int]time.Time {
+	if dl.verified == nil {
+		return nil
+	}
+	return dl.verified.All()
+}
+
+// ForceRefresh downloads all of the schedule's files again, ignoring the copies on disk, such as when
+// they are suspected to be corrupt.  It returns the files available as GetFilesForSchedule does.
+func (dl *Downloader) ForceRefresh(ctx context.Context, schedule playlist.Schedule) (map[int]string, error) {
+	return dl.getFiles(ctx, schedule.GetReferencedSounds(), true)
+}
+
+// recordVerified notes that a file has just been verified against the server.
+func (dl *Downloader) recordVerified(fileId int) {
+	if dl.verified != nil {
+		dl.verified.SetVerified(fileId, time.Now())
+	}
+}
+
+// needsVerifying works out whether a file on disk should be checked against the server.
+func (dl *Downloader) needsVerifying(fileId int, force bool) bool {
+	if force {
+		return true
+	}
+	if dl.cacheTTL <= 0 || dl.verified == nil {
+		return false
+	}
+	at, exists := dl.verified.Verified(fileId)
+	return !exists || time.Since(at) > dl.cacheTTL
+}
+
+// reverifyFiles checks the files on disk that need it against the server, downloading them again if
+// they have changed, or if force is set whether or not they have.  A file that can't be checked is
+// still used.  It stops early if ctx is done.
+func (dl *Downloader) reverifyFiles(ctx context.Context, audioLibrary *AudioFileLibrary, localFiles map[int]string, force bool) {
+	for fileId := range localFiles {
+		if ctx.Err() != nil || !dl.needsVerifying(fileId, force) {
+			continue
+		}
+		filename, exists := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId))
+		if !exists {
+			continue
+		}
+		fileInfo, err := dl.api.GetFileDetails(fileId)
+		if err == nil {
+			_, err = dl.refreshFile(audioLibrary, fileId, fileInfo, filename, force)
+		}
+		if err != nil {
+			log.Printf("Could not verify file with id %d, using the copy on disk: %s", fileId, err)
+			continue
+		}
+		dl.recordLoudnessHints(fileId, fileInfo)
+		dl.recordVerified(fileId)
+	}
+}
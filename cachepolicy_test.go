@@ -0,0 +1,111 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCachingDownloader creates a downloader that records when files are verified, with file 1 downloaded.
+func newCachingDownloader(t *testing.T) (*fileServer, *Downloader) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	dl.verified = OpenVerifiedTimes(dl.store)
+	_, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	return files, dl
+}
+
+func downloadedContents(t *testing.T, dl *Downloader) string {
+	contents, err := ioutil.ReadFile(filepath.Join(dl.audioDir, "beep-1.wav"))
+	assert.Nil(t, err)
+	return string(contents)
+}
+
+func TestVerifiedTimesAreKeptInTheStore(t *testing.T) {
+	store := NewMemoryStore()
+	at := time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC)
+	OpenVerifiedTimes(store).SetVerified(3, at)
+
+	verified := OpenVerifiedTimes(store)
+	got, exists := verified.Verified(3)
+	assert.True(t, exists)
+	assert.True(t, at.Equal(got))
+	_, exists = verified.Verified(4)
+	assert.False(t, exists)
+
+	assert.Nil(t, store.Put(verifiedFilename, []byte("{")))
+	assert.Empty(t, OpenVerifiedTimes(store).All())
+}
+
+func TestFilesOnDiskAreTrustedWithoutACacheTTL(t *testing.T) {
+	files, dl := newCachingDownloader(t)
+	files.versions["1"] = "v2"
+
+	_, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, files.downloads)
+	assert.Equal(t, "v1", downloadedContents(t, dl))
+}
+
+func TestFilesVerifiedLongerAgoThanTheCacheTTLAreChecked(t *testing.T) {
+	files, dl := newCachingDownloader(t)
+	dl.SetCacheTTL(time.Hour)
+
+	// Recently verified files aren't checked.
+	files.versions["1"] = "v2"
+	_, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", downloadedContents(t, dl))
+
+	dl.verified.SetVerified(1, time.Now().Add(-2*time.Hour))
+	_, err = dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, files.downloads)
+	assert.Equal(t, "v2", downloadedContents(t, dl))
+	assert.WithinDuration(t, time.Now(), dl.LastVerified()[1], time.Minute)
+
+	// Unchanged files are checked without downloading them again.
+	dl.verified.SetVerified(1, time.Now().Add(-2*time.Hour))
+	_, err = dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, files.downloads)
+	assert.WithinDuration(t, time.Now(), dl.LastVerified()[1], time.Minute)
+}
+
+func TestForceRefreshDownloadsFilesAgain(t *testing.T) {
+	files, dl := newCachingDownloader(t)
+
+	available, err := dl.ForceRefresh(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.wav"}, available)
+	assert.Equal(t, 2, files.downloads)
+}
+
+func TestLastVerifiedIsEmptyWithoutVerifiedTimes(t *testing.T) {
+	assert.Nil(t, (&Downloader{}).LastVerified())
+
+	_, dl := newCachingDownloader(t)
+	assert.Contains(t, dl.LastVerified(), 1)
+}
+
+func TestCacheTTLIsReadFromTheConfig(t *testing.T) {
+	ttl, err := (&AudioConfig{}).CacheTTLDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	ttl, err = (&AudioConfig{CacheTTL: "24h"}).CacheTTLDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, ttl)
+
+	_, err = (&AudioConfig{CacheTTL: "daily"}).CacheTTLDuration()
+	assert.NotNil(t, err)
+}
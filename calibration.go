@@ -0,0 +1,59 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CalibrationPoint maps a schedule volume to the mixer gain that gives the intended sound level on
+// this device's speaker.
+type CalibrationPoint struct {
+	Volume int     `yaml:"volume"`
+	GainDB float64 `yaml:"gain-db"`
+}
+
+// VolumeCalibration is a curve of calibration points.  Volumes between points are linearly
+// interpolated and volumes outside them use the nearest point.  An empty calibration leaves volumes
+// as mixer percentages.
+type VolumeCalibration []CalibrationPoint
+
+// Validate checks the calibration points have valid volumes, with no volume given twice.
+func (calibration VolumeCalibration) Validate() error {
+	seen := make(map[int]bool)
+	for _, point := range calibration {
+		if point.Volume < 0 || point.Volume > 10 {
+			return fmt.Errorf("calibration volume %d is not between 0 and 10", point.Volume)
+		}
+		if seen[point.Volume] {
+			return fmt.Errorf("calibration volume %d given more than once", point.Volume)
+		}
+		seen[point.Volume] = true
+	}
+	return nil
+}
+
+// GainDB gets the mixer gain for a schedule volume.  It returns false if there is no calibration.
+func (calibration VolumeCalibration) GainDB(volume int) (float64, bool) {
+	if len(calibration) == 0 {
+		return 0, false
+	}
+	points := make([]CalibrationPoint, len(calibration))
+	copy(points, calibration)
+	sort.Slice(points, func(i, j int) bool { return points[i].Volume < points[j].Volume })
+
+	if volume <= points[0].Volume {
+		return points[0].GainDB, true
+	}
+	for i := 1; i < len(points); i++ {
+		low, high := points[i-1], points[i]
+		if volume <= high.Volume {
+			fraction := float64(volume-low.Volume) / float64(high.Volume-low.Volume)
+			return low.GainDB + fraction*(high.GainDB-low.GainDB), true
+		}
+	}
+	return points[len(points)-1].GainDB, true
+}
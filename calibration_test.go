@@ -0,0 +1,68 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrationInterpolatesBetweenPoints(t *testing.T) {
+	// Points can be given in any order.
+	calibration := VolumeCalibration{{Volume: 8, GainDB: -6}, {Volume: 2, GainDB: -30}, {Volume: 4, GainDB: -18}}
+
+	for volume, expected := range map[int]float64{2: -30, 3: -24, 4: -18, 6: -12, 8: -6} {
+		gain, ok := calibration.GainDB(volume)
+		assert.True(t, ok)
+		assert.Equal(t, expected, gain, "volume %d", volume)
+	}
+}
+
+func TestCalibrationUsesTheNearestPointOutsideTheCurve(t *testing.T) {
+	calibration := VolumeCalibration{{Volume: 2, GainDB: -30}, {Volume: 8, GainDB: -6}}
+
+	gain, _ := calibration.GainDB(0)
+	assert.Equal(t, -30.0, gain)
+	gain, _ = calibration.GainDB(10)
+	assert.Equal(t, -6.0, gain)
+
+	single := VolumeCalibration{{Volume: 5, GainDB: -10}}
+	gain, _ = single.GainDB(9)
+	assert.Equal(t, -10.0, gain)
+}
+
+func TestWithoutCalibrationVolumesAreMixerPercentages(t *testing.T) {
+	_, ok := VolumeCalibration(nil).GainDB(5)
+	assert.False(t, ok)
+	assert.Equal(t, []string{"vol", "0.3"}, SoundCardPlayer{}.softwareVolumeArgs(3))
+}
+
+func TestCalibrationPointsAreValidated(t *testing.T) {
+	assert.Nil(t, VolumeCalibration{{Volume: 0}, {Volume: 10}}.Validate())
+	assert.EqualError(t, VolumeCalibration{{Volume: 11}}.Validate(), "calibration volume 11 is not between 0 and 10")
+	assert.EqualError(t, VolumeCalibration{{Volume: -1}}.Validate(), "calibration volume -1 is not between 0 and 10")
+	assert.EqualError(t, VolumeCalibration{{Volume: 3, GainDB: -20}, {Volume: 3, GainDB: -10}}.Validate(),
+		"calibration volume 3 given more than once")
+}
+
+func TestCalibrationIsReadFromTheConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "audiobait.yaml")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(`volume-calibration:
+  - volume: 1
+    gain-db: -40
+  - volume: 10
+    gain-db: -2.5
+`), 0644))
+	conf, err := ParseConfigFile(configFile)
+	assert.Nil(t, err)
+	assert.Equal(t, VolumeCalibration{{Volume: 1, GainDB: -40}, {Volume: 10, GainDB: -2.5}}, conf.VolumeCalibration)
+
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte("volume-calibration:\n  - volume: 12\n"), 0644))
+	_, err = ParseConfigFile(configFile)
+	assert.EqualError(t, err, "calibration volume 12 is not between 0 and 10")
+}
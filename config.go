@@ -5,15 +5,236 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"time"
 
+	"github.com/TheCacophonyProject/audiobait/playlist"
 	yaml "gopkg.in/yaml.v1"
 )
 
 type AudioConfig struct {
-	AudioDir      string `yaml:"audio-directory"`
-	Card          int    `yaml:"card"`
-	VolumeControl string `yaml:"volume-control"`
+	AudioDir          string             `yaml:"audio-directory"`
+	Card              int                `yaml:"card"`
+	Mono              bool               `yaml:"mono"`
+	VolumeControl     string             `yaml:"volume-control"`
+	QuietHours        []QuietHoursConfig `yaml:"quiet-hours"`
+	BootSound         BootSoundConfig    `yaml:"boot-sound"`
+	EventsDisabled    bool               `yaml:"events-disabled"`
+	EventDefaults     map[string]string  `yaml:"event-defaults"`
+	DownloadPolicy    string             `yaml:"download-policy"`
+	VolumeCalibration VolumeCalibration  `yaml:"volume-calibration"`
+	OriginalFileNames bool               `yaml:"original-file-names"`
+	ContentHashNames  bool               `yaml:"content-hash-names"`
+	MaxFileBytes      int64              `yaml:"max-file-bytes"`
+	Zones             []ZoneConfig       `yaml:"zones"`
+	Heartbeat         HeartbeatConfig    `yaml:"heartbeat"`
+	PinnedCerts       []string           `yaml:"pinned-certs"`
+	CacheTTL          string             `yaml:"cache-ttl"`
+	Transcode         TranscodeConfig    `yaml:"transcode"`
+	PlayHooks         PlayHooksConfig    `yaml:"play-hooks"`
+	EventFiles        []string           `yaml:"event-files"`
+	MQTT              MQTTConfig         `yaml:"mqtt"`
+	Tags              []string           `yaml:"tags"`
+	PreRoll           string             `yaml:"pre-roll"`
+	ReportInventory   bool               `yaml:"report-inventory"`
+	Location          LocationConfig     `yaml:"location"`
+	EventSigningKey   string             `yaml:"event-signing-key"`
+	SignedURLHeader   bool               `yaml:"signed-url-header"`
+	SyncEvents        bool               `yaml:"sync-events"`
+	PowerSupply       string             `yaml:"power-supply"`
+	PlayLimit         PlayLimitConfig    `yaml:"play-limit"`
+	PlayHistory       PlayHistoryConfig  `yaml:"play-history"`
+	LogRequests       bool               `yaml:"log-requests"`
+	TransportTimeouts TransportTimeouts  `yaml:"transport-timeouts"`
+
+	BootConnectTimeout string        `yaml:"boot-connect-timeout"`
+	Ambient            AmbientConfig `yaml:"ambient"`
+	SoundCooldown      string        `yaml:"sound-cooldown"`
+	Stream             bool          `yaml:"stream"`
+	AdaptivePolling    bool          `yaml:"adaptive-polling"`
+	PollJitter         float64       `yaml:"poll-jitter"`
+	SyncFiles          SyncConfig    `yaml:"sync-files"`
+}
+
+// PlayLimitConfig limits how many sounds can play at once across all of the zones.
+type PlayLimitConfig struct {
+	// MaxPlaying is the most sounds that can play at once.  There is no limit if it isn't set.
+	MaxPlaying int `yaml:"max-playing"`
+	// Drop skips sounds over the limit instead of having them wait for another sound to finish.
+	Drop bool `yaml:"drop"`
+}
+
+// NewPlayLimit creates the configured limit, or nil if there isn't one.
+func (conf PlayLimitConfig) NewPlayLimit() *playlist.PlayLimit {
+	if conf.MaxPlaying == 0 {
+		return nil
+	}
+	return playlist.NewPlayLimit(conf.MaxPlaying, conf.Drop)
+}
+
+// PowerSource gets the configured power supply to report readings from, or nil if there isn't one.
+func (conf *AudioConfig) PowerSource() PowerSource {
+	if conf.PowerSupply == "" {
+		return nil
+	}
+	return NewSysfsPowerSource(conf.PowerSupply)
+}
+
+// EventDefaultDetails gets the fields to add to every event.
+func (conf *AudioConfig) EventDefaultDetails() map[string]interface{} {
+	defaults := make(map[string]interface{}, len(conf.EventDefaults))
+	for key, value := range conf.EventDefaults {
+		defaults[key] = value
+	}
+	return defaults
+}
+
+// BootSoundConfig controls the sound played when audiobait starts, to confirm the device is working.
+type BootSoundConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FileId is the id of a downloaded sound to play.  If it isn't set the built in chime is played.
+	FileId int `yaml:"file-id"`
+	Volume int `yaml:"volume"`
+}
+
+// CacheTTLDuration gets how long downloaded files are trusted before being checked against the server
+// again, or zero if they always are.
+func (conf *AudioConfig) CacheTTLDuration() (time.Duration, error) {
+	if conf.CacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(conf.CacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache-ttl: %v", err)
+	}
+	return ttl, nil
+}
+
+// SoundCooldownDuration gets how long after a sound plays before it can play again, for schedules that
+// don't set a cooldown, or zero if sounds can play again straight away.
+func (conf *AudioConfig) SoundCooldownDuration() (time.Duration, error) {
+	if conf.SoundCooldown == "" {
+		return 0, nil
+	}
+	cooldown, err := time.ParseDuration(conf.SoundCooldown)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sound-cooldown: %v", err)
+	}
+	if cooldown < 0 {
+		return 0, fmt.Errorf("sound-cooldown must not be negative")
+	}
+	return cooldown, nil
+}
+
+// defaultBootConnectTimeout is how long to wait for the server to be reachable at startup if it isn't
+// configured.
+const defaultBootConnectTimeout = 2 * time.Minute
+
+// BootConnectTimeoutDuration gets how long to keep trying to reach the server when audiobait starts,
+// while the network comes up, or zero to not wait for it.
+func (conf *AudioConfig) BootConnectTimeoutDuration() (time.Duration, error) {
+	if conf.BootConnectTimeout == "" {
+		return defaultBootConnectTimeout, nil
+	}
+	timeout, err := time.ParseDuration(conf.BootConnectTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid boot-connect-timeout: %v", err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("boot-connect-timeout must not be negative")
+	}
+	return timeout, nil
+}
+
+// PreRollDuration gets how long to wait before the first sound of each burst, or zero for no wait.
+func (conf *AudioConfig) PreRollDuration() (time.Duration, error) {
+	if conf.PreRoll == "" {
+		return 0, nil
+	}
+	preRoll, err := time.ParseDuration(conf.PreRoll)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pre-roll: %v", err)
+	}
+	if preRoll < 0 {
+		return 0, fmt.Errorf("pre-roll must not be negative")
+	}
+	return preRoll, nil
+}
+
+// TransportTimeouts sets how long requests to the server wait for the network, such as to allow for a
+// slow cellular link.  Each is a duration, e.g. "45s", and the API client's default is used for any
+// that aren't set.
+type TransportTimeouts struct {
+	Dial           string `yaml:"dial"`
+	TLSHandshake   string `yaml:"tls-handshake"`
+	ResponseHeader string `yaml:"response-header"`
+}
+
+// Durations gets the dial, TLS handshake and response header timeouts, with zero for any that aren't set.
+func (conf TransportTimeouts) Durations() (dial, tlsHandshake, responseHeader time.Duration, err error) {
+	if dial, err = parseTransportTimeout("dial", conf.Dial); err != nil {
+		return 0, 0, 0, err
+	}
+	if tlsHandshake, err = parseTransportTimeout("tls-handshake", conf.TLSHandshake); err != nil {
+		return 0, 0, 0, err
+	}
+	if responseHeader, err = parseTransportTimeout("response-header", conf.ResponseHeader); err != nil {
+		return 0, 0, 0, err
+	}
+	return dial, tlsHandshake, responseHeader, nil
+}
+
+func parseTransportTimeout(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid transport-timeouts %s: %v", name, err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("transport-timeouts %s must not be negative", name)
+	}
+	return timeout, nil
+}
+
+// MQTTConfig sets an MQTT broker to publish events to instead of sending them to the server.
+type MQTTConfig struct {
+	// Broker is the broker's URL, e.g. "tcp://localhost:1883".  Events go to the server if it isn't set.
+	Broker   string `yaml:"broker"`
+	Topic    string `yaml:"topic"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HeartbeatConfig controls the event regularly reported to show the device is alive.
+type HeartbeatConfig struct {
+	// Interval is how often to report a heartbeat, e.g. "1h".  No heartbeats are reported if it isn't set.
+	Interval string `yaml:"interval"`
+	// SkipQuietHours stops heartbeats being reported during quiet hours.
+	SkipQuietHours bool `yaml:"skip-quiet-hours"`
+}
+
+// HeartbeatInterval gets how often to report a heartbeat, or zero if heartbeats are off.
+func (conf *AudioConfig) HeartbeatInterval() (time.Duration, error) {
+	if conf.Heartbeat.Interval == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(conf.Heartbeat.Interval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid heartbeat interval: %v", err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("heartbeat interval must be positive")
+	}
+	return interval, nil
+}
+
+// QuietHoursConfig is a window of the day during which no sounds will be played.
+type QuietHoursConfig struct {
+	From  string `yaml:"from"`
+	Until string `yaml:"until"`
 }
 
 func ParseConfigFile(filename string) (*AudioConfig, error) {
@@ -27,5 +248,78 @@ func ParseConfigFile(filename string) (*AudioConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if _, err := audioConfig.QuietHourWindows(); err != nil {
+		return nil, err
+	}
+	if _, err := ParseDownloadPolicy(audioConfig.DownloadPolicy); err != nil {
+		return nil, err
+	}
+	if err := audioConfig.VolumeCalibration.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateZones(audioConfig.Zones); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.HeartbeatInterval(); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.CacheTTLDuration(); err != nil {
+		return nil, err
+	}
+	if audioConfig.MQTT.Broker != "" && audioConfig.MQTT.Topic == "" {
+		return nil, fmt.Errorf("mqtt has a broker but no topic")
+	}
+	if err := audioConfig.Transcode.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.PlayHooks.TimeoutDuration(); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.PreRollDuration(); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.BootConnectTimeoutDuration(); err != nil {
+		return nil, err
+	}
+	if _, err := audioConfig.SoundCooldownDuration(); err != nil {
+		return nil, err
+	}
+	if _, _, _, err := audioConfig.TransportTimeouts.Durations(); err != nil {
+		return nil, err
+	}
+	if audioConfig.PollJitter < 0 || audioConfig.PollJitter > 1 {
+		return nil, fmt.Errorf("poll-jitter must be from 0 to 1")
+	}
+	if audioConfig.PlayLimit.MaxPlaying < 0 {
+		return nil, fmt.Errorf("play-limit max-playing must not be negative")
+	}
+	if err := audioConfig.PlayHistory.Validate(); err != nil {
+		return nil, err
+	}
+	if err := audioConfig.Ambient.Validate(); err != nil {
+		return nil, err
+	}
+	if audioConfig.Location.Timezone != "" {
+		if _, err := time.LoadLocation(audioConfig.Location.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid location timezone: %v", err)
+		}
+	}
 	return &audioConfig, nil
 }
+
+// QuietHourWindows converts the configured quiet hours to time windows.
+func (conf *AudioConfig) QuietHourWindows() ([]playlist.TimeWindow, error) {
+	windows := make([]playlist.TimeWindow, 0, len(conf.QuietHours))
+	for _, quiet := range conf.QuietHours {
+		from, err := playlist.ParseTimeOfDay(quiet.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet-hours from time: %v", err)
+		}
+		until, err := playlist.ParseTimeOfDay(quiet.Until)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quiet-hours until time: %v", err)
+		}
+		windows = append(windows, playlist.TimeWindow{From: *from, Until: *until})
+	}
+	return windows, nil
+}
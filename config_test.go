@@ -0,0 +1,38 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseConfig(t *testing.T, contents string) (*AudioConfig, error) {
+	configFile := filepath.Join(t.TempDir(), "audiobait.yaml")
+	assert.Nil(t, ioutil.WriteFile(configFile, []byte(contents), 0644))
+	return ParseConfigFile(configFile)
+}
+
+func TestTransportTimeoutsAreReadFromTheConfig(t *testing.T) {
+	conf, err := parseConfig(t, "transport-timeouts:\n  dial: 1m\n  response-header: 45s\n")
+	assert.Nil(t, err)
+	dial, tlsHandshake, responseHeader, err := conf.TransportTimeouts.Durations()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Minute, dial)
+	assert.Equal(t, time.Duration(0), tlsHandshake)
+	assert.Equal(t, 45*time.Second, responseHeader)
+}
+
+func TestInvalidTransportTimeoutsAreRejected(t *testing.T) {
+	_, err := parseConfig(t, "transport-timeouts:\n  tls-handshake: -1s\n")
+	assert.EqualError(t, err, "transport-timeouts tls-handshake must not be negative")
+
+	_, err = parseConfig(t, "transport-timeouts:\n  dial: soon\n")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+)
+
+// contentHashLength is how many hex digits of a file's SHA-256 hash are put in its name.
+const contentHashLength = 12
+
+// SetContentHashNames saves downloaded files as <id>-<hash>.<ext>, where hash is the start of the
+// hash of the file's contents, instead of by name.  A file that changes on the server is saved under a
+// new name next to the old version, so the version being played is never overwritten.  The audio
+// library records which version is current and PruneStaleVersions deletes the others.
+func (dl *Downloader) SetContentHashNames(hashed bool) {
+	dl.contentHashNames = hashed
+}
+
+// contentHashFileName gets the name the version of a file with the given hash is saved as.
+func contentHashFileName(fileId int, hash string, ext string) string {
+	return fmt.Sprintf("%d-%s%s", fileId, hash[:contentHashLength], ext)
+}
+
+// parseContentHashFileName gets the ID of the file a name made by contentHashFileName is a version of.
+func parseContentHashFileName(filename string) (int, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(filename, filepath.Ext(filename)), "-", 2)
+	if len(parts) != 2 || len(parts[1]) != contentHashLength || strings.Trim(parts[1], "0123456789abcdef") != "" {
+		return 0, false
+	}
+	fileId, err := strconv.Atoi(parts[0])
+	return fileId, err == nil
+}
+
+// isContentHashFileName checks whether filename is a version of the file with the given ID.
+func isContentHashFileName(filename string, fileId int) bool {
+	id, ok := parseContentHashFileName(filename)
+	return ok && id == fileId
+}
+
+// nameByContentHash renames a file that has just been downloaded as filename to include the hash of
+// its contents, returning the new name.
+func (dl *Downloader) nameByContentHash(fileId int, filename string) (string, error) {
+	path := filepath.Join(dl.audioDir, filename)
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	named := contentHashFileName(fileId, hash, filepath.Ext(filename))
+	if err := os.Rename(path, filepath.Join(dl.audioDir, named)); err != nil {
+		return "", err
+	}
+	return named, nil
+}
+
+// downloadByContentHash downloads a file and saves it under the name made from its contents, compressing
+// it if transcoding is on.  If refresh is set it is only downloaded if it has changed on the server;
+// the returned name is empty if it hasn't.
+func (dl *Downloader) downloadByContentHash(ctx context.Context, fileId int, fileInfo *api.FileResponse, refresh bool) (string, error) {
+	staging := fileInfo.File.Details.FileName(fileId)
+	stagingPath := filepath.Join(dl.audioDir, staging)
+	if refresh {
+		written, err := dl.api.RefreshFileAt(fileInfo, stagingPath, true)
+		if err != nil || !written {
+			return "", err
+		}
+	} else if err := dl.api.DownloadFileContext(ctx, fileInfo, stagingPath); err != nil {
+		return "", err
+	}
+	filename, err := dl.nameByContentHash(fileId, staging)
+	if err != nil {
+		os.Remove(stagingPath)
+		return "", err
+	}
+	return dl.transcodeFile(fileId, filename), nil
+}
+
+// refreshHashedFile downloads a file saved by content hash again if it has changed on the server, or
+// whether or not it has if force is set.  The new version becomes the current one in the audio library
+// and the old version is left for PruneStaleVersions.
+func (dl *Downloader) refreshHashedFile(audioLibrary *AudioFileLibrary, fileId int, fileInfo *api.FileResponse, filename string, force bool) (bool, error) {
+	named, err := dl.downloadByContentHash(context.Background(), fileId, fileInfo, !force)
+	if err != nil || named == "" {
+		return false, err
+	}
+	if named != filename {
+		log.Printf("File with id %d has changed, now using %s instead of %s", fileId, named, filename)
+	}
+	return true, audioLibrary.AddFile(strconv.Itoa(fileId), named)
+}
+
+// PruneStaleVersions deletes the versions of files saved by content hash that the audio library no
+// longer uses, returning how many were deleted.  Call it when none of them can be playing.
+func (dl *Downloader) PruneStaleVersions() (int, error) {
+	return dl.pruneStaleVersions(OpenLibrary(dl.stateStore()))
+}
+
+func (dl *Downloader) pruneStaleVersions(audioLibrary *AudioFileLibrary) (int, error) {
+	infos, err := ioutil.ReadDir(dl.audioDir)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, info := range infos {
+		name := info.Name()
+		fileId, ok := parseContentHashFileName(name)
+		if !info.Mode().IsRegular() || !ok {
+			continue
+		}
+		if current, exists := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId)); exists && current == name {
+			continue
+		}
+		log.Printf("Deleting old version %s of file with id %d", name, fileId)
+		dl.removeAudioFile(name)
+		pruned++
+	}
+	return pruned, nil
+}
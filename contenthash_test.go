@@ -0,0 +1,80 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// versionFileName gets the name the version of file 1 with the given contents is saved as.
+func versionFileName(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return "1-" + hex.EncodeToString(sum[:])[:contentHashLength] + ".wav"
+}
+
+func TestContentHashFileNamesAreParsed(t *testing.T) {
+	name := versionFileName("v1")
+	fileId, ok := parseContentHashFileName(name)
+	assert.True(t, ok)
+	assert.Equal(t, 1, fileId)
+	assert.True(t, isContentHashFileName(name, 1))
+	assert.False(t, isContentHashFileName(name, 2))
+
+	for _, name := range []string{"beep-1.wav", "1-0123456789ab0.wav", "1-0123456789AB.wav", "x-0123456789ab.wav"} {
+		_, ok := parseContentHashFileName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestChangedFilesAreSavedAsNewVersions(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	dl.SetContentHashNames(true)
+
+	available, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: versionFileName("v1")}, available)
+	// Nothing is left under the name the file was downloaded as.
+	_, err = os.Stat(filepath.Join(dl.audioDir, "beep-1.wav"))
+	assert.True(t, os.IsNotExist(err))
+
+	files.versions["1"] = "v2"
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, report.Replaced)
+	current, _ := OpenLibrary(dl.stateStore()).GetFileNameOnDisk("1")
+	assert.Equal(t, versionFileName("v2"), current)
+	// The old version is kept in case it is playing.
+	assert.FileExists(t, filepath.Join(dl.audioDir, versionFileName("v1")))
+
+	pruned, err := dl.PruneStaleVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+	names, _ := filepath.Glob(filepath.Join(dl.audioDir, "1-*"))
+	assert.Equal(t, []string{filepath.Join(dl.audioDir, versionFileName("v2"))}, names)
+}
+
+func TestUnchangedFilesKeepTheirVersion(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	dl.SetContentHashNames(true)
+	_, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, report.Unchanged)
+	assert.Equal(t, 1, files.downloads)
+	pruned, err := dl.PruneStaleVersions()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+}
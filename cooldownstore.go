@@ -0,0 +1,42 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+const lastPlayedFilename = "last-played.json"
+
+// CooldownFile saves when each sound last played in the store, so that sounds on cooldown stay on
+// cooldown after a restart.
+type CooldownFile struct {
+	store Store
+}
+
+// LoadLastPlayed reads the saved times, keyed by file ID.  If nothing has been saved yet no sounds are
+// on cooldown.
+func (file CooldownFile) LoadLastPlayed() (map[int]time.Time, error) {
+	lastPlayed := make(map[int]time.Time)
+	jsonData, err := file.store.Get(lastPlayedFilename)
+	if os.IsNotExist(err) {
+		return lastPlayed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsonData, &lastPlayed)
+	return lastPlayed, err
+}
+
+// SaveLastPlayed writes the times to the store, replacing the ones saved before.
+func (file CooldownFile) SaveLastPlayed(lastPlayed map[int]time.Time) error {
+	jsonData, err := json.Marshal(lastPlayed)
+	if err != nil {
+		return err
+	}
+	return file.store.Put(lastPlayedFilename, jsonData)
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// crossfadeRate is the sample rate the sounds are converted to so that sox can mix them.
+const crossfadeRate = "48000"
+
+// PlayCrossfaded plays the sounds as one sox command, each sound delayed by its start and faded in and
+// out over the ones either side of it.  A sound shorter than two crossfades can't fade in and out
+// without the fades overlapping, so it is played after a gap instead.  The mixer is set to the first
+// sound's volume and the others are played relative to it.
+func (p SoundCardPlayer) PlayCrossfaded(sounds []playlist.CrossfadeSound, crossfade time.Duration) ([]time.Duration, error) {
+	p.ambient.Pause()
+	defer p.ambient.Resume()
+	lengths := make([]time.Duration, len(sounds))
+	gaps := make([]time.Duration, len(sounds))
+	for i, sound := range sounds {
+		if _, err := os.Stat(sound.FileName); err != nil {
+			return nil, &PlaybackError{Kind: PlaybackMissingFile, Err: err}
+		}
+		length, err := playedLength(sound.FileName, sound.Options)
+		if err != nil {
+			return nil, err
+		}
+		lengths[i], gaps[i] = length, sound.Gap
+	}
+	starts, fades := crossfadeStarts(lengths, gaps, crossfade)
+
+	volumeArgs := p.applyVolume(sounds[0].Volume)
+	args := []string{"-q", "-m"}
+	for i, sound := range sounds {
+		effects, err := p.trimArgs(sound.FileName, sound.Options)
+		if err != nil {
+			return nil, err
+		}
+		effects = append(effects, loudnessArgs(sound.FileName, sound.Options)...)
+		effects = append(effects, p.panArgs(sound.Options.Pan)...)
+		if sound.Volume != sounds[0].Volume && sounds[0].Volume > 0 {
+			effects = append(effects, "vol", strconv.FormatFloat(float64(sound.Volume)/float64(sounds[0].Volume), 'f', 2, 64))
+		}
+		fadeIn, fadeOut := time.Duration(0), time.Duration(0)
+		if i > 0 && fades[i-1] {
+			fadeIn = crossfade
+		}
+		if i < len(fades) && fades[i] {
+			fadeOut = crossfade
+		}
+		if fadeIn > 0 || fadeOut > 0 {
+			effects = append(effects, "fade", "t", formatSeconds(fadeIn), "0", formatSeconds(fadeOut))
+		}
+		effects = append(effects, "channels", "2", "rate", crossfadeRate, "pad", formatSeconds(starts[i]))
+		// Each sound is an input piped from its own sox command, at full volume rather than the share
+		// of it that -m would give each input.
+		args = append(args, "-v", "1", "|sox -q "+shellQuote(sound.FileName)+" -p "+strings.Join(effects, " "))
+	}
+	args = append(args, volumeArgs...)
+
+	cmd := exec.Command("play", args...)
+	if p.device != "" {
+		cmd.Env = append(os.Environ(), "AUDIODRIVER=alsa", "AUDIODEV="+p.device)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return starts, &PlaybackError{Kind: playbackErrorKind(string(out)), Output: string(out), Err: err}
+	}
+	return starts, nil
+}
+
+// playedLength works out how long the part of a file played with the options lasts.
+func playedLength(filename string, options playlist.PlayOptions) (time.Duration, error) {
+	length, err := probeDuration(filename)
+	if err != nil {
+		return 0, err
+	}
+	if !options.RandomOffset {
+		length -= options.Offset
+	}
+	if options.Duration > 0 && options.Duration < length {
+		length = options.Duration
+	}
+	return length, nil
+}
+
+// crossfadeStarts works out when each sound starts after the first, and for each sound but the last
+// whether it crossfades into the next one.  Sounds too short to fade in and out are followed, and
+// preceded, by their gaps instead.
+func crossfadeStarts(lengths, gaps []time.Duration, crossfade time.Duration) ([]time.Duration, []bool) {
+	starts := make([]time.Duration, len(lengths))
+	fades := make([]bool, len(lengths)-1)
+	for i := 1; i < len(lengths); i++ {
+		fades[i-1] = lengths[i-1] >= 2*crossfade && lengths[i] >= 2*crossfade
+		if fades[i-1] {
+			starts[i] = starts[i-1] + lengths[i-1] - crossfade
+		} else {
+			starts[i] = starts[i-1] + lengths[i-1] + gaps[i]
+		}
+	}
+	return starts, fades
+}
+
+// shellQuote quotes a file name for the shell sox runs piped inputs with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
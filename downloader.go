@@ -5,14 +5,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/TheCacophonyProject/audiobait/api"
 	"github.com/TheCacophonyProject/audiobait/playlist"
@@ -24,16 +27,126 @@ const libraryFilename = "audiofilelibrary.txt"
 type Downloader struct {
 	api      *api.CacophonyAPI
 	audioDir string
+	apiOpts  []api.Option
+	store    Store
+	policy   DownloadPolicy
+	spool    *EventSpool
+	loudness *LoudnessHints
+	verified *VerifiedTimes
+	cacheTTL time.Duration
+
+	transcode  TranscodeConfig
+	transcoded *TranscodedFiles
+
+	// transport, if set, is where events are sent instead of the API.
+	transport api.EventReporter
+
+	originalFileNames bool
+	contentHashNames  bool
+	power             PowerSource
+
+	// syncEvents limits how often the stages of syncing are reported, or is nil if they aren't.
+	syncEvents *eventRateLimiter
+
+	// fetchedScheduleID is the ID of the schedule last downloaded from the server, waiting to be
+	// acknowledged.
+	fetchedScheduleID *int
+
+	// These control how WatchSchedule polls.
+	adaptivePolling bool
+	pollJitter      float64
+	pollRand        *rand.Rand
+	pollMu          sync.Mutex
+	pollInterval    time.Duration
 }
 
-func NewDownloader(audioPath string) (*Downloader, error) {
+func NewDownloader(audioPath string, apiOpts ...api.Option) (*Downloader, error) {
+	return NewDownloaderWithStore(audioPath, NewFileStore(audioPath), apiOpts...)
+}
+
+// NewDownloaderWithStore creates a downloader that keeps its state, such as the event spool and the
+// saved schedule, in store instead of in files in the audio directory.  The audio files are still
+// downloaded to audioPath.
+func NewDownloaderWithStore(audioPath string, store Store, apiOpts ...api.Option) (*Downloader, error) {
+	return newDownloaderWithOpener(audioPath, store, tryToInitiateAPI, apiOpts...)
+}
+
+// newDownloaderWithOpener creates a downloader as NewDownloaderWithStore does, connecting to the server
+// with open, which is given the downloader's API options.
+func newDownloaderWithOpener(audioPath string, store Store, open func(opts ...api.Option) *api.CacophonyAPI, apiOpts ...api.Option) (*Downloader, error) {
 	if err := createAudioPath(audioPath); err != nil {
 		return nil, err
 	}
 
-	api := tryToInitiateAPI()
+	apiOpts = append(apiOpts[:len(apiOpts):len(apiOpts)], api.WithFileCache(OpenETagCache(store)))
+	api := open(apiOpts...)
+
+	return &Downloader{
+		api:      api,
+		audioDir: audioPath,
+		apiOpts:  apiOpts,
+		store:    store,
+		spool:    NewEventSpool(store),
+		loudness: OpenLoudnessHints(store),
+		verified: OpenVerifiedTimes(store),
+
+		transcoded: OpenTranscodedFiles(store),
+	}, nil
+}
+
+// tokenRefreshWindow is how long before the API token expires that it is renewed, so that the day's
+// long waits between downloads and events never leave it expired.
+const tokenRefreshWindow = 10 * time.Minute
+
+// StartTokenRefresher keeps the downloader's API token renewed in the background until ctx is done.
+func (dl *Downloader) StartTokenRefresher(ctx context.Context) {
+	if dl.api != nil {
+		dl.api.StartTokenRefresher(ctx, tokenRefreshWindow)
+	}
+}
+
+// stateStore gets where the downloader keeps its state, which is the audio directory unless it was
+// created with another store.
+func (dl *Downloader) stateStore() Store {
+	if dl.store == nil {
+		return NewFileStore(dl.audioDir)
+	}
+	return dl.store
+}
+
+// LoudnessHints gets the server's loudness hints for the downloaded audio files, keyed by file ID.
+func (dl *Downloader) LoudnessHints() map[int]playlist.LoudnessHint {
+	if dl.loudness == nil {
+		return nil
+	}
+	return dl.loudness.All()
+}
+
+// recordLoudnessHints remembers the loudness hints in a file's details from the server.
+func (dl *Downloader) recordLoudnessHints(fileId int, fileInfo *api.FileResponse) {
+	if dl.loudness != nil {
+		dl.loudness.Set(fileId, fileInfo.File.Details)
+	}
+}
+
+// SetDownloadPolicy sets what happens when some of a schedule's files can't be downloaded.
+func (dl *Downloader) SetDownloadPolicy(policy DownloadPolicy) {
+	dl.policy = policy
+}
+
+// SetOriginalFileNames saves downloaded files using their original file names, which are easier for
+// people to recognise, instead of their names and IDs.  Files already downloaded keep their names.
+func (dl *Downloader) SetOriginalFileNames(original bool) {
+	dl.originalFileNames = original
+}
 
-	return &Downloader{api: api, audioDir: audioPath}, nil
+// DownloadThroughput gets the recent average download speed in bytes per second, or zero if it isn't
+// known.  It can be used to decide whether the link is good enough for a big download.
+func (dl *Downloader) DownloadThroughput() float64 {
+	if dl.api == nil {
+		return 0
+	}
+	return dl.api.DownloadThroughput()
 }
 
 func createAudioPath(audioPath string) error {
@@ -44,9 +157,12 @@ func createAudioPath(audioPath string) error {
 	return nil
 }
 
-func tryToInitiateAPI() *api.CacophonyAPI {
+// apiConfigFile holds the server and device details, shared with thermal-uploader.
+const apiConfigFile = "/etc/thermal-uploader.yaml"
+
+func tryToInitiateAPI(opts ...api.Option) *api.CacophonyAPI {
 	log.Println("Connecting with API")
-	api, err := api.Open("/etc/thermal-uploader.yaml")
+	api, err := api.Open(apiConfigFile, opts...)
 	if err != nil {
 		log.Printf("Failed to connect with API %s", err.Error())
 	}
@@ -54,14 +170,11 @@ func tryToInitiateAPI() *api.CacophonyAPI {
 }
 
 func (dl *Downloader) saveScheduleToDisk(jsonData []byte) error {
-	filepath := filepath.Join(dl.audioDir, scheduleFilename)
-	err := ioutil.WriteFile(filepath, jsonData, 0644)
-	return err
+	return dl.stateStore().Put(scheduleFilename, jsonData)
 }
 
 func (dl *Downloader) loadScheduleFromDisk() (playlist.Schedule, error) {
-	filepath := filepath.Join(dl.audioDir, scheduleFilename)
-	jsonData, err := ioutil.ReadFile(filepath)
+	jsonData, err := dl.stateStore().Get(scheduleFilename)
 	if err != nil {
 		return playlist.Schedule{}, err
 	}
@@ -75,12 +188,17 @@ func (dl *Downloader) loadScheduleFromDisk() (playlist.Schedule, error) {
 }
 
 func (dl *Downloader) GetTodaysSchedule() playlist.Schedule {
+	return dl.getTodaysSchedule(context.Background())
+}
 
+func (dl *Downloader) getTodaysSchedule(ctx context.Context) playlist.Schedule {
 	if dl.api != nil {
 		log.Println("Downloading schedule from server")
-		if schedule, err := dl.downloadSchedule(); err == nil {
+		if schedule, err := dl.downloadSchedule(ctx); err == nil {
 			// success!
 			return schedule
+		} else if err == api.ErrNoSchedule {
+			log.Println("Server has no schedule, keeping the previous one")
 		} else {
 			log.Printf("Failed to download schedule schedule: %s", err)
 		}
@@ -96,24 +214,143 @@ func (dl *Downloader) GetTodaysSchedule() playlist.Schedule {
 	return schedule
 }
 
-// GetFilesFromSchedule will get all files from the IDs in the schedule and save to disk.
-func (dl *Downloader) GetFilesForSchedule(schedule playlist.Schedule) (map[int]string, error) {
-	referencedFiles := schedule.GetReferencedSounds()
+// GetScheduleForDate gets the schedule (as per GetTodaysSchedule) filtered down to the combos that will
+// be played on the audiobait day starting on the given date.  ctx stops the schedule being downloaded, in
+// which case the schedule on disk is used.
+func (dl *Downloader) GetScheduleForDate(ctx context.Context, date time.Time) playlist.Schedule {
+	schedule := dl.getTodaysSchedule(ctx)
+	return schedule.ForDate(date)
+}
 
-	audioLibrary := OpenLibrary(filepath.Join(dl.audioDir, libraryFilename))
+// GetFilesFromSchedule will get all files from the IDs in the schedule and save to disk.  The files that are
+// available are always returned.  If some files couldn't be downloaded a *DownloadError saying why is also
+// returned, and what else was downloaded depends on the download policy.  If ctx is cancelled, such as
+// when the schedule has been replaced, the file being downloaded is abandoned without leaving any of it
+// behind, and the DownloadError lists the files that were completed.
+func (dl *Downloader) GetFilesForSchedule(ctx context.Context, schedule playlist.Schedule) (map[int]string, error) {
+	return dl.getFiles(ctx, schedule.GetReferencedSounds(), false)
+}
+
+// GetFilesForSchedules gets the files for several schedules at once, as GetFilesForSchedule does.
+func (dl *Downloader) GetFilesForSchedules(ctx context.Context, schedules []playlist.ZoneSchedule) (map[int]string, error) {
+	var fileIds []int
+	for _, zoneSchedule := range schedules {
+		fileIds = append(fileIds, zoneSchedule.Schedule.GetReferencedSounds()...)
+	}
+	return dl.getFiles(ctx, uniqueFileIds(fileIds), false)
+}
+
+// GetFilesForWindow gets the files for just the combos in the schedule that play within the given time
+// from now, as GetFilesForSchedule does, to save downloading sounds that aren't needed yet.  If it can't
+// work out which combos those are the files for the whole schedule are fetched.  The runner doesn't use
+// it, as each daily run fetches every file the day's schedule needs; it is for programs using the
+// downloader as a library that fetch files more often.
+func (dl *Downloader) GetFilesForWindow(ctx context.Context, schedule playlist.Schedule, within time.Duration) (map[int]string, error) {
+	return dl.getFilesForWindow(ctx, schedule, time.Now(), within)
+}
+
+func (dl *Downloader) getFilesForWindow(ctx context.Context, schedule playlist.Schedule, now time.Time, within time.Duration) (map[int]string, error) {
+	fileIds, ok := schedule.GetSoundsActiveWithin(now, within)
+	if !ok {
+		log.Printf("Can't tell which combos play in the next %v, fetching all files", within)
+		fileIds = schedule.GetReferencedSounds()
+	}
+	return dl.getFiles(ctx, fileIds, false)
+}
 
+// uniqueFileIds returns the ids with any repeats removed.
+func uniqueFileIds(fileIds []int) []int {
+	seen := make(map[int]bool, len(fileIds))
+	unique := make([]int, 0, len(fileIds))
+	for _, fileId := range fileIds {
+		if !seen[fileId] {
+			seen[fileId] = true
+			unique = append(unique, fileId)
+		}
+	}
+	return unique
+}
+
+// GetAllGroupSounds downloads every audio bait file available to the device's group into the audio
+// directory, not just the ones the current schedule uses.  This warms the cache when provisioning a
+// device so that later schedule changes need fewer downloads.  Files already downloaded are skipped.
+// It returns the files available, as GetFilesForSchedule does.
+func (dl *Downloader) GetAllGroupSounds(ctx context.Context) (map[int]string, error) {
+	if dl.api == nil {
+		return nil, errors.New("not connected to API")
+	}
+	fileIds, err := dl.api.ListAudioFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Group has %d audio files", len(fileIds))
+	return dl.getFiles(ctx, fileIds, false)
+}
+
+// getFiles downloads any of the given files that aren't available locally and returns those that are.
+// Local files are checked against the server as the cache TTL says, or all downloaded again if force
+// is set.
+func (dl *Downloader) getFiles(ctx context.Context, referencedFiles []int, force bool) (map[int]string, error) {
+	audioLibrary := OpenLibrary(dl.stateStore())
+	hashIndex := dl.openHashIndex()
+	defer dl.saveHashIndex(hashIndex)
+
+	var err error
 	if dl.api != nil {
-		dl.downloadAllNewFiles(audioLibrary, referencedFiles)
+		localFiles := dl.verifyLocalSounds(audioLibrary, hashIndex, referencedFiles)
+		dl.reverifyFiles(ctx, audioLibrary, localFiles, force)
+		if completed, failures := dl.downloadAllNewFiles(ctx, audioLibrary, localFiles, referencedFiles); len(failures) > 0 {
+			err = &DownloadError{Failures: failures, Completed: completed}
+		}
 	}
 
-	availableFiles := dl.listAvailableFiles(audioLibrary, referencedFiles)
+	localFiles := dl.verifyLocalSounds(audioLibrary, hashIndex, referencedFiles)
+	availableFiles := dl.listAvailableFiles(audioLibrary, localFiles)
+
+	return availableFiles, err
+}
+
+// VerifyLocalSounds checks which of the given files in the audio library are present on disk.  It returns a
+// map of file ID to the SHA-256 hash of each file found.  Hashes are cached in a sidecar index so files are
+// only re-read when they have changed.
+func (dl *Downloader) VerifyLocalSounds(fileIds []int) map[int]string {
+	audioLibrary := OpenLibrary(dl.stateStore())
+	hashIndex := dl.openHashIndex()
+	defer dl.saveHashIndex(hashIndex)
 
-	return availableFiles, nil
+	return dl.verifyLocalSounds(audioLibrary, hashIndex, fileIds)
 }
 
-func (dl *Downloader) listAvailableFiles(audioLibrary *AudioFileLibrary, referencedFiles []int) map[int]string {
+func (dl *Downloader) verifyLocalSounds(audioLibrary *AudioFileLibrary, hashIndex *HashIndex, fileIds []int) map[int]string {
+	hashes := make(map[int]string)
+	for _, fileId := range fileIds {
+		filename, exists := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId))
+		if !exists {
+			continue
+		}
+		hash, err := hashIndex.Hash(filepath.Join(dl.audioDir, filename))
+		if err != nil {
+			log.Printf("Audio file %s with id %d is not available: %s", filename, fileId, err)
+			continue
+		}
+		hashes[fileId] = hash
+	}
+	return hashes
+}
+
+func (dl *Downloader) openHashIndex() *HashIndex {
+	return OpenHashIndex(dl.stateStore())
+}
+
+func (dl *Downloader) saveHashIndex(hashIndex *HashIndex) {
+	if err := hashIndex.Save(); err != nil {
+		log.Printf("Failed to save hash index.  Error %s.", err)
+	}
+}
+
+func (dl *Downloader) listAvailableFiles(audioLibrary *AudioFileLibrary, localFiles map[int]string) map[int]string {
 	availableFiles := make(map[int]string)
-	for _, fileId := range referencedFiles {
+	for fileId := range localFiles {
 		strFileId := strconv.Itoa(fileId)
 		if filename, exists := audioLibrary.GetFileNameOnDisk(strFileId); exists {
 			availableFiles[fileId] = filename
@@ -122,57 +359,291 @@ func (dl *Downloader) listAvailableFiles(audioLibrary *AudioFileLibrary, referen
 	return availableFiles
 }
 
-func (dl *Downloader) downloadAllNewFiles(audioLibrary *AudioFileLibrary, referencedFiles []int) {
+// downloadAllNewFiles downloads the referenced files that aren't available locally, following the download
+// policy.  It stops early if ctx is done.  It returns why each file that failed couldn't be downloaded.
+func (dl *Downloader) downloadAllNewFiles(ctx context.Context, audioLibrary *AudioFileLibrary, localFiles map[int]string, referencedFiles []int) ([]int, map[int]error) {
 	log.Println("Starting downloading audio files.")
+	start := time.Now()
+	missing := countMissingFiles(localFiles, referencedFiles)
+	if missing > 0 {
+		dl.reportDownloadStarted(missing)
+	}
+	failures := make(map[int]error)
+	var downloaded []int
+	attempted := make(map[int]bool)
 	for _, fileId := range referencedFiles {
 		strFileId := strconv.Itoa(fileId)
-		if _, exists := audioLibrary.GetFileNameOnDisk(strFileId); !exists {
+		if _, exists := localFiles[fileId]; !exists && !attempted[fileId] {
+			attempted[fileId] = true
+			if err := ctx.Err(); err != nil {
+				log.Printf("Not downloading any more files: %s", err)
+				failures[fileId] = err
+				break
+			}
 			log.Printf("Attempting to download file with id %s", strFileId)
 
 			fileInfo, err := dl.api.GetFileDetails(fileId)
+			if err == nil {
+				_, err = dl.downloadFile(ctx, audioLibrary, fileId, fileInfo)
+			}
 			if err != nil {
-				log.Printf("Could not download file with id %s.   Downloading next file" + strFileId)
-			} else {
-				fileNameParts := strings.Split(fileInfo.File.Details.OriginalName, ".")
-				fileExt := ""
-				if len(fileNameParts) > 1 {
-					fileExt = "." + fileNameParts[len(fileNameParts)-1]
+				failures[fileId] = err
+				if ctx.Err() != nil {
+					log.Printf("Download of file with id %s was cancelled. Not downloading any more files", strFileId)
+					break
 				}
-				fileNameOnDisk := fileInfo.File.Details.Name + "-" + strFileId + fileExt
-
-				if err = dl.api.DownloadFile(fileInfo, filepath.Join(dl.audioDir, fileNameOnDisk)); err != nil {
-					log.Printf("Could not download file with id %s.  Error is %s. Downloading next file", strFileId, err)
-				} else {
-					audioLibrary.AddFile(strFileId, fileNameOnDisk)
+				if dl.policy == FailFast {
+					log.Printf("Could not download file with id %s.  Error is %s. Not downloading any more files", strFileId, err)
+					break
 				}
+				log.Printf("Could not download file with id %s.  Error is %s. Downloading next file", strFileId, err)
+			} else {
+				downloaded = append(downloaded, fileId)
 			}
 		}
 	}
+
+	if len(failures) > 0 && dl.policy == AllOrNothing {
+		log.Printf("Removing the %d files downloaded as %d failed", len(downloaded), len(failures))
+		dl.removeFiles(audioLibrary, downloaded)
+		downloaded = nil
+	}
+	if missing > 0 {
+		dl.reportDownloadFinished(len(downloaded), failures, time.Since(start))
+	}
 	log.Println("Downloading audio files complete.")
+	return downloaded, failures
+}
+
+// countMissingFiles counts the referenced files that aren't in localFiles.
+func countMissingFiles(localFiles map[int]string, referencedFiles []int) int {
+	missing := 0
+	for _, fileId := range uniqueFileIds(referencedFiles) {
+		if _, exists := localFiles[fileId]; !exists {
+			missing++
+		}
+	}
+	return missing
+}
+
+// removeFiles deletes the given files and removes them from the audio library.
+func (dl *Downloader) removeFiles(audioLibrary *AudioFileLibrary, fileIds []int) {
+	for _, fileId := range fileIds {
+		strFileId := strconv.Itoa(fileId)
+		filename, exists := audioLibrary.GetFileNameOnDisk(strFileId)
+		if !exists {
+			continue
+		}
+		if err := audioLibrary.RemoveFile(strFileId); err != nil {
+			log.Printf("Could not remove file %s from the audio library: %s", strFileId, err)
+			continue
+		}
+		dl.removeAudioFile(filename)
+	}
+}
+
+// downloadFile downloads a file, compressing it if transcoding is on, and adds it to the audio library,
+// returning the name it was saved as.
+func (dl *Downloader) downloadFile(ctx context.Context, audioLibrary *AudioFileLibrary, fileId int, fileInfo *api.FileResponse) (string, error) {
+	var filename string
+	if dl.contentHashNames {
+		named, err := dl.downloadByContentHash(ctx, fileId, fileInfo, false)
+		if err != nil {
+			return "", err
+		}
+		filename = named
+	} else {
+		filename = dl.fileNameOnDisk(audioLibrary, fileInfo, fileId)
+		if err := dl.api.DownloadFileContext(ctx, fileInfo, filepath.Join(dl.audioDir, filename)); err != nil {
+			return "", err
+		}
+		filename = dl.transcodeFile(fileId, filename)
+	}
+	dl.recordLoudnessHints(fileId, fileInfo)
+	dl.recordVerified(fileId)
+	return filename, audioLibrary.AddFile(strconv.Itoa(fileId), filename)
+}
+
+// fileNameOnDisk works out the name a file from the server is saved as.  By default that is the file's
+// name followed by its ID, but if original file names are being used it is the file's original name,
+// with the ID added only if another file already has that name.
+func (dl *Downloader) fileNameOnDisk(audioLibrary *AudioFileLibrary, fileInfo *api.FileResponse, fileId int) string {
+	idFileName := fileInfo.File.Details.FileName(fileId)
+	if !dl.originalFileNames {
+		return idFileName
+	}
+
+	filename := sanitizeFileName(fileInfo.File.Details.OriginalName)
+	if filename == "" {
+		return idFileName
+	}
+	if dl.fileNameTaken(audioLibrary, filename, fileId) {
+		ext := filepath.Ext(filename)
+		filename = strings.TrimSuffix(filename, ext) + "-" + strconv.Itoa(fileId) + ext
+	}
+	return filename
+}
+
+// fileNameTaken checks whether a file name is used by a file other than the one with the given ID.
+func (dl *Downloader) fileNameTaken(audioLibrary *AudioFileLibrary, filename string, fileId int) bool {
+	strFileId := strconv.Itoa(fileId)
+	for id, existing := range audioLibrary.FilesById {
+		if existing == filename {
+			return id != strFileId
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dl.audioDir, filename)); err == nil {
+		return true
+	}
+	// Don't clash with the library or other files kept in the audio directory.
+	switch filename {
+	case libraryFilename, scheduleFilename, hashIndexFilename, spoolFilename, deadLetterFilename, etagCacheFilename,
+		sequencePositionFilename, loudnessFilename, verifiedFilename, transcodedFilename, groupInfoFilename,
+		lastPlayedFilename:
+		return true
+	}
+	return false
+}
+
+// sanitizeFileName makes a file name from the server safe to save in the audio directory.
+func sanitizeFileName(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	return strings.TrimLeft(name, ".")
 }
 
 // GetSchedule will get the audio schedule
-func (dl *Downloader) downloadSchedule() (playlist.Schedule, error) {
-	jsonData, err := dl.api.GetSchedule()
-	if err != nil {
+func (dl *Downloader) downloadSchedule(ctx context.Context) (playlist.Schedule, error) {
+	start := time.Now()
+	var fetched fetchedSchedule
+	if err := dl.api.DecodeScheduleContext(ctx, &fetched); err != nil {
 		return playlist.Schedule{}, err
 	}
 	log.Println("Audio schedule downloaded from server")
+	choice := dl.api.ScheduleChoice()
+	if len(choice.Tags) > 0 {
+		log.Printf("Chose schedule %d with tags %v", choice.ID, choice.Tags)
+	}
 
-	// parse schedule
-	var sr scheduleResponse
-	if err := json.Unmarshal(jsonData, &sr); err != nil {
+	if err := dl.checkSchedule(fetched.Schedule); err != nil {
 		return playlist.Schedule{}, err
 	}
-	log.Println("Audio schedule parsed sucessfully")
 
-	if err := dl.saveScheduleToDisk(jsonData); err != nil {
+	sr := savedSchedule{ScheduleID: choice.ID, Schedule: fetched.JSON}
+	if jsonData, err := json.Marshal(sr); err != nil {
+		log.Printf("Failed to save schedule to disk.  Error %s.", err)
+	} else if err := dl.saveScheduleToDisk(jsonData); err != nil {
 		log.Printf("Failed to save schedule to disk.  Error %s.", err)
 	}
 
+	dl.fetchedScheduleID = &sr.ScheduleID
+	dl.reportScheduleReceived(sr.ScheduleID, len(fetched.Schedule.Combos), time.Since(start))
+	return fetched.Schedule, nil
+}
+
+// GetScheduleByID gets the schedule with the given ID from the server instead of the device's current
+// one, such as to preview or pin a schedule version.  It is validated as downloaded schedules are, but
+// isn't saved or acknowledged.
+func (dl *Downloader) GetScheduleByID(ctx context.Context, id int) (playlist.Schedule, error) {
+	if dl.api == nil {
+		return playlist.Schedule{}, errors.New("not connected to API")
+	}
+	jsonData, err := dl.api.GetScheduleByID(ctx, id)
+	if err != nil {
+		return playlist.Schedule{}, err
+	}
+	log.Printf("Audio schedule %d downloaded from server", id)
+	sr, err := dl.parseSchedule(jsonData)
+	if err != nil {
+		return playlist.Schedule{}, err
+	}
 	return sr.Schedule, nil
 }
 
+// parseSchedule parses and validates a schedule downloaded from the server, reporting it if it is
+// invalid.
+func (dl *Downloader) parseSchedule(jsonData []byte) (scheduleResponse, error) {
+	var sr scheduleResponse
+	if err := json.Unmarshal(jsonData, &sr); err != nil {
+		return scheduleResponse{}, err
+	}
+	if err := dl.checkSchedule(sr.Schedule); err != nil {
+		return scheduleResponse{}, err
+	}
+	return sr, nil
+}
+
+// checkSchedule validates a schedule downloaded from the server, reporting it if it is invalid.
+func (dl *Downloader) checkSchedule(schedule playlist.Schedule) error {
+	log.Println("Audio schedule parsed sucessfully")
+
+	if err := schedule.Validate(); err != nil {
+		dl.reportInvalidSchedule(err)
+		return err
+	}
+	for _, warning := range schedule.Warnings() {
+		log.Printf("Schedule warning: %s", warning)
+	}
+	return nil
+}
+
+// AckSchedule tells the server the device has the schedule last downloaded from it.  Call it once the
+// schedule's files have been downloaded.  Nothing is sent if the schedule came from disk or has
+// already been acknowledged.
+func (dl *Downloader) AckSchedule(ctx context.Context) error {
+	if dl.api == nil || dl.fetchedScheduleID == nil {
+		return nil
+	}
+	if err := dl.api.AckSchedule(ctx, *dl.fetchedScheduleID); err != nil {
+		return err
+	}
+	dl.fetchedScheduleID = nil
+	return nil
+}
+
+// invalidScheduleEvents stops a persistently bad schedule from flooding the server with events.
+var invalidScheduleEvents = newEventRateLimiter(6 * time.Hour)
+
+func (dl *Downloader) reportInvalidSchedule(validationErr error) {
+	if !invalidScheduleEvents.Allow(validationErr.Error(), time.Now()) {
+		return
+	}
+
+	details := map[string]interface{}{"error": validationErr.Error()}
+	if ve, ok := validationErr.(*playlist.ValidationError); ok {
+		details["problems"] = ve.Problems
+	}
+	if err := dl.reportEvent("audioBaitScheduleInvalid", details); err != nil {
+		log.Printf("Could not report invalid schedule: %s", err)
+	}
+}
+
 type scheduleResponse struct {
+	ScheduleID int `json:"scheduleId"`
+	Schedule   playlist.Schedule
+}
+
+// savedSchedule is how a downloaded schedule is saved to disk, which loads as a scheduleResponse.
+type savedSchedule struct {
+	ScheduleID int             `json:"scheduleId"`
+	Schedule   json.RawMessage `json:"schedule"`
+}
+
+// fetchedSchedule is a schedule streamed from the server by DecodeSchedule.  Only the schedule's own
+// JSON is kept, not the rest of the response, as it has to be saved to disk for when the device starts
+// without a connection.  It is saved as the server sent it so that it loads exactly as it was decoded.
+type fetchedSchedule struct {
 	Schedule playlist.Schedule
+	JSON     json.RawMessage
+}
+
+func (f *fetchedSchedule) UnmarshalJSON(data []byte) error {
+	f.JSON = append(json.RawMessage(nil), data...)
+	return json.Unmarshal(data, &f.Schedule)
 }
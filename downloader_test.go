@@ -0,0 +1,102 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadedSchedulesAreSavedForStartingOffline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"success": true, "messages": ["ok"], "scheduleId": 7,
+			"schedule": {"playNights": 1, "combos": [{"from": "21:00", "until": "22:00", "every": 600, "waits": [0], "sounds": ["3"], "volumes": [5]}]}}`)
+	}))
+	t.Cleanup(server.Close)
+	dl := &Downloader{store: NewMemoryStore(), api: api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret")}
+
+	schedule, err := dl.downloadSchedule(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, schedule.Combos, 1)
+	assert.Equal(t, 7, *dl.fetchedScheduleID)
+
+	// Only the schedule is saved, not the rest of the response.
+	saved, err := dl.stateStore().Get(scheduleFilename)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(saved), "messages")
+	loaded, err := dl.loadScheduleFromDisk()
+	assert.Nil(t, err)
+	assert.Equal(t, schedule, loaded)
+}
+
+// duskAndDawn is a schedule playing file 1 at dusk and file 2 at dawn.
+func duskAndDawn() playlist.Schedule {
+	combo := func(from, until, sound string) playlist.Combo {
+		return playlist.Combo{From: *playlist.NewTimeOfDay(from), Until: *playlist.NewTimeOfDay(until), Every: 1800,
+			Waits: []int{0}, Volumes: []int{5}, Sounds: []string{sound}}
+	}
+	return playlist.Schedule{Combos: []playlist.Combo{combo("18:00", "20:00", "1"), combo("05:00", "07:00", "2")}}
+}
+
+func TestGetFilesForWindowOnlyFetchesTheFilesPlayingSoon(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "2": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	now := time.Date(2018, time.November, 5, 17, 0, 0, 0, time.Local)
+
+	available, err := dl.getFilesForWindow(context.Background(), duskAndDawn(), now, 4*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.wav"}, available)
+	assert.Equal(t, 1, files.downloads)
+}
+
+func TestGetFilesForWindowFetchesEverythingWhenItCantTell(t *testing.T) {
+	_, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "2": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	now := time.Date(2018, time.November, 5, 17, 0, 0, 0, time.Local)
+
+	// A whole day, or a combo in a time zone that can't be loaded, covers the whole schedule.
+	available, err := dl.getFilesForWindow(context.Background(), duskAndDawn(), now, 24*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.wav", 2: "beep-2.wav"}, available)
+
+	schedule := duskAndDawn()
+	schedule.Combos[1].Timezone = "Nowhere/Special"
+	dl = newSyncDownloader(t, cacophonyAPI)
+	available, err = dl.getFilesForWindow(context.Background(), schedule, now, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.wav", 2: "beep-2.wav"}, available)
+}
+
+func TestGetScheduleForDateLeavesOutControlNights(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"scheduleId": 7, "schedule": {"playNights": 1, "controlNights": 1,
+			"combos": [{"from": "21:00", "until": "22:00", "every": 600, "waits": [0], "sounds": ["3"], "volumes": [5]}]}}`)
+	}))
+	t.Cleanup(server.Close)
+	dl := &Downloader{store: NewMemoryStore(), api: api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret")}
+
+	playing := dl.GetScheduleForDate(context.Background(), time.Date(2018, time.November, 5, 0, 0, 0, 0, time.Local))
+	assert.Equal(t, []int{3}, playing.GetReferencedSounds())
+	control := dl.GetScheduleForDate(context.Background(), time.Date(2018, time.November, 6, 0, 0, 0, 0, time.Local))
+	assert.Empty(t, control.Combos)
+	assert.Equal(t, 2, requests)
+
+	// Once ctx is done the schedule saved on disk is used.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	playing = dl.GetScheduleForDate(ctx, time.Date(2018, time.November, 7, 0, 0, 0, 0, time.Local))
+	assert.Equal(t, []int{3}, playing.GetReferencedSounds())
+	assert.Equal(t, 2, requests)
+}
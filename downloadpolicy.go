@@ -0,0 +1,59 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DownloadPolicy controls what GetFilesForSchedule does when some files can't be downloaded.
+type DownloadPolicy int
+
+const (
+	// BestEffort downloads every file it can and reports the ones that failed.
+	BestEffort DownloadPolicy = iota
+	// FailFast stops downloading at the first failure.
+	FailFast
+	// AllOrNothing removes the files downloaded in this batch if any file fails, so the
+	// audio library is only updated when the whole schedule can be downloaded.
+	AllOrNothing
+)
+
+// ParseDownloadPolicy parses a download policy from the config file.
+func ParseDownloadPolicy(policy string) (DownloadPolicy, error) {
+	switch policy {
+	case "", "best-effort":
+		return BestEffort, nil
+	case "fail-fast":
+		return FailFast, nil
+	case "all-or-nothing":
+		return AllOrNothing, nil
+	}
+	return BestEffort, fmt.Errorf("unknown download policy %q", policy)
+}
+
+// DownloadError is returned when some files could not be downloaded.
+type DownloadError struct {
+	// Failures maps the ID of each file that failed to why it failed.
+	Failures map[int]error
+	// Completed lists the files that were downloaded, and kept, before the download stopped.
+	Completed []int
+}
+
+func (e *DownloadError) Error() string {
+	fileIds := make([]int, 0, len(e.Failures))
+	for fileId := range e.Failures {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Ints(fileIds)
+
+	failures := make([]string, len(fileIds))
+	for i, fileId := range fileIds {
+		failures[i] = fmt.Sprintf("%d: %v", fileId, e.Failures[fileId])
+	}
+	return fmt.Sprintf("%d files failed to download (%s)", len(fileIds), strings.Join(failures, "; "))
+}
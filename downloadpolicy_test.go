@@ -0,0 +1,71 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDownloadPolicy(t *testing.T) {
+	for text, expected := range map[string]DownloadPolicy{"": BestEffort, "best-effort": BestEffort, "fail-fast": FailFast, "all-or-nothing": AllOrNothing} {
+		policy, err := ParseDownloadPolicy(text)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, policy, text)
+	}
+	_, err := ParseDownloadPolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+// downloadWithPolicy downloads files 1, 2 and 3, in that order, where file 2 can't be downloaded.
+func downloadWithPolicy(t *testing.T, policy DownloadPolicy, alreadyDownloaded ...int) (*fileServer, map[int]string, *DownloadError) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "3": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	_, err := dl.getFiles(context.Background(), alreadyDownloaded, false)
+	assert.Nil(t, err)
+	dl.SetDownloadPolicy(policy)
+
+	available, err := dl.getFiles(context.Background(), []int{1, 2, 3}, false)
+	downloadErr, ok := err.(*DownloadError)
+	assert.True(t, ok)
+	assert.Equal(t, []int{2}, failedFileIds(downloadErr))
+	return files, available, downloadErr
+}
+
+func failedFileIds(err *DownloadError) []int {
+	var fileIds []int
+	for fileId := range err.Failures {
+		fileIds = append(fileIds, fileId)
+	}
+	return fileIds
+}
+
+func TestBestEffortDownloadsEveryFileItCan(t *testing.T) {
+	_, available, err := downloadWithPolicy(t, BestEffort)
+	assert.Equal(t, map[int]string{1: "beep-1.wav", 3: "beep-3.wav"}, available)
+	assert.Equal(t, []int{1, 3}, err.Completed)
+}
+
+func TestFailFastStopsAtTheFirstFailure(t *testing.T) {
+	files, available, err := downloadWithPolicy(t, FailFast)
+	assert.Equal(t, map[int]string{1: "beep-1.wav"}, available)
+	assert.Equal(t, []int{1}, err.Completed)
+	assert.Equal(t, 1, files.downloads)
+}
+
+func TestAllOrNothingRemovesTheFilesItDownloaded(t *testing.T) {
+	_, available, err := downloadWithPolicy(t, AllOrNothing, 3)
+	// The file that was already downloaded is kept.
+	assert.Equal(t, map[int]string{3: "beep-3.wav"}, available)
+	assert.Empty(t, err.Completed)
+}
+
+func TestDownloadErrorListsTheFailures(t *testing.T) {
+	err := &DownloadError{Failures: map[int]error{7: errors.New("not found"), 4: errors.New("timeout")}}
+	assert.Equal(t, "2 files failed to download (4: timeout; 7: not found)", err.Error())
+}
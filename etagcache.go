@@ -0,0 +1,65 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const etagCacheFilename = "etags.json"
+
+// ETagCache keeps the ETags of downloaded audio files in the store so that checking whether a file
+// has changed on the server only costs a small request.
+type ETagCache struct {
+	mu    sync.Mutex
+	store Store
+	etags map[string]string
+}
+
+// OpenETagCache loads the ETag cache kept in the store.  A missing or unreadable cache is treated
+// as empty.
+func OpenETagCache(store Store) *ETagCache {
+	cache := &ETagCache{store: store, etags: make(map[string]string)}
+
+	jsonData, err := store.Get(etagCacheFilename)
+	if os.IsNotExist(err) {
+		return cache
+	} else if err != nil {
+		log.Printf("Error loading ETag cache %s", err)
+		return cache
+	}
+	if err := json.Unmarshal(jsonData, &cache.etags); err != nil {
+		log.Printf("ETag cache is corrupt and will be rebuilt: %s", err)
+		cache.etags = make(map[string]string)
+	}
+	return cache
+}
+
+// ETag gets the ETag recorded for a file.
+func (cache *ETagCache) ETag(fileId int) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	etag, exists := cache.etags[strconv.Itoa(fileId)]
+	return etag, exists
+}
+
+// SetETag records the ETag of a file that has just been downloaded and saves the cache.
+func (cache *ETagCache) SetETag(fileId int, etag string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.etags[strconv.Itoa(fileId)] = etag
+
+	jsonData, err := json.Marshal(cache.etags)
+	if err == nil {
+		err = cache.store.Put(etagCacheFilename, jsonData)
+	}
+	if err != nil {
+		log.Printf("Error saving ETag cache %s", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventFile is an event reporter that appends events to a value in a store, such as a local file, one
+// JSON event per line in the same form as the event spool, keeping a copy of the events sent to the
+// server.
+type EventFile struct {
+	mu    sync.Mutex
+	store Store
+	key   string
+}
+
+// NewEventFile creates a reporter that appends events to the value for key in store.
+func NewEventFile(store Store, key string) *EventFile {
+	return &EventFile{store: store, key: key}
+}
+
+// ReportEventWithKey appends the event to the file.
+func (file *EventFile) ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	return appendEvents(file.store, file.key, []spooledEvent{{Details: jsonDetails, Times: times, Key: key}})
+}
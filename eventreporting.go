@@ -0,0 +1,101 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+)
+
+// SetEventTransport sets where events are sent instead of the API, such as an MQTT broker.
+func (dl *Downloader) SetEventTransport(reporter api.EventReporter) {
+	dl.transport = reporter
+}
+
+// eventReporter gets where events are sent, or nil if there is nowhere.
+func (dl *Downloader) eventReporter() api.EventReporter {
+	if dl.transport != nil {
+		return dl.transport
+	}
+	if dl.api != nil {
+		return dl.api
+	}
+	return nil
+}
+
+// SetPowerSource sets where the readings added to the events the downloader reports, and its heartbeats,
+// come from.  No readings are added if it isn't set.
+func (dl *Downloader) SetPowerSource(source PowerSource) {
+	dl.power = source
+}
+
+// reportEvent reports an event of the given type straight to the event transport, by default the API.
+// If it can't be reached the
+// event is spooled to be sent by FlushEvents later, with the same idempotency key so the server won't
+// record it twice if it did get it.
+func (dl *Downloader) reportEvent(eventType string, details map[string]interface{}) error {
+	return dl.reportEventAt(time.Now(), api.Event{Type: eventType, Details: details})
+}
+
+// reportEventAt reports an event that happened at ts, as reportEvent does.
+func (dl *Downloader) reportEventAt(ts time.Time, event api.Event) error {
+	addPowerDetails(dl.power, event.Details)
+	detailsJSON, err := event.JSON()
+	if err != nil {
+		return err
+	}
+	times := []time.Time{ts}
+	key := api.NewIdempotencyKey()
+	if reporter := dl.eventReporter(); reporter != nil {
+		err = reporter.ReportEventWithKey(detailsJSON, times, key)
+		if err == nil || api.IsPermanentError(err) || dl.spool == nil {
+			return err
+		}
+	}
+	log.Printf("Spooling %s event to send later", event.Type)
+	return dl.spool.Add(detailsJSON, times, key)
+}
+
+// errNotConnected is the error given when the spooled events can't be sent as there is no connection to
+// the server.
+var errNotConnected = errors.New("not connected to API")
+
+// FlushEvents sends events spooled while the API couldn't be reached.  Events that last happened
+// before minTime are moved to a dead letter file rather than sent, and no more than maxBatch are sent
+// at once, or all of them if maxBatch is zero.
+func (dl *Downloader) FlushEvents(minTime time.Time, maxBatch int) (FlushResult, error) {
+	reporter := dl.eventReporter()
+	if reporter == nil {
+		return FlushResult{}, errNotConnected
+	}
+	return dl.spool.Flush(reporter.ReportEventWithKey, minTime, maxBatch)
+}
+
+// eventRateLimiter stops the same kind of event being reported more than once per interval.
+type eventRateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newEventRateLimiter(interval time.Duration) *eventRateLimiter {
+	return &eventRateLimiter{interval: interval, last: make(map[string]time.Time)}
+}
+
+// Allow returns true if an event with the given key may be reported now.
+func (rl *eventRateLimiter) Allow(key string, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if last, exists := rl.last[key]; exists && now.Sub(last) < rl.interval {
+		return false
+	}
+	rl.last[key] = now
+	return true
+}
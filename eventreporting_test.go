@@ -0,0 +1,65 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTransport is an event reporter that keeps the events it is sent.
+type testTransport struct {
+	events []map[string]interface{}
+	times  [][]time.Time
+}
+
+func (transport *testTransport) ReportEventWithKey(jsonDetails []byte, times []time.Time, key string) error {
+	var event map[string]interface{}
+	if err := json.Unmarshal(jsonDetails, &event); err != nil {
+		return err
+	}
+	transport.events = append(transport.events, event["description"].(map[string]interface{}))
+	transport.times = append(transport.times, times)
+	return nil
+}
+
+func newTestDownloader(transport api.EventReporter) *Downloader {
+	store := NewMemoryStore()
+	return &Downloader{store: store, spool: NewEventSpool(store), transport: transport}
+}
+
+func TestRecorderEventsAreSentWithTheTransport(t *testing.T) {
+	transport := &testTransport{}
+	recorder := AudioBaitEventRecorder{Transport: newTestDownloader(transport)}
+	played := time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC)
+
+	recorder.OnAudioBaitPlayed(played, 3, 7)
+	recorder.OnPlaySkipped(playlist.SkippedPlay{Time: played.Add(time.Minute), FileId: 4, Reason: "transportTest"})
+
+	assert.Len(t, transport.events, 2)
+	assert.Equal(t, "audioBait", transport.events[0]["type"])
+	assert.Equal(t, map[string]interface{}{"fileId": 3.0, "volume": 7.0}, transport.events[0]["details"])
+	assert.Equal(t, []time.Time{played}, transport.times[0])
+	assert.Equal(t, "audioBaitSkipped", transport.events[1]["type"])
+}
+
+func TestRecorderEventsAreSpooledWhenTheTransportIsDown(t *testing.T) {
+	// Nothing listens on port 1, so the broker can't be reached.
+	broker, err := api.NewMQTTReporter("tcp://127.0.0.1:1", "audiobait/events", "", "")
+	assert.Nil(t, err)
+	downloader := newTestDownloader(broker)
+	recorder := AudioBaitEventRecorder{Transport: downloader}
+
+	recorder.OnAudioBaitPlayed(time.Now(), 3, 7)
+
+	spooled, err := downloader.spool.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, spooled)
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+)
+
+const (
+	spoolFilename      = "eventspool.jsonl"
+	deadLetterFilename = "eventspool-dead.jsonl"
+)
+
+// spooledEvent is an event waiting to be sent to the API.
+type spooledEvent struct {
+	Details json.RawMessage `json:"details"`
+	Times   []time.Time     `json:"times"`
+	// Key is the event's idempotency key, kept so every attempt to send the event uses the same one.
+	// Events spooled before keys were added don't have one until they are first flushed.
+	Key string `json:"key,omitempty"`
+}
+
+// latest gets the most recent time the event happened.
+func (event *spooledEvent) latest() time.Time {
+	var latest time.Time
+	for _, t := range event.Times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// EventSpool keeps events that couldn't be reported in the store, one JSON event per line, so they can
+// be sent once the server can be reached again.
+type EventSpool struct {
+	mu    sync.Mutex
+	store Store
+}
+
+// NewEventSpool creates an event spool kept in the given store.
+func NewEventSpool(store Store) *EventSpool {
+	return &EventSpool{store: store}
+}
+
+// Add adds an event, with the idempotency key it was sent with, to the end of the spool.
+func (spool *EventSpool) Add(details []byte, times []time.Time, key string) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return appendEvents(spool.store, spoolFilename, []spooledEvent{{Details: details, Times: times, Key: key}})
+}
+
+// Len gets the number of events in the spool.
+func (spool *EventSpool) Len() (int, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	events, err := readEvents(spool.store, spoolFilename)
+	return len(events), err
+}
+
+// FlushResult counts what happened to the spooled events during a flush.
+type FlushResult struct {
+	Sent      int
+	Dropped   int
+	Remaining int
+}
+
+// Flush sends the spooled events, oldest first, using send with each event's idempotency key.  Events that last happened before minTime,
+// and events the server rejects outright, are moved to the dead letter file instead.  A zero minTime
+// keeps events of any age.  At most maxBatch events are sent, or all of them if maxBatch is zero.  The
+// flush stops at the first temporary failure, leaving that event and the rest in the spool.
+func (spool *EventSpool) Flush(send func(details []byte, times []time.Time, key string) error, minTime time.Time, maxBatch int) (FlushResult, error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	var result FlushResult
+	events, err := readEvents(spool.store, spoolFilename)
+	if err != nil || len(events) == 0 {
+		return result, err
+	}
+
+	var dropped, remaining []spooledEvent
+	var sendErr error
+	for i, event := range events {
+		if sendErr != nil || (maxBatch > 0 && result.Sent >= maxBatch) {
+			remaining = append(remaining, events[i:]...)
+			break
+		}
+		if !minTime.IsZero() && event.latest().Before(minTime) {
+			dropped = append(dropped, event)
+			continue
+		}
+		if event.Key == "" {
+			event.Key = api.NewIdempotencyKey()
+		}
+		if err := send(event.Details, event.Times, event.Key); err == nil {
+			result.Sent++
+		} else if api.IsPermanentError(err) {
+			dropped = append(dropped, event)
+		} else {
+			sendErr = err
+			remaining = append(remaining, event)
+		}
+	}
+	result.Dropped = len(dropped)
+	result.Remaining = len(remaining)
+
+	if err := appendEvents(spool.store, deadLetterFilename, dropped); err != nil {
+		return result, err
+	}
+	if err := writeEvents(spool.store, spoolFilename, remaining); err != nil {
+		return result, err
+	}
+	return result, sendErr
+}
+
+func readEvents(store Store, key string) ([]spooledEvent, error) {
+	data, err := store.Get(key)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var events []spooledEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var event spooledEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// Skip a partly written line rather than lose the whole spool.
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+func encodeEvents(events []spooledEvent) ([]byte, error) {
+	var data []byte
+	for _, event := range events {
+		line, err := json.Marshal(&event)
+		if err != nil {
+			return nil, err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return data, nil
+}
+
+func appendEvents(store Store, key string, events []spooledEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+	return appendToStore(store, key, data)
+}
+
+// writeEvents replaces the events in the store, which does it atomically so a crash can't lose the spool.
+func writeEvents(store Store, key string, events []spooledEvent) error {
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+	return store.Put(key, data)
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// spoolSender sends events for a flush, failing with the errors given for the events with those details.
+type spoolSender struct {
+	errs map[string]error
+	sent []string
+	keys []string
+}
+
+func (sender *spoolSender) send(details []byte, times []time.Time, key string) error {
+	sender.keys = append(sender.keys, key)
+	if err := sender.errs[string(details)]; err != nil {
+		return err
+	}
+	sender.sent = append(sender.sent, string(details))
+	return nil
+}
+
+// unreachableError gets the temporary error sending an event to a broker that can't be reached gives.
+func unreachableError(t *testing.T) error {
+	broker, err := api.NewMQTTReporter("tcp://127.0.0.1:1", "audiobait/events", "", "")
+	assert.Nil(t, err)
+	err = broker.ReportEventWithKey([]byte(`{}`), []time.Time{time.Now()}, "key")
+	assert.False(t, api.IsPermanentError(err))
+	return err
+}
+
+func newTestSpool(t *testing.T, events map[string]time.Time, order ...string) *EventSpool {
+	spool := NewEventSpool(NewMemoryStore())
+	for _, details := range order {
+		assert.Nil(t, spool.Add([]byte(details), []time.Time{events[details]}, ""))
+	}
+	return spool
+}
+
+func TestFlushSendsTheSpooledEventsInOrder(t *testing.T) {
+	now := time.Now()
+	spool := newTestSpool(t, map[string]time.Time{`{"a":1}`: now, `{"b":2}`: now}, `{"a":1}`, `{"b":2}`)
+	sender := &spoolSender{}
+
+	result, err := spool.Flush(sender.send, time.Time{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, FlushResult{Sent: 2}, result)
+	assert.Equal(t, []string{`{"a":1}`, `{"b":2}`}, sender.sent)
+	remaining, err := spool.Len()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, remaining)
+}
+
+func TestFlushStopsAtATemporaryFailureAndRetriesWithTheSameKey(t *testing.T) {
+	now := time.Now()
+	spool := newTestSpool(t, map[string]time.Time{`{"a":1}`: now, `{"b":2}`: now, `{"c":3}`: now}, `{"a":1}`, `{"b":2}`, `{"c":3}`)
+	sender := &spoolSender{errs: map[string]error{`{"b":2}`: unreachableError(t)}}
+
+	result, err := spool.Flush(sender.send, time.Time{}, 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, FlushResult{Sent: 1, Remaining: 2}, result)
+	assert.Equal(t, []string{`{"a":1}`}, sender.sent)
+	failedKey := sender.keys[1]
+
+	sender = &spoolSender{}
+	result, err = spool.Flush(sender.send, time.Time{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, FlushResult{Sent: 2}, result)
+	assert.Equal(t, []string{`{"b":2}`, `{"c":3}`}, sender.sent)
+	assert.Equal(t, failedKey, sender.keys[0])
+}
+
+func TestFlushMovesOldAndRejectedEventsToTheDeadLetters(t *testing.T) {
+	now := time.Now()
+	spool := newTestSpool(t, map[string]time.Time{`{"old":1}`: now.Add(-48 * time.Hour), `{"bad":2}`: now, `{"ok":3}`: now},
+		`{"old":1}`, `{"bad":2}`, `{"ok":3}`)
+	sender := &spoolSender{errs: map[string]error{`{"bad":2}`: errors.New("rejected")}}
+
+	result, err := spool.Flush(sender.send, now.Add(-24*time.Hour), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, FlushResult{Sent: 1, Dropped: 2}, result)
+	assert.Equal(t, []string{`{"ok":3}`}, sender.sent)
+
+	dead, err := readEvents(spool.store, deadLetterFilename)
+	assert.Nil(t, err)
+	if assert.Len(t, dead, 2) {
+		assert.Equal(t, `{"old":1}`, string(dead[0].Details))
+		assert.Equal(t, `{"bad":2}`, string(dead[1].Details))
+	}
+}
+
+func TestFlushSendsNoMoreThanTheBatch(t *testing.T) {
+	now := time.Now()
+	spool := newTestSpool(t, map[string]time.Time{`{"a":1}`: now, `{"b":2}`: now}, `{"a":1}`, `{"b":2}`)
+	sender := &spoolSender{}
+
+	result, err := spool.Flush(sender.send, time.Time{}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, FlushResult{Sent: 1, Remaining: 1}, result)
+	assert.Equal(t, []string{`{"a":1}`}, sender.sent)
+}
+
+func TestFlushingWithoutAConnectionSaysSo(t *testing.T) {
+	_, err := (&Downloader{spool: NewEventSpool(NewMemoryStore())}).FlushEvents(time.Time{}, 0)
+	assert.Equal(t, errNotConnected, err)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+const groupInfoFilename = "groupinfo.json"
+
+// LocationConfig is where the device is, for when the server doesn't say.  Only the timezone is used, as
+// nothing played depends on the device's latitude and longitude.
+type LocationConfig struct {
+	// Timezone is the IANA name, e.g. "Pacific/Auckland", of the timezone the device is in.
+	Timezone string `yaml:"timezone"`
+}
+
+// GroupInfo gets the device's group from the server, keeping a copy in the store that is used when the
+// server can't be reached.  It returns false if the group isn't known either way.
+func (dl *Downloader) GroupInfo(ctx context.Context) (api.GroupInfo, bool) {
+	store := dl.stateStore()
+	if dl.api != nil {
+		info, err := dl.api.GetGroupInfo(ctx)
+		if err == nil {
+			if jsonData, err := json.Marshal(info); err == nil {
+				if err := store.Put(groupInfoFilename, jsonData); err != nil {
+					log.Printf("Error saving group info %s", err)
+				}
+			}
+			return info, true
+		}
+		log.Printf("Could not get group info from server: %v", err)
+	}
+
+	jsonData, err := store.Get(groupInfoFilename)
+	if os.IsNotExist(err) {
+		return api.GroupInfo{}, false
+	} else if err != nil {
+		log.Printf("Error loading group info %s", err)
+		return api.GroupInfo{}, false
+	}
+	var info api.GroupInfo
+	if err := json.Unmarshal(jsonData, &info); err != nil {
+		log.Printf("Group info is corrupt and will be fetched again: %s", err)
+		return api.GroupInfo{}, false
+	}
+	return info, true
+}
+
+// Location works out where the device is from its group's details on the server, using the configured
+// location for anything the server doesn't give.
+func (dl *Downloader) Location(ctx context.Context, conf LocationConfig) LocationConfig {
+	location := conf
+	if info, ok := dl.GroupInfo(ctx); ok && info.Timezone != "" {
+		location.Timezone = info.Timezone
+	}
+	return location
+}
+
+// ReportLocation tells the server the device has moved to the given latitude and longitude.
+func (dl *Downloader) ReportLocation(ctx context.Context, lat, lon float64) error {
+	if dl.api == nil {
+		return errors.New("not connected to the server")
+	}
+	return dl.api.ReportLocation(ctx, lat, lon)
+}
+
+// applyLocation puts the schedule in the device's timezone, if the schedule doesn't give its own, so
+// that its combos' windows are worked out in the right timezone.
+func applyLocation(schedule *playlist.Schedule, location LocationConfig) {
+	if schedule.Timezone == "" && location.Timezone != "" {
+		log.Printf("Using timezone %s for the schedule", location.Timezone)
+		schedule.Timezone = location.Timezone
+	}
+}
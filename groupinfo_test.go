@@ -0,0 +1,72 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+// newGroupServer runs a server for the device's group, answering with the given JSON.
+func newGroupServer(t *testing.T, groupJSON string) *api.CacophonyAPI {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/groups/north", r.URL.Path)
+		fmt.Fprint(w, groupJSON)
+	}))
+	t.Cleanup(server.Close)
+	return api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret")
+}
+
+func TestGroupInfoIsKeptForWhenTheServerCantBeReached(t *testing.T) {
+	store := NewMemoryStore()
+	dl := &Downloader{store: store, api: newGroupServer(t, `{"groups": [{"groupname": "north", "timezone": "Pacific/Chatham"}]}`)}
+	info, ok := dl.GroupInfo(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, "Pacific/Chatham", info.Timezone)
+
+	offline := &Downloader{store: store}
+	info, ok = offline.GroupInfo(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, api.GroupInfo{Name: "north", Timezone: "Pacific/Chatham"}, info)
+}
+
+func TestGroupInfoIsUnknownWithoutAServerOrACopy(t *testing.T) {
+	dl := &Downloader{store: NewMemoryStore()}
+	_, ok := dl.GroupInfo(context.Background())
+	assert.False(t, ok)
+
+	assert.Nil(t, dl.store.Put(groupInfoFilename, []byte("{corrupt")))
+	_, ok = dl.GroupInfo(context.Background())
+	assert.False(t, ok)
+}
+
+func TestLocationUsesTheGroupsTimezoneOverTheConfigured(t *testing.T) {
+	configured := LocationConfig{Timezone: "Pacific/Auckland"}
+
+	dl := &Downloader{store: NewMemoryStore(), api: newGroupServer(t, `{"groups": [{"groupname": "north", "timezone": "Pacific/Chatham"}]}`)}
+	assert.Equal(t, LocationConfig{Timezone: "Pacific/Chatham"}, dl.Location(context.Background(), configured))
+
+	dl = &Downloader{store: NewMemoryStore(), api: newGroupServer(t, `{"groups": [{"groupname": "north"}]}`)}
+	assert.Equal(t, configured, dl.Location(context.Background(), configured))
+}
+
+func TestApplyLocationOnlySetsTheTimezoneOfSchedulesWithout(t *testing.T) {
+	location := LocationConfig{Timezone: "Pacific/Auckland"}
+
+	schedule := playlist.Schedule{}
+	applyLocation(&schedule, location)
+	assert.Equal(t, "Pacific/Auckland", schedule.Timezone)
+
+	schedule = playlist.Schedule{Timezone: "UTC"}
+	applyLocation(&schedule, location)
+	assert.Equal(t, "UTC", schedule.Timezone)
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const hashIndexFilename = "hashindex.json"
+
+// HashIndex is a sidecar index of the SHA-256 hashes of files on disk.  A file is only re-hashed
+// when its size or modification time no longer match what was recorded, so checking a large
+// library on flash storage stays cheap.
+type HashIndex struct {
+	store   Store
+	entries map[string]hashIndexEntry
+	changed bool
+}
+
+type hashIndexEntry struct {
+	Size    int64
+	ModTime time.Time
+	Hash    string
+}
+
+// OpenHashIndex loads the hash index kept in the store.  If the index is missing or can't be read
+// an empty index is returned and will be rebuilt as files are hashed.
+func OpenHashIndex(store Store) *HashIndex {
+	index := &HashIndex{store: store, entries: make(map[string]hashIndexEntry)}
+
+	jsonData, err := store.Get(hashIndexFilename)
+	if os.IsNotExist(err) {
+		return index
+	} else if err != nil {
+		log.Printf("Error loading hash index %s", err)
+		return index
+	}
+
+	if err := json.Unmarshal(jsonData, &index.entries); err != nil {
+		log.Printf("Hash index is corrupt and will be rebuilt: %s", err)
+		index.entries = make(map[string]hashIndexEntry)
+		index.changed = true
+	}
+	return index
+}
+
+// Hash returns the hex encoded SHA-256 hash of the file at path, only reading the file if
+// it has changed since it was last hashed.
+func (index *HashIndex) Hash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		index.forget(path)
+		return "", err
+	}
+
+	if entry, exists := index.entries[path]; exists &&
+		entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry.Hash, nil
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		index.forget(path)
+		return "", err
+	}
+	index.entries[path] = hashIndexEntry{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+	index.changed = true
+	return hash, nil
+}
+
+// Save writes the index back to the store if it has changed.
+func (index *HashIndex) Save() error {
+	if !index.changed {
+		return nil
+	}
+	jsonData, err := json.Marshal(index.entries)
+	if err != nil {
+		return err
+	}
+	if err := index.store.Put(hashIndexFilename, jsonData); err != nil {
+		return err
+	}
+	index.changed = false
+	return nil
+}
+
+func (index *HashIndex) forget(path string) {
+	if _, exists := index.entries[path]; exists {
+		delete(index.entries, path)
+		index.changed = true
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
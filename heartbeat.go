@@ -0,0 +1,82 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// startTime is when audiobait started, for reporting its uptime.
+var startTime = time.Now()
+
+// StartHeartbeat reports an audioBaitHeartbeat event every interval until ctx is done, so that a device
+// that is alive but has nothing to play can be told apart from one that has died.  No heartbeats are
+// sent during the given quiet hours.  Heartbeats that can't be sent are dropped rather than spooled, as
+// a late heartbeat says nothing about whether the device is alive now.
+func (dl *Downloader) StartHeartbeat(ctx context.Context, interval time.Duration, quietHours []playlist.TimeWindow) {
+	go func() {
+		for {
+			dl.heartbeat(quietHours, time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// heartbeat sends a heartbeat unless now is during the quiet hours.
+func (dl *Downloader) heartbeat(quietHours []playlist.TimeWindow, now time.Time) {
+	if playlist.IsQuietTime(quietHours, now) {
+		return
+	}
+	if err := dl.sendHeartbeat(); err != nil {
+		log.Printf("Could not send heartbeat: %v", err)
+	}
+}
+
+func (dl *Downloader) sendHeartbeat() error {
+	if dl.api == nil && dl.transport == nil {
+		dl.api = tryToInitiateAPI(dl.apiOpts...)
+		if dl.api == nil {
+			return errors.New("not connected to API")
+		}
+	}
+
+	now := time.Now()
+	details := map[string]interface{}{
+		"version": version,
+		"uptime":  int(now.Sub(startTime).Seconds()),
+	}
+	if info, err := os.Stat(filepath.Join(dl.audioDir, scheduleFilename)); err == nil {
+		details["scheduleAge"] = int(now.Sub(info.ModTime()).Seconds())
+	}
+	if dl.spool != nil {
+		if spooled, err := dl.spool.Len(); err == nil {
+			details["spooledEvents"] = spooled
+		}
+	}
+	addPowerDetails(dl.power, details)
+	jsonDetails, err := json.Marshal(map[string]interface{}{
+		"description": map[string]interface{}{
+			"type":    "audioBaitHeartbeat",
+			"details": details,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return dl.eventReporter().ReportEventWithKey(jsonDetails, []time.Time{now}, api.NewIdempotencyKey())
+}
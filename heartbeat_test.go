@@ -0,0 +1,39 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatsAreNotSentDuringQuietHours(t *testing.T) {
+	transport := &testTransport{}
+	dl := newTestDownloader(transport)
+	quietHours := []playlist.TimeWindow{{From: *playlist.NewTimeOfDay("23:30"), Until: *playlist.NewTimeOfDay("01:30")}}
+
+	dl.heartbeat(quietHours, time.Date(2018, time.April, 1, 0, 30, 0, 0, time.Local))
+	assert.Empty(t, transport.events)
+
+	dl.heartbeat(quietHours, time.Date(2018, time.April, 1, 21, 0, 0, 0, time.Local))
+	assert.Equal(t, []string{"audioBaitHeartbeat"}, eventTypes(transport))
+}
+
+func TestHeartbeatReportsTheDevicesState(t *testing.T) {
+	transport := &testTransport{}
+	dl := newTestDownloader(transport)
+	dl.audioDir = t.TempDir()
+
+	assert.Nil(t, dl.sendHeartbeat())
+	details := transport.events[0]["details"].(map[string]interface{})
+	assert.Equal(t, version, details["version"])
+	assert.Contains(t, details, "uptime")
+	assert.Equal(t, 0.0, details["spooledEvents"])
+	// There is no schedule yet.
+	assert.NotContains(t, details, "scheduleAge")
+}
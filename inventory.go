@@ -0,0 +1,72 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// InventoryEntry is a sound file the device holds, as reported in an audioBaitInventory event.
+type InventoryEntry struct {
+	ID   int    `json:"id"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// Inventory lists the sound files in the downloader's audio library that are on disk, in ID order.
+// Hashes come from its hash index, so only files that have changed since they were last hashed are
+// read.
+func (dl *Downloader) Inventory(ctx context.Context) ([]InventoryEntry, error) {
+	store := dl.stateStore()
+	audioLibrary := OpenLibrary(store)
+	hashIndex := OpenHashIndex(store)
+	defer func() {
+		if err := hashIndex.Save(); err != nil {
+			log.Printf("Failed to save hash index.  Error %s.", err)
+		}
+	}()
+
+	inventory := []InventoryEntry{}
+	for strFileId, filename := range audioLibrary.FilesById {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fileId, err := strconv.Atoi(strFileId)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dl.audioDir, filename)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		hash, err := hashIndex.Hash(path)
+		if err != nil {
+			continue
+		}
+		inventory = append(inventory, InventoryEntry{ID: fileId, File: filename, Size: info.Size(), Hash: hash})
+	}
+	sort.Slice(inventory, func(i, j int) bool { return inventory[i].ID < inventory[j].ID })
+	return inventory, nil
+}
+
+// ReportInventory reports the sound files the device holds, with their hashes, as an audioBaitInventory
+// event, so that devices with stale or corrupt libraries can be found remotely.
+func (dl *Downloader) ReportInventory(ctx context.Context) error {
+	inventory, err := dl.Inventory(ctx)
+	if err != nil {
+		return err
+	}
+	return dl.reportEvent("audioBaitInventory", map[string]interface{}{
+		"files": inventory,
+		"count": len(inventory),
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventoryListsTheFilesOnDiskInIdOrder(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{3: "squeal", 1: "beep", 2: "tweet"})
+	assert.Nil(t, os.Remove(filepath.Join(dl.audioDir, "beep-2.wav")))
+
+	inventory, err := dl.Inventory(context.Background())
+	assert.Nil(t, err)
+	beepHash, _ := hashFile(filepath.Join(dl.audioDir, "beep-1.wav"))
+	squealHash, _ := hashFile(filepath.Join(dl.audioDir, "beep-3.wav"))
+	assert.Equal(t, []InventoryEntry{
+		{ID: 1, File: "beep-1.wav", Size: 4, Hash: beepHash},
+		{ID: 3, File: "beep-3.wav", Size: 6, Hash: squealHash},
+	}, inventory)
+}
+
+func TestInventoryOnlyHashesFilesThatHaveChanged(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep"})
+	path := filepath.Join(dl.audioDir, "beep-1.wav")
+	hashIndex := OpenHashIndex(dl.stateStore())
+	entry := hashIndex.entries[path]
+	entry.Hash = "cached"
+	hashIndex.entries[path] = entry
+	hashIndex.changed = true
+	assert.Nil(t, hashIndex.Save())
+
+	inventory, err := dl.Inventory(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", inventory[0].Hash)
+}
+
+func TestReportInventorySendsAnInventoryEvent(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep"})
+	transport := &testTransport{}
+	dl.transport = transport
+
+	assert.Nil(t, dl.ReportInventory(context.Background()))
+	assert.Len(t, transport.events, 1)
+	assert.Equal(t, "audioBaitInventory", transport.events[0]["type"])
+	details := transport.events[0]["details"].(map[string]interface{})
+	assert.Equal(t, 1.0, details["count"])
+	files := details["files"].([]interface{})
+	assert.Equal(t, "beep-1.wav", files[0].(map[string]interface{})["file"])
+}
+
+func TestInventoryStopsWhenCancelled(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := dl.Inventory(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+const loudnessFilename = "loudness.json"
+
+// LoudnessHints keeps the server's loudness hints for the downloaded audio files in the store, so that
+// they are still applied after a restart when the files aren't downloaded again.
+type LoudnessHints struct {
+	mu    sync.Mutex
+	store Store
+	hints map[string]loudnessHint
+}
+
+type loudnessHint struct {
+	GainDB     float64 `json:"gainDb,omitempty"`
+	TargetLUFS float64 `json:"targetLUFS,omitempty"`
+}
+
+// OpenLoudnessHints loads the hints kept in the store.  Missing or unreadable hints are treated as
+// empty.
+func OpenLoudnessHints(state Store) *LoudnessHints {
+	store := &LoudnessHints{store: state, hints: make(map[string]loudnessHint)}
+
+	jsonData, err := state.Get(loudnessFilename)
+	if os.IsNotExist(err) {
+		return store
+	} else if err != nil {
+		log.Printf("Error loading loudness hints %s", err)
+		return store
+	}
+	if err := json.Unmarshal(jsonData, &store.hints); err != nil {
+		log.Printf("Loudness hints are corrupt and will be rebuilt: %s", err)
+		store.hints = make(map[string]loudnessHint)
+	}
+	return store
+}
+
+// Set records the hints in a file's details from the server and saves them.
+func (store *LoudnessHints) Set(fileId int, details api.FileDetails) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	hint := loudnessHint{GainDB: details.GainDB, TargetLUFS: details.TargetLUFS}
+	key := strconv.Itoa(fileId)
+	if existing, exists := store.hints[key]; exists && existing == hint {
+		return
+	}
+	if hint == (loudnessHint{}) {
+		delete(store.hints, key)
+	} else {
+		store.hints[key] = hint
+	}
+
+	jsonData, err := json.Marshal(store.hints)
+	if err == nil {
+		err = store.store.Put(loudnessFilename, jsonData)
+	}
+	if err != nil {
+		log.Printf("Error saving loudness hints %s", err)
+	}
+}
+
+// All gets the hints for every file that has them, keyed by file ID.
+func (store *LoudnessHints) All() map[int]playlist.LoudnessHint {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	hints := make(map[int]playlist.LoudnessHint, len(store.hints))
+	for key, hint := range store.hints {
+		if fileId, err := strconv.Atoi(key); err == nil {
+			hints[fileId] = playlist.LoudnessHint{GainDB: hint.GainDB, TargetLUFS: hint.TargetLUFS}
+		}
+	}
+	return hints
+}
@@ -5,9 +5,19 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/TheCacophonyProject/audiobait/api"
 	"github.com/TheCacophonyProject/audiobait/playlist"
 	arg "github.com/alexflint/go-arg"
 )
@@ -15,9 +25,30 @@ import (
 // version is populated at link time via goreleaser
 var version = "No version provided"
 
+const (
+	// maxSpooledEventAge is how old a spooled event can be before the server won't accept it.
+	maxSpooledEventAge = 30 * 24 * time.Hour
+	eventFlushBatch    = 100
+)
+
 type argSpec struct {
-	ConfigFile string `arg:"-c,--config" help:"path to configuration file"`
-	Timestamps bool   `arg:"-t,--timestamps" help:"include timestamps in log output"`
+	ConfigFile     string `arg:"-c,--config" help:"path to configuration file"`
+	Timestamps     bool   `arg:"-t,--timestamps" help:"include timestamps in log output"`
+	PrefetchAll    bool   `arg:"--prefetch-all" help:"download every audio file for the device's group, then exit"`
+	CheckIntegrity bool   `arg:"--check-integrity" help:"check the audio files for the saved schedule, print a JSON manifest, then exit"`
+	Plan           string `arg:"--plan" help:"print what the saved schedule will play on a date (YYYY-MM-DD) as JSON, then exit"`
+	ForceRefresh   bool   `arg:"--force-refresh" help:"download the audio files for the saved schedule again, then exit"`
+	CheckAuth      bool   `arg:"--check-auth" help:"check the server accepts the device's credentials, without registering, then exit"`
+	Preflight      bool   `arg:"--preflight" help:"check the credentials, schedule, audio files and sound card, print a JSON report, then exit"`
+	ReportLocation string `arg:"--report-location" help:"tell the server the device has moved to LAT,LON, then exit"`
+	ListDevices    bool   `arg:"--list-devices" help:"print the audio output devices as JSON, then exit"`
+
+	Replay      string  `arg:"--replay" help:"play the saved schedule again as it played on a past date (YYYY-MM-DD), then exit"`
+	ReplaySpeed float64 `arg:"--replay-speed" help:"how many times faster than real time to replay"`
+
+	ExportHistory string `arg:"--export-history" help:"print the local play history from a date (YYYY-MM-DD), then exit"`
+	HistoryUntil  string `arg:"--history-until" help:"the last date (YYYY-MM-DD) to export the play history for, by default the same date"`
+	HistoryFormat string `arg:"--history-format" help:"the format to export the play history in, json or csv"`
 }
 
 func (argSpec) Version() string {
@@ -50,11 +81,60 @@ func runMain() error {
 		return err
 	}
 
-	soundCard := NewSoundCardPlayer(conf.Card, conf.VolumeControl)
 	log.Printf("Audio files directory is %s", conf.AudioDir)
+	if args.PrefetchAll {
+		return prefetchAllSounds(conf)
+	}
+	if args.CheckIntegrity {
+		return checkIntegrity(conf)
+	}
+	if args.Plan != "" {
+		return printPlan(conf, args.Plan)
+	}
+	if args.ForceRefresh {
+		return forceRefresh(conf)
+	}
+	if args.CheckAuth {
+		return checkAuth(conf)
+	}
+	if args.Preflight {
+		return runPreflight(conf)
+	}
+	if args.ReportLocation != "" {
+		return reportLocation(conf, args.ReportLocation)
+	}
+	if args.ListDevices {
+		return printAudioDevices()
+	}
+	if args.Replay != "" {
+		return replayDay(conf, args.Replay, args.ReplaySpeed)
+	}
+	if args.ExportHistory != "" {
+		return exportPlayHistory(conf, args.ExportHistory, args.HistoryUntil, args.HistoryFormat)
+	}
 
+	if err := startHeartbeat(conf); err != nil {
+		return err
+	}
+
+	checkOutputDevices(conf)
+	soundCard := NewSoundCardPlayer(conf.Card, conf.VolumeControl, conf.VolumeCalibration)
+	soundCard.mono = conf.Mono
+	if ambient := conf.Ambient.NewAmbientLoop(soundCard); ambient != nil {
+		soundCard.ambient = ambient
+		ambient.Start()
+	}
+
+	// The signals are listened for the whole time audiobait runs, not just while it plays, so that one
+	// sent while downloading or waiting for the next day doesn't kill it, and a pause lasts into the
+	// next day.
+	pause := playlist.NewPauseSwitch(newEventRecorder(conf))
+	pauseOnSignals(pause)
+
+	boot := true
 	for {
-		err = DownloadAndPlaySounds(conf.AudioDir, soundCard)
+		err = DownloadAndPlaySounds(conf, soundCard, pause, boot)
+		boot = false
 		if err != nil {
 			// Wait until tomorrow.
 			log.Printf("Error playing sounds: %v", err)
@@ -63,25 +143,560 @@ func runMain() error {
 	}
 }
 
-func DownloadAndPlaySounds(audioDir string, soundCard playlist.AudioDevice) error {
-	downloader, err := NewDownloader(audioDir)
+// apiOptions gets the options for connecting to the API from the configuration.
+func apiOptions(conf *AudioConfig) []api.Option {
+	apiOpts := []api.Option{api.WithEventDefaults(conf.EventDefaultDetails())}
+	if conf.EventsDisabled {
+		apiOpts = append(apiOpts, api.WithEventsDisabled())
+	}
+	if conf.MaxFileBytes > 0 {
+		apiOpts = append(apiOpts, api.WithMaxFileBytes(conf.MaxFileBytes))
+	}
+	if len(conf.PinnedCerts) > 0 {
+		apiOpts = append(apiOpts, api.WithPinnedCertSHA256(conf.PinnedCerts...))
+	}
+	if len(conf.Tags) > 0 {
+		apiOpts = append(apiOpts, api.WithTags(conf.Tags...))
+	}
+	if conf.EventSigningKey != "" {
+		apiOpts = append(apiOpts, api.WithEventSigning([]byte(conf.EventSigningKey)))
+	}
+	if conf.SignedURLHeader {
+		apiOpts = append(apiOpts, api.WithSignedURLAuthHeader())
+	}
+	for _, path := range conf.EventFiles {
+		apiOpts = append(apiOpts, api.WithEventReporters(NewEventFile(NewFileStore(filepath.Dir(path)), filepath.Base(path))))
+	}
+	if conf.LogRequests {
+		apiOpts = append(apiOpts, api.WithRequestLogging(log.New(log.Writer(), "api: ", log.Flags())))
+	}
+	// The config has already been checked, so the timeouts can be parsed.
+	if dial, tlsHandshake, responseHeader, err := conf.TransportTimeouts.Durations(); err == nil {
+		apiOpts = append(apiOpts, api.WithTransportTimeouts(dial, tlsHandshake, responseHeader))
+	}
+	return apiOpts
+}
+
+// mqttReporter creates the reporter for publishing events over MQTT, or returns nil if it isn't configured.
+func mqttReporter(conf *AudioConfig) (*api.MQTTReporter, error) {
+	if conf.MQTT.Broker == "" {
+		return nil, nil
+	}
+	return api.NewMQTTReporter(conf.MQTT.Broker, conf.MQTT.Topic, conf.MQTT.Username, conf.MQTT.Password, apiOptions(conf)...)
+}
+
+// startHeartbeat starts reporting heartbeats in the background, if they are configured.
+func startHeartbeat(conf *AudioConfig) error {
+	interval, err := conf.HeartbeatInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	var quietHours []playlist.TimeWindow
+	if conf.Heartbeat.SkipQuietHours {
+		if quietHours, err = conf.QuietHourWindows(); err != nil {
+			return err
+		}
+	}
+	downloader, err := NewDownloader(conf.AudioDir, apiOptions(conf)...)
+	if err != nil {
+		return err
+	}
+	mqtt, err := mqttReporter(conf)
+	if err != nil {
+		return err
+	} else if mqtt != nil {
+		downloader.SetEventTransport(mqtt)
+	}
+	downloader.SetPowerSource(conf.PowerSource())
+	downloader.StartHeartbeat(context.Background(), interval, quietHours)
+	return nil
+}
+
+// newDayDownloader creates the downloader for the day.  When audiobait has just started it gives the
+// network time to come up, trying to reach the server while it is unreachable until it can be or the
+// boot connect timeout has passed, and the downloader uses the connection that opens.
+func newDayDownloader(conf *AudioConfig, boot bool) (*Downloader, error) {
+	timeout, err := conf.BootConnectTimeoutDuration()
+	if !boot || err != nil || timeout == 0 {
+		return NewDownloader(conf.AudioDir, apiOptions(conf)...)
+	}
+	return newDownloaderWithOpener(conf.AudioDir, NewFileStore(conf.AudioDir), waitForServer(timeout), apiOptions(conf)...)
+}
+
+// waitForServer opens the API as tryToInitiateAPI does, trying again while the server is unreachable
+// until timeout has passed.
+func waitForServer(timeout time.Duration) func(opts ...api.Option) *api.CacophonyAPI {
+	return func(opts ...api.Option) *api.CacophonyAPI {
+		log.Println("Connecting with API")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cacophonyAPI, err := api.OpenAtBoot(ctx, apiConfigFile, api.BootBackoff, opts...)
+		if err != nil {
+			log.Printf("Carrying on without waiting for the server: %v", err)
+		}
+		return cacophonyAPI
+	}
+}
+
+// DownloadAndPlaySounds downloads the day's schedule and its sounds and plays them, paused while pause
+// is.
+func DownloadAndPlaySounds(conf *AudioConfig, soundCard playlist.AudioDevice, pause *playlist.PauseSwitch, boot bool) error {
+	audioDir := conf.AudioDir
+	downloader, err := newDayDownloader(conf, boot)
 	if err != nil {
 		return err
 	}
+	refreshCtx, stopRefreshing := context.WithCancel(context.Background())
+	defer stopRefreshing()
+	downloader.StartTokenRefresher(refreshCtx)
+	mqtt, err := mqttReporter(conf)
+	if err != nil {
+		return err
+	} else if mqtt != nil {
+		defer mqtt.Close()
+		downloader.SetEventTransport(mqtt)
+	}
+	flushSpooledEvents(downloader)
+	downloader.SetSyncEvents(conf.SyncEvents)
+	downloader.SetPowerSource(conf.PowerSource())
+	if removed, err := CleanupTempFiles(audioDir); err != nil {
+		log.Printf("Could not clean up temporary files: %v", err)
+	} else if removed > 0 {
+		log.Printf("Deleted %d temporary files left by interrupted downloads", removed)
+	}
 
 	schedule := downloader.GetTodaysSchedule()
-	if len(schedule.Combos) == 0 {
+	applyLocation(&schedule, downloader.Location(context.Background(), conf.Location))
+	zoneSchedules, err := conf.ZoneSchedules(schedule)
+	if err != nil {
+		return err
+	}
+	if len(schedule.Combos) == 0 && !hasSoundsToPlay(zoneSchedules) {
 		return errors.New("No audio schedule for device, or no sounds to play in schedule.")
 	}
 
-	files, err := downloader.GetFilesForSchedule(schedule)
+	policy, err := ParseDownloadPolicy(conf.DownloadPolicy)
 	if err != nil {
 		return err
 	}
+	downloader.SetDownloadPolicy(policy)
+	downloader.SetOriginalFileNames(conf.OriginalFileNames)
+	downloader.SetContentHashNames(conf.ContentHashNames)
+	downloader.SetTranscoding(conf.Transcode)
+	cacheTTL, err := conf.CacheTTLDuration()
+	if err != nil {
+		return err
+	}
+	downloader.SetCacheTTL(cacheTTL)
+
+	if conf.SyncFiles.Enabled {
+		syncDayFiles(context.Background(), downloader, schedule, zoneSchedules, conf.Stream, conf.SyncFiles.Prune)
+	}
+	files, err := getDayFiles(context.Background(), downloader, schedule, zoneSchedules, conf.Stream)
+	if _, partial := err.(*DownloadError); partial && policy == BestEffort && len(files) > 0 {
+		log.Printf("Playing with the audio files available: %v", err)
+	} else if err != nil {
+		return err
+	}
+	if conf.ContentHashNames {
+		if pruned, err := downloader.PruneStaleVersions(); err != nil {
+			log.Printf("Could not delete old versions of audio files: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Deleted %d old versions of audio files", pruned)
+		}
+	}
+	if err == nil {
+		if err := downloader.AckSchedule(context.Background()); err != nil {
+			log.Printf("Could not acknowledge schedule: %v", err)
+		}
+	}
+	if conf.ReportInventory {
+		if err := downloader.ReportInventory(context.Background()); err != nil {
+			log.Printf("Could not report sound inventory: %v", err)
+		}
+	}
 
 	log.Printf("Playing todays audiobait schedule...")
 	player := playlist.NewPlayer(soundCard, files, audioDir)
-	player.SetRecorder(AudioBaitEventRecorder{})
+	recorder := newEventRecorder(conf)
+	if mqtt != nil {
+		recorder.Transport = downloader
+	}
+	pause.SetRecorder(recorder)
+	player.SetRecorder(recorder)
+	player.SetPauseSwitch(pause)
+	player.SetSequenceStore(SequenceFile{store: downloader.stateStore()})
+	if err := configurePlayer(conf, downloader, player, CooldownFile{store: downloader.stateStore()}); err != nil {
+		return err
+	}
+	if boot && conf.BootSound.Enabled {
+		playBootSound(player, recorder, conf.BootSound)
+	}
+	// The watcher has its own connection so polling doesn't race with the player's downloader.
+	var updates <-chan playlist.Schedule
+	if watcher, err := NewDownloader(audioDir, apiOptions(conf)...); err != nil {
+		log.Printf("Not watching for the schedule being muted: %v", err)
+	} else {
+		watcher.SetAdaptivePolling(conf.AdaptivePolling)
+		watcher.SetPollJitter(conf.PollJitter, watcher.deviceName())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		updates = watchMuted(ctx, watcher, schedule)
+	}
+	if len(zoneSchedules) > 0 {
+		var ambient *AmbientLoop
+		if card, ok := soundCard.(SoundCardPlayer); ok {
+			ambient = card.ambient
+		}
+		zones := playlist.NewMultiPlayer(conf.ZoneDevices(ambient), files, audioDir)
+		zones.SetRecorder(recorder)
+		zones.Settings().SetPauseSwitch(pause)
+		zones.Settings().SetScheduleUpdates(updates)
+		if err := configurePlayer(conf, downloader, zones.Settings(), CooldownFile{store: downloader.stateStore()}); err != nil {
+			return err
+		}
+		return zones.PlayTodaysSchedules(zoneSchedules)
+	}
+	player.SetScheduleUpdates(updates)
 	player.PlayTodaysSchedule(schedule)
 	return nil
 }
+
+// getDayFiles gets the audio files for the day's schedule, or for its zones' schedules if it has zones.
+// The sounds that are only streamed aren't downloaded, and are given names that just show which sound
+// is playing.
+func getDayFiles(ctx context.Context, downloader *Downloader, schedule playlist.Schedule, zoneSchedules []playlist.ZoneSchedule, streamAll bool) (map[int]string, error) {
+	if len(zoneSchedules) > 0 {
+		downloaded, streamed := splitStreamedZoneCombos(zoneSchedules, streamAll)
+		files, err := downloader.GetFilesForSchedules(ctx, downloaded)
+		return addStreamedFiles(files, streamed), err
+	}
+	downloaded, streamed := splitStreamedCombos(schedule, streamAll)
+	files, err := downloader.GetFilesForSchedule(ctx, downloaded)
+	return addStreamedFiles(files, streamed), err
+}
+
+// syncDayFiles checks the files for the day's schedule, or its zones' schedules, against the server as
+// SyncFiles does, before getDayFiles gets them.  The sounds that are only streamed aren't synced, and
+// are deleted if prune is set.  The files are still played if they can't be synced.
+func syncDayFiles(ctx context.Context, downloader *Downloader, schedule playlist.Schedule, zoneSchedules []playlist.ZoneSchedule, streamAll, prune bool) {
+	var report *SyncReport
+	var err error
+	if len(zoneSchedules) > 0 {
+		downloaded, _ := splitStreamedZoneCombos(zoneSchedules, streamAll)
+		report, err = downloader.SyncFilesForSchedules(ctx, downloaded, prune)
+	} else {
+		downloaded, _ := splitStreamedCombos(schedule, streamAll)
+		report, err = downloader.SyncFiles(ctx, downloaded, prune)
+	}
+	if err != nil {
+		log.Printf("Could not sync audio files: %v", err)
+		return
+	}
+	log.Printf("Synced audio files: %d downloaded, %d replaced, %d unchanged, %d deleted, %d failed",
+		len(report.Downloaded), len(report.Replaced), len(report.Unchanged), len(report.Pruned), len(report.Failed))
+}
+
+// configurePlayer sets the player up from the configuration.  It is used wherever a day is played,
+// whether today's or a replayed one, and for a MultiPlayer's settings, so that each plays by the same
+// rules.  The recorder, and the sequence store of a player that has one, are left to the caller.  When
+// each sound last played is kept in cooldowns, which can be nil to not keep it.
+func configurePlayer(conf *AudioConfig, downloader *Downloader, player *playlist.SchedulePlayer, cooldowns playlist.CooldownStore) error {
+	quietHours, err := conf.QuietHourWindows()
+	if err != nil {
+		return err
+	}
+	player.SetQuietHours(quietHours)
+	preRoll, err := conf.PreRollDuration()
+	if err != nil {
+		return err
+	}
+	player.SetPreRoll(preRoll)
+	player.SetLoudnessHints(downloader.LoudnessHints())
+	cooldown, err := conf.SoundCooldownDuration()
+	if err != nil {
+		return err
+	}
+	player.SetSoundCooldown(cooldown)
+	player.SetCooldownStore(cooldowns)
+	player.SetSoundStreamer(downloaderStreamer{dl: downloader}, conf.Stream)
+	player.SetPlayLimit(conf.PlayLimit.NewPlayLimit())
+	return setPlayHooks(player, conf.PlayHooks)
+}
+
+// newEventRecorder creates the recorder that reports what the player does as events.
+func newEventRecorder(conf *AudioConfig) AudioBaitEventRecorder {
+	return AudioBaitEventRecorder{
+		Disabled: conf.EventsDisabled,
+		Defaults: conf.EventDefaultDetails(),
+		Power:    conf.PowerSource(),
+		History:  conf.PlayHistory.NewPlayHistory(),
+	}
+}
+
+// prefetchAllSounds downloads all of the group's audio files, for provisioning a new device.
+func prefetchAllSounds(conf *AudioConfig) error {
+	downloader, err := NewDownloader(conf.AudioDir, apiOptions(conf)...)
+	if err != nil {
+		return err
+	}
+	downloader.SetOriginalFileNames(conf.OriginalFileNames)
+	downloader.SetContentHashNames(conf.ContentHashNames)
+	downloader.SetTranscoding(conf.Transcode)
+	files, err := downloader.GetAllGroupSounds(context.Background())
+	log.Printf("%d audio files available", len(files))
+	if throughput := downloader.DownloadThroughput(); throughput > 0 {
+		log.Printf("Recent download throughput %.0f bytes/s", throughput)
+	}
+	return err
+}
+
+// forceRefresh downloads the saved schedule's audio files again, for when they may be corrupt.
+func forceRefresh(conf *AudioConfig) error {
+	downloader, err := NewDownloader(conf.AudioDir, apiOptions(conf)...)
+	if err != nil {
+		return err
+	}
+	downloader.SetOriginalFileNames(conf.OriginalFileNames)
+	downloader.SetContentHashNames(conf.ContentHashNames)
+	downloader.SetTranscoding(conf.Transcode)
+	schedule, err := downloader.loadScheduleFromDisk()
+	if err != nil {
+		return err
+	}
+	files, err := downloader.ForceRefresh(context.Background(), schedule)
+	log.Printf("%d audio files available", len(files))
+	return err
+}
+
+// checkAuth checks the configured device credentials against the server, changing nothing.
+func checkAuth(conf *AudioConfig) error {
+	cacophonyAPI, err := api.OpenUnauthenticated(apiConfigFile, apiOptions(conf)...)
+	if err != nil {
+		return err
+	}
+	if err := cacophonyAPI.VerifyCredentials(context.Background()); err != nil {
+		if api.IsPermanentError(err) {
+			return fmt.Errorf("credentials rejected: %v", err)
+		}
+		return fmt.Errorf("could not check credentials: %v", err)
+	}
+	log.Println("Credentials OK")
+	return nil
+}
+
+// reportLocation tells the server where the device has moved to, given as "LAT,LON".
+func reportLocation(conf *AudioConfig, latLon string) error {
+	parts := strings.Split(latLon, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid location %q, expected LAT,LON", latLon)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return fmt.Errorf("invalid latitude: %v", err)
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return fmt.Errorf("invalid longitude: %v", err)
+	}
+	downloader, err := NewDownloader(conf.AudioDir, apiOptions(conf)...)
+	if err != nil {
+		return err
+	}
+	if err := downloader.ReportLocation(context.Background(), lat, lon); err != nil {
+		return err
+	}
+	log.Printf("Reported the device is at %v, %v", lat, lon)
+	return nil
+}
+
+// runPreflight runs the startup checks and prints the report as JSON, returning an error if any failed.
+func runPreflight(conf *AudioConfig) error {
+	soundCard := NewSoundCardPlayer(conf.Card, conf.VolumeControl, conf.VolumeCalibration)
+	report, checkErr := NewPreflightChecker(soundCard, apiOptions(conf)...).Preflight(context.Background(), conf.AudioDir)
+	jsonData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonData))
+	return checkErr
+}
+
+// checkIntegrity prints the manifest of the saved schedule's audio files as JSON, returning an error if
+// any of them aren't OK.
+func checkIntegrity(conf *AudioConfig) error {
+	downloader := &Downloader{audioDir: conf.AudioDir}
+	schedule, err := downloader.loadScheduleFromDisk()
+	if err != nil {
+		return err
+	}
+	manifest, err := downloader.Manifest(schedule)
+	if err != nil {
+		return err
+	}
+	jsonData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(jsonData))
+
+	for _, entry := range manifest {
+		if entry.Status != ManifestOK {
+			return errors.New("audio library has problems")
+		}
+	}
+	return nil
+}
+
+// printPlan prints the saved schedule's plan for a date as JSON.
+func printPlan(conf *AudioConfig, date string) error {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid plan date: %v", err)
+	}
+	downloader := &Downloader{audioDir: conf.AudioDir}
+	downloader.loudness = OpenLoudnessHints(downloader.stateStore())
+	schedule, err := downloader.loadScheduleFromDisk()
+	if err != nil {
+		return err
+	}
+	applyLocation(&schedule, downloader.Location(context.Background(), conf.Location))
+	// The plan is made by a player set up the same as the day's, so that it plays by the same rules.
+	player := playlist.NewPlayer(nil, nil, conf.AudioDir)
+	if err := configurePlayer(conf, downloader, player, nil); err != nil {
+		return err
+	}
+	planJSON, err := json.MarshalIndent(player.Plan(schedule, day, time.Local), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(planJSON))
+	return nil
+}
+
+// exportPlayHistory prints the play history for the dates from fromDate to untilDate, inclusive, as a
+// JSON array or as CSV.
+func exportPlayHistory(conf *AudioConfig, fromDate, untilDate, format string) error {
+	history := conf.PlayHistory.NewPlayHistory()
+	if history == nil {
+		return errors.New("no play-history file is configured")
+	}
+	from, err := time.ParseInLocation("2006-01-02", fromDate, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid history date: %v", err)
+	}
+	until := from
+	if untilDate != "" {
+		if until, err = time.ParseInLocation("2006-01-02", untilDate, time.Local); err != nil {
+			return fmt.Errorf("invalid history until date: %v", err)
+		}
+	}
+	entries, err := history.Export(from, until.AddDate(0, 0, 1))
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "", "json":
+		if entries == nil {
+			entries = []PlayHistoryEntry{}
+		}
+		historyJSON, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(historyJSON))
+		return nil
+	case "csv":
+		return WritePlayHistoryCSV(os.Stdout, entries)
+	}
+	return fmt.Errorf("unknown history format %q", format)
+}
+
+// replayDay plays the saved schedule's audiobait day starting on a past date again, with the sounds
+// already downloaded.  The events reported are tagged as a replay so they can be told apart from what
+// really played.
+func replayDay(conf *AudioConfig, date string, speed float64) error {
+	day, err := time.ParseInLocation("2006-01-02", date, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid replay date: %v", err)
+	}
+	// The downloader only connects to the server if a sound is streamed.
+	downloader := &Downloader{audioDir: conf.AudioDir, apiOpts: apiOptions(conf)}
+	downloader.loudness = OpenLoudnessHints(downloader.stateStore())
+	schedule, err := downloader.loadScheduleFromDisk()
+	if err != nil {
+		return err
+	}
+	applyLocation(&schedule, downloader.Location(context.Background(), conf.Location))
+	zoneSchedules, err := conf.ZoneSchedules(schedule)
+	if err != nil {
+		return err
+	}
+	zonesForDay := make([]playlist.ZoneSchedule, len(zoneSchedules))
+	for i, zoneSchedule := range zoneSchedules {
+		zonesForDay[i] = playlist.ZoneSchedule{Zone: zoneSchedule.Zone, Schedule: zoneSchedule.Schedule.ForDate(day)}
+	}
+	files, err := getDayFiles(context.Background(), downloader, schedule.ForDate(day), zonesForDay, conf.Stream)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Replaying the audiobait day starting on %s", date)
+	eventDefaults := conf.EventDefaultDetails()
+	eventDefaults["replay"] = true
+	eventDefaults["replayDate"] = date
+	recorder := AudioBaitEventRecorder{Disabled: conf.EventsDisabled, Defaults: eventDefaults, Power: conf.PowerSource()}
+	// The replay doesn't keep when sounds played, so that it doesn't put them on cooldown for real.
+	if len(zoneSchedules) > 0 {
+		zones := playlist.NewReplayMultiPlayer(conf.ZoneDevices(nil), files, conf.AudioDir, day, time.Local, speed)
+		zones.SetRecorder(recorder)
+		if err := configurePlayer(conf, downloader, zones.Settings(), nil); err != nil {
+			return err
+		}
+		return zones.PlayTodaysSchedules(zoneSchedules)
+	}
+	soundCard := NewSoundCardPlayer(conf.Card, conf.VolumeControl, conf.VolumeCalibration)
+	soundCard.mono = conf.Mono
+	player := playlist.NewReplayPlayer(soundCard, files, conf.AudioDir, day, time.Local, speed)
+	player.SetRecorder(recorder)
+	if err := configurePlayer(conf, downloader, player, nil); err != nil {
+		return err
+	}
+	player.PlayTodaysSchedule(schedule)
+	return nil
+}
+
+// notConnectedLogged stops a device that never connects logging that it can't send its spooled events
+// every day.
+var notConnectedLogged sync.Once
+
+// flushSpooledEvents sends the events that couldn't be reported earlier, dropping those the server
+// would consider too old.
+func flushSpooledEvents(downloader *Downloader) {
+	result, err := downloader.FlushEvents(time.Now().Add(-maxSpooledEventAge), eventFlushBatch)
+	if result.Sent > 0 || result.Dropped > 0 {
+		log.Printf("Sent %d spooled events, dropped %d, %d remaining", result.Sent, result.Dropped, result.Remaining)
+	}
+	if err == errNotConnected {
+		notConnectedLogged.Do(func() { log.Printf("Could not send spooled events: %v", err) })
+	} else if err != nil {
+		log.Printf("Could not send spooled events: %v", err)
+	}
+}
+
+// playBootSound plays the startup sound and reports that the device has booted.
+func playBootSound(player *playlist.SchedulePlayer, recorder AudioBaitEventRecorder, bootSound BootSoundConfig) {
+	now := time.Now()
+	played, err := player.PlayStartupSound(bootSound.FileId, bootSound.Volume)
+	details := map[string]interface{}{
+		"version": version,
+		"played":  played,
+	}
+	if err != nil {
+		log.Printf("Could not play startup sound: %v", err)
+		details["error"] = err.Error()
+	}
+	if err := recorder.queueEvent(now, "audioBaitBoot", details); err != nil {
+		log.Printf("Could not log audiobait boot: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// Statuses of the files in a sound library manifest.
+const (
+	// ManifestOK means the file is on disk and matches what was recorded when it was downloaded.
+	ManifestOK = "ok"
+	// ManifestNotDownloaded means the file isn't in the audio library.
+	ManifestNotDownloaded = "notDownloaded"
+	// ManifestMissing means the file is in the audio library but not on disk.
+	ManifestMissing = "missing"
+	// ManifestCorrupt means the file on disk no longer matches what was recorded.
+	ManifestCorrupt = "corrupt"
+	// ManifestUnrecorded means the file is on disk but its size and hash were never recorded.
+	ManifestUnrecorded = "unrecorded"
+)
+
+// ManifestEntry describes one of the sounds a schedule uses and the state of its file on disk.  The
+// expected size and hash are those recorded in the hash index when the file was first checked after
+// being downloaded.  A file compressed after it was downloaded also has the size and hash of the original.
+type ManifestEntry struct {
+	ID           int    `json:"id"`
+	File         string `json:"file,omitempty"`
+	ExpectedSize int64  `json:"expectedSize,omitempty"`
+	ExpectedHash string `json:"expectedHash,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	OriginalFile string `json:"originalFile,omitempty"`
+	OriginalSize int64  `json:"originalSize,omitempty"`
+	OriginalHash string `json:"originalHash,omitempty"`
+	Status       string `json:"status"`
+}
+
+// Manifest lists the sounds the schedule uses and the state of each in the audio directory.
+func (dl *Downloader) Manifest(schedule playlist.Schedule) ([]ManifestEntry, error) {
+	return dl.buildManifest(schedule)
+}
+
+// CheckIntegrity does a full check of the downloader's sound library, re-reading every file the
+// schedule uses, and returns the entries for the files that aren't OK.
+func (dl *Downloader) CheckIntegrity(schedule playlist.Schedule) ([]ManifestEntry, error) {
+	manifest, err := dl.buildManifest(schedule)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []ManifestEntry
+	for _, entry := range manifest {
+		if entry.Status != ManifestOK {
+			mismatches = append(mismatches, entry)
+		}
+	}
+	return mismatches, nil
+}
+
+// buildManifest hashes each of the schedule's files in full, ignoring the cached hashes, and compares
+// them with what the hash index recorded.
+func (dl *Downloader) buildManifest(schedule playlist.Schedule) ([]ManifestEntry, error) {
+	store := dl.stateStore()
+	audioLibrary := OpenLibrary(store)
+	hashIndex := OpenHashIndex(store)
+	transcoded := OpenTranscodedFiles(store)
+
+	var manifest []ManifestEntry
+	for _, fileId := range schedule.GetReferencedSounds() {
+		entry := ManifestEntry{ID: fileId}
+		filename, exists := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId))
+		if !exists {
+			entry.Status = ManifestNotDownloaded
+			manifest = append(manifest, entry)
+			continue
+		}
+		entry.File = filename
+		if original, exists := transcoded.Get(fileId); exists && original.Stored == filename {
+			entry.OriginalFile = original.Original
+			entry.OriginalSize = original.OriginalSize
+			entry.OriginalHash = original.OriginalHash
+		}
+		path := filepath.Join(dl.audioDir, filename)
+		recorded, hasRecord := hashIndex.entries[path]
+		entry.ExpectedSize = recorded.Size
+		entry.ExpectedHash = recorded.Hash
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			entry.Status = ManifestMissing
+			manifest = append(manifest, entry)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Size = info.Size()
+		entry.Hash = hash
+
+		switch {
+		case !hasRecord:
+			entry.Status = ManifestUnrecorded
+		case entry.Size != recorded.Size || entry.Hash != recorded.Hash:
+			entry.Status = ManifestCorrupt
+		default:
+			entry.Status = ManifestOK
+		}
+		manifest = append(manifest, entry)
+	}
+	return manifest, nil
+}
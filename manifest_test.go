@@ -0,0 +1,63 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newLibraryDownloader creates a downloader whose audio library has each of the files, saved with their
+// contents, and their hashes recorded as they are after a download.
+func newLibraryDownloader(t *testing.T, files map[int]string) *Downloader {
+	dl := &Downloader{audioDir: t.TempDir()}
+	audioLibrary := OpenLibrary(dl.stateStore())
+	var fileIds []int
+	for fileId, contents := range files {
+		filename := fmt.Sprintf("beep-%d.wav", fileId)
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dl.audioDir, filename), []byte(contents), 0644))
+		assert.Nil(t, audioLibrary.AddFile(strconv.Itoa(fileId), filename))
+		fileIds = append(fileIds, fileId)
+	}
+	dl.VerifyLocalSounds(fileIds)
+	return dl
+}
+
+func TestCheckIntegrityFindsCorruptAndMissingFiles(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep", 2: "tweet", 3: "squeal"})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dl.audioDir, "beep-2.wav"), []byte("tw??t"), 0644))
+	assert.Nil(t, os.Remove(filepath.Join(dl.audioDir, "beep-3.wav")))
+
+	mismatches, err := dl.CheckIntegrity(scheduleOf("1", "2", "3", "4"))
+	assert.Nil(t, err)
+	statuses := make(map[int]string)
+	for _, entry := range mismatches {
+		statuses[entry.ID] = entry.Status
+	}
+	assert.Equal(t, map[int]string{2: ManifestCorrupt, 3: ManifestMissing, 4: ManifestNotDownloaded}, statuses)
+}
+
+func TestCheckIntegrityIsEmptyForAnUndamagedLibrary(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep", 2: "tweet"})
+
+	mismatches, err := dl.CheckIntegrity(scheduleOf("1", "2"))
+	assert.Nil(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestPreflightFailsCorruptFiles(t *testing.T) {
+	dl := newLibraryDownloader(t, map[int]string{1: "beep"})
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dl.audioDir, "beep-1.wav"), []byte("b??p"), 0644))
+
+	check := (&PreflightChecker{}).CheckFiles(dl.audioDir, scheduleOf("1"))
+	assert.Equal(t, failedCheck(PreflightFiles,
+		"1 of 1 files have problems, run --force-refresh to download them again: 1 (corrupt)"), check)
+}
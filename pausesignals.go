@@ -0,0 +1,44 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// pausable is something, such as a playlist.PauseSwitch, that pauses and resumes players while they play.
+type pausable interface {
+	Pause()
+	Resume()
+}
+
+// pauseOnSignals pauses the player when audiobait is sent SIGUSR1 and resumes it on SIGUSR2, so that
+// playback can be stopped for maintenance without losing audiobait's place.  The returned function
+// stops listening for the signals.
+func pauseOnSignals(player pausable) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGUSR1 {
+					player.Pause()
+				} else {
+					player.Resume()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// What happened to each sound in the play history.
+const (
+	PlayOutcomePlayed  = "played"
+	PlayOutcomeFailed  = "failed"
+	PlayOutcomeSkipped = "skipped"
+)
+
+const (
+	defaultPlayHistoryMaxBytes = 1 << 20
+	defaultPlayHistoryKeep     = 5
+)
+
+// PlayHistoryEntry is a sound that was due to play, as kept in the play history.  The history file has
+// one entry per line as a JSON object with these fields.  The format is stable: fields may be added but
+// existing ones won't be changed or removed.
+type PlayHistoryEntry struct {
+	// Time is when the sound was due to start, in RFC 3339 format.
+	Time   time.Time `json:"time"`
+	FileId int       `json:"fileId"`
+	Volume int       `json:"volume"`
+	// Duration is how long playing took in seconds, or 0 if the sound was skipped.
+	Duration float64 `json:"duration"`
+	// Outcome is one of the PlayOutcome... values.
+	Outcome string `json:"outcome"`
+	// Reason is why the sound was skipped or failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// playHistoryCSVHeader is the first line of an exported CSV history, naming the columns in the order
+// they are written.
+var playHistoryCSVHeader = []string{"time", "fileId", "volume", "duration", "outcome", "reason"}
+
+// PlayHistory keeps a record of every sound that was due to play in a local file, so it can be
+// retrieved from the device when the server can't be reached.  When the file grows past its size
+// limit it is rotated, keeping a number of older files named by adding .1, .2 and so on, .1 being the
+// newest.
+type PlayHistory struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+}
+
+// NewPlayHistory creates a history kept in the file at path, which is rotated once it is bigger than
+// maxBytes, keeping keep older files.
+func NewPlayHistory(path string, maxBytes int64, keep int) *PlayHistory {
+	return &PlayHistory{path: path, maxBytes: maxBytes, keep: keep}
+}
+
+// Record adds an entry to the end of the history, rotating the file first if the entry would take it
+// over its size limit.
+func (history *PlayHistory) Record(entry PlayHistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	if info, err := os.Stat(history.path); err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > history.maxBytes {
+		if err := history.rotate(); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(history.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (history *PlayHistory) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", history.path, n)
+}
+
+// rotate moves each file along one, dropping the oldest.
+func (history *PlayHistory) rotate() error {
+	if history.keep <= 0 {
+		return os.Remove(history.path)
+	}
+	if err := os.Remove(history.rotatedPath(history.keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := history.keep - 1; n >= 1; n-- {
+		if err := os.Rename(history.rotatedPath(n), history.rotatedPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(history.path, history.rotatedPath(1))
+}
+
+// Export gets the entries from from until until, oldest first, from the current file and the rotated
+// ones.  Lines that can't be read are left out.
+func (history *PlayHistory) Export(from, until time.Time) ([]PlayHistoryEntry, error) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	paths := []string{history.path}
+	for n := 1; n <= history.keep; n++ {
+		paths = append([]string{history.rotatedPath(n)}, paths...)
+	}
+	var entries []PlayHistoryEntry
+	for _, path := range paths {
+		fileEntries, err := readPlayHistory(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range fileEntries {
+			if !entry.Time.Before(from) && entry.Time.Before(until) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+func readPlayHistory(path string) ([]PlayHistoryEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []PlayHistoryEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry PlayHistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping unreadable play history line in %s: %v", path, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// WritePlayHistoryCSV writes entries as CSV, with a header line naming the columns.  Times are in
+// RFC 3339 format and durations in seconds, as in the history file.
+func WritePlayHistoryCSV(w io.Writer, entries []PlayHistoryEntry) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(playHistoryCSVHeader); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		record := []string{
+			entry.Time.Format(time.RFC3339Nano),
+			strconv.Itoa(entry.FileId),
+			strconv.Itoa(entry.Volume),
+			strconv.FormatFloat(entry.Duration, 'f', -1, 64),
+			entry.Outcome,
+			entry.Reason,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// recordPlayFinished adds a sound that played, or failed to, to the history.
+func (history *PlayHistory) recordPlayFinished(play playlist.PlayInfo) {
+	entry := PlayHistoryEntry{
+		Time:     play.Time,
+		FileId:   play.FileId,
+		Volume:   play.Volume,
+		Duration: play.Duration.Seconds(),
+		Outcome:  PlayOutcomePlayed,
+	}
+	if play.Err != nil {
+		entry.Outcome = PlayOutcomeFailed
+		entry.Reason = play.Err.Error()
+	}
+	if err := history.Record(entry); err != nil {
+		log.Printf("Could not add to play history: %v", err)
+	}
+}
+
+// recordPlaySkipped adds a sound that was due to play but didn't to the history.
+func (history *PlayHistory) recordPlaySkipped(skip playlist.SkippedPlay) {
+	entry := PlayHistoryEntry{
+		Time:    skip.Time,
+		FileId:  skip.FileId,
+		Volume:  skip.Volume,
+		Outcome: PlayOutcomeSkipped,
+		Reason:  skip.Reason,
+	}
+	if err := history.Record(entry); err != nil {
+		log.Printf("Could not add to play history: %v", err)
+	}
+}
+
+// PlayHistoryConfig sets a local file to keep a record of every sound that was due to play in.
+type PlayHistoryConfig struct {
+	// File is where the history is kept.  No history is kept if it isn't set.
+	File string `yaml:"file"`
+	// MaxBytes is how big the file can grow before it is rotated.  It is 1MB if it isn't set.
+	MaxBytes int64 `yaml:"max-bytes"`
+	// Keep is how many rotated files are kept.  It is 5 if it isn't set.
+	Keep int `yaml:"keep"`
+}
+
+// Validate checks the limits aren't negative.
+func (conf PlayHistoryConfig) Validate() error {
+	if conf.MaxBytes < 0 {
+		return fmt.Errorf("play-history max-bytes must not be negative")
+	}
+	if conf.Keep < 0 {
+		return fmt.Errorf("play-history keep must not be negative")
+	}
+	return nil
+}
+
+// NewPlayHistory creates the configured history, or nil if there isn't one.
+func (conf PlayHistoryConfig) NewPlayHistory() *PlayHistory {
+	if conf.File == "" {
+		return nil
+	}
+	maxBytes := conf.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultPlayHistoryMaxBytes
+	}
+	keep := conf.Keep
+	if keep == 0 {
+		keep = defaultPlayHistoryKeep
+	}
+	return NewPlayHistory(conf.File, maxBytes, keep)
+}
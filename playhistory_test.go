@@ -0,0 +1,103 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+var historyStart = time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC)
+
+func TestPlayHistoryFileFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history := NewPlayHistory(path, defaultPlayHistoryMaxBytes, defaultPlayHistoryKeep)
+
+	history.recordPlayFinished(playlist.PlayInfo{FileId: 3, Volume: 7, Time: historyStart, Duration: 1500 * time.Millisecond})
+	history.recordPlayFinished(playlist.PlayInfo{FileId: 4, Volume: 5, Time: historyStart.Add(time.Minute), Duration: time.Second,
+		Err: errors.New("card busy")})
+	history.recordPlaySkipped(playlist.SkippedPlay{FileId: 3, Volume: 7, Time: historyStart.Add(2 * time.Minute), Reason: "quietHours"})
+
+	contents, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"time":"2018-04-01T21:00:00Z","fileId":3,"volume":7,"duration":1.5,"outcome":"played"}
+{"time":"2018-04-01T21:01:00Z","fileId":4,"volume":5,"duration":1,"outcome":"failed","reason":"card busy"}
+{"time":"2018-04-01T21:02:00Z","fileId":3,"volume":7,"duration":0,"outcome":"skipped","reason":"quietHours"}
+`, string(contents))
+}
+
+func TestPlayHistoryCSVFormat(t *testing.T) {
+	var out bytes.Buffer
+	err := WritePlayHistoryCSV(&out, []PlayHistoryEntry{
+		{Time: historyStart, FileId: 3, Volume: 7, Duration: 1.5, Outcome: PlayOutcomePlayed},
+		{Time: historyStart.Add(time.Minute), FileId: 4, Volume: 5, Outcome: PlayOutcomeSkipped, Reason: "paused, again"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `time,fileId,volume,duration,outcome,reason
+2018-04-01T21:00:00Z,3,7,1.5,played,
+2018-04-01T21:01:00Z,4,5,0,skipped,"paused, again"
+`, out.String())
+}
+
+// recordPlays adds a played entry to the history for each minute from the start of the history.
+func recordPlays(t *testing.T, history *PlayHistory, count int) {
+	for i := 0; i < count; i++ {
+		assert.Nil(t, history.Record(PlayHistoryEntry{Time: historyStart.Add(time.Duration(i) * time.Minute), FileId: i, Outcome: PlayOutcomePlayed}))
+	}
+}
+
+func exportedFileIds(t *testing.T, history *PlayHistory, from, until time.Time) []int {
+	entries, err := history.Export(from, until)
+	assert.Nil(t, err)
+	var fileIds []int
+	for _, entry := range entries {
+		fileIds = append(fileIds, entry.FileId)
+	}
+	return fileIds
+}
+
+func TestPlayHistoryRotatesAndDropsTheOldestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	line := `{"time":"2018-04-01T21:00:00Z","fileId":0,"volume":0,"duration":0,"outcome":"played"}` + "\n"
+	// Each file holds two entries.
+	history := NewPlayHistory(path, int64(2*len(line)), 2)
+
+	recordPlays(t, history, 7)
+
+	for n, fileIds := range map[string][]int{"": {6}, ".1": {4, 5}, ".2": {2, 3}, ".3": nil} {
+		entries, err := readPlayHistory(path + n)
+		assert.Nil(t, err)
+		var got []int
+		for _, entry := range entries {
+			got = append(got, entry.FileId)
+		}
+		assert.Equal(t, fileIds, got, fmt.Sprintf("history%s", n))
+	}
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, exportedFileIds(t, history, historyStart, historyStart.Add(time.Hour)))
+}
+
+func TestPlayHistoryExportsADateRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history := NewPlayHistory(path, defaultPlayHistoryMaxBytes, defaultPlayHistoryKeep)
+	recordPlays(t, history, 5)
+
+	assert.Equal(t, []int{1, 2}, exportedFileIds(t, history, historyStart.Add(time.Minute), historyStart.Add(3*time.Minute)))
+}
+
+func TestPlayHistoryWithoutRotatedFilesStartsAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history := NewPlayHistory(path, 100, 0)
+	recordPlays(t, history, 3)
+
+	assert.Equal(t, []int{2}, exportedFileIds(t, history, historyStart, historyStart.Add(time.Hour)))
+}
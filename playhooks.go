@@ -0,0 +1,96 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// playHookWaitDelay is how long a hook command's output is waited for after it has been stopped.
+const playHookWaitDelay = 500 * time.Millisecond
+
+// PlayHooksConfig sets shell commands to run around each sound that is played, such as to switch an
+// amplifier on and off.  The commands are given the sound's details in AUDIOBAIT_ environment variables.
+type PlayHooksConfig struct {
+	// Before is run before each sound.  If it fails the sound isn't played.
+	Before string `yaml:"before"`
+	// After is run after each sound.
+	After string `yaml:"after"`
+	// Timeout is how long a command may run before it is stopped, e.g. "10s".
+	Timeout string `yaml:"timeout"`
+}
+
+// TimeoutDuration gets how long a hook command may run, or zero for the player's default.  Negative
+// timeouts are rejected.
+func (conf PlayHooksConfig) TimeoutDuration() (time.Duration, error) {
+	if conf.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid play-hooks timeout: %v", err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("play-hooks timeout %v is negative", timeout)
+	}
+	return timeout, nil
+}
+
+// setPlayHooks sets the player to run the configured commands.
+func setPlayHooks(player *playlist.SchedulePlayer, conf PlayHooksConfig) error {
+	timeout, err := conf.TimeoutDuration()
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		timeout = playlist.DefaultHookTimeout
+	}
+	// Give the command time to be stopped before the player stops waiting for it.
+	player.SetHookTimeout(timeout + 2*playHookWaitDelay)
+	if conf.Before != "" {
+		player.OnBeforePlay(func(play playlist.PlayInfo) error {
+			return runPlayHook(conf.Before, play, timeout)
+		})
+	}
+	if conf.After != "" {
+		player.OnAfterPlay(func(play playlist.PlayInfo) {
+			if err := runPlayHook(conf.After, play, timeout); err != nil {
+				log.Printf("After play hook failed: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// runPlayHook runs a hook command, stopping it if it takes longer than timeout.
+func runPlayHook(command string, play playlist.PlayInfo, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	// Stopping the shell doesn't stop the commands it started, which can keep its output open, so don't
+	// wait long for them once it has been stopped.
+	cmd.WaitDelay = playHookWaitDelay
+	cmd.Env = append(os.Environ(),
+		"AUDIOBAIT_FILE_ID="+strconv.Itoa(play.FileId),
+		"AUDIOBAIT_VOLUME="+strconv.Itoa(play.Volume),
+		"AUDIOBAIT_TIME="+play.Time.Format(time.RFC3339),
+		"AUDIOBAIT_DURATION="+formatSeconds(play.Duration),
+	)
+	if play.Err != nil {
+		cmd.Env = append(cmd.Env, "AUDIOBAIT_ERROR="+play.Err.Error())
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("hook %q failed: %v\noutput:\n%s", command, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlayHookTimeoutsAreParsed(t *testing.T) {
+	timeout, err := PlayHooksConfig{}.TimeoutDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	timeout, err = PlayHooksConfig{Timeout: "10s"}.TimeoutDuration()
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Second, timeout)
+
+	_, err = PlayHooksConfig{Timeout: "soon"}.TimeoutDuration()
+	assert.NotNil(t, err)
+	_, err = PlayHooksConfig{Timeout: "-5s"}.TimeoutDuration()
+	assert.EqualError(t, err, "play-hooks timeout -5s is negative")
+	assert.NotNil(t, setPlayHooks(&playlist.SchedulePlayer{}, PlayHooksConfig{Timeout: "-5s"}))
+}
+
+func TestPlayHooksAreGivenTheSoundsDetails(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hook.txt")
+	play := playlist.PlayInfo{
+		FileId:   3,
+		Volume:   7,
+		Time:     time.Date(2018, time.April, 1, 21, 0, 0, 0, time.UTC),
+		Duration: 1500 * time.Millisecond,
+		Err:      errors.New("card busy"),
+	}
+
+	command := `echo "$AUDIOBAIT_FILE_ID $AUDIOBAIT_VOLUME $AUDIOBAIT_TIME $AUDIOBAIT_DURATION $AUDIOBAIT_ERROR" > ` + out
+	assert.Nil(t, runPlayHook(command, play, time.Minute))
+	contents, _ := ioutil.ReadFile(out)
+	assert.Equal(t, "3 7 2018-04-01T21:00:00Z 1.500 card busy\n", string(contents))
+}
+
+func TestFailingPlayHooksReportTheirOutput(t *testing.T) {
+	err := runPlayHook("echo no amplifier; exit 1", playlist.PlayInfo{}, time.Minute)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no amplifier")
+}
+
+func TestSlowPlayHooksAreStopped(t *testing.T) {
+	start := time.Now()
+	assert.NotNil(t, runPlayHook("sleep 10", playlist.PlayInfo{}, 50*time.Millisecond))
+	assert.True(t, time.Since(start) < 5*time.Second, "took %v", time.Since(start))
+}
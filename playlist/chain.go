@@ -0,0 +1,41 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"time"
+)
+
+// maxComboChain is the most follow-up combos played one after another, so that combos which chain
+// into each other in a loop don't play for ever.
+const maxComboChain = 8
+
+// playChain plays a burst of the combo that combo chains into with Next straight after combo has
+// completed, and so on along the chain.  The chain stops at a combo whose window isn't active, or after
+// maxComboChain combos.  If the clock jumps it stops and returns how far.
+func (sp SchedulePlayer) playChain(combo Combo, combos []Combo) time.Duration {
+	for depth := 0; combo.Next != nil; depth++ {
+		next := *combo.Next
+		if depth == maxComboChain {
+			log.Printf("Not playing follow-up combo %d, the chain is longer than %d combos", next, maxComboChain)
+			return 0
+		}
+		if next < 0 || next >= len(combos) {
+			log.Printf("Follow-up combo %d doesn't exist", next)
+			return 0
+		}
+		combo = combos[next]
+		if !sp.createWindow(combo).Active() {
+			log.Printf("Not playing follow-up combo %d as it is outside its window", next)
+			return 0
+		}
+		log.Printf("Playing follow-up combo %d", next)
+		if jump := sp.playSounds(combo, sp.newSoundChooser()); jump != 0 {
+			return jump
+		}
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComboChainsIntoNextCombo(t *testing.T) {
+	distress := createCombo("19:00", "19:10", 60, "beep")
+	distress.Sounds = []string{"3"}
+	feeding := createCombo("19:00", "20:00", 24*60, "tweet")
+	feeding.Sounds = []string{"4"}
+	feeding.Waits = []int{30}
+	next := 1
+	distress.Next = &next
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	schedulePlayer.playTodaysCombos([]Combo{distress, feeding})
+
+	assert.Equal(t, []string{
+		registerPlaySound("19:00:00", "beep"),
+		registerPlaySound("19:10:30", "tweet"),
+	}, testRecorder.PlayTimes)
+}
+
+func TestComboChainStopsOutsideNextComboWindow(t *testing.T) {
+	distress := createCombo("19:00", "19:10", 60, "beep")
+	distress.Sounds = []string{"3"}
+	feeding := createCombo("21:00", "22:00", 24*60, "tweet")
+	feeding.Sounds = []string{"4"}
+	next := 1
+	distress.Next = &next
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	schedulePlayer.playTodaysCombos([]Combo{distress, feeding})
+
+	assert.Equal(t, []string{
+		registerPlaySound("19:00:00", "beep"),
+		registerPlaySound("21:00:00", "tweet"),
+	}, testRecorder.PlayTimes)
+}
+
+func TestComboChainLoopIsBounded(t *testing.T) {
+	first := createCombo("19:00", "20:00", 24*60, "beep")
+	first.Sounds = []string{"3"}
+	second := first
+	zero, one := 0, 1
+	first.Next, second.Next = &one, &zero
+
+	schedulePlayer, testRecorder := createPlayer("19:30")
+	schedulePlayer.playChain(first, []Combo{first, second})
+
+	assert.Len(t, testRecorder.PlayTimes, maxComboChain)
+}
+
+func TestValidateChecksNextCombo(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "beep")
+	next := 1
+	combo.Next = &next
+	schedule := Schedule{Combos: []Combo{combo}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{"combo 0 has next combo 1, which doesn't exist"}, err.(*ValidationError).Problems)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"time"
+)
+
+// clockJumpThreshold is how far the clock can be from where a wait should have left it before the
+// player treats it as having jumped, such as when NTP first sets the clock of a device that booted
+// with the wrong time.  Waits can overrun a little on a busy device, so smaller differences are ignored.
+const clockJumpThreshold = 2 * time.Minute
+
+// wait waits for the duration and returns how far the clock jumped while it was waiting, or zero if
+// it didn't.  The clock's times must not carry monotonic clock readings, as ActualClock's don't, or the
+// jump is never seen.
+func (sp SchedulePlayer) wait(duration time.Duration) time.Duration {
+	expected := sp.time.Now().Add(duration)
+	sp.time.Wait(duration)
+	jump := sp.time.Now().Sub(expected)
+	if jump > clockJumpThreshold || jump < -clockJumpThreshold {
+		log.Printf("Clock jumped by %v", jump)
+		return jump
+	}
+	return 0
+}
+
+// recoverFromClockJump gets the player ready to carry on after the clock jumped.  After a jump forward
+// the sounds that were skipped over are missed, rather than all being played at once, as the player
+// carries on from the combo playing now.  After a jump back it waits until the clock gets back to where
+// it was, so that sounds already played aren't played again.
+func (sp SchedulePlayer) recoverFromClockJump(jump time.Duration) {
+	if jump < 0 {
+		log.Printf("Waiting %v for the clock to catch up", -jump)
+		sp.time.Wait(-jump)
+	} else {
+		log.Println("Carrying on from the current time")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockJumpForwardMidNightCarriesOnFromNow(t *testing.T) {
+	combos := []Combo{
+		createCombo("19:00", "20:00", 30, "beep"),
+		createCombo("21:00", "22:00", 30, "beep"),
+		createCombo("02:00", "04:00", 30, "beep"),
+	}
+	for i := range combos {
+		combos[i].Sounds = []string{"3"}
+	}
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	testRecorder.JumpAt = NewTimeOfDay("20:00").Time
+	testRecorder.JumpBy = 6 * time.Hour
+	schedulePlayer.playTodaysCombos(combos)
+
+	// The sounds skipped over at 21:00 and 21:30 aren't played when the clock jumps past them.
+	assert.Equal(t, []string{
+		registerPlaySound("19:00:00", "beep"),
+		registerPlaySound("19:30:00", "beep"),
+		registerPlaySound("02:00:00", "beep"),
+		registerPlaySound("02:30:00", "beep"),
+		registerPlaySound("03:00:00", "beep"),
+		registerPlaySound("03:30:00", "beep"),
+	}, testRecorder.PlayTimes)
+}
+
+func TestClockJumpBackDoesNotPlaySoundsAgain(t *testing.T) {
+	combos := []Combo{
+		createCombo("19:00", "20:00", 30, "beep"),
+		createCombo("21:00", "22:00", 30, "beep"),
+	}
+	for i := range combos {
+		combos[i].Sounds = []string{"3"}
+	}
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	testRecorder.JumpAt = NewTimeOfDay("20:00").Time
+	testRecorder.JumpBy = -time.Hour
+	schedulePlayer.playTodaysCombos(combos)
+
+	assert.Equal(t, []string{
+		registerPlaySound("19:00:00", "beep"),
+		registerPlaySound("19:30:00", "beep"),
+		registerPlaySound("21:00:00", "beep"),
+		registerPlaySound("21:30:00", "beep"),
+	}, testRecorder.PlayTimes)
+}
+
+// settingClock is the actual clock, except that the time is set forward by jumpBy during each wait
+// instead of waiting, as NTP would set it.
+type settingClock struct {
+	ActualClock
+	offset time.Duration
+	jumpBy time.Duration
+}
+
+func (c *settingClock) Now() time.Time {
+	return c.ActualClock.Now().Add(c.offset)
+}
+
+func (c *settingClock) Wait(duration time.Duration) {
+	c.offset += duration + c.jumpBy
+}
+
+func TestActualClockTimesSeeTheClockBeingSet(t *testing.T) {
+	now := new(ActualClock).Now()
+	assert.Equal(t, now.Round(0), now, "has no monotonic clock reading")
+
+	clock := &settingClock{jumpBy: time.Hour}
+	schedulePlayer := SchedulePlayer{time: clock}
+	assert.InDelta(t, float64(time.Hour), float64(schedulePlayer.wait(time.Minute)), float64(time.Second))
+
+	clock.jumpBy = 0
+	assert.Equal(t, time.Duration(0), schedulePlayer.wait(time.Minute))
+}
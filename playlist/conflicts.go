@@ -0,0 +1,289 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Conflict policies, which say what plays when the windows of two or more combos overlap.
+const (
+	// ConflictSequential, the default, plays the combo whose window starts first to the end of its
+	// window and then carries on with the next combo for what is left of its window.
+	ConflictSequential = ""
+	// ConflictPriority plays the combo that comes first in the schedule wherever windows overlap.
+	// The other combos only play outside of its window.
+	ConflictPriority = "priority"
+	// ConflictInterleave takes turns between the overlapping combos, giving each of them one burst
+	// at a time.
+	ConflictInterleave = "interleave"
+	// ConflictMerge plays the sounds of all of the overlapping combos in each burst, one combo after
+	// another, as often as the most frequent of them.
+	ConflictMerge = "merge"
+	// ConflictOneWins plays only the combo that comes first in the schedule.  Any combo that overlaps
+	// a combo before it doesn't play at all.
+	ConflictOneWins = "oneWins"
+)
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case ConflictSequential, ConflictPriority, ConflictInterleave, ConflictMerge, ConflictOneWins:
+		return true
+	}
+	return false
+}
+
+// warningDay is the audiobait day used to check whether combos overlap when warning about it.
+var warningDay = time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// Warnings lists things about the schedule that don't stop it being played but may not be what was
+// meant, such as combos whose windows overlap.
+func (schedule *Schedule) Warnings() []string {
+	var warnings []string
+	windows := schedule.comboWindows(schedule.Combos, warningDay)
+	for i := range windows {
+		for j := i + 1; j < len(windows); j++ {
+			if windows[i].overlaps(windows[j]) {
+				policy := schedule.ConflictPolicy
+				if policy == ConflictSequential {
+					policy = "sequential"
+				}
+				warnings = append(warnings, fmt.Sprintf("combos %d and %d overlap and will be played by the %s conflict policy", i, j, policy))
+			}
+		}
+	}
+	return warnings
+}
+
+// absoluteWindow is when a combo plays on a particular day.
+type absoluteWindow struct {
+	from  time.Time
+	until time.Time
+}
+
+func (win absoluteWindow) overlaps(other absoluteWindow) bool {
+	return win.from.Before(other.until) && other.from.Before(win.until)
+}
+
+func (schedule Schedule) comboWindows(combos []Combo, dayStart time.Time) []absoluteWindow {
+	windows := make([]absoluteWindow, len(combos))
+	for i, combo := range combos {
+		windows[i].from, windows[i].until = schedule.comboWindow(combo, dayStart)
+	}
+	return windows
+}
+
+// playingCombos gets the combos the player plays today for the given combos, once the schedule's
+// conflict policy has been applied to those that overlap.  The combos are returned as they are if
+// none overlap or the policy is sequential, which the player does itself.
+func (sp SchedulePlayer) playingCombos(combos []Combo) []Combo {
+	schedule := Schedule{Combos: combos, Timezone: sp.timezone, ConflictPolicy: sp.conflictPolicy}
+	return schedule.resolveConflicts(sp.dayStart())
+}
+
+// playsCombo checks whether combo is one of the combos the player would play today for the schedule.
+func (sp SchedulePlayer) playsCombo(schedule Schedule, combo Combo) bool {
+	schedule.Combos = schedule.resolveConflicts(sp.dayStart())
+	return schedule.indexOfCombo(combo) >= 0
+}
+
+// dayStart works out when the audiobait day being played started.
+func (sp SchedulePlayer) dayStart() time.Time {
+	return sp.nextDayStart().Add(-24 * time.Hour)
+}
+
+// resolveConflicts applies the conflict policy to the schedule's combos on the audiobait day starting
+// at dayStart, returning combos whose windows don't overlap.  Combos are cut into pieces when only part
+// of them plays, and each keeps its Next, which is still an index into the schedule's combos.
+func (schedule Schedule) resolveConflicts(dayStart time.Time) []Combo {
+	combos := schedule.Combos
+	if schedule.ConflictPolicy == ConflictSequential || !validConflictPolicy(schedule.ConflictPolicy) {
+		return combos
+	}
+	windows := schedule.comboWindows(combos, dayStart)
+	if !anyOverlap(windows) {
+		return combos
+	}
+
+	if schedule.ConflictPolicy == ConflictOneWins {
+		var winners []Combo
+		var won []absoluteWindow
+		for i, combo := range combos {
+			if overlapsAny(windows[i], won) {
+				log.Printf("Not playing combo %d as it overlaps a combo before it", i)
+				continue
+			}
+			winners = append(winners, combo)
+			won = append(won, windows[i])
+		}
+		return winners
+	}
+
+	var pieces []comboPiece
+	// addPiece adds a piece of the combo with the given index, carrying on with the last piece if
+	// it is the same combo, so that its bursts keep to the same times.
+	addPiece := func(index int, from, until time.Time) {
+		if last := len(pieces) - 1; last >= 0 && pieces[last].index == index && pieces[last].until.Equal(from) {
+			pieces[last].until = until
+			return
+		}
+		pieces = append(pieces, comboPiece{absoluteWindow{from, until}, index, combos[index]})
+	}
+	for _, segment := range overlapSegments(windows) {
+		from, until := segment.from, segment.until
+		switch {
+		case len(segment.active) == 1 || schedule.ConflictPolicy == ConflictPriority:
+			addPiece(segment.active[0], from, until)
+		case schedule.ConflictPolicy == ConflictMerge:
+			pieces = append(pieces, comboPiece{segment.absoluteWindow, -1, mergeCombos(combos, segment.active)})
+		case schedule.ConflictPolicy == ConflictInterleave:
+			for turn := 0; from.Before(until); turn++ {
+				index := segment.active[turn%len(segment.active)]
+				end := from.Add(comboTurn(combos[index]))
+				if end.After(until) {
+					end = until
+				}
+				addPiece(index, from, end)
+				from = end
+			}
+		}
+	}
+
+	resolved := make([]Combo, len(pieces))
+	for i, piece := range pieces {
+		resolved[i] = schedule.cutCombo(piece.combo, piece.absoluteWindow, dayStart)
+	}
+	return resolved
+}
+
+// comboPiece is part of the day given to a combo, or to combos merged together, when resolving conflicts.
+type comboPiece struct {
+	absoluteWindow
+	// index is the index of the combo in the schedule, or -1 for merged combos.
+	index int
+	combo Combo
+}
+
+func anyOverlap(windows []absoluteWindow) bool {
+	for i := range windows {
+		if overlapsAny(windows[i], windows[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func overlapsAny(win absoluteWindow, others []absoluteWindow) bool {
+	for _, other := range others {
+		if win.overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapSegment is a stretch of the day during which the same combos' windows are open.
+type overlapSegment struct {
+	absoluteWindow
+	// active lists the indexes of the combos whose windows are open, in schedule order.
+	active []int
+}
+
+// overlapSegments splits the day at the start and end of every window, joining up neighbouring
+// stretches where the same combos are open.  The stretches when no combo is open are left out.
+func overlapSegments(windows []absoluteWindow) []overlapSegment {
+	var times []time.Time
+	for _, win := range windows {
+		times = append(times, win.from, win.until)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	var segments []overlapSegment
+	for i := 0; i+1 < len(times); i++ {
+		from, until := times[i], times[i+1]
+		if !from.Before(until) {
+			continue
+		}
+		var active []int
+		for index, win := range windows {
+			if !win.from.After(from) && win.until.After(from) {
+				active = append(active, index)
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		if last := len(segments) - 1; last >= 0 && segments[last].until.Equal(from) && sameIndexes(segments[last].active, active) {
+			segments[last].until = until
+			continue
+		}
+		segments = append(segments, overlapSegment{absoluteWindow{from, until}, active})
+	}
+	return segments
+}
+
+func sameIndexes(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cutCombo makes a copy of combo that plays only during win on the day starting at dayStart.  The combo
+// itself is returned if win is its whole window.
+func (schedule Schedule) cutCombo(combo Combo, win absoluteWindow, dayStart time.Time) Combo {
+	comboFrom, comboUntil := schedule.comboWindow(combo, dayStart)
+	if win.from.Equal(comboFrom) && win.until.Equal(comboUntil) {
+		return combo
+	}
+	// The times of day are in the timezone the combo's window is worked out in.
+	loc := comboFrom.Location()
+	combo.From = timeOfDayAt(win.from.In(loc))
+	combo.Until = timeOfDayAt(win.until.In(loc))
+	combo.FromMin, combo.UntilMin = nil, nil
+	return combo
+}
+
+func timeOfDayAt(t time.Time) TimeOfDay {
+	return TimeOfDay{Time: time.Date(0, time.January, 1, t.Hour(), t.Minute(), t.Second(), 0, time.UTC)}
+}
+
+// mergeCombos makes a combo that plays the sounds of each of the combos in turn in every burst.  It
+// plays as often as the most frequent of them, and otherwise is like the first of them.
+func mergeCombos(combos []Combo, indexes []int) Combo {
+	merged := combos[indexes[0]]
+	merged.Sounds, merged.Waits, merged.Volumes = nil, nil, nil
+	for _, index := range indexes {
+		combo := combos[index]
+		merged.Sounds = append(merged.Sounds, combo.Sounds...)
+		merged.Waits = append(merged.Waits, combo.Waits...)
+		merged.Volumes = append(merged.Volumes, combo.Volumes...)
+		if combo.Every > 0 && (merged.Every <= 0 || combo.Every < merged.Every) {
+			merged.Every = combo.Every
+		}
+	}
+	return merged
+}
+
+// minComboTurn is the shortest turn a combo gets when interleaving, so that a combo that plays very
+// often doesn't cut the day into tiny pieces.
+const minComboTurn = time.Minute
+
+// comboTurn gets how long a combo's turn lasts when interleaving, which is long enough for one burst.
+func comboTurn(combo Combo) time.Duration {
+	turn := time.Duration(combo.Every) * time.Second
+	if turn < minComboTurn {
+		return minComboTurn
+	}
+	return turn
+}
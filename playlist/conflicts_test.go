@@ -0,0 +1,100 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// overlappingCombos are a combo of beeps and one of tweets whose windows overlap from 19:30 until 20:00.
+func overlappingCombos(beepEvery int) (Combo, Combo) {
+	beeps := createCombo("19:00", "20:00", beepEvery, "beep")
+	beeps.Sounds = []string{"3"}
+	tweets := createCombo("19:30", "20:30", 10, "tweet")
+	tweets.Sounds = []string{"4"}
+	return beeps, tweets
+}
+
+func playWithConflictPolicy(policy string, combos ...Combo) []string {
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	schedulePlayer.conflictPolicy = policy
+	schedulePlayer.playTodaysCombos(combos)
+	return testRecorder.PlayTimes
+}
+
+func TestOverlappingCombosPlaySequentiallyByDefault(t *testing.T) {
+	beeps, tweets := overlappingCombos(30)
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:30:00: Playing beep",
+		"20:00:00: Playing tweet",
+		"20:10:00: Playing tweet",
+		"20:20:00: Playing tweet",
+	}, playWithConflictPolicy(ConflictSequential, beeps, tweets))
+}
+
+func TestOverlappingCombosWithPriority(t *testing.T) {
+	beeps, tweets := overlappingCombos(30)
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:30:00: Playing tweet",
+		"19:40:00: Playing tweet",
+		"19:50:00: Playing tweet",
+		"20:00:00: Playing tweet",
+		"20:10:00: Playing tweet",
+		"20:20:00: Playing tweet",
+	}, playWithConflictPolicy(ConflictPriority, tweets, beeps))
+}
+
+func TestOverlappingCombosInterleave(t *testing.T) {
+	beeps, tweets := overlappingCombos(10)
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:10:00: Playing beep",
+		"19:20:00: Playing beep",
+		"19:30:00: Playing beep",
+		"19:40:00: Playing tweet",
+		"19:50:00: Playing beep",
+		"20:00:00: Playing tweet",
+		"20:10:00: Playing tweet",
+		"20:20:00: Playing tweet",
+	}, playWithConflictPolicy(ConflictInterleave, beeps, tweets))
+}
+
+func TestOverlappingCombosMerge(t *testing.T) {
+	beeps, tweets := overlappingCombos(30)
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:30:00: Playing beep",
+		"19:30:00: Playing tweet",
+		"19:40:00: Playing beep",
+		"19:40:00: Playing tweet",
+		"19:50:00: Playing beep",
+		"19:50:00: Playing tweet",
+		"20:00:00: Playing tweet",
+		"20:10:00: Playing tweet",
+		"20:20:00: Playing tweet",
+	}, playWithConflictPolicy(ConflictMerge, beeps, tweets))
+}
+
+func TestOverlappingCombosOneWins(t *testing.T) {
+	beeps, tweets := overlappingCombos(30)
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:30:00: Playing beep",
+	}, playWithConflictPolicy(ConflictOneWins, beeps, tweets))
+}
+
+func TestOverlappingCombosAreWarnedAbout(t *testing.T) {
+	beeps, tweets := overlappingCombos(30)
+	schedule := Schedule{Combos: []Combo{beeps, tweets}, ConflictPolicy: ConflictMerge}
+	assert.Equal(t, []string{"combos 0 and 1 overlap and will be played by the merge conflict policy"}, schedule.Warnings())
+
+	tweets = createCombo("20:00", "20:30", 10, "tweet")
+	schedule.Combos = []Combo{beeps, tweets}
+	assert.Empty(t, schedule.Warnings())
+}
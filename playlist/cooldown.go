@@ -0,0 +1,169 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// SkippedCooldown is the reason given when a sound is not played because its cooldown since it last
+// played hasn't finished.
+const SkippedCooldown = "cooldown"
+
+// coolingDown is put in place of a chosen sound that is on cooldown, so that it isn't played.
+const coolingDown = -1
+
+// CooldownStore saves when each sound last played so that their cooldowns carry on after a restart.
+type CooldownStore interface {
+	LoadLastPlayed() (map[int]time.Time, error)
+	SaveLastPlayed(lastPlayed map[int]time.Time) error
+}
+
+// cooldownState is how long each sound is on cooldown for after it plays.  It is shared by pointer between
+// copies of the player.
+type cooldownState struct {
+	mu sync.Mutex
+	// defaultCooldown is used for sounds the schedule doesn't give a cooldown for.
+	defaultCooldown time.Duration
+	cooldown        time.Duration
+	cooldowns       map[int]time.Duration
+	history         *playedHistory
+}
+
+// playedHistory tracks when each sound last played.  The zones of a MultiPlayer each have their own
+// cooldowns, from their own schedules, but share one history, so a sound played on one zone is on
+// cooldown on all of them.
+type playedHistory struct {
+	mu         sync.Mutex
+	lastPlayed map[int]time.Time
+	store      CooldownStore
+}
+
+func newCooldownState() *cooldownState {
+	return &cooldownState{history: &playedHistory{}}
+}
+
+// SetSoundCooldown sets how long after a sound plays before it can be played again, for schedules
+// that don't set their own cooldowns.
+func (sp *SchedulePlayer) SetSoundCooldown(cooldown time.Duration) {
+	sp.cooldown.mu.Lock()
+	defer sp.cooldown.mu.Unlock()
+	sp.cooldown.defaultCooldown = cooldown
+}
+
+// SetCooldownStore sets where the times the sounds last played are saved, so that after a restart
+// they stay on cooldown.
+func (sp *SchedulePlayer) SetCooldownStore(store CooldownStore) {
+	sp.cooldown.history.setStore(store)
+}
+
+// setStore sets where the last played times are saved and restores the saved times.
+func (state *playedHistory) setStore(store CooldownStore) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.store = store
+	if store == nil {
+		return
+	}
+	lastPlayed, err := store.LoadLastPlayed()
+	if err != nil {
+		log.Printf("Could not load when sounds last played, no sounds are on cooldown: %v", err)
+		return
+	}
+	state.lastPlayed = lastPlayed
+}
+
+// setSchedule uses the cooldowns from the schedule being played.
+func (state *cooldownState) setSchedule(schedule Schedule) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.cooldown = time.Duration(schedule.Cooldown) * time.Second
+	state.cooldowns = make(map[int]time.Duration, len(schedule.Cooldowns))
+	for fileId, seconds := range schedule.Cooldowns {
+		state.cooldowns[fileId] = time.Duration(seconds) * time.Second
+	}
+}
+
+// cooldownFor gets the sound's cooldown, from the schedule if it has one or else the player's.
+func (state *cooldownState) cooldownFor(fileId int) time.Duration {
+	if cooldown, ok := state.cooldowns[fileId]; ok {
+		return cooldown
+	}
+	if state.cooldown > 0 {
+		return state.cooldown
+	}
+	return state.defaultCooldown
+}
+
+// onCooldown checks whether the sound played too recently to be played at now.
+func (state *cooldownState) onCooldown(fileId int, now time.Time) bool {
+	last, ok := state.history.last(fileId)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return ok && now.Sub(last) < state.cooldownFor(fileId)
+}
+
+// played records that a sound played.
+func (state *cooldownState) played(fileId int, at time.Time) {
+	state.history.played(fileId, at)
+}
+
+// last gets when the sound last played, if it has.
+func (state *playedHistory) last(fileId int) (time.Time, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	last, ok := state.lastPlayed[fileId]
+	return last, ok
+}
+
+// played records that a sound played, saving the times to the store if there is one.
+func (state *playedHistory) played(fileId int, at time.Time) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.lastPlayed == nil {
+		state.lastPlayed = make(map[int]time.Time)
+	}
+	state.lastPlayed[fileId] = at
+	if state.store != nil {
+		if err := state.store.SaveLastPlayed(state.lastPlayed); err != nil {
+			log.Printf("Could not save when sounds last played: %v", err)
+		}
+	}
+}
+
+// skipCoolingDown reports the chosen sounds that are on cooldown as skipped, replacing them so that they
+// aren't played.  A sound played more than once in a burst only needs to be off cooldown at its start.
+func (sp SchedulePlayer) skipCoolingDown(combo Combo, fileIds []int) []int {
+	now := sp.time.Now()
+	for i, fileId := range fileIds {
+		if fileId > 0 && sp.cooldown.onCooldown(fileId, now) {
+			log.Printf("Not playing sound %d as it is on cooldown", fileId)
+			sp.recordSkipped(combo, now, fileId, combo.Volumes[i], SkippedCooldown)
+			fileIds[i] = coolingDown
+		}
+	}
+	return fileIds
+}
+
+// availableKeys gets the random sounds that aren't on cooldown.  If every one of them is, they are all
+// returned, and the one chosen is skipped when it is due to play.
+func (chooser *SoundChooser) availableKeys() []int {
+	if chooser.cooldown == nil {
+		return chooser.allKeys
+	}
+	now := chooser.now()
+	keys := make([]int, 0, len(chooser.allKeys))
+	for _, key := range chooser.allKeys {
+		if !chooser.cooldown.onCooldown(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return chooser.allKeys
+	}
+	return keys
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCooldownStore struct {
+	lastPlayed map[int]time.Time
+}
+
+func (store *testCooldownStore) LoadLastPlayed() (map[int]time.Time, error) {
+	return store.lastPlayed, nil
+}
+
+func (store *testCooldownStore) SaveLastPlayed(lastPlayed map[int]time.Time) error {
+	store.lastPlayed = make(map[int]time.Time, len(lastPlayed))
+	for fileId, at := range lastPlayed {
+		store.lastPlayed[fileId] = at
+	}
+	return nil
+}
+
+func TestSoundOnCooldownIsSkipped(t *testing.T) {
+	combo := createCombo("19:00", "19:45", 10, "beep")
+	addAnotherSound(&combo, 5, "same")
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	schedulePlayer.cooldown.setSchedule(Schedule{Cooldown: 25 * 60})
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	assert.Equal(t, []string{
+		"19:00:00: Playing beep",
+		"19:00:05: Playing beep",
+		"19:30:00: Playing beep",
+		"19:30:05: Playing beep",
+	}, testRecorder.PlayTimes)
+	// Each of the burst's sounds is skipped.
+	assert.Equal(t, []string{
+		"19:10:00: Skipped beep (cooldown)",
+		"19:10:00: Skipped beep (cooldown)",
+		"19:20:00: Skipped beep (cooldown)",
+		"19:20:00: Skipped beep (cooldown)",
+		"19:40:00: Skipped beep (cooldown)",
+		"19:40:00: Skipped beep (cooldown)",
+	}, testRecorder.SkipTimes)
+}
+
+func TestRandomSoundsOnCooldownAreNotChosen(t *testing.T) {
+	combo := createCombo("19:00", "19:25", 10, "random")
+	chirp, _ := strconv.Atoi(makeSoundNameForSchedule("chirp"))
+	warble, _ := strconv.Atoi(makeSoundNameForSchedule("warble"))
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	schedulePlayer.randomSeed = 1
+	schedulePlayer.allSounds = map[int]string{chirp: "chirp", warble: "warble"}
+	schedulePlayer.SetSoundCooldown(25 * time.Minute)
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	// Once both have played neither can be chosen, so the next burst is skipped.
+	assert.Len(t, testRecorder.PlayTimes, 2)
+	assert.NotEqual(t, testRecorder.PlayTimes[0][10:], testRecorder.PlayTimes[1][10:])
+	assert.Len(t, testRecorder.SkipTimes, 1)
+	assert.Contains(t, testRecorder.SkipTimes[0], "19:20:00: Skipped")
+}
+
+// lastPlayedOf gets the sound the player played at a time of day.
+func lastPlayedOf(sp *SchedulePlayer, at string) int {
+	for fileId, last := range sp.cooldown.history.lastPlayed {
+		if last.Format("15:04") == at {
+			return fileId
+		}
+	}
+	return 0
+}
+
+func TestCooldownsAreKeptAcrossRestarts(t *testing.T) {
+	combo := createCombo("19:00", "19:15", 10, "beep")
+	store := &testCooldownStore{}
+
+	schedulePlayer, _ := createPlayer("18:00")
+	schedulePlayer.SetCooldownStore(store)
+	schedulePlayer.playCombo(combo)
+	assert.Len(t, store.lastPlayed, 1)
+
+	restarted, testRecorder := createPlayer("19:10")
+	restarted.SetCooldownStore(store)
+	restarted.cooldown.setSchedule(Schedule{Cooldowns: map[int]int{lastPlayedOf(schedulePlayer, "19:10"): 30 * 60}})
+	restarted.playCombo(combo)
+	assert.Empty(t, testRecorder.PlayTimes)
+	assert.Len(t, testRecorder.SkipTimes, 1)
+}
+
+func TestValidateChecksCooldowns(t *testing.T) {
+	schedule := Schedule{Cooldown: -1, Cooldowns: map[int]int{3: -5}}
+	assert.EqualError(t, schedule.Validate(), "invalid schedule: cooldown is negative; sound 3 has a negative cooldown")
+}
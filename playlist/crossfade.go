@@ -0,0 +1,144 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// CrossfadeSound is one of the sounds played by a CrossfadePlayer.
+type CrossfadeSound struct {
+	FileName string
+	Volume   int
+	Options  PlayOptions
+	// Gap is how long to wait after the sound before it, used instead of crossfading when either of
+	// them is too short to crossfade.
+	Gap time.Duration
+}
+
+// CrossfadePlayer can also be implemented by an AudioDevice that can play sounds overlapping each other.
+type CrossfadePlayer interface {
+	// PlayCrossfaded plays the sounds one after another, each one starting crossfade before the one
+	// before it ends and fading in as that one fades out.  It returns how long after the first sound
+	// each sound started.
+	PlayCrossfaded(sounds []CrossfadeSound, crossfade time.Duration) ([]time.Duration, error)
+}
+
+// crossfadePlayer gets the device as a CrossfadePlayer, if it can crossfade.
+func crossfadePlayer(device AudioDevice) (CrossfadePlayer, bool) {
+	if zone, ok := device.(*zoneDevice); ok {
+		if _, ok := zone.device.(CrossfadePlayer); !ok {
+			return nil, false
+		}
+	}
+	crossfader, ok := device.(CrossfadePlayer)
+	return crossfader, ok
+}
+
+// crossfadeDuration gets how long the combo's sounds overlap, or zero if they don't.
+func (combo *Combo) crossfadeDuration() time.Duration {
+	return time.Duration(combo.Crossfade * float64(time.Second))
+}
+
+// playCrossfaded plays one run through the combo's sounds crossfaded, with the pre-roll first if first
+// is set.  It returns false, without playing anything, if the sounds can't be crossfaded, such as when
+// the device can't or one of the sounds is missing, so that they are played one at a time instead.
+// During quiet hours or while paused the sounds are played one at a time too, so each is reported as
+// skipped, and so are streamed sounds.  Combos that play from random offsets aren't crossfaded either, as
+// where the offset lands isn't known until each sound is trimmed, so nor is how long it overlaps.
+func (sp SchedulePlayer) playCrossfaded(combo Combo, fileIds []int, first bool) (time.Duration, bool) {
+	crossfader, ok := crossfadePlayer(sp.player)
+	if !ok || combo.crossfadeDuration() <= 0 || len(fileIds) < 2 || sp.isQuietTime() || sp.pause.isPaused() || sp.streams(combo) ||
+		combo.RandomOffset {
+		return 0, false
+	}
+	sounds := make([]CrossfadeSound, len(fileIds))
+	for i, fileId := range fileIds {
+		if fileId <= 0 {
+			return 0, false
+		}
+		options := combo.playOptions()
+		hint := sp.loudness[fileId]
+		options.GainDB, options.TargetLUFS = hint.GainDB, hint.TargetLUFS
+		sounds[i] = CrossfadeSound{
+			FileName: filepath.Join(sp.filesDir, sp.allSounds[fileId]),
+			Volume:   combo.Volumes[i],
+			Options:  options,
+			Gap:      time.Duration(combo.Waits[i]) * time.Second,
+		}
+	}
+
+	if jump := sp.wait(time.Duration(combo.Waits[0]) * time.Second); jump != 0 {
+		return jump, true
+	}
+	now := sp.time.Now()
+	// As in playSequence, the slot is taken before the hook runs so the hooks aren't run for sounds that
+	// are dropped.
+	if !sp.playLimit.acquire() {
+		log.Print("Not playing crossfaded sounds as too many sounds are already playing")
+		for i, fileId := range fileIds {
+			sp.recordSkipped(combo, now, fileId, combo.Volumes[i], SkippedTooManyPlaying)
+		}
+		return 0, true
+	}
+	play := PlayInfo{FileId: fileIds[0], Volume: combo.Volumes[0], Time: now}
+	if err := sp.runBeforePlay(play); err != nil {
+		sp.playLimit.release()
+		log.Printf("Not playing crossfaded sounds: %v", err)
+		for i, fileId := range fileIds {
+			sp.recordSkipped(combo, now, fileId, combo.Volumes[i], SkippedBeforePlayHook)
+		}
+		return 0, true
+	}
+	if preRoll := sp.comboPreRoll(combo); first && preRoll > 0 {
+		if jump := sp.wait(preRoll); jump != 0 {
+			sp.playLimit.release()
+			return jump, true
+		}
+		now = sp.time.Now()
+		play.Time = now
+	}
+	log.Printf("Playing %d sounds crossfaded by %v", len(sounds), combo.crossfadeDuration())
+	starts, err := crossfader.PlayCrossfaded(sounds, combo.crossfadeDuration())
+	sp.playLimit.release()
+	total := sp.time.Now().Sub(now)
+	if err != nil {
+		log.Printf("Play failed: %v", err)
+	}
+
+	for i, fileId := range fileIds {
+		sound := PlayInfo{FileId: fileId, Volume: combo.Volumes[i], Time: now, Err: err}
+		if i < len(starts) {
+			sound.Time = now.Add(starts[i])
+		}
+		// Each sound lasts until the next one starts, apart from the last which lasts until the end.
+		sound.Duration = now.Add(total).Sub(sound.Time)
+		if i+1 < len(starts) {
+			sound.Duration = starts[i+1] - starts[i]
+		}
+		if err != nil {
+			sp.recordFailed(sound.Time, fileId, sound.Volume, err)
+		} else {
+			sp.cooldown.played(fileId, sound.Time)
+			if sp.recorder != nil {
+				sp.recorder.OnAudioBaitPlayed(sound.Time, fileId, sound.Volume)
+			}
+		}
+		if finishedRecorder, ok := sp.recorder.(PlayFinishedRecorder); ok {
+			finishedRecorder.OnPlayFinished(sound)
+		}
+	}
+	play.Duration, play.Err = total, err
+	sp.runAfterPlay(play)
+	return 0, true
+}
+
+func (zone *zoneDevice) PlayCrossfaded(sounds []CrossfadeSound, crossfade time.Duration) ([]time.Duration, error) {
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+	return zone.device.(CrossfadePlayer).PlayCrossfaded(sounds, crossfade)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crossfadeDevice plays crossfaded sounds as though each one lasted 10 seconds.
+type crossfadeDevice struct {
+	TestClockAndAudioDevice
+	Crossfaded [][]CrossfadeSound
+}
+
+func (d *crossfadeDevice) PlayCrossfaded(sounds []CrossfadeSound, crossfade time.Duration) ([]time.Duration, error) {
+	d.Crossfaded = append(d.Crossfaded, sounds)
+	starts := make([]time.Duration, len(sounds))
+	for i := range starts {
+		starts[i] = time.Duration(i) * (10*time.Second - crossfade)
+	}
+	return starts, nil
+}
+
+func TestCrossfadedSoundsArePlayedTogether(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+	combo.Crossfade = 2
+
+	device := &crossfadeDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	schedulePlayer := newSchedulePlayerWithClock(device, device, soundFiles, "")
+	schedulePlayer.SetRecorder(device)
+	schedulePlayer.playCombo(combo)
+
+	assert.Len(t, device.Crossfaded, 1)
+	assert.Equal(t, "beep", device.Crossfaded[0][0].FileName)
+	assert.Equal(t, 5*time.Second, device.Crossfaded[0][1].Gap)
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:01:08: Playing tweet"}, device.PlayTimes)
+}
+
+func TestSoundsAreNotCrossfadedWithoutADeviceThatCan(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+	combo.Crossfade = 2
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:01:05: Playing tweet"}, testRecorder.PlayTimes)
+}
+
+func TestCrossfadeHooksDontRunForSoundsOverTheLimit(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+	combo.Crossfade = 2
+
+	device := &crossfadeDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	schedulePlayer := newSchedulePlayerWithClock(device, device, soundFiles, "")
+	schedulePlayer.SetRecorder(device)
+	limit := NewPlayLimit(1, true)
+	limit.acquire()
+	schedulePlayer.SetPlayLimit(limit)
+	var before, after int
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		before++
+		return nil
+	})
+	schedulePlayer.OnAfterPlay(func(play PlayInfo) {
+		after++
+	})
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, device.Crossfaded)
+	assert.Equal(t, 0, before)
+	assert.Equal(t, 0, after)
+	assert.Equal(t, []string{
+		"12:01:00: Skipped beep (tooManyPlaying)",
+		"12:01:00: Skipped tweet (tooManyPlaying)",
+	}, device.SkipTimes)
+}
+
+func TestRandomOffsetSoundsAreNotCrossfaded(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+	combo.Crossfade = 2
+	combo.RandomOffset = true
+	combo.Duration = 3
+
+	device := &crossfadeDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	schedulePlayer := newSchedulePlayerWithClock(device, device, soundFiles, "")
+	schedulePlayer.SetRecorder(device)
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, device.Crossfaded)
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:01:05: Playing tweet"}, device.PlayTimes)
+}
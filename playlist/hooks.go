@@ -0,0 +1,94 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PlayInfo describes a sound being played, for the hooks run around playing it.
+type PlayInfo struct {
+	FileId int
+	Volume int
+	// Time is when the sound was due to start.
+	Time time.Time
+	// Duration is how long playing took.  It is only set after playing.
+	Duration time.Duration
+	// Err is why the sound couldn't be played, if it couldn't.  It is only set after playing.
+	Err error
+}
+
+// BeforePlayHook is run before each sound is played, such as to power up an amplifier.  If it returns
+// an error the sound isn't played.
+type BeforePlayHook func(play PlayInfo) error
+
+// AfterPlayHook is run after each sound has been played, or has failed to.
+type AfterPlayHook func(play PlayInfo)
+
+// SkippedBeforePlayHook is the reason given when a sound is not played because the before play hook
+// failed or took too long.
+const SkippedBeforePlayHook = "beforePlayHook"
+
+// DefaultHookTimeout is how long the player waits for a hook before carrying on without it, unless
+// SetHookTimeout is used to change it.
+const DefaultHookTimeout = 30 * time.Second
+
+// OnBeforePlay sets a hook to run before each sound is played.  A hook that takes longer than the hook
+// timeout is treated as failing so that it can't hold up the schedule.
+func (sp *SchedulePlayer) OnBeforePlay(hook BeforePlayHook) {
+	sp.beforePlay = hook
+}
+
+// OnAfterPlay sets a hook to run after each sound is played.  The player waits no longer than the hook
+// timeout for it to finish.
+func (sp *SchedulePlayer) OnAfterPlay(hook AfterPlayHook) {
+	sp.afterPlay = hook
+}
+
+// SetHookTimeout sets how long the player waits for the play hooks.
+func (sp *SchedulePlayer) SetHookTimeout(timeout time.Duration) {
+	sp.hookTimeout = timeout
+}
+
+// runBeforePlay runs the before play hook, if there is one.
+func (sp SchedulePlayer) runBeforePlay(play PlayInfo) error {
+	if sp.beforePlay == nil {
+		return nil
+	}
+	result := make(chan error, 1)
+	go func() { result <- sp.beforePlay(play) }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(sp.hookTimeoutOrDefault()):
+		return fmt.Errorf("before play hook took longer than %v", sp.hookTimeoutOrDefault())
+	}
+}
+
+// runAfterPlay runs the after play hook, if there is one.
+func (sp SchedulePlayer) runAfterPlay(play PlayInfo) {
+	if sp.afterPlay == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		sp.afterPlay(play)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(sp.hookTimeoutOrDefault()):
+		log.Printf("After play hook took longer than %v, not waiting for it", sp.hookTimeoutOrDefault())
+	}
+}
+
+func (sp SchedulePlayer) hookTimeoutOrDefault() time.Duration {
+	if sp.hookTimeout > 0 {
+		return sp.hookTimeout
+	}
+	return DefaultHookTimeout
+}
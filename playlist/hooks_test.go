@@ -0,0 +1,70 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlayHooksRunAroundEachPlay(t *testing.T) {
+	combo := createCombo("12:01", "12:40", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	var before, after []PlayInfo
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		before = append(before, play)
+		return nil
+	})
+	schedulePlayer.OnAfterPlay(func(play PlayInfo) {
+		after = append(after, play)
+	})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:31:00: Playing beep"}, testRecorder.PlayTimes)
+	assert.Len(t, before, 2)
+	assert.Len(t, after, 2)
+	assert.Equal(t, 3, before[0].FileId)
+	assert.Equal(t, 10, before[0].Volume)
+	assert.Equal(t, "12:31:00", before[1].Time.Format("15:04:05"))
+	assert.Equal(t, before[1].Time, after[1].Time)
+	assert.Nil(t, after[1].Err)
+}
+
+func TestBeforePlayHookErrorStopsPlay(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		return errors.New("amplifier is off")
+	})
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, testRecorder.PlayTimes)
+	assert.Equal(t, []string{"12:01:00: Skipped beep (beforePlayHook)"}, testRecorder.SkipTimes)
+}
+
+func TestSlowBeforePlayHookTimesOut(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	release := make(chan struct{})
+	defer close(release)
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		<-release
+		return nil
+	})
+	schedulePlayer.SetHookTimeout(10 * time.Millisecond)
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, testRecorder.PlayTimes)
+	assert.Equal(t, []string{"12:01:00: Skipped beep (beforePlayHook)"}, testRecorder.SkipTimes)
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComboStartedAtItsLastIntervalPlaysStraightAway(t *testing.T) {
+	combo := createCombo("19:00", "20:00", 30, "beep")
+
+	schedulePlayer, testRecorder := createPlayer("19:30")
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	assert.Equal(t, []string{registerPlaySound("19:30:00", "beep")}, testRecorder.PlayTimes)
+}
+
+func TestComboStartedPartWayThroughAnIntervalWaitsForTheNext(t *testing.T) {
+	combo := createCombo("19:00", "20:30", 30, "beep")
+
+	schedulePlayer, testRecorder := createPlayer("19:10")
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	assert.Equal(t, []string{registerPlaySound("19:30:00", "beep"), registerPlaySound("20:00:00", "beep")}, testRecorder.PlayTimes)
+}
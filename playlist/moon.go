@@ -0,0 +1,95 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// SkippedMoonGate is the reason given when a sound is not played because the moon is too bright or too
+// dark for its combo.
+const SkippedMoonGate = "moonGate"
+
+// MoonGate limits a combo to nights when the moon is lit within a range, for species that respond
+// differently in moonlight.  Illumination is the percentage of the moon's disc that is lit, from 0 at
+// new moon to 100 at full moon.
+type MoonGate struct {
+	// Below, when set, only plays the combo while the illumination is less than this percentage.
+	Below float64 `json:"below"`
+	// Above, when set, only plays the combo while the illumination is more than this percentage.
+	Above float64 `json:"above"`
+}
+
+// Met checks whether the gate lets its combo play when the moon is illumination percent lit.  A nil
+// gate is always met.
+func (gate *MoonGate) Met(illumination float64) bool {
+	if gate == nil {
+		return true
+	}
+	if gate.Below > 0 && illumination >= gate.Below {
+		return false
+	}
+	return !(gate.Above > 0 && illumination <= gate.Above)
+}
+
+// MoonIllumination works out the percentage of the moon's disc that is lit at t.  It is worked out from
+// the moon's phase, which is the same wherever it is seen from to within a fraction of a percent, so no
+// location is needed.  It is accurate to about half a percent.
+func MoonIllumination(t time.Time) float64 {
+	// From chapter 48 of Meeus' Astronomical Algorithms, using the low accuracy phase angle.
+	const jdUnixEpoch = 2440587.5
+	jd := jdUnixEpoch + float64(t.Unix())/86400
+	centuries := (jd - 2451545) / 36525
+	rad := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	sin := func(degrees float64) float64 { return math.Sin(rad(degrees)) }
+
+	// The moon's mean elongation, and the sun's and the moon's mean anomalies, in degrees.
+	elongation := 297.8501921 + 445267.1114034*centuries
+	sunAnomaly := 357.5291092 + 35999.0502909*centuries
+	moonAnomaly := 134.9633964 + 477198.8675055*centuries
+
+	phaseAngle := 180 - elongation -
+		6.289*sin(moonAnomaly) +
+		2.100*sin(sunAnomaly) -
+		1.274*sin(2*elongation-moonAnomaly) -
+		0.658*sin(2*elongation) -
+		0.214*sin(2*moonAnomaly) -
+		0.110*sin(elongation)
+	return 100 * (1 + math.Cos(rad(phaseAngle))) / 2
+}
+
+// moonGateMet checks whether the moon lets the combo play today.  The illumination at the start of the
+// combo's window is used for all of it, so that a night either plays or doesn't, the same as its plan.
+func (sp SchedulePlayer) moonGateMet(combo Combo) (float64, bool) {
+	if combo.MoonGate == nil {
+		return 0, true
+	}
+	dayStart := sp.nextDayStart().Add(-24 * time.Hour)
+	from, _ := Schedule{Timezone: sp.timezone}.comboWindow(combo, dayStart)
+	illumination := MoonIllumination(from)
+	return illumination, combo.MoonGate.Met(illumination)
+}
+
+// skipMoonGated reports the burst's sounds as skipped if the moon doesn't let the combo play today, and
+// returns whether it did.  It is checked before the burst's sounds are chosen, so that a gated burst
+// doesn't move the sequence on or use up random choices, and only the sounds the combo names by ID are
+// reported.
+func (sp SchedulePlayer) skipMoonGated(combo Combo) bool {
+	illumination, met := sp.moonGateMet(combo)
+	if met {
+		return false
+	}
+	log.Printf("Not playing sound burst as the moon is %.0f%% lit", illumination)
+	now := sp.time.Now()
+	for i, sound := range combo.Sounds {
+		if fileId, err := strconv.Atoi(sound); err == nil && sp.allSounds[fileId] != "" {
+			sp.recordSkipped(combo, now, fileId, combo.Volumes[i], SkippedMoonGate)
+		}
+	}
+	return true
+}
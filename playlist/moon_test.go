@@ -0,0 +1,93 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMoonIlluminationFollowsThePhases(t *testing.T) {
+	newMoon := time.Date(2018, time.January, 17, 2, 17, 0, 0, time.UTC)
+	firstQuarter := time.Date(2018, time.January, 24, 22, 20, 0, 0, time.UTC)
+	fullMoon := time.Date(2018, time.January, 31, 13, 27, 0, 0, time.UTC)
+
+	assert.InDelta(t, 0, MoonIllumination(newMoon), 1)
+	assert.InDelta(t, 50, MoonIllumination(firstQuarter), 2)
+	assert.InDelta(t, 100, MoonIllumination(fullMoon), 1)
+}
+
+func TestMoonGateLimitsIllumination(t *testing.T) {
+	var gate *MoonGate
+	assert.True(t, gate.Met(100))
+
+	dark := &MoonGate{Below: 30}
+	assert.True(t, dark.Met(10))
+	assert.False(t, dark.Met(30))
+
+	between := &MoonGate{Above: 20, Below: 60}
+	assert.False(t, between.Met(20))
+	assert.True(t, between.Met(40))
+	assert.False(t, between.Met(80))
+}
+
+func TestComboIsSkippedWhenMoonGateIsNotMet(t *testing.T) {
+	combo := createCombo("19:00", "19:30", 15, "beep")
+	combo.MoonGate = &MoonGate{Below: 30}
+
+	schedulePlayer, testRecorder := createPlayer("18:00")
+	// The night of a full moon.
+	testRecorder.NowTime = time.Date(2018, time.January, 31, 18, 0, 0, 0, time.UTC)
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	assert.Empty(t, testRecorder.PlayTimes)
+	assert.Equal(t, []string{
+		"19:00:00: Skipped beep (moonGate)",
+		"19:15:00: Skipped beep (moonGate)",
+	}, testRecorder.SkipTimes)
+
+	combo.MoonGate = &MoonGate{Above: 70}
+	schedulePlayer, testRecorder = createPlayer("18:00")
+	testRecorder.NowTime = time.Date(2018, time.January, 31, 18, 0, 0, 0, time.UTC)
+	schedulePlayer.playTodaysCombos([]Combo{combo})
+
+	assert.Equal(t, []string{"19:00:00: Playing beep", "19:15:00: Playing beep"}, testRecorder.PlayTimes)
+	assert.Empty(t, testRecorder.SkipTimes)
+}
+
+func TestPlanShowsMoonGatedCombosAsSkipped(t *testing.T) {
+	combo := createCombo("21:00", "21:20", 10, "")
+	combo.Sounds = []string{"3"}
+	combo.MoonGate = &MoonGate{Below: 30}
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{combo}}
+
+	plan := schedule.Plan(time.Date(2018, time.January, 31, 0, 0, 0, 0, time.UTC), time.UTC)
+	assert.Len(t, plan.Windows, 1)
+	assert.Equal(t, SkippedMoonGate, plan.Windows[0].Skipped)
+	assert.InDelta(t, 100, *plan.Windows[0].MoonIllumination, 1)
+	assert.Empty(t, plan.Plays)
+
+	plan = schedule.Plan(time.Date(2018, time.January, 17, 0, 0, 0, 0, time.UTC), time.UTC)
+	assert.Equal(t, "", plan.Windows[0].Skipped)
+	assert.InDelta(t, 0, *plan.Windows[0].MoonIllumination, 1)
+	assert.Len(t, plan.Plays, 2)
+}
+
+func TestMoonGatedBurstsDontMoveTheSequenceOn(t *testing.T) {
+	gated := createCombo("21:00", "21:40", 30, "sequence")
+	gated.MoonGate = &MoonGate{Below: 30}
+	schedule := Schedule{PlayNights: 1, Sequence: Sequence{Sounds: []string{"1", "3", "4"}}, Combos: []Combo{
+		gated,
+		createCombo("22:00", "22:40", 30, "sequence"),
+	}}
+
+	// The night of a full moon.
+	sim := NewSimulator(time.Date(2018, time.January, 31, 13, 0, 0, 0, time.UTC), soundFiles)
+	plays := sim.Run(schedule, 1)
+
+	assert.Equal(t, []string{"22:00 squeal", "22:30 beep"}, describePlays(plays))
+}
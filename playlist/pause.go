@@ -0,0 +1,125 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// SkippedPaused is the reason given when a sound is not played because the player is paused.
+const SkippedPaused = "paused"
+
+// PlayerPausedRecorder can also be implemented by a SoundPlayedRecorder to be told when the player is
+// paused and resumed.
+type PlayerPausedRecorder interface {
+	OnPlayerPaused(ts time.Time)
+	OnPlayerResumed(ts time.Time)
+}
+
+// PauseSwitch is whether players are paused.  It is shared by pointer between the players using it, and
+// can be changed while they play.  One switch can be kept for as long as audiobait runs, and given to
+// each day's player, so that being paused carries on from one day to the next.
+type PauseSwitch struct {
+	mu       sync.Mutex
+	paused   bool
+	recorder SoundPlayedRecorder
+	clock    Clock
+}
+
+// NewPauseSwitch creates a switch, not paused, that tells the recorder when it is paused and resumed.
+func NewPauseSwitch(recorder SoundPlayedRecorder) *PauseSwitch {
+	return &PauseSwitch{recorder: recorder, clock: new(ActualClock)}
+}
+
+// SetRecorder sets the recorder the switch tells when it is paused and resumed.
+func (state *PauseSwitch) SetRecorder(recorder SoundPlayedRecorder) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.recorder = recorder
+}
+
+// Pause pauses the players using the switch, as SchedulePlayer.Pause does.
+func (state *PauseSwitch) Pause() {
+	state.pause(state.switchRecorder(), state.clock)
+}
+
+// Resume resumes the players using the switch.
+func (state *PauseSwitch) Resume() {
+	state.resume(state.switchRecorder(), state.clock)
+}
+
+func (state *PauseSwitch) switchRecorder() SoundPlayedRecorder {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.recorder
+}
+
+// SetPauseSwitch sets the switch that pauses the player, in place of its own.
+func (sp *SchedulePlayer) SetPauseSwitch(pause *PauseSwitch) {
+	sp.pause = pause
+}
+
+// Pause stops the player playing any more sounds until Resume is called, such as during maintenance.  A
+// sound that is playing is finished.  The schedule carries on being followed while paused, with each
+// sound that comes due reported as skipped, so that after resuming the player carries on from where the
+// schedule has got to.  It can be called while the player is playing.
+func (sp *SchedulePlayer) Pause() {
+	sp.pause.pause(sp.recorder, sp.time)
+}
+
+// Resume starts the player playing sounds again after Pause, from the next one that comes due.
+func (sp *SchedulePlayer) Resume() {
+	sp.pause.resume(sp.recorder, sp.time)
+}
+
+// Pause stops every zone playing any more sounds until Resume is called, as SchedulePlayer.Pause does.
+func (mp *MultiPlayer) Pause() {
+	mp.settings.Pause()
+}
+
+// Resume starts every zone playing sounds again after Pause.
+func (mp *MultiPlayer) Resume() {
+	mp.settings.Resume()
+}
+
+// pause pauses, telling the recorder if it wasn't already paused.
+func (state *PauseSwitch) pause(recorder SoundPlayedRecorder, clock Clock) {
+	if !state.set(true) {
+		return
+	}
+	log.Println("Pausing playback")
+	if pausedRecorder, ok := recorder.(PlayerPausedRecorder); ok {
+		pausedRecorder.OnPlayerPaused(clock.Now())
+	}
+}
+
+// resume resumes, telling the recorder if it was paused.
+func (state *PauseSwitch) resume(recorder SoundPlayedRecorder, clock Clock) {
+	if !state.set(false) {
+		return
+	}
+	log.Println("Resuming playback")
+	if pausedRecorder, ok := recorder.(PlayerPausedRecorder); ok {
+		pausedRecorder.OnPlayerResumed(clock.Now())
+	}
+}
+
+// set pauses or resumes, returning whether that changed anything.
+func (state *PauseSwitch) set(paused bool) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	changed := state.paused != paused
+	state.paused = paused
+	return changed
+}
+
+// isPaused checks whether the player is paused.
+func (state *PauseSwitch) isPaused() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.paused
+}
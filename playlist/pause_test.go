@@ -0,0 +1,119 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pauseChange is when a pausingDevice pauses or resumes its player.
+type pauseChange struct {
+	at    time.Time
+	pause bool
+}
+
+// pausingDevice pauses and resumes its player part way through waits, as if an operator did so while the
+// player slept.
+type pausingDevice struct {
+	TestClockAndAudioDevice
+	player  *SchedulePlayer
+	changes []pauseChange
+	Pauses  []string
+}
+
+func (d *pausingDevice) Wait(duration time.Duration) {
+	end := d.NowTime.Add(duration)
+	for len(d.changes) > 0 && !d.changes[0].at.After(end) {
+		d.NowTime = d.changes[0].at
+		if d.changes[0].pause {
+			d.player.Pause()
+		} else {
+			d.player.Resume()
+		}
+		d.changes = d.changes[1:]
+	}
+	d.NowTime = end.Add(time.Microsecond)
+}
+
+func (d *pausingDevice) OnPlayerPaused(ts time.Time) {
+	d.Pauses = append(d.Pauses, fmt.Sprintf("%02d:%02d:%02d: Paused", ts.Hour(), ts.Minute(), ts.Second()))
+}
+
+func (d *pausingDevice) OnPlayerResumed(ts time.Time) {
+	d.Pauses = append(d.Pauses, fmt.Sprintf("%02d:%02d:%02d: Resumed", ts.Hour(), ts.Minute(), ts.Second()))
+}
+
+func createPausingPlayer(startTime string, changes ...pauseChange) (*SchedulePlayer, *pausingDevice) {
+	device := &pausingDevice{changes: changes}
+	device.NowTime = NewTimeOfDay(startTime).Time
+	device.player = newSchedulePlayerWithClock(device, device, soundFiles, "")
+	device.player.SetRecorder(device)
+	return device.player, device
+}
+
+func TestPauseDuringWaitStopsTheNextSound(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 10, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+
+	schedulePlayer, device := createPausingPlayer("12:00",
+		pauseChange{at: NewTimeOfDay("12:01").Add(2 * time.Second), pause: true},
+		pauseChange{at: NewTimeOfDay("12:05").Time, pause: false})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{
+		"12:01:00: Playing beep",
+		"12:11:00: Playing beep",
+		"12:11:05: Playing tweet",
+	}, device.PlayTimes)
+	assert.Equal(t, []string{"12:01:05: Skipped tweet (paused)"}, device.SkipTimes)
+	assert.Equal(t, []string{"12:01:02: Paused", "12:05:00: Resumed"}, device.Pauses)
+}
+
+func TestResumeDuringWaitPlaysTheNextSound(t *testing.T) {
+	combo := createCombo("12:01", "12:10", 10, "beep")
+	addAnotherSound(&combo, 5, "tweet")
+
+	schedulePlayer, device := createPausingPlayer("12:00",
+		pauseChange{at: NewTimeOfDay("12:00").Add(30 * time.Second), pause: true},
+		pauseChange{at: NewTimeOfDay("12:01").Add(2 * time.Second), pause: false})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{"12:01:05: Playing tweet"}, device.PlayTimes)
+	assert.Equal(t, []string{"12:01:00: Skipped beep (paused)"}, device.SkipTimes)
+}
+
+func TestPausingTwiceIsOnlyReportedOnce(t *testing.T) {
+	schedulePlayer, device := createPausingPlayer("12:00")
+	schedulePlayer.Pause()
+	schedulePlayer.Pause()
+	schedulePlayer.Resume()
+	schedulePlayer.Resume()
+
+	assert.Equal(t, []string{"12:00:00: Paused", "12:00:00: Resumed"}, device.Pauses)
+}
+
+func TestPauseSwitchPausesEachPlayerGivenIt(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	device := &pausingDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	pause := &PauseSwitch{recorder: device, clock: device}
+	pause.Pause()
+
+	// A player for the next day, set up after the switch was paused.
+	schedulePlayer := newSchedulePlayerWithClock(device, device, soundFiles, "")
+	schedulePlayer.SetRecorder(device)
+	schedulePlayer.SetPauseSwitch(pause)
+	schedulePlayer.playCombo(combo)
+	pause.Resume()
+	schedulePlayer.playCombo(createCombo("13:01", "13:20", 30, "beep"))
+
+	assert.Equal(t, []string{"12:01:00: Skipped beep (paused)"}, device.SkipTimes)
+	assert.Equal(t, []string{"13:01:00: Playing beep"}, device.PlayTimes)
+	assert.Equal(t, []string{"12:00:00: Paused", "12:20:00: Resumed"}, device.Pauses)
+}
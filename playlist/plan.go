@@ -0,0 +1,171 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Plan is what a schedule will play over one audiobait day, which runs from midday on its date until
+// midday the next day.
+type Plan struct {
+	Date       string        `json:"date"`
+	Timezone   string        `json:"timezone"`
+	PlayingDay bool          `json:"playingDay"`
+	Windows    []PlanWindow  `json:"windows"`
+	Plays      []PlannedPlay `json:"plays"`
+	Skips      []PlannedSkip `json:"skips,omitempty"`
+}
+
+// PlanWindow is when a combo plays, resolved to absolute times.  For a combo with a moon gate it also
+// has how lit the moon is at the window's start, and if that means the combo isn't played, why.
+type PlanWindow struct {
+	Combo            int      `json:"combo"`
+	From             string   `json:"from"`
+	Until            string   `json:"until"`
+	MoonIllumination *float64 `json:"moonIllumination,omitempty"`
+	Skipped          string   `json:"skipped,omitempty"`
+}
+
+// PlannedPlay is a sound the schedule will play.
+type PlannedPlay struct {
+	Time   string `json:"time"`
+	FileId int    `json:"fileId"`
+	Volume int    `json:"volume"`
+}
+
+// PlannedSkip is a sound that comes due but won't be played, such as during quiet hours or while it is
+// cooling down, and why.
+type PlannedSkip struct {
+	Time   string `json:"time"`
+	FileId int    `json:"fileId"`
+	Reason string `json:"reason"`
+}
+
+// planSeed makes the random sounds chosen for a date's plan the same every time.
+func planSeed(date time.Time) int64 {
+	return int64(date.Year()*10000 + int(date.Month())*100 + date.Day())
+}
+
+// Plan works out what the schedule will play on the audiobait day starting on the given date, as if the
+// device's clock was in loc, by a player with none of its settings changed from the defaults.  See
+// SchedulePlayer.Plan.
+func (schedule Schedule) Plan(date time.Time, loc *time.Location) Plan {
+	return NewPlayer(nil, nil, "").Plan(schedule, date, loc)
+}
+
+// Plan works out what the player will play of the schedule on the audiobait day starting on the given
+// date, as if the device's clock was in loc.  It plays the schedule through a simulated player with the
+// same settings, such as the quiet hours, cooldowns, play limit and pre-roll, so the times are exactly
+// those the player would use.  The hooks aren't run and nothing is streamed.  Random sounds are chosen
+// with a seed from the date, which keeps the plan the same each time it is made, but the device makes
+// its own random choices when it plays.
+func (sp *SchedulePlayer) Plan(schedule Schedule, date time.Time, loc *time.Location) Plan {
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, loc)
+	plan := Plan{
+		Date:       dayStart.Format("2006-01-02"),
+		Timezone:   loc.String(),
+		PlayingDay: schedule.isPlayingDay(dayStart),
+		Windows:    []PlanWindow{},
+		Plays:      []PlannedPlay{},
+	}
+	if !plan.PlayingDay {
+		return plan
+	}
+
+	for i, combo := range schedule.Combos {
+		from, until := schedule.comboWindow(combo, dayStart)
+		planWindow := PlanWindow{
+			Combo: i,
+			From:  from.In(loc).Format(time.RFC3339),
+			Until: until.In(loc).Format(time.RFC3339),
+		}
+		if combo.MoonGate != nil {
+			illumination := MoonIllumination(from)
+			if !combo.MoonGate.Met(illumination) {
+				planWindow.Skipped = SkippedMoonGate
+			}
+			illumination = math.Round(illumination*10) / 10
+			planWindow.MoonIllumination = &illumination
+		}
+		plan.Windows = append(plan.Windows, planWindow)
+	}
+
+	allSounds := make(map[int]string)
+	for _, fileId := range schedule.GetReferencedSounds() {
+		allSounds[fileId] = strconv.Itoa(fileId)
+	}
+	// Start just after midday, as the player treats midday itself as the end of the previous day.
+	sim := NewSimulator(dayStart.Add(time.Nanosecond), allSounds)
+	sim.player = sp.planPlayer(sim)
+	sim.player.randomSeed = planSeed(dayStart)
+	sim.Run(schedule, 1)
+	for _, event := range sim.Events {
+		switch event.Type {
+		case SimulatedPlayedEvent:
+			plan.Plays = append(plan.Plays, PlannedPlay{
+				Time:   event.Time.In(loc).Format(time.RFC3339),
+				FileId: event.FileId,
+				Volume: event.Volume,
+			})
+		case SimulatedSkippedEvent:
+			plan.Skips = append(plan.Skips, PlannedSkip{
+				Time:   event.Time.In(loc).Format(time.RFC3339),
+				FileId: event.FileId,
+				Reason: event.Reason,
+			})
+		}
+	}
+	return plan
+}
+
+// planPlayer copies the player's settings to a player that plays on the simulator.  It has its own
+// sequence, cooldowns and play limit so that planning doesn't change the player's, and no hooks or
+// streamer so that nothing outside the simulator is run.
+func (sp *SchedulePlayer) planPlayer(sim *Simulator) *SchedulePlayer {
+	player := *sp
+	player.player, player.time, player.recorder = sim, sim, sim
+	player.allSounds, player.filesDir = sim.player.allSounds, ""
+	player.updates = nil
+	player.sequence = &sequenceState{}
+	player.cooldown = &cooldownState{defaultCooldown: sp.cooldown.defaultCooldown, history: &playedHistory{}}
+	player.playLimit = sp.playLimit.copy()
+	player.beforePlay, player.afterPlay = nil, nil
+	player.streamer = nil
+	player.pause = &PauseSwitch{}
+	return &player
+}
+
+// PlanJSON gets the schedule's plan for a date, as Plan does, as indented JSON.
+func (schedule Schedule) PlanJSON(date time.Time, loc *time.Location) ([]byte, error) {
+	return json.MarshalIndent(schedule.Plan(date, loc), "", "  ")
+}
+
+// comboWindow works out when a combo starts and stops on the audiobait day starting at dayStart.
+func (schedule Schedule) comboWindow(combo Combo, dayStart time.Time) (time.Time, time.Time) {
+	timezone := combo.Timezone
+	if timezone == "" {
+		timezone = schedule.Timezone
+	}
+	if loc, err := loadTimezone(timezone); err == nil && loc != nil {
+		dayStart = dayStart.In(loc)
+	}
+	at := func(day time.Time, timeOfDay TimeOfDay) time.Time {
+		return time.Date(day.Year(), day.Month(), day.Day(), timeOfDay.Hour(), timeOfDay.Minute(), timeOfDay.Second(), 0, day.Location())
+	}
+
+	from := at(dayStart, combo.FromTime())
+	if from.Before(dayStart) {
+		from = from.AddDate(0, 0, 1)
+	}
+	until := at(from, combo.UntilTime())
+	if !until.After(from) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return from, until
+}
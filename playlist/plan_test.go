@@ -0,0 +1,120 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const planSchedule = `{
+	"playNights": 1,
+	"allSounds": [3, 4],
+	"combos": [
+		{"from": "21:00", "until": "21:50", "every": 1800, "waits": [0, 5], "volumes": [5, 7], "sounds": ["3", "random"]},
+		{"from": "07:00", "until": "07:20", "every": 1200, "waits": [0], "volumes": [9], "sounds": ["4"], "timezone": "UTC"}
+	]
+}`
+
+func TestPlanJSON(t *testing.T) {
+	var schedule Schedule
+	assert.Nil(t, ParseJSONConfigFile(planSchedule, &schedule))
+	nz, err := time.LoadLocation("Pacific/Auckland")
+	assert.Nil(t, err)
+
+	planJSON, err := schedule.PlanJSON(time.Date(2018, time.November, 5, 0, 0, 0, 0, time.UTC), nz)
+	assert.Nil(t, err)
+	assert.Equal(t, `{
+  "date": "2018-11-05",
+  "timezone": "Pacific/Auckland",
+  "playingDay": true,
+  "windows": [
+    {
+      "combo": 0,
+      "from": "2018-11-05T21:00:00+13:00",
+      "until": "2018-11-05T21:50:00+13:00"
+    },
+    {
+      "combo": 1,
+      "from": "2018-11-05T20:00:00+13:00",
+      "until": "2018-11-05T20:20:00+13:00"
+    }
+  ],
+  "plays": [
+    {
+      "time": "2018-11-05T20:00:00+13:00",
+      "fileId": 4,
+      "volume": 9
+    },
+    {
+      "time": "2018-11-05T21:00:00+13:00",
+      "fileId": 3,
+      "volume": 5
+    },
+    {
+      "time": "2018-11-05T21:00:05+13:00",
+      "fileId": 4,
+      "volume": 7
+    },
+    {
+      "time": "2018-11-05T21:30:00+13:00",
+      "fileId": 3,
+      "volume": 5
+    },
+    {
+      "time": "2018-11-05T21:30:05+13:00",
+      "fileId": 4,
+      "volume": 7
+    }
+  ]
+}`, string(planJSON))
+}
+
+func TestPlanShowsRepeats(t *testing.T) {
+	combo := createCombo("21:00", "21:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+	combo.Repeat = 2
+	combo.RepeatGap = 30
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{combo}}
+
+	plan := schedule.Plan(time.Date(2018, time.November, 5, 0, 0, 0, 0, time.UTC), time.UTC)
+	assert.Equal(t, []PlannedPlay{
+		{Time: "2018-11-05T21:00:00Z", FileId: 3, Volume: 10},
+		{Time: "2018-11-05T21:00:30Z", FileId: 3, Volume: 10},
+	}, plan.Plays)
+}
+
+func TestPlanOnControlDayHasNoPlays(t *testing.T) {
+	schedule := Schedule{PlayNights: 1, ControlNights: 1, StartDay: 1, Combos: []Combo{createCombo("21:00", "22:00", 30, "beep")}}
+
+	plan := schedule.Plan(time.Date(2018, time.November, 2, 0, 0, 0, 0, time.UTC), time.UTC)
+	assert.False(t, plan.PlayingDay)
+	assert.Empty(t, plan.Windows)
+	assert.Empty(t, plan.Plays)
+}
+
+func TestPlanFollowsThePlayersSettings(t *testing.T) {
+	combo := createCombo("21:00", "22:30", 30, "")
+	combo.Sounds = []string{"3"}
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{combo}}
+	date := time.Date(2018, time.November, 5, 0, 0, 0, 0, time.UTC)
+
+	player := NewPlayer(nil, nil, "")
+	player.SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("21:45"), Until: *NewTimeOfDay("22:15")}})
+	player.SetSoundCooldown(45 * time.Minute)
+	player.SetPreRoll(10 * time.Second)
+	plan := player.Plan(schedule, date, time.UTC)
+
+	assert.Equal(t, []PlannedPlay{{Time: "2018-11-05T21:00:10Z", FileId: 3, Volume: 10}}, plan.Plays)
+	assert.Equal(t, []PlannedSkip{
+		{Time: "2018-11-05T21:30:00Z", FileId: 3, Reason: SkippedCooldown},
+		{Time: "2018-11-05T22:00:00Z", FileId: 3, Reason: SkippedQuietHours},
+	}, plan.Skips)
+
+	// Planning doesn't use up the player's cooldowns.
+	assert.Equal(t, plan, player.Plan(schedule, date, time.UTC))
+}
@@ -5,8 +5,10 @@
 package playlist
 
 import (
+	"errors"
 	"log"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/TheCacophonyProject/window"
@@ -15,7 +17,36 @@ import (
 // AudioDevice models the device playing the audio.
 type AudioDevice interface {
 	// Play plays a given audio file at a specified volume.
-	Play(audioFileName string, volume int) error
+	Play(audioFileName string, volume int, options PlayOptions) error
+}
+
+// PlayOptions controls which part of an audio file is played.
+type PlayOptions struct {
+	// Offset is how far into the audio file to start playing.
+	Offset time.Duration
+	// RandomOffset starts playing at a random point in the file that still leaves Duration to play.
+	RandomOffset bool
+	// Duration is how long to play for.  Zero plays to the end of the file.
+	Duration time.Duration
+	// GainDB adjusts the level of the file, on top of the volume.  Zero means no adjustment.
+	GainDB float64
+	// TargetLUFS is the loudness to play the file at, if GainDB isn't set.  The device measures the
+	// file to work out the gain needed.  Zero means no target.
+	TargetLUFS float64
+	// Pan steers the sound between the left (-1) and right (1) speakers.  Zero plays it from both.
+	Pan float64
+}
+
+// LoudnessHint is how loud the server says a file should be played.
+type LoudnessHint struct {
+	GainDB     float64
+	TargetLUFS float64
+}
+
+// ChimePlayer can also be implemented by an AudioDevice that has a built in chime sound.
+type ChimePlayer interface {
+	// PlayChime plays the built in chime at a specified volume.
+	PlayChime(volume int) error
 }
 
 // Clock models a clock.   That has been abstracted for unit testing.
@@ -32,11 +63,71 @@ type SoundPlayedRecorder interface {
 	OnAudioBaitPlayed(ts time.Time, fileId int, volume int)
 }
 
+// SoundSkippedRecorder can also be implemented by a SoundPlayedRecorder to get a notification when a
+// scheduled sound was deliberately not played.
+type SoundSkippedRecorder interface {
+	// OnAudioBaitSkipped is called when a sound that was due to play was suppressed, with the reason why.
+	OnAudioBaitSkipped(ts time.Time, fileId int, volume int, reason string)
+}
+
+// SoundFailedRecorder can also be implemented by a SoundPlayedRecorder to get a notification when a
+// scheduled sound couldn't be played.
+type SoundFailedRecorder interface {
+	// OnAudioBaitFailed is called when a sound that was due to play failed, with the error why.
+	OnAudioBaitFailed(ts time.Time, fileId int, volume int, err error)
+}
+
+// ScheduleMutedRecorder can also be implemented by a SoundPlayedRecorder to get a notification when sounds
+// aren't being played because the schedule is muted.
+type ScheduleMutedRecorder interface {
+	// OnScheduleMuted is called when the player stops playing sounds, or doesn't start, because the
+	// schedule is muted.
+	OnScheduleMuted(ts time.Time)
+}
+
+// SkippedPlay describes a sound that was due to play but didn't.
+type SkippedPlay struct {
+	Time   time.Time
+	FileId int
+	Volume int
+	Reason string
+	// From and Until are the window of the combo the sound was to be played in.
+	From  TimeOfDay
+	Until TimeOfDay
+}
+
+// PlaySkippedRecorder can also be implemented by a SoundPlayedRecorder to be told more about each sound
+// that was due to play but didn't than SoundSkippedRecorder is.  It is used instead of
+// SoundSkippedRecorder, and is also told about sounds whose files are missing, as well as them being
+// reported as failures.
+type PlaySkippedRecorder interface {
+	OnPlaySkipped(skip SkippedPlay)
+}
+
+// PlayFinishedRecorder can also be implemented by a SoundPlayedRecorder to be told about each sound
+// once it has been played, or failed to, along with how long playing took.
+type PlayFinishedRecorder interface {
+	OnPlayFinished(play PlayInfo)
+}
+
+// ErrSoundNotAvailable is the error given when a sound can't be played because its file hasn't been
+// downloaded.
+var ErrSoundNotAvailable = errors.New("sound file not available")
+
+// SkippedQuietHours is the reason given when a sound is not played because it is during quiet hours.
+const SkippedQuietHours = "quietHours"
+
+// SkippedMissingFile is the reason given when a sound is not played because its file hasn't been
+// downloaded.
+const SkippedMissingFile = "missingFile"
+
 // ActualClock uses the standard go time.
 type ActualClock struct{}
 
+// Now gets the wall clock time.  The monotonic clock reading is stripped, so that comparing times sees
+// the clock being set, as the player needs to notice the clock jumping.
 func (t *ActualClock) Now() time.Time {
-	return time.Now()
+	return time.Now().Round(0)
 }
 
 func (t *ActualClock) Wait(duration time.Duration) {
@@ -50,8 +141,29 @@ type SchedulePlayer struct {
 	time     Clock
 	recorder SoundPlayedRecorder
 	// allSounds is a map of audio file ID to name of audio file on disk
-	allSounds map[int]string
-	filesDir  string
+	allSounds  map[int]string
+	filesDir   string
+	quietHours []TimeWindow
+	updates    <-chan Schedule
+	sequence   *sequenceState
+	// timezone is the timezone of the schedule being played.
+	timezone string
+	rotation Rotation
+	loudness map[int]LoudnessHint
+	// randomSeed, if set, makes the random sounds chosen repeatable.
+	randomSeed  int64
+	beforePlay  BeforePlayHook
+	afterPlay   AfterPlayHook
+	hookTimeout time.Duration
+	preRoll     time.Duration
+
+	playLimit *PlayLimit
+	// conflictPolicy is the conflict policy of the schedule being played.
+	conflictPolicy string
+	cooldown       *cooldownState
+	streamer       SoundStreamer
+	streamAll      bool
+	pause          *PauseSwitch
 }
 
 // NewPlayer creates a new schedule player.
@@ -64,7 +176,15 @@ func newSchedulePlayerWithClock(audioDevice AudioDevice,
 	clock Clock,
 	allSoundsMap map[int]string,
 	filesDirectory string) *SchedulePlayer {
-	return &SchedulePlayer{player: audioDevice, time: clock, allSounds: allSoundsMap, filesDir: filesDirectory}
+	return &SchedulePlayer{
+		player:    audioDevice,
+		time:      clock,
+		allSounds: allSoundsMap,
+		filesDir:  filesDirectory,
+		sequence:  &sequenceState{},
+		cooldown:  newCooldownState(),
+		pause:     &PauseSwitch{},
+	}
 }
 
 // WaitUntilNextDay calculates when out when the next audiobait day starts (typically around midday) and wait until then.
@@ -112,37 +232,128 @@ func (sp *SchedulePlayer) SetRecorder(recorder SoundPlayedRecorder) {
 	sp.recorder = recorder
 }
 
-// IsSoundPlayingDay works out whether sounds should be played today.
-// Having control days when we play no sound, helps to make sure that we canaccurately determine whether
-// sounds are attracting more animals or not.   They may also help stop animals getting
-// attuned to hearing the sounds.
-func (sp SchedulePlayer) IsSoundPlayingDay(schedule Schedule) bool {
-	if schedule.ControlNights <= 0 {
-		return true
+// SetScheduleUpdates sets a channel, such as the one from the schedule watcher, that new schedules are
+// received on while playing.  A new schedule takes over at the next play boundary, so a sound that is
+// playing is never interrupted, and combos the new schedule still has carry on as before.  The new
+// schedule's sounds must already be available to the player.
+func (sp *SchedulePlayer) SetScheduleUpdates(updates <-chan Schedule) {
+	sp.updates = updates
+}
+
+// scheduleUpdate checks, without waiting, whether a new schedule has arrived.  If several have arrived
+// only the latest is returned.
+func (sp SchedulePlayer) scheduleUpdate() (Schedule, bool) {
+	var latest Schedule
+	found := false
+	for {
+		select {
+		case schedule, ok := <-sp.updates:
+			if !ok {
+				return latest, found
+			}
+			latest, found = schedule, true
+		default:
+			return latest, found
+		}
+	}
+}
+
+// SetSequenceStore sets where the position in the schedule's sequence is saved, so that after a
+// restart the sequence carries on where it left off.
+func (sp *SchedulePlayer) SetSequenceStore(store SequenceStore) {
+	sp.sequence.setStore(store)
+}
+
+// SetLoudnessHints sets how loud each audio file, keyed by ID, should be played on top of the combo's
+// volume.
+func (sp *SchedulePlayer) SetLoudnessHints(hints map[int]LoudnessHint) {
+	sp.loudness = hints
+}
+
+// SetQuietHours sets windows of the day when no sounds will be played, whatever the schedule says.
+func (sp *SchedulePlayer) SetQuietHours(quietHours []TimeWindow) {
+	sp.quietHours = quietHours
+}
+
+// SetPreRoll sets how long to wait before the first sound of each burst, for combos that don't set their
+// own pre-roll.  It is waited for after the before play hook has run, so that a hook can switch on an
+// amplifier and have it settle before the sound starts.  The default is no pre-roll.
+func (sp *SchedulePlayer) SetPreRoll(preRoll time.Duration) {
+	sp.preRoll = preRoll
+}
+
+// comboPreRoll gets the pre-roll for a combo.
+func (sp SchedulePlayer) comboPreRoll(combo Combo) time.Duration {
+	if combo.PreRoll > 0 {
+		return time.Duration(combo.PreRoll * float64(time.Second))
 	}
+	return sp.preRoll
+}
+
+// isQuietTime works out if it is currently quiet hours.
+func (sp SchedulePlayer) isQuietTime() bool {
+	return IsQuietTime(sp.quietHours, sp.time.Now())
+}
 
-	firstDay := schedule.StartDay
-	if firstDay < 1 {
-		firstDay = 1
+// IsQuietTime works out whether now is during any of the quiet hours.
+func IsQuietTime(quietHours []TimeWindow, now time.Time) bool {
+	for _, quiet := range quietHours {
+		win := window.New(quiet.From.Time, quiet.Until.Time)
+		win.Now = func() time.Time { return now }
+		if win.Active() {
+			return true
+		}
 	}
+	return false
+}
 
-	todaysStart := sp.nextDayStart().Add(-24 * time.Hour)
+// PlayStartupSound plays a sound to confirm that the device has started and that audio works.  If fileId isn't
+// one of the available sounds then the audio device's built in chime is played instead, if it has one.
+// Nothing is played during quiet hours.  It returns whether a sound was played.
+func (sp SchedulePlayer) PlayStartupSound(fileId int, volume int) (bool, error) {
+	if sp.isQuietTime() {
+		log.Println("Not playing startup sound during quiet hours")
+		return false, nil
+	}
 
-	dayOfCycle := (todaysStart.Day() - firstDay) % schedule.CycleLength()
-	if dayOfCycle < 0 {
-		dayOfCycle += schedule.CycleLength()
+	if filename, exists := sp.allSounds[fileId]; exists {
+		soundFilePath := filepath.Join(sp.filesDir, filename)
+		log.Printf("Playing startup sound %s", soundFilePath)
+		return true, sp.player.Play(soundFilePath, volume, PlayOptions{})
 	}
 
-	return dayOfCycle < schedule.PlayNights
+	if chimePlayer, ok := sp.player.(ChimePlayer); ok {
+		log.Println("Playing startup chime")
+		return true, chimePlayer.PlayChime(volume)
+	}
+	return false, errors.New("no startup sound available")
+}
+
+// IsSoundPlayingDay works out whether sounds should be played today.
+// Having control days when we play no sound, helps to make sure that we canaccurately determine whether
+// sounds are attracting more animals or not.   They may also help stop animals getting
+// attuned to hearing the sounds.
+func (sp SchedulePlayer) IsSoundPlayingDay(schedule Schedule) bool {
+	todaysStart := sp.nextDayStart().Add(-24 * time.Hour)
+	return schedule.isPlayingDay(todaysStart)
 }
 
 // PlayTodaysSchedule plays todays schedule or if it is a control day it waits until the start of the next day
 func (sp SchedulePlayer) PlayTodaysSchedule(schedule Schedule) {
 	tomorrowStart := sp.nextDayStart()
-	if sp.IsSoundPlayingDay(schedule) {
+	sp.useSchedule(schedule)
+	if schedule.Muted {
+		log.Println("The schedule is muted and no audiobait sounds will be played until it is unmuted.")
+		sp.recordMuted(sp.time.Now())
+		if unmuted, ok := sp.waitForUnmute(tomorrowStart); ok {
+			schedule = unmuted
+			sp.useSchedule(schedule)
+		}
+	}
+	if !schedule.Muted && sp.IsSoundPlayingDay(schedule) {
 		log.Println("Today is an audiobait day.  Lets see what animals we can attract...")
 		sp.playTodaysCombos(schedule.Combos)
-	} else {
+	} else if !schedule.Muted {
 		log.Println("Today is a control day and no audiobait sounds will be played.")
 	}
 	log.Println("No more audiobait scheduled for today. Waiting until new day starts (sometime around midday)")
@@ -150,34 +361,112 @@ func (sp SchedulePlayer) PlayTodaysSchedule(schedule Schedule) {
 	sp.time.Wait(tomorrowStart.Sub(sp.time.Now()))
 }
 
-// PlayTodaysCombos plays the given combos - doesn't not care whether it is a control day
-func (sp SchedulePlayer) playTodaysCombos(combos []Combo) {
+// PlayTodaysCombos plays the given combos - doesn't not care whether it is a control day.  If a new
+// schedule arrives its combos are played from then on, unless it makes today a control day.  If it is
+// muted nothing more is played until one arrives that isn't.  When the
+// combo that was playing is still in the new schedule the new schedule's next combo follows it.
+func (sp SchedulePlayer) playTodaysCombos(scheduled []Combo) {
 	tomorrowStart := sp.nextDayStart()
-	numberCombos := len(combos)
+	combos := sp.playingCombos(scheduled)
+	if len(combos) == 0 {
+		return
+	}
 	count := sp.findNextCombo(combos)
 
 	nextComboStart := sp.time.Now().Add(sp.createWindow(combos[count]).Until())
 
 	for nextComboStart.Before(tomorrowStart) {
 		log.Println("Playing combo...")
-		sp.playCombo(combos[count])
-		count = (count + 1) % numberCombos
+		update, updated, jump := sp.playCombo(combos[count])
+		if !updated && jump == 0 {
+			jump = sp.playChain(combos[count], scheduled)
+		}
+		if updated {
+			wasMuted := update.Muted
+			if update.Muted {
+				log.Println("New schedule is muted, not playing any more sounds until it is unmuted")
+				sp.recordMuted(sp.time.Now())
+				unmuted, ok := sp.waitForUnmute(tomorrowStart)
+				if !ok {
+					return
+				}
+				update = unmuted
+			}
+			if !update.isPlayingDay(tomorrowStart.Add(-24*time.Hour)) || len(update.Combos) == 0 {
+				log.Println("New schedule has no sounds to play today")
+				return
+			}
+			log.Println("Switching to new schedule")
+			sp.useSchedule(update)
+			playing := sp.playingCombos(update.Combos)
+			if len(playing) == 0 {
+				log.Println("New schedule has no sounds to play today")
+				return
+			}
+			// After being muted the player carries on from whichever combo is playing now.
+			if index := (Schedule{Combos: playing}).indexOfCombo(combos[count]); index >= 0 && !wasMuted {
+				count = (index + 1) % len(playing)
+			} else {
+				count = sp.findNextCombo(playing)
+			}
+			scheduled, combos = update.Combos, playing
+		} else if jump != 0 {
+			sp.recoverFromClockJump(jump)
+			count = sp.findNextCombo(combos)
+		} else {
+			count = (count + 1) % len(combos)
+		}
 		nextComboStart = sp.time.Now().Add(sp.createWindow(combos[count]).Until())
 	}
 	log.Println("Completed playing combos for today")
 }
 
+// useSchedule takes the settings that come from the schedule being played.
+func (sp *SchedulePlayer) useSchedule(schedule Schedule) {
+	sp.sequence.setSequence(schedule.Sequence)
+	sp.timezone = schedule.Timezone
+	sp.conflictPolicy = schedule.ConflictPolicy
+	sp.rotation = schedule.Rotation
+	sp.cooldown.setSchedule(schedule)
+}
+
+// unmutePollInterval is how often a muted player checks whether its schedule has been unmuted.
+const unmutePollInterval = time.Minute
+
+// waitForUnmute waits while the schedule is muted for a new schedule that isn't, returning it, or until
+// the day ends, returning false.
+func (sp SchedulePlayer) waitForUnmute(tomorrowStart time.Time) (Schedule, bool) {
+	if sp.updates == nil {
+		return Schedule{}, false
+	}
+	for sp.time.Now().Before(tomorrowStart) {
+		wait := tomorrowStart.Sub(sp.time.Now())
+		if wait > unmutePollInterval {
+			wait = unmutePollInterval
+		}
+		sp.time.Wait(wait)
+		if update, ok := sp.scheduleUpdate(); ok && !update.Muted {
+			log.Println("The schedule has been unmuted, carrying on playing")
+			return update, true
+		}
+	}
+	return Schedule{}, false
+}
+
 // nextDayStart works out when the next playing day starts.   As the playing day starts around midday, this could actually be
 // later today.
 func (sp SchedulePlayer) nextDayStart() time.Time {
 	return nextDayStart(sp.time.Now())
 }
 
-// playCombo plays a single combo
-func (sp SchedulePlayer) playCombo(combo Combo) bool {
+// playCombo plays a single combo.  If a new schedule arrives that no longer has this combo, or is muted,
+// it stops before the next burst and returns the new schedule.  If the new schedule still has the combo it is
+// played to the end as usual before the new schedule is returned.  If the clock jumps the combo stops
+// straight away and how far it jumped is returned.
+func (sp SchedulePlayer) playCombo(combo Combo) (Schedule, bool, time.Duration) {
 	const startOfIntervalFuzzyFactor = 3 * time.Second
 	win := sp.createWindow(combo)
-	soundChooser := NewSoundChooser(sp.allSounds)
+	soundChooser := sp.newSoundChooser()
 
 	every := time.Duration(combo.Every)
 	if every < 1 {
@@ -185,55 +474,281 @@ func (sp SchedulePlayer) playCombo(combo Combo) bool {
 	}
 	every = every * time.Second
 
+	var update Schedule
+	updated := false
+	// carryOn checks for a new schedule, returning false if this combo should stop.
+	carryOn := func() bool {
+		if latest, ok := sp.scheduleUpdate(); ok {
+			update, updated = latest, true
+			if latest.Muted || !sp.playsCombo(latest, combo) {
+				return false
+			}
+			log.Println("New schedule still has the playing combo, carrying on with it")
+		}
+		return true
+	}
+
+	if combo.PlaysPerHour > 0 {
+		jump := sp.playAtRandomTimes(combo, win, soundChooser, carryOn)
+		return update, updated, jump
+	}
+
 	toWindow := win.Until()
 	if win.Until() > time.Duration(0) {
 		log.Printf("sleeping until next window (%s)", toWindow)
-		sp.time.Wait(toWindow)
-		sp.playSounds(combo, soundChooser)
-	} else if win.UntilNextInterval(every) > every-startOfIntervalFuzzyFactor {
+		if jump := sp.wait(toWindow); jump != 0 {
+			return update, updated, jump
+		}
+		if !carryOn() {
+			return update, true, 0
+		}
+		if jump := sp.playSounds(combo, soundChooser); jump != 0 {
+			return update, updated, jump
+		}
+	} else if win.Active() && sinceIntervalStart(win, every) < startOfIntervalFuzzyFactor {
 		// If we have waited we might have missed the start by milliseconds
-		sp.playSounds(combo, soundChooser)
+		if jump := sp.playSounds(combo, soundChooser); jump != 0 {
+			return update, updated, jump
+		}
 	}
 
 	for {
 		nextBurstSleep := win.UntilNextInterval(every)
 		if nextBurstSleep > time.Duration(-1) {
 			log.Print("Sleeping until next burst")
-			sp.time.Wait(nextBurstSleep)
-			sp.playSounds(combo, soundChooser)
+			if jump := sp.wait(nextBurstSleep); jump != 0 {
+				return update, updated, jump
+			}
+			if !carryOn() {
+				return update, true, 0
+			}
+			if jump := sp.playSounds(combo, soundChooser); jump != 0 {
+				return update, updated, jump
+			}
 		} else {
 			log.Print("Played last burst, sleeping until near end of window")
-			sp.time.Wait(win.UntilEnd()) // Stop 3s early so we don't miss the start of the next interval
-			return true
+			jump := sp.wait(win.UntilEnd()) // Stop 3s early so we don't miss the start of the next interval
+			return update, updated, jump
+		}
+	}
+}
+
+// sinceIntervalStart works out how long it is since the start of the active window's current interval.
+// Unlike win.UntilNextInterval it works during the window's last interval too.
+func sinceIntervalStart(win *window.Window, every time.Duration) time.Duration {
+	now := win.Now()
+	now = time.Date(1, 1, 1, now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+	if now.Before(win.Start) {
+		now = now.Add(24 * time.Hour)
+	}
+	return now.Sub(win.Start) % every
+}
+
+// newSoundChooser creates the chooser for a combo's sounds, with the player's sequence and tonight's
+// rotation group.
+func (sp SchedulePlayer) newSoundChooser() *SoundChooser {
+	soundChooser := NewSoundChooser(sp.allSounds)
+	if sp.randomSeed != 0 {
+		soundChooser = NewSoundChooserWithRandom(sp.allSounds, sp.randomSeed)
+	}
+	soundChooser.sequence = sp.sequence
+	soundChooser.cooldown, soundChooser.now = sp.cooldown, sp.time.Now
+	soundChooser.setRandomGroup(sp.rotation.ActiveGroup(sp.nextDayStart().Add(-24 * time.Hour)))
+	return soundChooser
+}
+
+// playAtRandomTimes plays a combo's bursts at random times through its window.  Each gap between bursts is
+// the combo's minimum gap plus an exponentially distributed time, chosen so that on average they play at
+// the combo's rate.  The chooser's random numbers are used, so a seeded player picks the same times.  It
+// stops at the end of the window, if carryOn says the combo should stop, or if the clock jumps, when
+// it returns how far.
+func (sp SchedulePlayer) playAtRandomTimes(combo Combo, win *window.Window, chooser *SoundChooser, carryOn func() bool) time.Duration {
+	if toWindow := win.Until(); toWindow > 0 {
+		log.Printf("sleeping until next window (%s)", toWindow)
+		if jump := sp.wait(toWindow); jump != 0 {
+			return jump
+		}
+		if !carryOn() {
+			return 0
+		}
+	}
+	minGap := time.Duration(combo.MinGap) * time.Second
+	meanGap := time.Duration(float64(time.Hour) / combo.PlaysPerHour)
+	for {
+		gap := minGap
+		if meanGap > minGap {
+			gap += time.Duration(chooser.random.ExpFloat64() * float64(meanGap-minGap))
+		}
+		untilEnd := win.UntilEnd()
+		if gap >= untilEnd {
+			log.Print("No more random bursts in window, sleeping until end of window")
+			return sp.wait(untilEnd)
+		}
+		log.Printf("Sleeping %v until next random burst", gap)
+		if jump := sp.wait(gap); jump != 0 {
+			return jump
+		}
+		if !carryOn() {
+			return 0
+		}
+		if jump := sp.playSounds(combo, chooser); jump != 0 {
+			return jump
 		}
 	}
 }
 
-// createWindow creates a window with the times specified in the combo definition
+// createWindow creates a window with the times specified in the combo definition.  The times are in the
+// combo's timezone, or else the schedule's, so the window compares them with the time there.
 func (sp SchedulePlayer) createWindow(combo Combo) *window.Window {
-	win := window.New(combo.From.Time, combo.Until.Time)
+	win := window.New(combo.FromTime().Time, combo.UntilTime().Time)
 	win.Now = sp.time.Now
+	timezone := combo.Timezone
+	if timezone == "" {
+		timezone = sp.timezone
+	}
+	if loc, err := loadTimezone(timezone); err != nil {
+		log.Printf("Using device time for combo: %v", err)
+	} else if loc != nil {
+		win.Now = func() time.Time { return sp.time.Now().In(loc) }
+	}
 	return win
 }
 
-// playSounds plays the sounds for a combo.
-func (sp SchedulePlayer) playSounds(combo Combo, chooser *SoundChooser) {
+// playSounds plays a burst of the sounds for a combo, playing them as many times as the combo repeats.
+// If the clock jumps the rest of the burst isn't played, and how far it jumped is returned.
+func (sp SchedulePlayer) playSounds(combo Combo, chooser *SoundChooser) time.Duration {
 	log.Print("Starting sound burst")
-	for count := 0; count < len(combo.Sounds); count++ {
-		sp.time.Wait(time.Duration(combo.Waits[count]) * time.Second)
-		file_id, soundFilename := chooser.ChooseSound(combo.Sounds[count])
+	if sp.skipMoonGated(combo) {
+		return 0
+	}
+	fileIds := combo.EffectiveSounds(chooser)
+	fileIds = sp.skipCoolingDown(combo, fileIds)
+	for repeat := 0; repeat < combo.repeats(); repeat++ {
+		if repeat > 0 {
+			log.Print("Repeating sound burst")
+			if jump := sp.wait(time.Duration(combo.RepeatGap) * time.Second); jump != 0 {
+				return jump
+			}
+		}
+		if jump := sp.playSequence(combo, fileIds, repeat == 0); jump != 0 {
+			return jump
+		}
+	}
+	return 0
+}
+
+// playSequence plays the sounds of one run through a combo, with the pre-roll before the first sound
+// played if first is set.
+func (sp SchedulePlayer) playSequence(combo Combo, fileIds []int, first bool) time.Duration {
+	if jump, crossfaded := sp.playCrossfaded(combo, fileIds, first); crossfaded {
+		return jump
+	}
+	preRolled := !first
+	for count, file_id := range fileIds {
+		if jump := sp.wait(time.Duration(combo.Waits[count]) * time.Second); jump != 0 {
+			return jump
+		}
 		if file_id > 0 {
-			soundFilePath := filepath.Join(sp.filesDir, soundFilename)
+			soundFilePath := filepath.Join(sp.filesDir, sp.allSounds[file_id])
 			volume := combo.Volumes[count]
 			now := sp.time.Now()
+			if sp.isQuietTime() {
+				log.Printf("Not playing sound %s during quiet hours", soundFilePath)
+				sp.recordSkipped(combo, now, file_id, volume, SkippedQuietHours)
+				continue
+			}
+			if sp.pause.isPaused() {
+				log.Printf("Not playing sound %s while paused", soundFilePath)
+				sp.recordSkipped(combo, now, file_id, volume, SkippedPaused)
+				continue
+			}
+			// The slot is taken before the hook runs, so a sound that is dropped never switches on what
+			// the hooks control.
+			if !sp.playLimit.acquire() {
+				log.Printf("Not playing sound %s as too many sounds are already playing", soundFilePath)
+				sp.recordSkipped(combo, now, file_id, volume, SkippedTooManyPlaying)
+				continue
+			}
+			play := PlayInfo{FileId: file_id, Volume: volume, Time: now}
+			if err := sp.runBeforePlay(play); err != nil {
+				sp.playLimit.release()
+				log.Printf("Not playing sound %s: %v", soundFilePath, err)
+				sp.recordSkipped(combo, now, file_id, volume, SkippedBeforePlayHook)
+				continue
+			}
+			if preRoll := sp.comboPreRoll(combo); !preRolled && preRoll > 0 {
+				if jump := sp.wait(preRoll); jump != 0 {
+					sp.playLimit.release()
+					return jump
+				}
+				now = sp.time.Now()
+			}
+			preRolled = true
 			log.Printf("Playing sound %s", soundFilePath)
-			if err := sp.player.Play(soundFilePath, volume); err != nil {
-				log.Printf("Play failed: %v", err)
-			} else if sp.recorder != nil {
-				sp.recorder.OnAudioBaitPlayed(now, file_id, volume)
+			options := combo.playOptions()
+			hint := sp.loudness[file_id]
+			options.GainDB, options.TargetLUFS = hint.GainDB, hint.TargetLUFS
+			play.Err = sp.playSound(combo, file_id, soundFilePath, volume, options)
+			sp.playLimit.release()
+			play.Duration = sp.time.Now().Sub(now)
+			if play.Err != nil {
+				log.Printf("Play failed: %v", play.Err)
+				sp.recordFailed(now, file_id, volume, play.Err)
+			} else {
+				sp.cooldown.played(file_id, now)
+				if sp.recorder != nil {
+					sp.recorder.OnAudioBaitPlayed(now, file_id, volume)
+				}
 			}
-		} else {
+			if finishedRecorder, ok := sp.recorder.(PlayFinishedRecorder); ok {
+				finishedRecorder.OnPlayFinished(play)
+			}
+			sp.runAfterPlay(play)
+		} else if file_id != coolingDown {
 			log.Printf("Could not play %s.  Either sound does not exist or this option cannot be parsed.", combo.Sounds[count])
+			if missingId, err := strconv.Atoi(combo.Sounds[count]); err == nil {
+				now := sp.time.Now()
+				sp.recordFailed(now, missingId, combo.Volumes[count], ErrSoundNotAvailable)
+				if skipRecorder, ok := sp.recorder.(PlaySkippedRecorder); ok {
+					skipRecorder.OnPlaySkipped(newSkippedPlay(combo, now, missingId, combo.Volumes[count], SkippedMissingFile))
+				}
+			}
 		}
 	}
+	return 0
+}
+
+// recordFailed tells the recorder, if it is interested, that a sound couldn't be played.
+func (sp SchedulePlayer) recordFailed(ts time.Time, fileId int, volume int, err error) {
+	if failRecorder, ok := sp.recorder.(SoundFailedRecorder); ok {
+		failRecorder.OnAudioBaitFailed(ts, fileId, volume, err)
+	}
+}
+
+// recordMuted tells the recorder, if it is interested, that sounds aren't being played because the
+// schedule is muted.
+func (sp SchedulePlayer) recordMuted(ts time.Time) {
+	if mutedRecorder, ok := sp.recorder.(ScheduleMutedRecorder); ok {
+		mutedRecorder.OnScheduleMuted(ts)
+	}
+}
+
+// recordSkipped tells the recorder, if it is interested, that a sound in combo was not played.
+func (sp SchedulePlayer) recordSkipped(combo Combo, ts time.Time, fileId int, volume int, reason string) {
+	if skipRecorder, ok := sp.recorder.(PlaySkippedRecorder); ok {
+		skipRecorder.OnPlaySkipped(newSkippedPlay(combo, ts, fileId, volume, reason))
+	} else if skipRecorder, ok := sp.recorder.(SoundSkippedRecorder); ok {
+		skipRecorder.OnAudioBaitSkipped(ts, fileId, volume, reason)
+	}
+}
+
+func newSkippedPlay(combo Combo, ts time.Time, fileId int, volume int, reason string) SkippedPlay {
+	return SkippedPlay{
+		Time:   ts,
+		FileId: fileId,
+		Volume: volume,
+		Reason: reason,
+		From:   combo.FromTime(),
+		Until:  combo.UntilTime(),
+	}
 }
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -24,13 +25,22 @@ type TestClockAndAudioDevice struct {
 	NowTime     time.Time
 	PlayTimes   []string
 	ErrorOnPlay bool
+	LastOptions PlayOptions
+	SkipTimes   []string
+	FailTimes   []string
+	MuteTimes   []string
+
+	// JumpAt, if set, makes the clock jump by JumpBy during the first wait that passes it.
+	JumpAt time.Time
+	JumpBy time.Duration
 }
 
-func (p *TestClockAndAudioDevice) Play(audioFileName string, _ int) error {
+func (p *TestClockAndAudioDevice) Play(audioFileName string, _ int, options PlayOptions) error {
 	if p.ErrorOnPlay {
 		fmt.Println("Did not play sound")
 		return errors.New("Pretending to not play successfully")
 	}
+	p.LastOptions = options
 	return nil
 }
 
@@ -40,6 +50,10 @@ func (t *TestClockAndAudioDevice) Now() time.Time {
 
 func (t *TestClockAndAudioDevice) Wait(duration time.Duration) {
 	t.NowTime = t.NowTime.Add(duration).Add(time.Microsecond)
+	if !t.JumpAt.IsZero() && !t.NowTime.Before(t.JumpAt) {
+		t.NowTime = t.NowTime.Add(t.JumpBy)
+		t.JumpAt = time.Time{}
+	}
 }
 
 func (t *TestClockAndAudioDevice) SetDay(day int, month time.Month) {
@@ -54,6 +68,20 @@ func (t *TestClockAndAudioDevice) OnAudioBaitPlayed(ts time.Time, fileId int, vo
 	fmt.Println(playingString)
 }
 
+func (t *TestClockAndAudioDevice) OnAudioBaitSkipped(ts time.Time, fileId int, volume int, reason string) {
+	nowTimeAsString := fmt.Sprintf("%02d:%02d:%02d", ts.Hour(), ts.Minute(), ts.Second())
+	t.SkipTimes = append(t.SkipTimes, fmt.Sprintf("%s: Skipped %s (%s)", nowTimeAsString, soundFiles[fileId], reason))
+}
+
+func (t *TestClockAndAudioDevice) OnAudioBaitFailed(ts time.Time, fileId int, volume int, err error) {
+	nowTimeAsString := fmt.Sprintf("%02d:%02d:%02d", ts.Hour(), ts.Minute(), ts.Second())
+	t.FailTimes = append(t.FailTimes, fmt.Sprintf("%s: Failed %d (%v)", nowTimeAsString, fileId, err))
+}
+
+func (t *TestClockAndAudioDevice) OnScheduleMuted(ts time.Time) {
+	t.MuteTimes = append(t.MuteTimes, fmt.Sprintf("%02d:%02d:%02d", ts.Hour(), ts.Minute(), ts.Second()))
+}
+
 func registerPlaySound(playTime, audioFileName string) string {
 	return fmt.Sprintf("%s: Playing %s", playTime, audioFileName)
 }
@@ -225,6 +253,299 @@ func TestRecorderIsNotCalledWhenSoundIsNotPlayed(t *testing.T) {
 	assert.Equal(t, testRecorder.PlayTimes, expectedPlayedTimes)
 }
 
+func TestRecorderIsToldWhenSoundFails(t *testing.T) {
+	combo := createCombo("12:01", "12:40", 30, "beep")
+	combo.Sounds = []string{"3"}
+	missing := createCombo("13:01", "13:20", 30, "beep")
+	missing.Sounds = []string{"99"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	testRecorder.ErrorOnPlay = true
+	schedulePlayer.playCombo(combo)
+	schedulePlayer.playCombo(missing)
+
+	assert.Equal(t, []string{
+		"12:01:00: Failed 3 (Pretending to not play successfully)",
+		"12:31:00: Failed 3 (Pretending to not play successfully)",
+		"13:01:00: Failed 99 (sound file not available)",
+	}, testRecorder.FailTimes)
+}
+
+// skipDetailsRecorder records the details of the sounds that were skipped.
+type skipDetailsRecorder struct {
+	TestClockAndAudioDevice
+	Skips []SkippedPlay
+}
+
+func (r *skipDetailsRecorder) OnPlaySkipped(skip SkippedPlay) {
+	r.Skips = append(r.Skips, skip)
+}
+
+func TestSkippedSoundsAreRecordedWithTheirWindow(t *testing.T) {
+	quiet := createCombo("12:01", "12:20", 30, "beep")
+	quiet.Sounds = []string{"3"}
+	missing := createCombo("13:01", "13:20", 30, "beep")
+	missing.Sounds = []string{"99"}
+
+	_, testClock := createPlayer("12:00")
+	recorder := &skipDetailsRecorder{}
+	schedulePlayer := newSchedulePlayerWithClock(testClock, testClock, soundFiles, "")
+	schedulePlayer.SetRecorder(recorder)
+	schedulePlayer.SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("12:00"), Until: *NewTimeOfDay("12:30")}})
+	schedulePlayer.playCombo(quiet)
+	schedulePlayer.playCombo(missing)
+
+	assert.Equal(t, 2, len(recorder.Skips))
+	assert.Equal(t, SkippedQuietHours, recorder.Skips[0].Reason)
+	assert.Equal(t, 3, recorder.Skips[0].FileId)
+	assert.Equal(t, "12:01", recorder.Skips[0].From.Format("15:04"))
+	assert.Equal(t, "12:20", recorder.Skips[0].Until.Format("15:04"))
+	assert.Equal(t, SkippedMissingFile, recorder.Skips[1].Reason)
+	assert.Equal(t, 99, recorder.Skips[1].FileId)
+	assert.Equal(t, "13:01", recorder.Skips[1].From.Format("15:04"))
+	assert.Empty(t, recorder.SkipTimes)
+	assert.Equal(t, []string{"13:01:00: Failed 99 (sound file not available)"}, recorder.FailTimes)
+}
+
+func TestComboRepeatsItsSoundsInEachBurst(t *testing.T) {
+	combo := createCombo("12:01", "12:40", 30, "beep")
+	addAnotherSound(&combo, 10, "tweet")
+	combo.Repeat = 2
+	combo.RepeatGap = 60
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{
+		"12:01:00: Playing beep",
+		"12:01:10: Playing tweet",
+		"12:02:10: Playing beep",
+		"12:02:20: Playing tweet",
+		"12:31:00: Playing beep",
+		"12:31:10: Playing tweet",
+		"12:32:10: Playing beep",
+		"12:32:20: Playing tweet",
+	}, testRecorder.PlayTimes)
+}
+
+func TestComboRepeatsRespectQuietHours(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+	combo.Repeat = 3
+	combo.RepeatGap = 60
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("12:02"), Until: *NewTimeOfDay("12:03")}})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:03:00: Playing beep"}, testRecorder.PlayTimes)
+	assert.Equal(t, []string{"12:02:00: Skipped beep (quietHours)"}, testRecorder.SkipTimes)
+}
+
+// finishedRecorder records the sounds that finished playing.
+type finishedRecorder struct {
+	TestClockAndAudioDevice
+	Finished []PlayInfo
+}
+
+func (r *finishedRecorder) OnPlayFinished(play PlayInfo) {
+	r.Finished = append(r.Finished, play)
+}
+
+func TestFinishedSoundsAreRecorded(t *testing.T) {
+	combo := createCombo("12:01", "12:40", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	_, testClock := createPlayer("12:00")
+	recorder := &finishedRecorder{}
+	schedulePlayer := newSchedulePlayerWithClock(testClock, testClock, soundFiles, "")
+	schedulePlayer.SetRecorder(recorder)
+	schedulePlayer.playCombo(combo)
+	testClock.ErrorOnPlay = true
+	schedulePlayer.playCombo(createCombo("13:01", "13:20", 30, "beep"))
+
+	assert.Equal(t, 3, len(recorder.Finished))
+	assert.Equal(t, 3, recorder.Finished[0].FileId)
+	assert.Equal(t, "12:31:00", recorder.Finished[1].Time.Format("15:04:05"))
+	assert.Nil(t, recorder.Finished[1].Err)
+	assert.NotNil(t, recorder.Finished[2].Err)
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:31:00: Playing beep"}, recorder.PlayTimes)
+}
+
+func TestComboSegmentIsPassedToAudioDevice(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "howl")
+	combo.Offset = 5
+	combo.Duration = 20
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, PlayOptions{Offset: 5 * time.Second, Duration: 20 * time.Second}, testRecorder.LastOptions)
+}
+
+func TestLoudnessHintIsPassedToAudioDevice(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetLoudnessHints(map[int]LoudnessHint{3: {GainDB: -3.5, TargetLUFS: -20}})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, PlayOptions{GainDB: -3.5, TargetLUFS: -20}, testRecorder.LastOptions)
+}
+
+func TestPreRollIsWaitedBeforeFirstSoundOfBurst(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 10, "beep")
+	combo.Sounds = []string{"3"}
+	addAnotherSound(&combo, 30, "tweet")
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetPreRoll(2 * time.Second)
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{
+		registerPlaySound("12:01:02", "beep"),
+		registerPlaySound("12:01:32", "tweet"),
+		registerPlaySound("12:11:02", "beep"),
+		registerPlaySound("12:11:32", "tweet"),
+	}, testRecorder.PlayTimes)
+}
+
+func TestComboPreRollIsWaitedForRandomSounds(t *testing.T) {
+	combo := createCombo("12:01", "12:05", 10, "random")
+	combo.PreRoll = 1.5
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetPreRoll(10 * time.Second)
+	schedulePlayer.playCombo(combo)
+
+	if assert.Equal(t, 1, len(testRecorder.PlayTimes)) {
+		assert.Regexp(t, "^12:01:01: Playing ", testRecorder.PlayTimes[0])
+	}
+}
+
+func TestPlaysPerHourPlaysAtRandomTimes(t *testing.T) {
+	combo := createCombo("12:01", "16:01", 0, "beep")
+	combo.Sounds = []string{"3"}
+	combo.PlaysPerHour = 6
+	combo.MinGap = 300
+
+	playRandomTimes := func() []string {
+		schedulePlayer, testRecorder := createPlayer("12:00")
+		schedulePlayer.randomSeed = 42
+		schedulePlayer.playCombo(combo)
+		return testRecorder.PlayTimes
+	}
+	plays := playRandomTimes()
+	assert.Equal(t, plays, playRandomTimes())
+	assert.InDelta(t, 24, len(plays), 12)
+
+	var gaps []time.Duration
+	previous := NewTimeOfDay("12:01").Time
+	for _, play := range plays {
+		playTime, err := time.Parse("15:04:05", strings.TrimSuffix(play, ": Playing beep"))
+		assert.Nil(t, err)
+		assert.True(t, playTime.Before(NewTimeOfDay("16:01").Time), play)
+		gap := playTime.Sub(previous)
+		assert.True(t, gap >= 300*time.Second, "%v before %s", gap, play)
+		gaps = append(gaps, gap)
+		previous = playTime
+	}
+	assert.NotEqual(t, gaps[0], gaps[1])
+	assert.NotEqual(t, gaps[1], gaps[2])
+}
+
+func TestMutedScheduleDoesNotPlay(t *testing.T) {
+	schedule := Schedule{Muted: true, Combos: []Combo{createCombo("12:01", "12:20", 5, "beep")}}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	testRecorder.NowTime = testRecorder.NowTime.Add(time.Second)
+	schedulePlayer.PlayTodaysSchedule(schedule)
+
+	assert.Equal(t, []string{}, testRecorder.PlayTimes)
+	assert.Equal(t, []string{"12:00:01"}, testRecorder.MuteTimes)
+}
+
+func TestMutingScheduleStopsAtNextBurst(t *testing.T) {
+	howl := createCombo("21:00", "22:10", 30, "howl")
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{howl}}
+	muted := schedule
+	muted.Muted = true
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 15, 0, 0, time.UTC), muted)
+	plays := sim.Run(schedule, 1)
+
+	assert.Equal(t, []string{"21:00 howl"}, describePlays(plays))
+}
+
+func TestUnmutingScheduleCarriesOnPlaying(t *testing.T) {
+	howl := createCombo("21:00", "22:10", 30, "howl")
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{howl}}
+	muted := schedule
+	muted.Muted = true
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 15, 0, 0, time.UTC), muted)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 40, 0, 0, time.UTC), schedule)
+	plays := sim.Run(schedule, 1)
+
+	assert.Equal(t, []string{"21:00 howl", "22:00 howl"}, describePlays(plays))
+}
+
+func TestScheduleMutedAtTheStartPlaysOnceUnmuted(t *testing.T) {
+	howl := createCombo("21:00", "22:10", 30, "howl")
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{howl}}
+	muted := schedule
+	muted.Muted = true
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 20, 0, 0, time.UTC), schedule)
+	plays := sim.Run(muted, 1)
+
+	assert.Equal(t, []string{"21:30 howl", "22:00 howl"}, describePlays(plays))
+}
+
+func TestNoSoundsPlayDuringQuietHours(t *testing.T) {
+	combos := []Combo{createCombo("23:00", "02:00", 60, "tweet")}
+
+	schedulePlayer, testRecorder := createPlayer("22:30")
+	schedulePlayer.SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("23:30"), Until: *NewTimeOfDay("01:30")}})
+	schedulePlayer.playTodaysCombos(combos)
+
+	assert.Equal(t, []string{registerPlaySound("23:00:00", "tweet")}, testRecorder.PlayTimes)
+	assert.Equal(t, []string{
+		"00:00:00: Skipped tweet (quietHours)",
+		"01:00:00: Skipped tweet (quietHours)",
+	}, testRecorder.SkipTimes)
+}
+
+func TestQuietHoursCanCrossMidnight(t *testing.T) {
+	quietHours := []TimeWindow{{From: *NewTimeOfDay("23:30"), Until: *NewTimeOfDay("01:30")}}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2018, time.April, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	assert.False(t, IsQuietTime(quietHours, at(23, 0)))
+	assert.True(t, IsQuietTime(quietHours, at(23, 45)))
+	assert.True(t, IsQuietTime(quietHours, at(1, 0)))
+	assert.False(t, IsQuietTime(quietHours, at(2, 0)))
+	assert.False(t, IsQuietTime(nil, at(1, 0)))
+}
+
+func TestStartupSoundIsNotPlayedDuringQuietHours(t *testing.T) {
+	schedulePlayer, _ := createPlayer("23:45")
+
+	played, err := schedulePlayer.PlayStartupSound(1, 5)
+	assert.True(t, played)
+	assert.Nil(t, err)
+
+	schedulePlayer.SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("23:30"), Until: *NewTimeOfDay("01:30")}})
+	played, err = schedulePlayer.PlayStartupSound(1, 5)
+	assert.False(t, played)
+	assert.Nil(t, err)
+}
+
 func createCombo(timeStart, timeEnd string, everyMinutes int, soundName string) Combo {
 	return Combo{
 		From:    *NewTimeOfDay(timeStart),
@@ -245,7 +566,7 @@ func addAnotherSound(combo *Combo, wait int, sound string) *Combo {
 
 func makeSoundNameForSchedule(soundName string) string {
 	scheduleIdentifier := soundName
-	if soundName != "same" && soundName != "random" {
+	if soundName != "same" && soundName != "random" && soundName != "sequence" {
 		soundId := len(soundFiles) + 3
 		soundFiles[soundId] = soundName
 		scheduleIdentifier = strconv.Itoa(soundId)
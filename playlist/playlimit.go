@@ -0,0 +1,61 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+// SkippedTooManyPlaying is the reason given when a sound is not played because as many sounds as
+// the play limit allows are already playing.
+const SkippedTooManyPlaying = "tooManyPlaying"
+
+// PlayLimit limits how many sounds can play at once across all of the players that share it.  When
+// the limit is reached a new sound either waits for one of the others to finish or, if the limit drops
+// sounds, isn't played.
+type PlayLimit struct {
+	slots chan struct{}
+	drop  bool
+}
+
+// NewPlayLimit creates a limit of max sounds playing at once.  If drop is set sounds over the limit are
+// skipped rather than waiting their turn.
+func NewPlayLimit(max int, drop bool) *PlayLimit {
+	return &PlayLimit{slots: make(chan struct{}, max), drop: drop}
+}
+
+// copy creates a limit of as many sounds as this one, with none of them playing.
+func (limit *PlayLimit) copy() *PlayLimit {
+	if limit == nil {
+		return nil
+	}
+	return NewPlayLimit(cap(limit.slots), limit.drop)
+}
+
+// acquire takes a slot for a sound to play in, returning false if the sound should be dropped.  A nil
+// limit never stops a sound playing.
+func (limit *PlayLimit) acquire() bool {
+	if limit == nil {
+		return true
+	}
+	if !limit.drop {
+		limit.slots <- struct{}{}
+		return true
+	}
+	select {
+	case limit.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func (limit *PlayLimit) release() {
+	if limit != nil {
+		<-limit.slots
+	}
+}
+
+// SetPlayLimit sets a limit on how many sounds can play at once, which can be shared with other players.
+func (sp *SchedulePlayer) SetPlayLimit(limit *PlayLimit) {
+	sp.playLimit = limit
+}
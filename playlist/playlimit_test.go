@@ -0,0 +1,96 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlayLimitDropsSoundsOverTheLimit(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	limit := NewPlayLimit(1, true)
+	limit.acquire()
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetPlayLimit(limit)
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, testRecorder.PlayTimes)
+	assert.Equal(t, []string{"12:01:00: Skipped beep (tooManyPlaying)"}, testRecorder.SkipTimes)
+}
+
+func TestPlayHooksDontRunForSoundsOverTheLimit(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Sounds = []string{"3"}
+	combo.PreRoll = 2
+
+	limit := NewPlayLimit(1, true)
+	limit.acquire()
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetPlayLimit(limit)
+	var before, after int
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		before++
+		return nil
+	})
+	schedulePlayer.OnAfterPlay(func(play PlayInfo) {
+		after++
+	})
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, 0, before)
+	assert.Equal(t, 0, after)
+	// The sound is skipped straight away, without waiting for the pre-roll.
+	assert.Equal(t, []string{"12:01:00: Skipped beep (tooManyPlaying)"}, testRecorder.SkipTimes)
+
+	limit.release()
+	schedulePlayer.OnBeforePlay(func(play PlayInfo) error {
+		before++
+		return errors.New("amplifier broken")
+	})
+	schedulePlayer.playCombo(createCombo("13:01", "13:20", 30, "beep"))
+	assert.Equal(t, 1, before)
+	// The slot is freed when the hook stops the sound.
+	assert.True(t, limit.acquire())
+}
+
+func TestPlayLimitIsFreedAfterEachSound(t *testing.T) {
+	combo := createCombo("12:01", "13:03", 30, "beep")
+	combo.Sounds = []string{"3"}
+
+	schedulePlayer, testRecorder := createPlayer("12:00")
+	schedulePlayer.SetPlayLimit(NewPlayLimit(1, true))
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{
+		registerPlaySound("12:01:00", "beep"),
+		registerPlaySound("12:31:00", "beep"),
+		registerPlaySound("13:01:00", "beep"),
+	}, testRecorder.PlayTimes)
+	assert.Empty(t, testRecorder.SkipTimes)
+}
+
+func TestPlayLimitQueuesSoundsOverTheLimit(t *testing.T) {
+	speaker := &overlapCounter{}
+	limit := NewPlayLimit(2, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, limit.acquire())
+			defer limit.release()
+			speaker.Play("howl", 5, PlayOptions{})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 2, speaker.maxPlaying)
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayClock is a clock that runs from a time in the past, optionally faster than real time, so that a
+// past audiobait day can be played again.  All of its time is sped up, so while a sound plays for as
+// long as it really does, the replayed time moves on by speed times as much.
+type ReplayClock struct {
+	mu        sync.Mutex
+	start     time.Time
+	realStart time.Time
+	speed     float64
+
+	// realNow and sleep are the real clock, replaced for testing.
+	realNow func() time.Time
+	sleep   func(time.Duration)
+}
+
+// NewReplayClock creates a clock that starts at start and runs speed times faster than real time.  A
+// speed of 1 or less runs at real time.
+func NewReplayClock(start time.Time, speed float64) *ReplayClock {
+	return newReplayClock(start, speed, time.Now, time.Sleep)
+}
+
+func newReplayClock(start time.Time, speed float64, realNow func() time.Time, sleep func(time.Duration)) *ReplayClock {
+	if speed < 1 {
+		speed = 1
+	}
+	return &ReplayClock{
+		start:     start,
+		realStart: realNow(),
+		speed:     speed,
+		realNow:   realNow,
+		sleep:     sleep,
+	}
+}
+
+// Now gets the replayed time.
+func (clock *ReplayClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	elapsed := clock.realNow().Sub(clock.realStart)
+	return clock.start.Add(time.Duration(float64(elapsed) * clock.speed))
+}
+
+// Wait waits for the given amount of replayed time.
+func (clock *ReplayClock) Wait(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	clock.sleep(time.Duration(float64(duration) / clock.speed))
+}
+
+// NewReplayPlayer creates a schedule player that plays the audiobait day starting on the given date
+// again, with the day's times in loc, the device's timezone.  Which combos play, and whether it is a
+// control day, are worked out for that date just as they were at the time.  Playing the schedule
+// through it replays the day from its start, speed times faster than real time.
+func NewReplayPlayer(audioDevice AudioDevice, allSoundsMap map[int]string, filesDirectory string,
+	date time.Time, loc *time.Location, speed float64) *SchedulePlayer {
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, loc)
+	// Start just after midday, as the player treats midday itself as the end of the previous day.
+	clock := NewReplayClock(dayStart.Add(time.Nanosecond), speed)
+	return newSchedulePlayerWithClock(audioDevice, clock, allSoundsMap, filesDirectory)
+}
+
+// NewReplayMultiPlayer creates a player for the given zones that replays the audiobait day starting on
+// the given date, as NewReplayPlayer does.
+func NewReplayMultiPlayer(zones map[string]AudioDevice, allSoundsMap map[int]string, filesDirectory string,
+	date time.Time, loc *time.Location, speed float64) *MultiPlayer {
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, loc)
+	clock := NewReplayClock(dayStart.Add(time.Nanosecond), speed)
+	return newMultiPlayerWithClock(zones, clock, allSoundsMap, filesDirectory)
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayClockRunsFaster(t *testing.T) {
+	realTime := time.Date(2020, time.March, 1, 9, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	clock := newReplayClock(time.Date(2018, time.April, 1, 12, 0, 0, 0, time.UTC), 60,
+		func() time.Time { return realTime },
+		func(duration time.Duration) { slept += duration; realTime = realTime.Add(duration) })
+
+	clock.Wait(time.Hour)
+	assert.Equal(t, time.Minute, slept)
+	assert.Equal(t, time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), clock.Now())
+}
+
+func TestReplayPlaysThePastDay(t *testing.T) {
+	schedule := Schedule{
+		ControlNights: 1,
+		PlayNights:    1,
+		Combos:        []Combo{createCombo("21:00", "22:30", 30, "howl")},
+	}
+
+	for _, test := range []struct {
+		day   int
+		plays []string
+	}{
+		{1, []string{"21:00:00: Playing howl", "21:30:00: Playing howl", "22:00:00: Playing howl"}},
+		{2, []string{}},
+	} {
+		device := new(TestClockAndAudioDevice)
+		device.PlayTimes = []string{}
+		player := NewReplayPlayer(device, soundFiles, "", time.Date(2018, time.April, test.day, 0, 0, 0, 0, time.UTC), time.UTC, 600)
+		player.SetRecorder(device)
+
+		realTime := time.Date(2020, time.March, 1, 9, 0, 0, 0, time.UTC)
+		var slept time.Duration
+		clock := player.time.(*ReplayClock)
+		clock.realStart = realTime
+		clock.realNow = func() time.Time { return realTime }
+		clock.sleep = func(duration time.Duration) { slept += duration; realTime = realTime.Add(duration) }
+
+		player.PlayTodaysSchedule(schedule)
+		assert.Equal(t, test.plays, device.PlayTimes)
+		assert.Equal(t, time.Date(2018, time.April, test.day+1, 12, 0, 0, 0, time.UTC), clock.Now().Round(time.Second))
+		assert.InDelta(t, float64(24*time.Hour/600), float64(slept), float64(time.Second))
+	}
+}
+
+func TestReplayMultiPlayerPlaysThePastDayOnItsZones(t *testing.T) {
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{createCombo("21:00", "22:00", 30, "howl")}}
+	device := new(TestClockAndAudioDevice)
+	zones := NewReplayMultiPlayer(map[string]AudioDevice{"north": device}, soundFiles, "",
+		time.Date(2018, time.April, 1, 0, 0, 0, 0, time.UTC), time.UTC, 600)
+	zones.SetRecorder(device)
+
+	realTime := time.Date(2020, time.March, 1, 9, 0, 0, 0, time.UTC)
+	clock := zones.settings.time.(*ReplayClock)
+	clock.realStart = realTime
+	clock.realNow = func() time.Time { return realTime }
+	clock.sleep = func(duration time.Duration) { realTime = realTime.Add(duration) }
+
+	assert.NoError(t, zones.PlayTodaysSchedules([]ZoneSchedule{{Zone: "north", Schedule: schedule}}))
+	assert.Equal(t, []string{"21:00:00: Playing howl", "21:30:00: Playing howl"}, device.PlayTimes)
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Rotation schemes, which set the order the groups of a rotation are used in.
+const (
+	// RotateInOrder uses the groups in the order they are given.
+	RotateInOrder = "inOrder"
+	// RotateShuffled uses the groups in a different random order each time round the rotation, but
+	// still uses every group once before any is used again.
+	RotateShuffled = "shuffled"
+)
+
+// Rotation splits the sounds that random sounds are chosen from into groups, with a different group
+// used each night, so that animals don't get used to hearing the same sounds.  Which group is used is
+// worked out from the date, so it carries on from the same place after a restart.
+type Rotation struct {
+	// Groups are the IDs of the sounds in each group.  There is no rotation if there are no groups.
+	Groups [][]int
+	// NightsPerGroup is how many nights in a row each group is used.  Zero means one.
+	NightsPerGroup int
+	// Scheme is RotateInOrder, the default, or RotateShuffled.
+	Scheme string
+}
+
+// rotationEpoch is the night the rotation is counted from.
+var rotationEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// nightIndex numbers the audiobait day starting at dayStart, counting up by one each day.
+func nightIndex(dayStart time.Time) int {
+	date := time.Date(dayStart.Year(), dayStart.Month(), dayStart.Day(), 0, 0, 0, 0, time.UTC)
+	// Count in seconds, as a time.Duration only spans about 290 years.
+	return int((date.Unix() - rotationEpoch.Unix()) / (24 * 60 * 60))
+}
+
+// ActiveGroup gets the sounds that random sounds are chosen from on the audiobait day starting at
+// dayStart, or nil if there is no rotation.
+func (rotation Rotation) ActiveGroup(dayStart time.Time) []int {
+	if len(rotation.Groups) == 0 {
+		return nil
+	}
+	nightsPerGroup := rotation.NightsPerGroup
+	if nightsPerGroup < 1 {
+		nightsPerGroup = 1
+	}
+	step := nightIndex(dayStart) / nightsPerGroup
+	groups := len(rotation.Groups)
+	round, position := step/groups, step%groups
+	if position < 0 {
+		round, position = round-1, position+groups
+	}
+
+	if rotation.Scheme == RotateShuffled {
+		order := rand.New(rand.NewSource(int64(round))).Perm(groups)
+		return rotation.Groups[order[position]]
+	}
+	return rotation.Groups[position]
+}
+
+// validateRotation checks the rotation's groups only have sounds from allSounds, and that every one of
+// allSounds is in a group and so gets played at some point in the rotation.
+func validateRotation(rotation Rotation, allSounds []int, addProblem func(format string, args ...interface{})) {
+	if len(rotation.Groups) == 0 {
+		return
+	}
+	if rotation.NightsPerGroup < 0 {
+		addProblem("rotation has negative nightsPerGroup")
+	}
+	if rotation.Scheme != "" && rotation.Scheme != RotateInOrder && rotation.Scheme != RotateShuffled {
+		addProblem("rotation has unknown scheme %q", rotation.Scheme)
+	}
+
+	known := make(map[int]bool, len(allSounds))
+	for _, sound := range allSounds {
+		known[sound] = true
+	}
+	inGroup := make(map[int]bool)
+	for i, group := range rotation.Groups {
+		if len(group) == 0 {
+			addProblem("rotation group %d has no sounds", i)
+		}
+		for _, sound := range group {
+			if !known[sound] {
+				addProblem("rotation group %d has sound %d that isn't one of the schedule's sounds", i, sound)
+			}
+			inGroup[sound] = true
+		}
+	}
+	for _, sound := range allSounds {
+		if !inGroup[sound] {
+			addProblem("sound %d is not in any rotation group", sound)
+		}
+	}
+}
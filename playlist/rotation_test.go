@@ -0,0 +1,81 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rotationGroups(rotation Rotation, firstDay time.Time, nights int) [][]int {
+	groups := make([][]int, nights)
+	for i := range groups {
+		groups[i] = rotation.ActiveGroup(firstDay.AddDate(0, 0, i))
+	}
+	return groups
+}
+
+func TestRotationAdvancesEachNight(t *testing.T) {
+	day := rotationEpoch.Add(12 * time.Hour)
+	rotation := Rotation{Groups: [][]int{{1}, {3}, {4}}}
+	assert.Equal(t, [][]int{{1}, {3}, {4}, {1}}, rotationGroups(rotation, day, 4))
+
+	rotation.NightsPerGroup = 2
+	assert.Equal(t, [][]int{{1}, {1}, {3}, {3}, {4}, {4}, {1}}, rotationGroups(rotation, day, 7))
+
+	// The rotation carries on from the same place whatever day it is started on.
+	assert.Equal(t, [][]int{{3}, {4}, {4}}, rotationGroups(rotation, day.AddDate(0, 0, 3), 3))
+}
+
+func TestShuffledRotationUsesEveryGroupEachRound(t *testing.T) {
+	rotation := Rotation{Groups: [][]int{{1}, {2}, {3}, {4}, {5}}, Scheme: RotateShuffled}
+	// Start at the beginning of a round, so that each run of five nights is a whole round.
+	day := rotationEpoch.Add(12 * time.Hour)
+	for round := 0; round < 4; round++ {
+		groups := rotationGroups(rotation, day.AddDate(0, 0, round*5), 5)
+		assert.ElementsMatch(t, rotation.Groups, groups)
+	}
+}
+
+func TestPlayerChoosesRandomSoundsFromTonightsGroup(t *testing.T) {
+	schedule := Schedule{
+		AllSounds: []int{1, 3},
+		Rotation:  Rotation{Groups: [][]int{{1}, {3}}},
+		Combos:    []Combo{createCombo("12:01", "12:03", 5, "random")},
+	}
+	player, clock := createPlayer("12:00")
+	clock.SetDay(1, time.April)
+	clock.NowTime = clock.NowTime.Add(time.Second)
+	player.PlayTodaysSchedule(schedule)
+	player.PlayTodaysSchedule(schedule)
+
+	firstNight := time.Date(1, time.April, 1, 12, 0, 0, 0, time.UTC)
+	first := schedule.Rotation.ActiveGroup(firstNight)[0]
+	second := schedule.Rotation.ActiveGroup(firstNight.AddDate(0, 0, 1))[0]
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, []string{
+		registerPlaySound("12:01:00", soundFiles[first]),
+		registerPlaySound("12:01:00", soundFiles[second]),
+	}, clock.PlayTimes)
+}
+
+func TestValidateChecksRotation(t *testing.T) {
+	schedule := Schedule{
+		AllSounds: []int{1, 3, 4},
+		Rotation:  Rotation{Groups: [][]int{{1, 7}, {}, {3}}, Scheme: "backwards"},
+	}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{
+			`rotation has unknown scheme "backwards"`,
+			"rotation group 0 has sound 7 that isn't one of the schedule's sounds",
+			"rotation group 1 has no sounds",
+			"sound 4 is not in any rotation group",
+		}, err.(*ValidationError).Problems)
+	}
+}
@@ -6,25 +6,149 @@ package playlist
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Schedule struct {
-	Description   string
-	ControlNights int
-	PlayNights    int
-	StartDay      int
-	Combos        []Combo
-	AllSounds     []int
+	Description   string  `json:"description"`
+	ControlNights int     `json:"controlNights"`
+	PlayNights    int     `json:"playNights"`
+	StartDay      int     `json:"startDay"`
+	Combos        []Combo `json:"combos"`
+	AllSounds     []int   `json:"allSounds"`
+	// Sequence is played through across all of the combos that play the sound "sequence".
+	Sequence Sequence `json:"sequence"`
+	// Timezone is the IANA name, e.g. "Pacific/Auckland", of the timezone the combos' times are in.  If
+	// it isn't set they are in the device's timezone.
+	Timezone string `json:"timezone"`
+	// Rotation limits random sounds to a different group of AllSounds each night.
+	Rotation Rotation `json:"rotation"`
+	// Muted stops any sounds being played, without changing the rest of the schedule, so that a device
+	// can be silenced quickly.
+	Muted bool `json:"muted"`
+	// ConflictPolicy says what plays when combos' windows overlap, one of the Conflict... policies.
+	ConflictPolicy string `json:"conflictPolicy"`
+	// Cooldown is the fewest seconds after a sound plays before it can play again, for the sounds not in
+	// Cooldowns.  Zero uses the device's cooldown.
+	Cooldown int `json:"cooldown"`
+	// Cooldowns gives the cooldown in seconds for particular sounds, keyed by file ID.
+	Cooldowns map[int]int `json:"cooldowns"`
+
+	// RawExtra holds the fields from the server that the schedule doesn't have, keyed by name.
+	RawExtra map[string]json.RawMessage `json:"-"`
 }
 
 type Combo struct {
-	From    TimeOfDay
-	Every   int
-	Until   TimeOfDay
-	Waits   []int
-	Volumes []int
-	Sounds  []string
+	From    TimeOfDay `json:"from"`
+	Every   int       `json:"every"`
+	Until   TimeOfDay `json:"until"`
+	Waits   []int     `json:"waits"`
+	Volumes []int     `json:"volumes"`
+	Sounds  []string  `json:"sounds"`
+	// FromMin and UntilMin give the window as minutes after midnight, 0-1439, instead of as times of
+	// day.  Each one, when set, is used instead of From or Until.
+	FromMin  *int `json:"fromMin"`
+	UntilMin *int `json:"untilMin"`
+	// Offset is the number of seconds into each sound to start playing from.
+	Offset int `json:"offset"`
+	// RandomOffset plays a randomly placed segment of each sound instead of starting at Offset.
+	RandomOffset bool `json:"randomOffset"`
+	// Duration is the number of seconds of each sound to play.  Zero plays the whole sound.
+	Duration int `json:"duration"`
+	// Timezone overrides the schedule's timezone for this combo.
+	Timezone string `json:"timezone"`
+	// PreRoll is the number of seconds of silence before the first sound of each burst, such as for an
+	// amplifier to settle after being switched on.  Zero uses the player's pre-roll.
+	PreRoll float64 `json:"preRoll"`
+	// PlaysPerHour, when set, plays the bursts at random times in the window at this average rate
+	// instead of every Every seconds.
+	PlaysPerHour float64 `json:"playsPerHour"`
+	// MinGap is the fewest seconds between one random burst finishing and the next starting.
+	MinGap int `json:"minGap"`
+	// Pan steers the combo's sounds toward the left (-1) or right (1) speaker, for devices with more than
+	// one.  Zero, the default, plays them from both.
+	Pan float64 `json:"pan"`
+	// Next, when set, is the index in the schedule's combos of a combo to play a burst of straight after
+	// this combo completes, if that combo's window is active then.
+	Next *int `json:"next"`
+	// Repeat is how many times each burst plays the combo's sounds, one after another.  Zero is the same
+	// as one.
+	Repeat int `json:"repeat"`
+	// RepeatGap is the number of seconds between the sounds of a burst finishing and them playing again.
+	RepeatGap int `json:"repeatGap"`
+	// Crossfade is the number of seconds each sound overlaps the one before it, fading in as that one
+	// fades out, on devices that can.  Waits are only used between sounds too short to crossfade.
+	// Combos with RandomOffset set are never crossfaded.
+	Crossfade float64 `json:"crossfade"`
+	// Stream plays the combo's sounds as they are downloaded from the server, instead of downloading
+	// them first, on devices set up to stream.
+	Stream bool `json:"stream"`
+	// MoonGate, when set, only plays the combo on nights when the moon is lit by the right amount.
+	MoonGate *MoonGate `json:"moonGate"`
+
+	// RawExtra holds the fields from the server that the combo doesn't have, keyed by name.
+	RawExtra map[string]json.RawMessage `json:"-"`
+}
+
+// repeats gets how many times each burst plays the combo's sounds.
+func (combo *Combo) repeats() int {
+	if combo.Repeat < 1 {
+		return 1
+	}
+	return combo.Repeat
+}
+
+// EffectiveSounds works out the IDs of the sound files that one burst of this combo will play, using the
+// chooser to resolve random and repeated sounds exactly as the player does.  A zero ID is returned for any
+// sound that can't be played.  Use a chooser from NewSoundChooserWithRandom for repeatable choices.
+//
+// It takes a chooser rather than a date and a random source because what a burst plays depends on more
+// than those: the sounds available, the one before for "same", the sequence's position and the random
+// group all live in the chooser, which the player keeps for the whole day.  The date only matters for
+// moon gated combos, which the player checks before choosing, and is covered by Plan.
+func (combo *Combo) EffectiveSounds(chooser *SoundChooser) []int {
+	fileIds := make([]int, len(combo.Sounds))
+	for i, sound := range combo.Sounds {
+		fileIds[i], _ = chooser.ChooseSound(sound)
+	}
+	return fileIds
+}
+
+// FromTime gets when the combo's window starts, from FromMin if it is set or else From.
+func (combo *Combo) FromTime() TimeOfDay {
+	return minutesOrTimeOfDay(combo.FromMin, combo.From)
+}
+
+// UntilTime gets when the combo's window ends, from UntilMin if it is set or else Until.
+func (combo *Combo) UntilTime() TimeOfDay {
+	return minutesOrTimeOfDay(combo.UntilMin, combo.Until)
+}
+
+const minutesPerDay = 24 * 60
+
+func minutesOrTimeOfDay(minutes *int, timeOfDay TimeOfDay) TimeOfDay {
+	if minutes == nil {
+		return timeOfDay
+	}
+	// The same date as a parsed time of day.
+	return TimeOfDay{Time: time.Date(0, time.January, 1, *minutes/60, *minutes%60, 0, 0, time.UTC)}
+}
+
+// playOptions gets the options for playing the sounds in this combo.
+func (combo *Combo) playOptions() PlayOptions {
+	return PlayOptions{
+		Offset:       time.Duration(combo.Offset) * time.Second,
+		RandomOffset: combo.RandomOffset,
+		Duration:     time.Duration(combo.Duration) * time.Second,
+		Pan:          combo.Pan,
+	}
 }
 
 func ParseJSONConfigFile(jsonAsString string, schedule *Schedule) error {
@@ -34,6 +158,86 @@ func ParseJSONConfigFile(jsonAsString string, schedule *Schedule) error {
 	return err
 }
 
+// UnmarshalJSON decodes a schedule, keeping the fields it doesn't have in RawExtra.
+func (schedule *Schedule) UnmarshalJSON(data []byte) error {
+	type plainSchedule Schedule
+	if err := json.Unmarshal(data, (*plainSchedule)(schedule)); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, reflect.TypeOf(*schedule))
+	schedule.RawExtra = extra
+	logUnknownFields("schedule", extra)
+	return err
+}
+
+// UnmarshalJSON decodes a combo, keeping the fields it doesn't have in RawExtra.
+func (combo *Combo) UnmarshalJSON(data []byte) error {
+	type plainCombo Combo
+	if err := json.Unmarshal(data, (*plainCombo)(combo)); err != nil {
+		return err
+	}
+	extra, err := unknownFields(data, reflect.TypeOf(*combo))
+	combo.RawExtra = extra
+	logUnknownFields("combo", extra)
+	return err
+}
+
+// unknownFields gets the fields of a JSON object that don't match any of the fields of the struct type,
+// matching names regardless of case as the decoder does.  It returns nil if there aren't any.
+func unknownFields(data []byte, structType reflect.Type) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name := range fields {
+		for i := 0; i < structType.NumField(); i++ {
+			field := structType.Field(i)
+			key := field.Name
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				key = tag
+			}
+			if field.PkgPath == "" && strings.EqualFold(name, key) {
+				delete(fields, name)
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+var (
+	loggedUnknownFieldsMu sync.Mutex
+	loggedUnknownFields   = make(map[string]bool)
+)
+
+// logUnknownFields logs the names of fields that aren't used, which could be from a newer server or
+// misspelt.  Each set of names is only logged the first time it is seen, as the schedule is decoded
+// again on every poll.
+func logUnknownFields(what string, extra map[string]json.RawMessage) {
+	if len(extra) == 0 {
+		return
+	}
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	message := fmt.Sprintf("Ignoring unknown %s fields: %s", what, strings.Join(names, ", "))
+
+	loggedUnknownFieldsMu.Lock()
+	defer loggedUnknownFieldsMu.Unlock()
+	if loggedUnknownFields[message] {
+		return
+	}
+	loggedUnknownFields[message] = true
+	log.Print(message)
+}
+
 // GetReferencedSounds finds the sound file ids that required for playing this schedule.
 func (schedule *Schedule) GetReferencedSounds() []int {
 	sounds := make(map[string]bool)
@@ -42,9 +246,20 @@ func (schedule *Schedule) GetReferencedSounds() []int {
 			sounds[sound] = true
 		}
 	}
+	if sounds["sequence"] {
+		for _, sound := range schedule.Sequence.Sounds {
+			sounds[sound] = true
+		}
+	}
 
 	if sounds["random"] {
-		return schedule.AllSounds
+		ids := schedule.AllSounds
+		for sound := range sounds {
+			if fileId, err := strconv.Atoi(sound); err == nil {
+				ids = append(ids[:len(ids):len(ids)], fileId)
+			}
+		}
+		return uniqueIds(ids)
 	}
 
 	ids := make([]int, len(sounds))
@@ -59,6 +274,198 @@ func (schedule *Schedule) GetReferencedSounds() []int {
 	return ids[:i]
 }
 
+// GetSoundsActiveWithin finds the sound file ids needed for the combos that play at some point in the
+// given time after now.  It returns false if it can't work out which combos those are, when all of the
+// schedule's sounds should be used instead.
+func (schedule *Schedule) GetSoundsActiveWithin(now time.Time, within time.Duration) ([]int, bool) {
+	if within <= 0 || within >= 24*time.Hour {
+		return nil, false
+	}
+	end := now.Add(within)
+	active := *schedule
+	active.Combos = []Combo{}
+	// The time can cover two audiobait days, the one now is in and the next one.
+	dayStart := nextDayStart(now).AddDate(0, 0, -1)
+	for _, day := range []time.Time{dayStart, dayStart.AddDate(0, 0, 1)} {
+		if !schedule.isPlayingDay(day) {
+			continue
+		}
+		for _, combo := range schedule.Combos {
+			timezone := combo.Timezone
+			if timezone == "" {
+				timezone = schedule.Timezone
+			}
+			if _, err := loadTimezone(timezone); err != nil {
+				return nil, false
+			}
+			from, until := schedule.comboWindow(combo, day)
+			if from.Before(end) && until.After(now) {
+				active.Combos = append(active.Combos, combo)
+			}
+		}
+	}
+	return active.GetReferencedSounds(), true
+}
+
+// ValidationError lists the problems found when validating a schedule.
+type ValidationError struct {
+	Problems []string
+	// Warnings are the schedule's warnings, which don't make it invalid on their own.
+	Warnings []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid schedule: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks that the schedule can be played.  If it can't a *ValidationError describing
+// all the problems found, and any warnings, is returned.  Warnings alone, such as combos that overlap,
+// don't make a schedule invalid; use Warnings to get them for a valid schedule.
+func (schedule *Schedule) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if schedule.ControlNights < 0 {
+		addProblem("controlNights is negative")
+	}
+	if schedule.PlayNights < 0 {
+		addProblem("playNights is negative")
+	}
+	if _, err := loadTimezone(schedule.Timezone); err != nil {
+		addProblem("unknown timezone %q", schedule.Timezone)
+	}
+	if !validConflictPolicy(schedule.ConflictPolicy) {
+		addProblem("unknown conflict policy %q", schedule.ConflictPolicy)
+	}
+	if schedule.Cooldown < 0 {
+		addProblem("cooldown is negative")
+	}
+	for fileId, cooldown := range schedule.Cooldowns {
+		if cooldown < 0 {
+			addProblem("sound %d has a negative cooldown", fileId)
+		}
+	}
+
+	for i, combo := range schedule.Combos {
+		if len(combo.Sounds) == 0 {
+			addProblem("combo %d has no sounds", i)
+		}
+		if len(combo.Waits) != len(combo.Sounds) || len(combo.Volumes) != len(combo.Sounds) {
+			addProblem("combo %d has %d sounds, %d waits and %d volumes", i, len(combo.Sounds), len(combo.Waits), len(combo.Volumes))
+		}
+		if combo.Every < 0 {
+			addProblem("combo %d has a negative every", i)
+		}
+		if combo.FromMin != nil && (*combo.FromMin < 0 || *combo.FromMin >= minutesPerDay) {
+			addProblem("combo %d has fromMin %d outside 0-%d", i, *combo.FromMin, minutesPerDay-1)
+		}
+		if combo.UntilMin != nil && (*combo.UntilMin < 0 || *combo.UntilMin >= minutesPerDay) {
+			addProblem("combo %d has untilMin %d outside 0-%d", i, *combo.UntilMin, minutesPerDay-1)
+		}
+		if combo.Offset < 0 {
+			addProblem("combo %d has a negative offset", i)
+		}
+		if combo.Duration < 0 {
+			addProblem("combo %d has a negative duration", i)
+		}
+		if combo.PreRoll < 0 {
+			addProblem("combo %d has a negative preRoll", i)
+		}
+		if combo.PlaysPerHour < 0 {
+			addProblem("combo %d has a negative playsPerHour", i)
+		}
+		if combo.Repeat < 0 {
+			addProblem("combo %d has a negative repeat", i)
+		}
+		if combo.RepeatGap < 0 {
+			addProblem("combo %d has a negative repeatGap", i)
+		}
+		if combo.Crossfade < 0 {
+			addProblem("combo %d has a negative crossfade", i)
+		}
+		if combo.MinGap < 0 {
+			addProblem("combo %d has a negative minGap", i)
+		}
+		if gate := combo.MoonGate; gate != nil {
+			if gate.Below < 0 || gate.Below > 100 || gate.Above < 0 || gate.Above > 100 {
+				addProblem("combo %d has a moon gate outside 0-100%%", i)
+			} else if gate.Below > 0 && gate.Above >= gate.Below {
+				addProblem("combo %d has a moon gate that is never met", i)
+			}
+		}
+		if combo.Next != nil && (*combo.Next < 0 || *combo.Next >= len(schedule.Combos)) {
+			addProblem("combo %d has next combo %d, which doesn't exist", i, *combo.Next)
+		}
+		if combo.Pan < -1 || combo.Pan > 1 {
+			addProblem("combo %d has pan %g outside -1 to 1", i, combo.Pan)
+		}
+		if combo.RandomOffset && combo.Duration == 0 {
+			addProblem("combo %d has a random offset but no duration", i)
+		}
+		if _, err := loadTimezone(combo.Timezone); err != nil {
+			addProblem("combo %d has unknown timezone %q", i, combo.Timezone)
+		}
+		for _, wait := range combo.Waits {
+			if wait < 0 {
+				addProblem("combo %d has a negative wait", i)
+			}
+		}
+		for _, volume := range combo.Volumes {
+			if volume < 0 || volume > 10 {
+				addProblem("combo %d has volume %d outside 0-10", i, volume)
+			}
+		}
+		for _, sound := range combo.Sounds {
+			if sound == "random" {
+				if len(schedule.AllSounds) == 0 {
+					addProblem("combo %d plays random sounds but the schedule has no sounds", i)
+				}
+			} else if sound == "sequence" {
+				if len(schedule.Sequence.Sounds) == 0 {
+					addProblem("combo %d plays the sequence but the schedule has no sequence", i)
+				}
+			} else if _, err := strconv.Atoi(sound); err != nil && sound != "same" {
+				addProblem("combo %d has unknown sound %q", i, sound)
+			}
+		}
+	}
+	for _, sound := range schedule.Sequence.Sounds {
+		if _, err := strconv.Atoi(sound); err != nil {
+			addProblem("sequence has unknown sound %q", sound)
+		}
+	}
+	validateRotation(schedule.Rotation, schedule.AllSounds, addProblem)
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems, Warnings: schedule.Warnings()}
+	}
+	return nil
+}
+
+// loadTimezone finds the timezone with the given IANA name.  No name means the device's timezone, for
+// which nil is returned.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// uniqueIds returns the ids with any repeats removed, keeping the original order.
+func uniqueIds(ids []int) []int {
+	seen := make(map[int]bool, len(ids))
+	unique := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
 // CycleLength calculates how many days the play-control cycle is.
 func (schedule *Schedule) CycleLength() int {
 	cycle := schedule.PlayNights + schedule.ControlNights
@@ -67,3 +474,44 @@ func (schedule *Schedule) CycleLength() int {
 	}
 	return 1
 }
+
+// ForDate returns a copy of the schedule containing only the combos that will be played
+// on the audiobait day starting on the given date.  On control days the copy has no combos,
+// so no sounds are referenced and nothing needs to be downloaded.
+func (schedule *Schedule) ForDate(date time.Time) Schedule {
+	filtered := *schedule
+	dayStart := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, date.Location())
+	if !schedule.isPlayingDay(dayStart) {
+		filtered.Combos = []Combo{}
+	}
+	return filtered
+}
+
+// isPlayingDay works out whether sounds should be played on the audiobait day starting at dayStart.
+func (schedule *Schedule) isPlayingDay(dayStart time.Time) bool {
+	if schedule.ControlNights <= 0 {
+		return true
+	}
+
+	firstDay := schedule.StartDay
+	if firstDay < 1 {
+		firstDay = 1
+	}
+
+	dayOfCycle := (dayStart.Day() - firstDay) % schedule.CycleLength()
+	if dayOfCycle < 0 {
+		dayOfCycle += schedule.CycleLength()
+	}
+
+	return dayOfCycle < schedule.PlayNights
+}
+
+// indexOfCombo finds the position of an identical combo in the schedule, or returns -1 if there isn't one.
+func (schedule Schedule) indexOfCombo(combo Combo) int {
+	for i := range schedule.Combos {
+		if reflect.DeepEqual(schedule.Combos[i], combo) {
+			return i
+		}
+	}
+	return -1
+}
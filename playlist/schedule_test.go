@@ -5,7 +5,13 @@
 package playlist
 
 import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -72,3 +78,280 @@ func TestParsingSchedule(t *testing.T) {
 		assert.Equal(t, requiredSounds, schedule.GetReferencedSounds())
 	}
 }
+
+func TestEveryScheduleFieldIsDecoded(t *testing.T) {
+	var schedule Schedule
+	err := ParseJSONConfigFile(`{
+		"description": "Possums",
+		"controlNights": 2,
+		"playNights": 5,
+		"startDay": 3,
+		"allSounds": [4, 5],
+		"sequence": {"sounds": ["4", "5"], "wrap": true},
+		"timezone": "Pacific/Auckland",
+		"rotation": {"groups": [[4], [5]], "nightsPerGroup": 2},
+		"muted": true,
+		"conflictPolicy": "merge",
+		"cooldown": 600,
+		"cooldowns": {"4": 1200},
+		"combos": [{
+			"from": "19:00",
+			"every": 60,
+			"until": "20:00",
+			"waits": [0, 5],
+			"volumes": [7, 8],
+			"sounds": ["4", "same"],
+			"fromMin": 1140,
+			"untilMin": 1200,
+			"offset": 2,
+			"randomOffset": true,
+			"duration": 10,
+			"timezone": "UTC",
+			"preRoll": 1.5,
+			"playsPerHour": 4,
+			"minGap": 30,
+			"pan": -0.5,
+			"next": 0,
+			"repeat": 2,
+			"repeatGap": 3,
+			"crossfade": 0.5,
+			"moonGate": {"below": 30, "above": 5}
+		}]
+	}`, &schedule)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Possums", schedule.Description)
+	assert.Equal(t, 2, schedule.ControlNights)
+	assert.Equal(t, 5, schedule.PlayNights)
+	assert.Equal(t, 3, schedule.StartDay)
+	assert.Equal(t, []int{4, 5}, schedule.AllSounds)
+	assert.Equal(t, Sequence{Sounds: []string{"4", "5"}, Wrap: true}, schedule.Sequence)
+	assert.Equal(t, "Pacific/Auckland", schedule.Timezone)
+	assert.Equal(t, Rotation{Groups: [][]int{{4}, {5}}, NightsPerGroup: 2}, schedule.Rotation)
+	assert.True(t, schedule.Muted)
+	assert.Equal(t, ConflictMerge, schedule.ConflictPolicy)
+	assert.Equal(t, 600, schedule.Cooldown)
+	assert.Equal(t, map[int]int{4: 1200}, schedule.Cooldowns)
+	assert.Nil(t, schedule.RawExtra)
+
+	fromMin, untilMin, next := 1140, 1200, 0
+	assert.Equal(t, Combo{
+		From:         *NewTimeOfDay("19:00"),
+		Every:        60,
+		Until:        *NewTimeOfDay("20:00"),
+		Waits:        []int{0, 5},
+		Volumes:      []int{7, 8},
+		Sounds:       []string{"4", "same"},
+		FromMin:      &fromMin,
+		UntilMin:     &untilMin,
+		Offset:       2,
+		RandomOffset: true,
+		Duration:     10,
+		Timezone:     "UTC",
+		PreRoll:      1.5,
+		PlaysPerHour: 4,
+		MinGap:       30,
+		Pan:          -0.5,
+		Next:         &next,
+		Repeat:       2,
+		RepeatGap:    3,
+		Crossfade:    0.5,
+		MoonGate:     &MoonGate{Below: 30, Above: 5},
+	}, schedule.Combos[0])
+}
+
+func TestUnknownScheduleFieldsAreKept(t *testing.T) {
+	var schedule Schedule
+	err := ParseJSONConfigFile(`{
+		"playNights": 2,
+		"allSounds": [4, 5],
+		"nightLength": 8,
+		"combos": [{"from": "19:00", "every": 60, "until": "20:00", "waits": [0], "volumes": [7], "sounds": ["4"], "fadeIn": true}]
+	}`, &schedule)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, schedule.PlayNights)
+	assert.Equal(t, []int{4, 5}, schedule.AllSounds)
+	assert.Equal(t, []int{0}, schedule.Combos[0].Waits)
+	assert.Equal(t, []int{7}, schedule.Combos[0].Volumes)
+	assert.Equal(t, map[string]json.RawMessage{"nightLength": json.RawMessage("8")}, schedule.RawExtra)
+	assert.Equal(t, map[string]json.RawMessage{"fadeIn": json.RawMessage("true")}, schedule.Combos[0].RawExtra)
+}
+
+func TestUnknownScheduleFieldsAreLoggedOnce(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	decode := func(contents string) {
+		var schedule Schedule
+		assert.NoError(t, ParseJSONConfigFile(contents, &schedule))
+	}
+	decode(`{"playNights": 1, "onceOnlyField": 8}`)
+	decode(`{"playNights": 2, "onceOnlyField": 9}`)
+	assert.Equal(t, 1, strings.Count(logged.String(), "Ignoring unknown schedule fields: onceOnlyField\n"))
+
+	decode(`{"playNights": 2, "onceOnlyField": 9, "anotherField": 1}`)
+	assert.Contains(t, logged.String(), "Ignoring unknown schedule fields: anotherField, onceOnlyField\n")
+}
+
+func TestScheduleForDateRemovesCombosOnControlDays(t *testing.T) {
+	schedule := Schedule{
+		ControlNights: 3,
+		PlayNights:    2,
+		StartDay:      19,
+		Combos:        []Combo{createCombo("19:00", "21:00", 30, "roar")},
+	}
+
+	playing := schedule.ForDate(time.Date(2018, time.April, 20, 18, 0, 0, 0, time.UTC))
+	assert.Equal(t, 1, len(playing.Combos))
+
+	control := schedule.ForDate(time.Date(2018, time.April, 21, 18, 0, 0, 0, time.UTC))
+	assert.Equal(t, 0, len(control.Combos))
+	assert.Equal(t, 0, len(control.GetReferencedSounds()))
+	assert.Equal(t, 1, len(schedule.Combos))
+}
+
+func TestValidateAcceptsGoodSchedule(t *testing.T) {
+	schedule := Schedule{
+		ControlNights: 1,
+		PlayNights:    1,
+		Combos:        []Combo{createCombo("19:00", "21:00", 30, "roar")},
+	}
+	addAnotherSound(&schedule.Combos[0], 3, "same")
+	schedule.Combos[0].Volumes[1] = 5
+
+	assert.Nil(t, schedule.Validate())
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "random")
+	combo.Volumes = []int{11}
+	combo.Waits = []int{0, 2}
+	schedule := Schedule{
+		ControlNights: -1,
+		Combos:        []Combo{combo, {Sounds: []string{"howl"}, Waits: []int{0}, Volumes: []int{5}}},
+	}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{
+			"controlNights is negative",
+			"combo 0 has 1 sounds, 2 waits and 1 volumes",
+			"combo 0 has volume 11 outside 0-10",
+			"combo 0 plays random sounds but the schedule has no sounds",
+			`combo 1 has unknown sound "howl"`,
+		}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateChecksTimezones(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "beep")
+	combo.Timezone = "Mars/Olympus_Mons"
+	schedule := Schedule{Timezone: "Pacific/Auckland", Combos: []Combo{combo}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{`combo 0 has unknown timezone "Mars/Olympus_Mons"`}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateChecksRepeats(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "beep")
+	combo.Repeat = -1
+	combo.RepeatGap = -5
+	schedule := Schedule{Combos: []Combo{combo}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{"combo 0 has a negative repeat", "combo 0 has a negative repeatGap"}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateChecksPan(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "beep")
+	combo.Pan = -1.5
+	schedule := Schedule{Combos: []Combo{combo}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{"combo 0 has pan -1.5 outside -1 to 1"}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateChecksMoonGate(t *testing.T) {
+	outside := createCombo("19:00", "21:00", 30, "beep")
+	outside.MoonGate = &MoonGate{Below: 120}
+	never := createCombo("19:00", "21:00", 30, "beep")
+	never.MoonGate = &MoonGate{Above: 60, Below: 40}
+	schedule := Schedule{Combos: []Combo{outside, never}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{
+			"combo 0 has a moon gate outside 0-100%",
+			"combo 1 has a moon gate that is never met",
+		}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestComboMinutesAfterMidnightOverrideTimes(t *testing.T) {
+	var schedule Schedule
+	err := ParseJSONConfigFile(`{"combos": [{"from": "19:00", "until": "21:00", "fromMin": 1380, "untilMin": 90}]}`, &schedule)
+	assert.Nil(t, err)
+
+	combo := schedule.Combos[0]
+	assert.Equal(t, "23:00", combo.FromTime().Format("15:04"))
+	assert.Equal(t, "01:30", combo.UntilTime().Format("15:04"))
+	assert.Equal(t, NewTimeOfDay("23:00").Time, combo.FromTime().Time)
+}
+
+func TestValidateChecksComboMinutes(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "beep")
+	fromMin, untilMin := -1, 1440
+	combo.FromMin, combo.UntilMin = &fromMin, &untilMin
+	schedule := Schedule{Combos: []Combo{combo}}
+
+	err := schedule.Validate()
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, []string{
+			"combo 0 has fromMin -1 outside 0-1439",
+			"combo 0 has untilMin 1440 outside 0-1439",
+		}, err.(*ValidationError).Problems)
+	}
+}
+
+func TestReferencedSoundsHaveNoDuplicates(t *testing.T) {
+	schedule := Schedule{
+		Combos:    []Combo{createCombo("19:00", "21:00", 30, "random")},
+		AllSounds: []int{212, 3, 212, 215, 3},
+	}
+	assert.Equal(t, []int{212, 3, 215}, schedule.GetReferencedSounds())
+
+	schedule = Schedule{Combos: []Combo{{Sounds: []string{"4", "same", "4"}}, {Sounds: []string{"4"}}}}
+	assert.Equal(t, []int{4}, schedule.GetReferencedSounds())
+}
+
+func TestGetSoundsActiveWithin(t *testing.T) {
+	dusk := createCombo("18:00", "20:00", 30, "")
+	dusk.Sounds = []string{"3"}
+	dawn := createCombo("05:00", "07:00", 30, "")
+	dawn.Sounds = []string{"4"}
+	schedule := Schedule{Combos: []Combo{dusk, dawn}}
+	now := time.Date(2018, time.November, 5, 17, 0, 0, 0, time.UTC)
+
+	sounds, ok := schedule.GetSoundsActiveWithin(now, 4*time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, []int{3}, sounds)
+
+	sounds, ok = schedule.GetSoundsActiveWithin(now, 13*time.Hour)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []int{3, 4}, sounds)
+
+	sounds, ok = schedule.GetSoundsActiveWithin(now.Add(-8*time.Hour), 2*time.Hour)
+	assert.True(t, ok)
+	assert.Empty(t, sounds)
+
+	_, ok = schedule.GetSoundsActiveWithin(now, 24*time.Hour)
+	assert.False(t, ok)
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"log"
+	"reflect"
+)
+
+// Sequence is an ordered list of sounds that is played through across the whole night, rather than per
+// combo.  Each time a combo plays the sound "sequence" the next sound in the sequence is played.
+type Sequence struct {
+	// Sounds are the IDs of the sounds to play, in order.
+	Sounds []string
+	// Wrap starts the sequence again once it reaches the end.  Otherwise no more sequence sounds are
+	// played.
+	Wrap bool
+}
+
+// SequencePosition is how far through a sequence the player has got.
+type SequencePosition struct {
+	Sounds []string `json:"sounds"`
+	Next   int      `json:"next"`
+}
+
+// SequenceStore saves the position in the sequence so that it carries on from the same place after
+// a restart.
+type SequenceStore interface {
+	LoadSequencePosition() (SequencePosition, error)
+	SaveSequencePosition(position SequencePosition) error
+}
+
+// sequenceState tracks the player's position in the schedule's sequence.  It is shared by pointer
+// between copies of the player.
+type sequenceState struct {
+	sequence Sequence
+	next     int
+	store    SequenceStore
+}
+
+// setStore sets where the position is saved and restores the saved position.
+func (state *sequenceState) setStore(store SequenceStore) {
+	state.store = store
+	if store == nil {
+		return
+	}
+	position, err := store.LoadSequencePosition()
+	if err != nil {
+		log.Printf("Could not load sequence position, starting from the beginning: %v", err)
+		return
+	}
+	state.restore(position)
+}
+
+// setSequence changes the sequence being played.  A different sequence starts from the beginning.
+func (state *sequenceState) setSequence(sequence Sequence) {
+	if reflect.DeepEqual(sequence.Sounds, state.sequence.Sounds) {
+		state.sequence = sequence
+		return
+	}
+	state.sequence = sequence
+	state.next = 0
+	if state.store != nil {
+		if position, err := state.store.LoadSequencePosition(); err == nil {
+			state.restore(position)
+		}
+	}
+}
+
+// restore carries on from a saved position if it was for the current sequence.
+func (state *sequenceState) restore(position SequencePosition) {
+	if reflect.DeepEqual(position.Sounds, state.sequence.Sounds) {
+		state.next = position.Next
+	}
+}
+
+// nextSound gets the next sound in the sequence, or false if the sequence has finished or is empty.
+func (state *sequenceState) nextSound() (string, bool) {
+	sounds := state.sequence.Sounds
+	if len(sounds) == 0 {
+		return "", false
+	}
+	if state.next >= len(sounds) {
+		if !state.sequence.Wrap {
+			return "", false
+		}
+		state.next = 0
+	}
+	sound := sounds[state.next]
+	state.next++
+	if state.store != nil {
+		if err := state.store.SaveSequencePosition(SequencePosition{Sounds: sounds, Next: state.next}); err != nil {
+			log.Printf("Could not save sequence position: %v", err)
+		}
+	}
+	return sound, true
+}
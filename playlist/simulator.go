@@ -0,0 +1,128 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"time"
+)
+
+// SimulatedPlay is a sound that the audio device was asked to play during a simulation.
+type SimulatedPlay struct {
+	Time      time.Time
+	AudioFile string
+	Volume    int
+	Options   PlayOptions
+}
+
+// SimulatedEvent is an event that would have been recorded during a simulation.
+type SimulatedEvent struct {
+	Time   time.Time
+	Type   string
+	FileId int
+	Volume int
+	Reason string
+}
+
+const (
+	SimulatedPlayedEvent  = "played"
+	SimulatedSkippedEvent = "skipped"
+	SimulatedFailedEvent  = "failed"
+)
+
+// Simulator runs schedules against a fake clock and a recording audio device, so whole nights can be played
+// out in milliseconds.  It is intended for checking schedules in tests.
+type Simulator struct {
+	now     time.Time
+	player  *SchedulePlayer
+	updates chan Schedule
+	pending []pendingUpdate
+	// PlayError, if set, is returned for every sound played.
+	PlayError error
+	Plays     []SimulatedPlay
+	Events    []SimulatedEvent
+}
+
+// NewSimulator creates a simulator whose clock starts at the given time.  allSounds is the map of audio
+// file ID to file name of the sounds available to play.
+func NewSimulator(start time.Time, allSounds map[int]string) *Simulator {
+	sim := &Simulator{now: start, updates: make(chan Schedule, 1)}
+	sim.player = newSchedulePlayerWithClock(sim, sim, allSounds, "")
+	sim.player.SetRecorder(sim)
+	sim.player.SetScheduleUpdates(sim.updates)
+	return sim
+}
+
+// pendingUpdate is a new schedule to be sent to the player once the simulated time reaches at.
+type pendingUpdate struct {
+	at       time.Time
+	schedule Schedule
+}
+
+// UpdateScheduleAt sends a new schedule to the player once the simulated time reaches at, as the
+// schedule watcher would when the server's schedule changes.
+func (sim *Simulator) UpdateScheduleAt(at time.Time, schedule Schedule) {
+	sim.pending = append(sim.pending, pendingUpdate{at: at, schedule: schedule})
+}
+
+// Player gets the schedule player being simulated so that it can be configured before running.
+func (sim *Simulator) Player() *SchedulePlayer {
+	return sim.player
+}
+
+// Run plays the schedule for the given number of days, returning the sounds played.
+func (sim *Simulator) Run(schedule Schedule, days int) []SimulatedPlay {
+	for day := 0; day < days; day++ {
+		sim.player.PlayTodaysSchedule(schedule)
+	}
+	return sim.Plays
+}
+
+// Now gets the simulated time.
+func (sim *Simulator) Now() time.Time {
+	return sim.now
+}
+
+// Wait moves the simulated time on by the given duration.  Just like a real sleep it overshoots slightly,
+// which stops the player from waiting for a window it is already at the boundary of.
+func (sim *Simulator) Wait(duration time.Duration) {
+	sim.now = sim.now.Add(duration).Add(time.Microsecond)
+
+	var stillPending []pendingUpdate
+	for _, update := range sim.pending {
+		if sim.now.Before(update.at) {
+			stillPending = append(stillPending, update)
+			continue
+		}
+		// Like the schedule watcher, only the latest schedule matters if the player hasn't taken
+		// the last one yet.
+		select {
+		case <-sim.updates:
+		default:
+		}
+		sim.updates <- update.schedule
+	}
+	sim.pending = stillPending
+}
+
+// Play records the sound as played.
+func (sim *Simulator) Play(audioFileName string, volume int, options PlayOptions) error {
+	if sim.PlayError != nil {
+		return sim.PlayError
+	}
+	sim.Plays = append(sim.Plays, SimulatedPlay{Time: sim.now, AudioFile: audioFileName, Volume: volume, Options: options})
+	return nil
+}
+
+func (sim *Simulator) OnAudioBaitPlayed(ts time.Time, fileId int, volume int) {
+	sim.Events = append(sim.Events, SimulatedEvent{Time: ts, Type: SimulatedPlayedEvent, FileId: fileId, Volume: volume})
+}
+
+func (sim *Simulator) OnAudioBaitFailed(ts time.Time, fileId int, volume int, err error) {
+	sim.Events = append(sim.Events, SimulatedEvent{Time: ts, Type: SimulatedFailedEvent, FileId: fileId, Volume: volume, Reason: err.Error()})
+}
+
+func (sim *Simulator) OnAudioBaitSkipped(ts time.Time, fileId int, volume int, reason string) {
+	sim.Events = append(sim.Events, SimulatedEvent{Time: ts, Type: SimulatedSkippedEvent, FileId: fileId, Volume: volume, Reason: reason})
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulateNightsWithControlNightsAndQuietHours(t *testing.T) {
+	schedule := Schedule{
+		ControlNights: 1,
+		PlayNights:    1,
+		Combos:        []Combo{createCombo("21:00", "22:30", 30, "howl")},
+	}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.Player().SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("21:45"), Until: *NewTimeOfDay("23:00")}})
+	plays := sim.Run(schedule, 3)
+
+	playTimes := make([]string, len(plays))
+	for i, play := range plays {
+		playTimes[i] = play.Time.Format("Jan 2 15:04")
+	}
+	assert.Equal(t, []string{"Apr 1 21:00", "Apr 1 21:30", "Apr 3 21:00", "Apr 3 21:30"}, playTimes)
+
+	skipped := 0
+	for _, event := range sim.Events {
+		if event.Type == SimulatedSkippedEvent {
+			assert.Equal(t, SkippedQuietHours, event.Reason)
+			skipped++
+		}
+	}
+	assert.Equal(t, 2, skipped)
+	assert.Equal(t, 6, len(sim.Events))
+}
+
+func TestSimulateScheduleChangeMidNight(t *testing.T) {
+	howl := createCombo("21:00", "22:10", 30, "howl")
+	before := Schedule{PlayNights: 1, Combos: []Combo{howl}}
+	after := Schedule{PlayNights: 1, Combos: []Combo{howl, createCombo("22:15", "22:40", 10, "hoot")}}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 45, 0, 0, time.UTC), after)
+	plays := sim.Run(before, 1)
+
+	assert.Equal(t, []string{
+		"21:00 howl",
+		"21:30 howl",
+		"22:00 howl",
+		"22:15 hoot",
+		"22:25 hoot",
+		"22:35 hoot",
+	}, describePlays(plays))
+}
+
+func TestSimulateScheduleChangeStopsRemovedCombo(t *testing.T) {
+	before := Schedule{PlayNights: 1, Combos: []Combo{createCombo("21:00", "23:00", 30, "howl")}}
+	after := Schedule{PlayNights: 1, Combos: []Combo{createCombo("22:15", "22:40", 10, "hoot")}}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.UpdateScheduleAt(time.Date(2018, time.April, 1, 21, 45, 0, 0, time.UTC), after)
+	plays := sim.Run(before, 1)
+
+	assert.Equal(t, []string{
+		"21:00 howl",
+		"21:30 howl",
+		"22:15 hoot",
+		"22:25 hoot",
+		"22:35 hoot",
+	}, describePlays(plays))
+}
+
+func TestSimulateSequenceSpansCombosAndStopsAtTheEnd(t *testing.T) {
+	sequence := Sequence{Sounds: []string{"1", "3", "4"}}
+	schedule := Schedule{PlayNights: 1, Sequence: sequence, Combos: []Combo{
+		createCombo("21:00", "21:40", 30, "sequence"),
+		createCombo("22:00", "22:40", 30, "sequence"),
+	}}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	plays := sim.Run(schedule, 1)
+
+	assert.Equal(t, []string{"21:00 squeal", "21:30 beep", "22:00 tweet"}, describePlays(plays))
+}
+
+func TestSimulateSequenceWrapsAndCarriesOnAfterRestart(t *testing.T) {
+	sequence := Sequence{Sounds: []string{"1", "3", "4"}, Wrap: true}
+	schedule := Schedule{PlayNights: 1, Sequence: sequence, Combos: []Combo{createCombo("21:00", "21:40", 30, "sequence")}}
+	store := &memorySequenceStore{}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	sim.Player().SetSequenceStore(store)
+	plays := sim.Run(schedule, 2)
+	assert.Equal(t, []string{"21:00 squeal", "21:30 beep", "21:00 tweet", "21:30 squeal"}, describePlays(plays))
+	assert.Equal(t, SequencePosition{Sounds: sequence.Sounds, Next: 1}, store.position)
+
+	restarted := NewSimulator(time.Date(2018, time.April, 3, 13, 0, 0, 0, time.UTC), soundFiles)
+	restarted.Player().SetSequenceStore(store)
+	plays = restarted.Run(schedule, 1)
+	assert.Equal(t, []string{"21:00 beep", "21:30 tweet"}, describePlays(plays))
+}
+
+func TestSimulateCombosInAnotherTimezone(t *testing.T) {
+	local := createCombo("21:00", "21:40", 30, "howl")
+	utc := createCombo("22:00", "22:40", 30, "hoot")
+	utc.Timezone = "UTC"
+	schedule := Schedule{PlayNights: 1, Timezone: "Asia/Kolkata", Combos: []Combo{local, utc}}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	plays := sim.Run(schedule, 1)
+
+	// 21:00 in India is 15:30 UTC.
+	assert.Equal(t, []string{"15:30 howl", "16:00 howl", "22:00 hoot", "22:30 hoot"}, describePlays(plays))
+}
+
+func TestSimulateComboWithMinutesAfterMidnight(t *testing.T) {
+	combo := createCombo("19:00", "21:00", 30, "howl")
+	fromMin, untilMin := 23*60+30, 20
+	combo.FromMin, combo.UntilMin = &fromMin, &untilMin
+	schedule := Schedule{PlayNights: 1, Combos: []Combo{combo}}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 13, 0, 0, 0, time.UTC), soundFiles)
+	plays := sim.Run(schedule, 1)
+
+	assert.Equal(t, []string{"23:30 howl", "00:00 howl"}, describePlays(plays))
+}
+
+type memorySequenceStore struct {
+	position SequencePosition
+}
+
+func (store *memorySequenceStore) LoadSequencePosition() (SequencePosition, error) {
+	return store.position, nil
+}
+
+func (store *memorySequenceStore) SaveSequencePosition(position SequencePosition) error {
+	store.position = position
+	return nil
+}
+
+func describePlays(plays []SimulatedPlay) []string {
+	descriptions := make([]string, len(plays))
+	for i, play := range plays {
+		descriptions[i] = play.Time.Format("15:04") + " " + play.AudioFile
+	}
+	return descriptions
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNoNextWindow is returned by SleepUntilNext when none of the schedule's combos will play again.
+var ErrNoNextWindow = errors.New("no combo will play again")
+
+// ContextClock is a clock whose waits can be cut short.  Clocks that can power the device down while
+// waiting, such as by setting a wake alarm, should implement it so that SleepUntilNext uses them.
+type ContextClock interface {
+	Clock
+	// WaitContext waits for the given time duration, returning ctx's error if it is done first.
+	WaitContext(ctx context.Context, duration time.Duration) error
+}
+
+// WaitContext waits for the duration, or until ctx is done.
+func (t *ActualClock) WaitContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SleepUntilNext waits until the next of the schedule's combos starts and returns it, or returns straight
+// away with a combo that is already playing.  The audiobait days are worked out in loc, the device's
+// timezone, although each combo's times are in its own timezone as usual.  ErrNoNextWindow is returned if
+// no combo will play again, or ctx's error if it is done before the combo starts.
+func (schedule *Schedule) SleepUntilNext(ctx context.Context, clock Clock, loc *time.Location) (*Combo, error) {
+	combo, start := schedule.nextWindow(clock.Now().In(loc))
+	if combo == nil {
+		return nil, ErrNoNextWindow
+	}
+	if err := waitContext(ctx, clock, start.Sub(clock.Now())); err != nil {
+		return nil, err
+	}
+	return combo, nil
+}
+
+// nextWindow finds the combo that is playing at now, or failing that the one that starts next, and
+// when it starts.  A nil combo is returned if none will play again.
+func (schedule *Schedule) nextWindow(now time.Time) (*Combo, time.Time) {
+	if len(schedule.Combos) == 0 {
+		return nil, time.Time{}
+	}
+	firstDay := nextDayStart(now).AddDate(0, 0, -1)
+	// Every combo's window on a day starts before any of them on the next day, so the first day that
+	// has a window still to come has the next one.  Looking one cycle ahead is far enough to reach a
+	// playing day.
+	for day := 0; day <= schedule.CycleLength(); day++ {
+		dayStart := firstDay.AddDate(0, 0, day)
+		if !schedule.isPlayingDay(dayStart) {
+			continue
+		}
+		var next *Combo
+		var nextStart time.Time
+		for i := range schedule.Combos {
+			from, until := schedule.comboWindow(schedule.Combos[i], dayStart)
+			if !until.After(now) {
+				continue
+			}
+			if from.Before(now) {
+				from = now
+			}
+			if next == nil || from.Before(nextStart) {
+				next = &schedule.Combos[i]
+				nextStart = from
+			}
+		}
+		if next != nil {
+			return next, nextStart
+		}
+	}
+	return nil, time.Time{}
+}
+
+// waitContext waits on the clock, giving up if ctx is done first.  Clocks that aren't a ContextClock are
+// left waiting in the background when ctx is done.
+func waitContext(ctx context.Context, clock Clock, duration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return nil
+	}
+	if contextClock, ok := clock.(ContextClock); ok {
+		return contextClock.WaitContext(ctx, duration)
+	}
+	done := make(chan struct{})
+	go func() {
+		clock.Wait(duration)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
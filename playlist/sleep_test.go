@@ -0,0 +1,53 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSleepUntilNextWaitsForNextCombo(t *testing.T) {
+	schedule := Schedule{Combos: []Combo{createCombo("18:00", "20:00", 30, "beep"), createCombo("05:00", "06:00", 30, "tweet")}}
+	_, clock := createPlayer("12:00")
+	clock.NowTime = clock.NowTime.Add(time.Minute)
+
+	combo, err := schedule.SleepUntilNext(context.Background(), clock, time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, &schedule.Combos[0], combo)
+	assert.Equal(t, "18:00", clock.NowTime.Format("15:04"))
+
+	// Already playing.
+	combo, err = schedule.SleepUntilNext(context.Background(), clock, time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, &schedule.Combos[0], combo)
+	assert.Equal(t, "18:00", clock.NowTime.Format("15:04"))
+
+	clock.NowTime = clock.NowTime.Add(3 * time.Hour)
+	combo, err = schedule.SleepUntilNext(context.Background(), clock, time.UTC)
+	assert.Nil(t, err)
+	assert.Equal(t, &schedule.Combos[1], combo)
+	assert.Equal(t, "05:00", clock.NowTime.Format("15:04"))
+}
+
+func TestSleepUntilNextWithNoCombos(t *testing.T) {
+	schedule := Schedule{}
+	_, clock := createPlayer("12:00")
+	_, err := schedule.SleepUntilNext(context.Background(), clock, time.UTC)
+	assert.Equal(t, ErrNoNextWindow, err)
+}
+
+func TestSleepUntilNextStopsWhenContextIsDone(t *testing.T) {
+	schedule := Schedule{Combos: []Combo{createCombo("18:00", "20:00", 30, "beep")}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, clock := createPlayer("13:00")
+	_, err := schedule.SleepUntilNext(ctx, clock, time.UTC)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "13:00", clock.NowTime.Format("15:04"))
+}
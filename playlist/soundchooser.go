@@ -6,6 +6,7 @@ package playlist
 
 import (
 	"math/rand"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -15,6 +16,10 @@ type SoundChooser struct {
 	allKeys   []int
 	random    *rand.Rand
 	previous  int
+	sequence  *sequenceState
+
+	cooldown *cooldownState
+	now      func() time.Time
 }
 
 func NewSoundChooser(allSoundsMap map[int]string) *SoundChooser {
@@ -35,9 +40,28 @@ func (chooser *SoundChooser) setAllSounds(allSoundsMap map[int]string) *SoundCho
 		chooser.allKeys[i] = key
 		i++
 	}
+	// Sort the keys so that a seeded chooser always makes the same choices.
+	sort.Ints(chooser.allKeys)
 	return chooser
 }
 
+// setRandomGroup limits the random sounds to those in group, when there is a group.
+func (chooser *SoundChooser) setRandomGroup(group []int) {
+	if group == nil {
+		return
+	}
+	keys := make([]int, 0, len(group))
+	for _, key := range chooser.allKeys {
+		for _, id := range group {
+			if key == id {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	chooser.allKeys = keys
+}
+
 func (chooser *SoundChooser) returnSound(soundId int) (int, string) {
 	chooser.previous = soundId
 	return soundId, chooser.allSounds[soundId]
@@ -49,12 +73,22 @@ func (chooser *SoundChooser) returnSound(soundId int) (int, string) {
 
 func (chooser *SoundChooser) ChooseSound(choice string) (int, string) {
 	if choice == "random" {
-		index := chooser.random.Intn(len(chooser.allKeys))
-		return chooser.returnSound(chooser.allKeys[index])
+		keys := chooser.availableKeys()
+		if len(keys) == 0 {
+			return 0, ""
+		}
+		index := chooser.random.Intn(len(keys))
+		return chooser.returnSound(keys[index])
 	} else if choice == "same" {
 		if chooser.previous != 0 {
 			return chooser.returnSound(chooser.previous)
 		}
+	} else if choice == "sequence" {
+		if chooser.sequence != nil {
+			if sound, ok := chooser.sequence.nextSound(); ok && sound != "sequence" {
+				return chooser.ChooseSound(sound)
+			}
+		}
 	} else {
 		fileId, err := strconv.Atoi(choice)
 		if err == nil {
@@ -6,6 +6,7 @@ package playlist
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -78,3 +79,38 @@ func TestSoundChooseByFileId(t *testing.T) {
 	assert.Equal(t, soundId, 0)
 	assert.Equal(t, soundName, "")
 }
+
+func TestEffectiveSoundsAreRepeatableWithTheSameSeed(t *testing.T) {
+	combo := Combo{Sounds: []string{"random", "same", "3", "random", "512"}}
+
+	first := combo.EffectiveSounds(NewSoundChooserWithRandom(soundChooserFiles, 7))
+	second := combo.EffectiveSounds(NewSoundChooserWithRandom(soundChooserFiles, 7))
+
+	assert.Equal(t, first, second)
+	assert.Equal(t, first[0], first[1])
+	assert.Equal(t, 3, first[2])
+	assert.Equal(t, 0, first[4])
+}
+
+func TestRandomWithNoSoundsCantBeChosen(t *testing.T) {
+	chooser := NewSoundChooserWithRandom(map[int]string{}, 1)
+	soundId, _ := chooser.ChooseSound("random")
+	assert.Equal(t, 0, soundId)
+}
+
+func TestEffectiveSoundsAreWhatThePlayerPlays(t *testing.T) {
+	combo := createCombo("21:00", "21:10", 30, "random")
+	addAnotherSound(&combo, 5, "random")
+	addAnotherSound(&combo, 5, "same")
+	combo.Sounds = []string{"random", "random", "same"}
+
+	sim := NewSimulator(time.Date(2018, time.April, 1, 12, 0, 1, 0, time.UTC), soundFiles)
+	sim.Player().randomSeed = 7
+	sim.Run(Schedule{PlayNights: 1, Combos: []Combo{combo}}, 1)
+
+	var played []int
+	for _, event := range sim.Events {
+		played = append(played, event.FileId)
+	}
+	assert.Equal(t, combo.EffectiveSounds(NewSoundChooserWithRandom(soundFiles, 7)), played)
+}
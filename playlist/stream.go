@@ -0,0 +1,77 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"io"
+	"log"
+)
+
+// SoundStream is a sound that is read as it is downloaded, instead of from a file.
+type SoundStream struct {
+	io.ReadCloser
+	// Type is the sound's file type, such as "mp3".
+	Type string
+}
+
+// SoundStreamer opens sounds to stream from the server.
+type SoundStreamer interface {
+	OpenSoundStream(fileId int) (SoundStream, error)
+}
+
+// StreamPlayer can also be implemented by an AudioDevice that can play a sound as it is read.  If
+// reading the sound fails part way through the play is stopped and an error returned.
+type StreamPlayer interface {
+	PlayStream(stream SoundStream, volume int, options PlayOptions) error
+}
+
+// SetSoundStreamer sets where sounds are streamed from, for the combos that stream their sounds
+// instead of playing them from their downloaded files.  If all is set every combo streams.
+func (sp *SchedulePlayer) SetSoundStreamer(streamer SoundStreamer, all bool) {
+	sp.streamer = streamer
+	sp.streamAll = all
+}
+
+// streams checks whether the combo's sounds are streamed, which needs a streamer and a device that can
+// play streams.
+func (sp SchedulePlayer) streams(combo Combo) bool {
+	if sp.streamer == nil || !(combo.Stream || sp.streamAll) {
+		return false
+	}
+	_, ok := streamPlayer(sp.player)
+	return ok
+}
+
+// streamPlayer gets the device as a StreamPlayer, if it can play streams.
+func streamPlayer(device AudioDevice) (StreamPlayer, bool) {
+	if zone, ok := device.(*zoneDevice); ok {
+		if _, ok := zone.device.(StreamPlayer); !ok {
+			return nil, false
+		}
+	}
+	streamer, ok := device.(StreamPlayer)
+	return streamer, ok
+}
+
+// playSound plays a sound, from its file or streamed if the combo streams.
+func (sp SchedulePlayer) playSound(combo Combo, fileId int, fileName string, volume int, options PlayOptions) error {
+	if !sp.streams(combo) {
+		return sp.player.Play(fileName, volume, options)
+	}
+	log.Printf("Streaming sound %d", fileId)
+	stream, err := sp.streamer.OpenSoundStream(fileId)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	streamer, _ := streamPlayer(sp.player)
+	return streamer.PlayStream(stream, volume, options)
+}
+
+func (zone *zoneDevice) PlayStream(stream SoundStream, volume int, options PlayOptions) error {
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+	return zone.device.(StreamPlayer).PlayStream(stream, volume, options)
+}
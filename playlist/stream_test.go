@@ -0,0 +1,105 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// streamDevice plays streams by reading them to the end.
+type streamDevice struct {
+	TestClockAndAudioDevice
+	Streamed []string
+}
+
+func (d *streamDevice) PlayStream(stream SoundStream, volume int, options PlayOptions) error {
+	contents, err := ioutil.ReadAll(stream)
+	d.Streamed = append(d.Streamed, string(contents))
+	return err
+}
+
+// testStreamer streams each sound's name, or fails part way through for the sound failAt.
+type testStreamer struct {
+	failAt int
+}
+
+func (streamer testStreamer) OpenSoundStream(fileId int) (SoundStream, error) {
+	reader := ioutil.NopCloser(strings.NewReader(soundFiles[fileId]))
+	if fileId == streamer.failAt {
+		reader = ioutil.NopCloser(&failingReader{})
+	}
+	return SoundStream{ReadCloser: reader, Type: "wav"}, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func createStreamPlayer(startTime string, streamer SoundStreamer, all bool) (*SchedulePlayer, *streamDevice) {
+	device := &streamDevice{}
+	device.NowTime = NewTimeOfDay(startTime).Time
+	schedulePlayer := newSchedulePlayerWithClock(device, device, soundFiles, "")
+	schedulePlayer.SetRecorder(device)
+	schedulePlayer.SetSoundStreamer(streamer, all)
+	return schedulePlayer, device
+}
+
+func TestStreamingCombosStreamTheirSounds(t *testing.T) {
+	streamed := createCombo("12:01", "12:20", 30, "beep")
+	streamed.Stream = true
+	downloaded := createCombo("12:01", "12:20", 30, "tweet")
+
+	schedulePlayer, device := createStreamPlayer("12:00", testStreamer{}, false)
+	schedulePlayer.playCombo(streamed)
+	schedulePlayer.playCombo(downloaded)
+
+	assert.Equal(t, []string{"beep"}, device.Streamed)
+	assert.Equal(t, []string{"12:01:00: Playing beep", "12:01:00: Playing tweet"}, device.PlayTimes)
+}
+
+func TestEveryComboStreamsWhenSet(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+
+	schedulePlayer, device := createStreamPlayer("12:00", testStreamer{}, true)
+	schedulePlayer.playCombo(combo)
+
+	assert.Equal(t, []string{"beep"}, device.Streamed)
+}
+
+func TestStreamFailingPartWayIsReported(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	fileId := combo.EffectiveSounds(NewSoundChooser(soundFiles))[0]
+
+	schedulePlayer, device := createStreamPlayer("12:00", testStreamer{failAt: fileId}, true)
+	schedulePlayer.playCombo(combo)
+
+	assert.Empty(t, device.PlayTimes)
+	assert.Len(t, device.FailTimes, 1)
+	assert.Contains(t, device.FailTimes[0], "connection reset")
+}
+
+func TestZonesStreamOnlyWhenTheirDeviceCan(t *testing.T) {
+	combo := createCombo("12:01", "12:20", 30, "beep")
+	combo.Stream = true
+
+	device := &streamDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	plain := &TestClockAndAudioDevice{}
+	mp := newMultiPlayerWithClock(map[string]AudioDevice{"north": device, "south": plain}, device, soundFiles, "")
+	mp.SetRecorder(device)
+	mp.Settings().SetSoundStreamer(testStreamer{}, false)
+
+	assert.True(t, mp.zonePlayer(mp.zones["north"]).streams(combo))
+	assert.False(t, mp.zonePlayer(mp.zones["south"]).streams(combo))
+	mp.zonePlayer(mp.zones["north"]).playCombo(combo)
+	assert.Equal(t, []string{"beep"}, device.Streamed)
+}
@@ -24,9 +24,25 @@ func (timeOfDay *TimeOfDay) UnmarshalJSON(bValue []byte) (err error) {
 }
 
 func NewTimeOfDay(timeOfDayString string) *TimeOfDay {
+	timeOfDay, err := ParseTimeOfDay(timeOfDayString)
+	if err != nil {
+		return &TimeOfDay{Time: time.Time{}}
+	}
+	return timeOfDay
+}
+
+// ParseTimeOfDay parses a time of day such as "21:30", returning an error if it isn't valid.
+func ParseTimeOfDay(timeOfDayString string) (*TimeOfDay, error) {
 	t, err := time.Parse(timeLayout, timeOfDayString)
 	if err != nil {
-		t = time.Time{}
+		return nil, err
 	}
-	return &TimeOfDay{Time: t}
+	return &TimeOfDay{Time: t}, nil
+}
+
+// TimeWindow is a recurring window between two times of day.  If From is after Until then
+// the window crosses midnight.
+type TimeWindow struct {
+	From  TimeOfDay
+	Until TimeOfDay
 }
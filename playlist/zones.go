@@ -0,0 +1,246 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ZoneSchedule is a schedule bound to the zone, an output device such as a speaker, that it plays on.
+type ZoneSchedule struct {
+	Zone     string
+	Schedule Schedule
+}
+
+// MultiPlayer plays several schedules at the same time, each on its own zone.  Sounds on different
+// zones can overlap, but sounds on the same zone are always played one after another.
+type MultiPlayer struct {
+	zones map[string]*zoneDevice
+	// settings is the player each zone's player is copied from, so that every setting of a
+	// SchedulePlayer applies to the zones too.
+	settings *SchedulePlayer
+}
+
+// NewMultiPlayer creates a player for the given zones, which are audio devices keyed by zone name.
+func NewMultiPlayer(zones map[string]AudioDevice, allSoundsMap map[int]string, filesDirectory string) *MultiPlayer {
+	return newMultiPlayerWithClock(zones, new(ActualClock), allSoundsMap, filesDirectory)
+}
+
+// newMultiPlayerWithClock creates a new multi player.  Should only be used for unit testing - use NewMultiPlayer otherwise.
+func newMultiPlayerWithClock(zones map[string]AudioDevice,
+	clock Clock,
+	allSoundsMap map[int]string,
+	filesDirectory string) *MultiPlayer {
+	mp := &MultiPlayer{
+		zones:    make(map[string]*zoneDevice, len(zones)),
+		settings: newSchedulePlayerWithClock(nil, clock, allSoundsMap, filesDirectory),
+	}
+	for name, device := range zones {
+		mp.zones[name] = &zoneDevice{name: name, device: device}
+	}
+	return mp
+}
+
+// Settings gets the player whose settings, such as its quiet hours, hooks and play limit, are used by
+// every zone.  Set them with its setters before PlayTodaysSchedules, apart from the recorder, which
+// should be set with SetRecorder.  Only whether each schedule update is muted is passed on to the zones,
+// as each zone plays its own schedule.  The player itself never plays anything.
+func (mp *MultiPlayer) Settings() *SchedulePlayer {
+	return mp.settings
+}
+
+// SetRecorder sets the call back that records when a sound has successfully played.  It is shared by
+// all of the zones, which take turns to call it.
+func (mp *MultiPlayer) SetRecorder(recorder SoundPlayedRecorder) {
+	mp.settings.SetRecorder(&lockedRecorder{recorder: recorder})
+}
+
+// PlayTodaysSchedules plays the day's schedules, each on its zone, returning once they have all
+// finished.  Nothing is played if any schedule is for a zone the player doesn't have.
+func (mp *MultiPlayer) PlayTodaysSchedules(schedules []ZoneSchedule) error {
+	players := make([]*SchedulePlayer, len(schedules))
+	for i, zoneSchedule := range schedules {
+		zone, exists := mp.zones[zoneSchedule.Zone]
+		if !exists {
+			return fmt.Errorf("schedule %d is for unknown zone %q", i, zoneSchedule.Zone)
+		}
+		players[i] = mp.zonePlayer(zone)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	if mp.settings.updates != nil {
+		mp.forwardMutes(schedules, players, done)
+	}
+
+	var wg sync.WaitGroup
+	for i := range schedules {
+		wg.Add(1)
+		go func(player *SchedulePlayer, zoneSchedule ZoneSchedule) {
+			defer wg.Done()
+			log.Printf("Playing schedule %q on zone %s", zoneSchedule.Schedule.Description, zoneSchedule.Zone)
+			player.PlayTodaysSchedule(zoneSchedule.Schedule)
+		}(players[i], schedules[i])
+	}
+	wg.Wait()
+	return nil
+}
+
+// zonePlayer copies the settings to a player for the zone.  Each zone plays its own schedule, so it keeps
+// its own place in its sequence and its own cooldowns, but which sounds have played recently is shared.
+func (mp *MultiPlayer) zonePlayer(zone *zoneDevice) *SchedulePlayer {
+	player := *mp.settings
+	player.player = zone
+	player.updates = nil
+	player.sequence = &sequenceState{}
+	player.cooldown = &cooldownState{
+		defaultCooldown: mp.settings.cooldown.defaultCooldown,
+		history:         mp.settings.cooldown.history,
+	}
+	return &player
+}
+
+// forwardMutes gives each player its own schedule updates, with its zone's schedule muted or unmuted
+// whenever an update from the settings' updates is, until done is closed.
+func (mp *MultiPlayer) forwardMutes(schedules []ZoneSchedule, players []*SchedulePlayer, done <-chan struct{}) {
+	zoneUpdates := make([]chan Schedule, len(players))
+	for i := range players {
+		zoneUpdates[i] = make(chan Schedule, 1)
+		players[i].updates = zoneUpdates[i]
+	}
+	go func() {
+		for {
+			select {
+			case update, ok := <-mp.settings.updates:
+				if !ok {
+					return
+				}
+				for i, zoneSchedule := range schedules {
+					schedule := zoneSchedule.Schedule
+					schedule.Muted = update.Muted
+					// Only the latest update matters if the zone hasn't taken the last one yet.
+					select {
+					case <-zoneUpdates[i]:
+					default:
+					}
+					zoneUpdates[i] <- schedule
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// zoneDevice stops schedules sharing a zone from playing over each other.
+type zoneDevice struct {
+	name   string
+	mu     sync.Mutex
+	device AudioDevice
+}
+
+func (zone *zoneDevice) Play(audioFileName string, volume int, options PlayOptions) error {
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+	return zone.device.Play(audioFileName, volume, options)
+}
+
+func (zone *zoneDevice) PlayChime(volume int) error {
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+	if chimePlayer, ok := zone.device.(ChimePlayer); ok {
+		return chimePlayer.PlayChime(volume)
+	}
+	return fmt.Errorf("zone %s has no chime", zone.name)
+}
+
+// lockedRecorder lets several zones share a recorder that isn't safe to call concurrently.
+type lockedRecorder struct {
+	mu       sync.Mutex
+	recorder SoundPlayedRecorder
+}
+
+func (lr *lockedRecorder) OnAudioBaitPlayed(ts time.Time, fileId int, volume int) {
+	if lr.recorder == nil {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.recorder.OnAudioBaitPlayed(ts, fileId, volume)
+}
+
+func (lr *lockedRecorder) OnAudioBaitFailed(ts time.Time, fileId int, volume int, err error) {
+	failRecorder, ok := lr.recorder.(SoundFailedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	failRecorder.OnAudioBaitFailed(ts, fileId, volume, err)
+}
+
+func (lr *lockedRecorder) OnScheduleMuted(ts time.Time) {
+	mutedRecorder, ok := lr.recorder.(ScheduleMutedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	mutedRecorder.OnScheduleMuted(ts)
+}
+
+func (lr *lockedRecorder) OnPlayerPaused(ts time.Time) {
+	pausedRecorder, ok := lr.recorder.(PlayerPausedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	pausedRecorder.OnPlayerPaused(ts)
+}
+
+func (lr *lockedRecorder) OnPlayerResumed(ts time.Time) {
+	pausedRecorder, ok := lr.recorder.(PlayerPausedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	pausedRecorder.OnPlayerResumed(ts)
+}
+
+func (lr *lockedRecorder) OnPlayFinished(play PlayInfo) {
+	finishedRecorder, ok := lr.recorder.(PlayFinishedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	finishedRecorder.OnPlayFinished(play)
+}
+
+func (lr *lockedRecorder) OnPlaySkipped(skip SkippedPlay) {
+	if skipRecorder, ok := lr.recorder.(PlaySkippedRecorder); ok {
+		lr.mu.Lock()
+		defer lr.mu.Unlock()
+		skipRecorder.OnPlaySkipped(skip)
+	} else if skipRecorder, ok := lr.recorder.(SoundSkippedRecorder); ok && skip.Reason != SkippedMissingFile {
+		lr.mu.Lock()
+		defer lr.mu.Unlock()
+		skipRecorder.OnAudioBaitSkipped(skip.Time, skip.FileId, skip.Volume, skip.Reason)
+	}
+}
+
+func (lr *lockedRecorder) OnAudioBaitSkipped(ts time.Time, fileId int, volume int, reason string) {
+	skipRecorder, ok := lr.recorder.(SoundSkippedRecorder)
+	if !ok {
+		return
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	skipRecorder.OnAudioBaitSkipped(ts, fileId, volume, reason)
+}
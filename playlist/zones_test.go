@@ -0,0 +1,137 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package playlist
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// overlapCounter is an audio device that records the most sounds it has had playing at once.
+type overlapCounter struct {
+	mu         sync.Mutex
+	playing    int
+	maxPlaying int
+}
+
+func (oc *overlapCounter) Play(audioFileName string, volume int, options PlayOptions) error {
+	oc.mu.Lock()
+	oc.playing++
+	if oc.playing > oc.maxPlaying {
+		oc.maxPlaying = oc.playing
+	}
+	oc.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	oc.mu.Lock()
+	oc.playing--
+	oc.mu.Unlock()
+	return nil
+}
+
+func playAtOnce(devices ...AudioDevice) {
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(device AudioDevice) {
+			defer wg.Done()
+			device.Play("howl", 5, PlayOptions{})
+		}(device)
+	}
+	wg.Wait()
+}
+
+func TestPlaysOnTheSameZoneDontOverlap(t *testing.T) {
+	speaker := &overlapCounter{}
+	mp := NewMultiPlayer(map[string]AudioDevice{"north": speaker}, soundFiles, "")
+
+	playAtOnce(mp.zones["north"], mp.zones["north"])
+	assert.Equal(t, 1, speaker.maxPlaying)
+}
+
+func TestPlaysOnDifferentZonesCanOverlap(t *testing.T) {
+	speaker := &overlapCounter{}
+	mp := NewMultiPlayer(map[string]AudioDevice{"north": speaker, "south": speaker}, soundFiles, "")
+
+	playAtOnce(mp.zones["north"], mp.zones["south"])
+	assert.Equal(t, 2, speaker.maxPlaying)
+}
+
+func TestScheduleForUnknownZoneIsNotPlayed(t *testing.T) {
+	speaker := &overlapCounter{}
+	mp := NewMultiPlayer(map[string]AudioDevice{"north": speaker}, soundFiles, "")
+
+	err := mp.PlayTodaysSchedules([]ZoneSchedule{{Zone: "north"}, {Zone: "east"}})
+	assert.EqualError(t, err, `schedule 1 is for unknown zone "east"`)
+}
+
+func TestZonePlayersUseTheSettings(t *testing.T) {
+	device := &TestClockAndAudioDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	mp := newMultiPlayerWithClock(map[string]AudioDevice{"north": device}, device, soundFiles, "")
+	mp.SetRecorder(device)
+	mp.Settings().SetQuietHours([]TimeWindow{{From: *NewTimeOfDay("12:00"), Until: *NewTimeOfDay("12:30")}})
+	played := 0
+	mp.Settings().OnBeforePlay(func(play PlayInfo) error {
+		played++
+		return nil
+	})
+
+	player := mp.zonePlayer(mp.zones["north"])
+	player.playCombo(createCombo("12:01", "12:40", 30, "beep"))
+
+	assert.Equal(t, []string{"12:31:00: Playing beep"}, device.PlayTimes)
+	assert.Equal(t, []string{"12:01:00: Skipped beep (quietHours)"}, device.SkipTimes)
+	assert.Equal(t, 1, played)
+	assert.True(t, mp.Settings().sequence != player.sequence)
+}
+
+func TestSoundPlayedOnOneZoneIsOnCooldownOnTheOthers(t *testing.T) {
+	device := &TestClockAndAudioDevice{}
+	device.NowTime = NewTimeOfDay("12:00").Time
+	mp := newMultiPlayerWithClock(map[string]AudioDevice{"north": device, "south": device}, device, soundFiles, "")
+	mp.SetRecorder(device)
+	mp.Settings().SetSoundCooldown(30 * time.Minute)
+
+	north := createCombo("12:01", "12:02", 30, "beep")
+	south := north
+	south.From, south.Until = *NewTimeOfDay("12:05"), *NewTimeOfDay("12:06")
+	mp.zonePlayer(mp.zones["north"]).playCombo(north)
+	mp.zonePlayer(mp.zones["south"]).playCombo(south)
+
+	assert.Equal(t, []string{"12:01:00: Playing beep"}, device.PlayTimes)
+	assert.Equal(t, []string{"12:05:00: Skipped beep (cooldown)"}, device.SkipTimes)
+}
+
+func TestMutingIsPassedOnToEachZone(t *testing.T) {
+	mp := NewMultiPlayer(map[string]AudioDevice{"north": &overlapCounter{}, "south": &overlapCounter{}}, soundFiles, "")
+	updates := make(chan Schedule)
+	mp.Settings().SetScheduleUpdates(updates)
+	schedules := []ZoneSchedule{
+		{Zone: "north", Schedule: Schedule{Description: "north"}},
+		{Zone: "south", Schedule: Schedule{Description: "south"}},
+	}
+	players := []*SchedulePlayer{mp.zonePlayer(mp.zones["north"]), mp.zonePlayer(mp.zones["south"])}
+	done := make(chan struct{})
+	defer close(done)
+	mp.forwardMutes(schedules, players, done)
+
+	updates <- Schedule{Description: "server", Muted: true}
+	updates <- Schedule{Description: "server", Muted: false}
+	updates <- Schedule{Description: "server", Muted: true}
+	// Give the last update time to be passed on after it was received.
+	time.Sleep(10 * time.Millisecond)
+
+	for i, player := range players {
+		update, ok := player.scheduleUpdate()
+		assert.True(t, ok)
+		assert.True(t, update.Muted)
+		assert.Equal(t, schedules[i].Schedule.Description, update.Description)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PowerSource reports the state of the device's power supply, such as a solar charged battery, so that
+// what was played can be matched up with how much power the device had.
+type PowerSource interface {
+	// Voltage gets the supply's voltage in volts.
+	Voltage() (float64, error)
+	// Charging gets whether the supply is being charged.
+	Charging() (bool, error)
+}
+
+// powerDetails gets the source's readings to add to an event's details, or nil if there is no source.
+// Readings that fail are left out.  They are read for every event, so sources log their own failures,
+// such as only when a reading first fails.
+func powerDetails(source PowerSource) map[string]interface{} {
+	if source == nil {
+		return nil
+	}
+	details := make(map[string]interface{})
+	if voltage, err := source.Voltage(); err == nil {
+		details["voltage"] = voltage
+	}
+	if charging, err := source.Charging(); err == nil {
+		details["charging"] = charging
+	}
+	return details
+}
+
+// addPowerDetails adds the source's readings, if there is a source, to an event's details as "power".
+func addPowerDetails(source PowerSource, details map[string]interface{}) {
+	if power := powerDetails(source); len(power) > 0 {
+		details["power"] = power
+	}
+}
+
+// powerSupplyDir is where Linux lists the power supplies it knows about.
+const powerSupplyDir = "/sys/class/power_supply"
+
+// SysfsPowerSource reads a power supply, such as a battery or charge controller, that Linux knows about.
+// A reading that fails is logged once, and again only if it works and then fails again.
+type SysfsPowerSource struct {
+	dir string
+
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+// NewSysfsPowerSource creates a source for the named supply in /sys/class/power_supply.
+func NewSysfsPowerSource(name string) *SysfsPowerSource {
+	return newSysfsPowerSource(filepath.Join(powerSupplyDir, name))
+}
+
+func newSysfsPowerSource(dir string) *SysfsPowerSource {
+	return &SysfsPowerSource{dir: dir, failing: make(map[string]bool)}
+}
+
+// Voltage reads voltage_now, which is in microvolts.
+func (source *SysfsPowerSource) Voltage() (float64, error) {
+	value, err := source.read("voltage_now")
+	var microvolts float64
+	if err == nil {
+		if microvolts, err = strconv.ParseFloat(value, 64); err != nil {
+			err = fmt.Errorf("invalid voltage %q", value)
+		}
+	}
+	return microvolts / 1e6, source.checked("voltage_now", err)
+}
+
+// Charging reads status, which is "Charging" while the supply is being charged.
+func (source *SysfsPowerSource) Charging() (bool, error) {
+	status, err := source.read("status")
+	return status == "Charging", source.checked("status", err)
+}
+
+func (source *SysfsPowerSource) read(attribute string) (string, error) {
+	value, err := ioutil.ReadFile(filepath.Join(source.dir, attribute))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// checked notes whether reading attribute worked, logging err if it has just started failing, and
+// returns err.
+func (source *SysfsPowerSource) checked(attribute string, err error) error {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if err == nil {
+		delete(source.failing, attribute)
+		return nil
+	}
+	if !source.failing[attribute] {
+		source.failing[attribute] = true
+		log.Printf("Could not read power supply %s: %v", attribute, err)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakePowerSupply creates a power supply directory laid out as sysfs does, with the given attributes.
+func newFakePowerSupply(t *testing.T, attributes map[string]string) *SysfsPowerSource {
+	dir := t.TempDir()
+	for name, value := range attributes {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(value+"\n"), 0644))
+	}
+	return newSysfsPowerSource(dir)
+}
+
+// captureLog collects what is logged until the test finishes.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+func TestSysfsPowerSourceReadsTheSupply(t *testing.T) {
+	source := newFakePowerSupply(t, map[string]string{"voltage_now": "12650000", "status": "Charging"})
+
+	assert.Equal(t, map[string]interface{}{"voltage": 12.65, "charging": true}, powerDetails(source))
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(source.dir, "status"), []byte("Discharging\n"), 0644))
+	charging, err := source.Charging()
+	assert.Nil(t, err)
+	assert.False(t, charging)
+}
+
+func TestSysfsPowerSourceLogsAFailedReadingOnce(t *testing.T) {
+	source := newFakePowerSupply(t, map[string]string{"voltage_now": "unknown", "status": "Charging"})
+	logged := captureLog(t)
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, map[string]interface{}{"charging": true}, powerDetails(source))
+	}
+	assert.Equal(t, 1, strings.Count(logged.String(), "Could not read power supply voltage_now"))
+
+	// Once it works again, failing again is logged again.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(source.dir, "voltage_now"), []byte("12000000\n"), 0644))
+	assert.Equal(t, map[string]interface{}{"voltage": 12.0, "charging": true}, powerDetails(source))
+	assert.Nil(t, os.Remove(filepath.Join(source.dir, "voltage_now")))
+	powerDetails(source)
+	powerDetails(source)
+	assert.Equal(t, 2, strings.Count(logged.String(), "Could not read power supply voltage_now"))
+}
+
+func TestPowerDetailsAreAddedToEvents(t *testing.T) {
+	details := map[string]interface{}{"fileId": 3}
+	addPowerDetails(newFakePowerSupply(t, map[string]string{"voltage_now": "3700000", "status": "Full"}), details)
+	assert.Equal(t, map[string]interface{}{"voltage": 3.7, "charging": false}, details["power"])
+
+	details = map[string]interface{}{"fileId": 3}
+	addPowerDetails(nil, details)
+	addPowerDetails(newFakePowerSupply(t, nil), details)
+	assert.Equal(t, map[string]interface{}{"fileId": 3}, details)
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// Names of the preflight checks.
+const (
+	PreflightCredentials  = "credentials"
+	PreflightSchedule     = "schedule"
+	PreflightFiles        = "files"
+	PreflightMixer        = "mixer"
+	PreflightOutputDevice = "outputDevice"
+)
+
+// PreflightCheck is the result of one of the startup checks.  Message says what was found and, if the
+// check failed, what to do about it.
+type PreflightCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// PreflightReport is the result of each of the startup checks, in the order they were run.
+type PreflightReport struct {
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// Passed checks whether all of the checks passed.
+func (report PreflightReport) Passed() bool {
+	for _, check := range report.Checks {
+		if !check.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// PreflightChecker checks that everything the device needs to play its schedule is working, so problems
+// can be found without logging in to the device.  Each check can also be run on its own.
+type PreflightChecker struct {
+	soundCard SoundCardPlayer
+	// open creates a client for the server from the device's configuration, without authenticating or
+	// registering the device.
+	open func() (*api.CacophonyAPI, error)
+}
+
+// NewPreflightChecker creates a checker for the device's sound card and connection to the server.
+func NewPreflightChecker(soundCard SoundCardPlayer, apiOpts ...api.Option) *PreflightChecker {
+	open := func() (*api.CacophonyAPI, error) {
+		return api.OpenUnauthenticated(apiConfigFile, apiOpts...)
+	}
+	return &PreflightChecker{soundCard: soundCard, open: open}
+}
+
+// Preflight runs all of the checks, using the audio files in fileFolder.  If the schedule can't be
+// fetched the files are checked against the schedule saved on disk.  An error is returned, along with
+// the report, if any check failed.
+func (pc *PreflightChecker) Preflight(ctx context.Context, fileFolder string) (PreflightReport, error) {
+	var report PreflightReport
+	report.Checks = append(report.Checks, pc.CheckCredentials(ctx))
+	scheduleCheck, schedule, fetched := pc.CheckSchedule()
+	report.Checks = append(report.Checks, scheduleCheck)
+	if !fetched {
+		saved, err := (&Downloader{audioDir: fileFolder}).loadScheduleFromDisk()
+		if err != nil {
+			report.Checks = append(report.Checks, failedCheck(PreflightFiles,
+				"no schedule to check the files against: the schedule couldn't be fetched and none is saved"))
+		} else {
+			report.Checks = append(report.Checks, pc.CheckFiles(fileFolder, saved))
+		}
+	} else {
+		report.Checks = append(report.Checks, pc.CheckFiles(fileFolder, schedule))
+	}
+	report.Checks = append(report.Checks, pc.CheckMixer(), pc.CheckOutputDevice())
+
+	if !report.Passed() {
+		return report, errors.New("preflight checks failed")
+	}
+	return report, nil
+}
+
+// CheckCredentials checks the server accepts the device's credentials, without registering the device.
+func (pc *PreflightChecker) CheckCredentials(ctx context.Context) PreflightCheck {
+	cacophonyAPI, err := pc.open()
+	if err != nil {
+		return failedCheck(PreflightCredentials, fmt.Sprintf("could not read %s: %v", apiConfigFile, err))
+	}
+	if err := cacophonyAPI.VerifyCredentials(ctx); err != nil {
+		if api.IsPermanentError(err) {
+			return failedCheck(PreflightCredentials, fmt.Sprintf("credentials rejected, check the device name and password in %s: %v", apiConfigFile, err))
+		}
+		return failedCheck(PreflightCredentials, fmt.Sprintf("could not reach the server, check the network connection: %v", err))
+	}
+	return passedCheck(PreflightCredentials, "credentials accepted")
+}
+
+// CheckSchedule fetches the device's schedule and validates it as the player does, returning it if it
+// was fetched.  Like CheckCredentials, it never registers the device.
+func (pc *PreflightChecker) CheckSchedule() (PreflightCheck, playlist.Schedule, bool) {
+	cacophonyAPI, err := pc.open()
+	if err != nil {
+		return failedCheck(PreflightSchedule, fmt.Sprintf("could not read %s: %v", apiConfigFile, err)), playlist.Schedule{}, false
+	}
+	if err := cacophonyAPI.RefreshToken(context.Background()); err != nil {
+		return failedCheck(PreflightSchedule, fmt.Sprintf("could not connect to the server: %v", err)), playlist.Schedule{}, false
+	}
+	var schedule playlist.Schedule
+	err = cacophonyAPI.DecodeSchedule(&schedule)
+	if err == api.ErrNoSchedule {
+		return failedCheck(PreflightSchedule, "the device has no schedule, give it or its group one on the server"), playlist.Schedule{}, false
+	} else if err != nil {
+		return failedCheck(PreflightSchedule, fmt.Sprintf("could not fetch the schedule: %v", err)), playlist.Schedule{}, false
+	}
+	if err := (&Downloader{api: cacophonyAPI}).checkSchedule(schedule); err != nil {
+		return failedCheck(PreflightSchedule, fmt.Sprintf("the schedule is invalid, fix it on the server: %v", err)), playlist.Schedule{}, false
+	}
+	message := fmt.Sprintf("schedule %d has %d combos", cacophonyAPI.ScheduleChoice().ID, len(schedule.Combos))
+	return passedCheck(PreflightSchedule, message), schedule, true
+}
+
+// CheckFiles checks that every file the schedule uses is in fileFolder, matches what was downloaded, as
+// CheckIntegrity checks, and can be read by the player.  Files whose hash was never recorded are only
+// checked for being playable.
+func (pc *PreflightChecker) CheckFiles(fileFolder string, schedule playlist.Schedule) PreflightCheck {
+	dl := &Downloader{audioDir: fileFolder}
+	mismatches, err := dl.CheckIntegrity(schedule)
+	if err != nil {
+		return failedCheck(PreflightFiles, fmt.Sprintf("could not check the audio files: %v", err))
+	}
+	var problems []string
+	damaged := make(map[int]bool)
+	for _, entry := range mismatches {
+		if entry.Status != ManifestUnrecorded {
+			damaged[entry.ID] = true
+			problems = append(problems, fmt.Sprintf("%d (%s)", entry.ID, entry.Status))
+		}
+	}
+	audioLibrary := OpenLibrary(dl.stateStore())
+	fileIds := schedule.GetReferencedSounds()
+	for _, fileId := range fileIds {
+		if damaged[fileId] {
+			continue
+		}
+		filename, _ := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId))
+		if _, err := probeDuration(filepath.Join(fileFolder, filename)); err != nil {
+			problems = append(problems, fmt.Sprintf("%d (unplayable: %v)", fileId, err))
+		}
+	}
+	if len(problems) > 0 {
+		return failedCheck(PreflightFiles, fmt.Sprintf("%d of %d files have problems, run --force-refresh to download them again: %s",
+			len(problems), len(fileIds), strings.Join(problems, ", ")))
+	}
+	return passedCheck(PreflightFiles, fmt.Sprintf("%d files present and playable", len(fileIds)))
+}
+
+// CheckMixer checks the mixer control used to set the volume can be read.  Sounds still play without
+// it, with the volume set by the player instead.
+func (pc *PreflightChecker) CheckMixer() PreflightCheck {
+	if _, err := lookPath("amixer"); err != nil {
+		return failedCheck(PreflightMixer, fmt.Sprintf("amixer isn't installed, install alsa-utils: %v", err))
+	}
+	out, err := exec.Command("amixer", "-c", fmt.Sprint(pc.soundCard.card), "sget", pc.soundCard.controlName).CombinedOutput()
+	if err != nil {
+		return failedCheck(PreflightMixer, fmt.Sprintf("could not read mixer control %q on card %d, check the card and volume-control settings: %v\noutput:\n%s",
+			pc.soundCard.controlName, pc.soundCard.card, err, out))
+	}
+	return passedCheck(PreflightMixer, fmt.Sprintf("mixer control %q on card %d is working", pc.soundCard.controlName, pc.soundCard.card))
+}
+
+// CheckOutputDevice checks the player is installed and the sound card is present.
+func (pc *PreflightChecker) CheckOutputDevice() PreflightCheck {
+	if _, err := lookPath("play"); err != nil {
+		return failedCheck(PreflightOutputDevice, fmt.Sprintf("play isn't installed, install sox: %v", err))
+	}
+	cardDir := fmt.Sprintf("/proc/asound/card%d", pc.soundCard.card)
+	if _, err := os.Stat(cardDir); err != nil {
+		return failedCheck(PreflightOutputDevice, fmt.Sprintf("sound card %d not found, check it is connected and the card setting: %v", pc.soundCard.card, err))
+	}
+	return passedCheck(PreflightOutputDevice, fmt.Sprintf("sound card %d is present", pc.soundCard.card))
+}
+
+func passedCheck(name, message string) PreflightCheck {
+	return PreflightCheck{Name: name, Passed: true, Message: message}
+}
+
+func failedCheck(name, message string) PreflightCheck {
+	return PreflightCheck{Name: name, Message: message}
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPreflightServer runs a server that accepts the device's password and gives it the schedule JSON.
+// It fails the test if the device is registered.
+func newPreflightServer(t *testing.T, scheduleJSON string) *PreflightChecker {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/authenticate_device":
+			fmt.Fprint(w, `{"success": true, "token": "JWT token"}`)
+		case "/api/v1/schedules":
+			assert.Equal(t, "JWT token", r.Header.Get("Authorization"))
+			fmt.Fprint(w, scheduleJSON)
+		case "/api/v1/events":
+			// An invalid schedule is reported, as it is when the player fetches it.
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+	open := func() (*api.CacophonyAPI, error) {
+		return api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret"), nil
+	}
+	return &PreflightChecker{open: open}
+}
+
+func TestCheckScheduleReturnsTheValidSchedule(t *testing.T) {
+	pc := newPreflightServer(t, `{"schedule": {"playNights": 1, "combos": [
+		{"from": "21:00", "until": "22:00", "every": 600, "sounds": ["3"], "waits": [0], "volumes": [5]}
+	]}, "scheduleId": 7}`)
+
+	check, schedule, fetched := pc.CheckSchedule()
+	assert.True(t, fetched)
+	assert.Equal(t, PreflightCheck{Name: PreflightSchedule, Passed: true, Message: "schedule 7 has 1 combos"}, check)
+	assert.Equal(t, []int{3}, schedule.GetReferencedSounds())
+}
+
+func TestCheckScheduleFailsAnInvalidSchedule(t *testing.T) {
+	pc := newPreflightServer(t, `{"schedule": {"playNights": 1, "combos": [{"sounds": []}]}, "scheduleId": 7}`)
+
+	check, _, fetched := pc.CheckSchedule()
+	assert.False(t, fetched)
+	assert.False(t, check.Passed)
+	assert.Contains(t, check.Message, "the schedule is invalid")
+	assert.Contains(t, check.Message, "combo 0 has no sounds")
+}
+
+func TestCheckScheduleFailsWithoutASchedule(t *testing.T) {
+	pc := newPreflightServer(t, `{"schedule": null}`)
+
+	check, _, fetched := pc.CheckSchedule()
+	assert.False(t, fetched)
+	assert.Equal(t, failedCheck(PreflightSchedule, "the device has no schedule, give it or its group one on the server"), check)
+}
+
+func TestCheckScheduleFailsWhenTheConfigurationCantBeRead(t *testing.T) {
+	pc := &PreflightChecker{open: func() (*api.CacophonyAPI, error) {
+		return nil, fmt.Errorf("no password")
+	}}
+
+	check, _, fetched := pc.CheckSchedule()
+	assert.False(t, fetched)
+	assert.False(t, check.Passed)
+	assert.Contains(t, check.Message, "no password")
+}
+
+func TestCheckCredentialsDoesntRegisterTheDevice(t *testing.T) {
+	pc := newPreflightServer(t, `{}`)
+
+	assert.Equal(t, passedCheck(PreflightCredentials, "credentials accepted"), pc.CheckCredentials(context.Background()))
+}
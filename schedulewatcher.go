@@ -0,0 +1,209 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"reflect"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/TheCacophonyProject/window"
+)
+
+const (
+	schedulePollInterval = time.Hour
+	minWatchBackoff      = 30 * time.Second
+
+	// With adaptive polling the schedule is polled every activePollInterval from activePollLead before
+	// a play window until it ends, and every idlePollInterval the rest of the time.
+	activePollInterval = 10 * time.Minute
+	idlePollInterval   = 4 * time.Hour
+	activePollLead     = time.Hour
+)
+
+// SetAdaptivePolling makes WatchSchedule poll frequently near and during the schedule's play windows
+// and only occasionally during the day, which saves power and data.  It must be called before
+// WatchSchedule.
+func (dl *Downloader) SetAdaptivePolling(adaptive bool) {
+	dl.adaptivePolling = adaptive
+}
+
+// SetPollJitter adds a random delay of up to fraction of the poll interval to each wait between
+// successful polls, so that a fleet of devices doesn't hit the server at the same moments.  If seed is
+// given, such as the device name, the delays are the same each time the device runs.  It must be
+// called before WatchSchedule.
+func (dl *Downloader) SetPollJitter(fraction float64, seed string) {
+	dl.pollJitter = fraction
+	source := rand.NewSource(time.Now().UnixNano())
+	if seed != "" {
+		h := fnv.New64a()
+		h.Write([]byte(seed))
+		source = rand.NewSource(int64(h.Sum64()))
+	}
+	dl.pollRand = rand.New(source)
+}
+
+// deviceName gets the name the downloader's connection to the server has the device as, or "" if it
+// isn't connected.
+func (dl *Downloader) deviceName() string {
+	if dl.api == nil {
+		return ""
+	}
+	return dl.api.DeviceName()
+}
+
+// jitter adds the poll jitter to a wait.
+func (dl *Downloader) jitter(wait time.Duration) time.Duration {
+	if dl.pollJitter <= 0 || dl.pollRand == nil {
+		return wait
+	}
+	return wait + time.Duration(dl.pollRand.Float64()*dl.pollJitter*float64(wait))
+}
+
+// PollInterval gets how long WatchSchedule is currently waiting between polls.
+func (dl *Downloader) PollInterval() time.Duration {
+	dl.pollMu.Lock()
+	defer dl.pollMu.Unlock()
+	return dl.pollInterval
+}
+
+func (dl *Downloader) setPollInterval(interval time.Duration) {
+	dl.pollMu.Lock()
+	defer dl.pollMu.Unlock()
+	dl.pollInterval = interval
+}
+
+// adaptivePollInterval works out how long to wait before polling again given the schedule's play
+// windows.  When idle it wakes up in time to poll frequently before the next window starts.
+func adaptivePollInterval(schedule playlist.Schedule, now time.Time) time.Duration {
+	interval := idlePollInterval
+	for _, combo := range schedule.Combos {
+		win := window.New(combo.FromTime().Time, combo.UntilTime().Time)
+		win.Now = func() time.Time { return now }
+		untilActive := win.Until() - activePollLead
+		if untilActive <= 0 {
+			return activePollInterval
+		}
+		if untilActive < interval {
+			interval = untilActive
+		}
+	}
+	return interval
+}
+
+// WatchSchedule keeps the device in sync with the server's audio schedule.  The first schedule
+// downloaded, and every schedule after that which differs from the previous one, is sent down the
+// returned schedule channel.
+//
+// The Cacophony API has no long-poll or push support for schedules, so this polls the server every
+// schedulePollInterval, or as SetAdaptivePolling describes.  When a poll fails the API connection is
+// re-established and the poll retried with an exponential backoff, or after the delay the server asked
+// for if it rate limited us.  Poll errors are sent down the error channel but are dropped if the caller
+// isn't keeping up with them.  Both channels are closed once ctx is done.
+func (dl *Downloader) WatchSchedule(ctx context.Context) (<-chan playlist.Schedule, <-chan error) {
+	schedules := make(chan playlist.Schedule)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(schedules)
+		defer close(errs)
+
+		var current *playlist.Schedule
+		backoff := minWatchBackoff
+		for {
+			wait := schedulePollInterval
+			schedule, err := dl.pollSchedule(ctx)
+			if err != nil {
+				log.Printf("Failed to poll for schedule: %s", err)
+				select {
+				case errs <- err:
+				default:
+				}
+				wait = backoff
+				if retryAfter, ok := api.RetryAfter(err); ok {
+					wait = retryAfter
+				}
+				backoff *= 2
+				if backoff > schedulePollInterval {
+					backoff = schedulePollInterval
+				}
+			} else {
+				backoff = minWatchBackoff
+				if current == nil || !reflect.DeepEqual(schedule, *current) {
+					current = &schedule
+					select {
+					case schedules <- schedule:
+					case <-ctx.Done():
+						return
+					}
+				}
+				if dl.adaptivePolling {
+					wait = adaptivePollInterval(schedule, time.Now())
+				}
+				wait = dl.jitter(wait)
+			}
+			dl.setPollInterval(wait)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return schedules, errs
+}
+
+// watchMuted polls for schedule changes while playing is being played, sending a copy of playing with
+// the server's mute flag whenever the flag changes.  Only the flag is passed on, so other changes to the
+// schedule still wait for the next day.  The channel is closed once ctx is done.
+func watchMuted(ctx context.Context, watcher *Downloader, playing playlist.Schedule) <-chan playlist.Schedule {
+	updates := make(chan playlist.Schedule)
+	schedules, _ := watcher.WatchSchedule(ctx)
+
+	go func() {
+		defer close(updates)
+		muted := playing.Muted
+		for schedule := range schedules {
+			if schedule.Muted == muted {
+				continue
+			}
+			muted = schedule.Muted
+			update := playing
+			update.Muted = muted
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates
+}
+
+// pollSchedule downloads the schedule, reconnecting to the API first if there is no connection.
+func (dl *Downloader) pollSchedule(ctx context.Context) (playlist.Schedule, error) {
+	if dl.api == nil {
+		dl.api = tryToInitiateAPI(dl.apiOpts...)
+		if dl.api == nil {
+			return playlist.Schedule{}, errors.New("not connected to API")
+		}
+	}
+
+	schedule, err := dl.downloadSchedule(ctx)
+	if err != nil {
+		// Force a reconnect next time in case the token or connection has gone bad.
+		dl.api = nil
+	}
+	return schedule, err
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptivePollIntervalFollowsThePlayWindows(t *testing.T) {
+	schedule := playlist.Schedule{Combos: []playlist.Combo{{
+		From:  *playlist.NewTimeOfDay("21:00"),
+		Until: *playlist.NewTimeOfDay("22:00"),
+	}}}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2018, time.April, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	assert.Equal(t, idlePollInterval, adaptivePollInterval(schedule, at(12, 0)))
+	assert.Equal(t, 2*time.Hour, adaptivePollInterval(schedule, at(18, 0)))
+	assert.Equal(t, activePollInterval, adaptivePollInterval(schedule, at(20, 30)))
+	assert.Equal(t, activePollInterval, adaptivePollInterval(schedule, at(21, 30)))
+	assert.Equal(t, idlePollInterval, adaptivePollInterval(playlist.Schedule{}, at(21, 30)))
+}
+
+// newScheduleServer runs a server that gives the device an empty schedule.
+func newScheduleServer(t *testing.T) *api.CacophonyAPI {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"schedule":{"playNights":1,"combos":[]},"scheduleId":7}`)
+	}))
+	t.Cleanup(server.Close)
+	return api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret")
+}
+
+// watchedPollInterval watches the schedule until the first poll has worked out how long to wait before
+// the next, and returns that.
+func watchedPollInterval(t *testing.T, dl *Downloader) time.Duration {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	schedules, _ := dl.WatchSchedule(ctx)
+	<-schedules
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if interval := dl.PollInterval(); interval != 0 {
+			return interval
+		}
+	}
+	t.Fatal("the watcher didn't set its poll interval")
+	return 0
+}
+
+func TestWatchSchedulePollsAdaptivelyWhenSetTo(t *testing.T) {
+	dl := &Downloader{store: NewMemoryStore(), api: newScheduleServer(t)}
+	assert.Equal(t, schedulePollInterval, watchedPollInterval(t, dl))
+
+	dl = &Downloader{store: NewMemoryStore(), api: newScheduleServer(t)}
+	dl.SetAdaptivePolling(true)
+	// With nothing to play the schedule is only polled occasionally.
+	assert.Equal(t, idlePollInterval, watchedPollInterval(t, dl))
+}
+
+func TestPollJitterIsTheSameForTheSameDevice(t *testing.T) {
+	dl := &Downloader{}
+	assert.Equal(t, time.Hour, dl.jitter(time.Hour))
+
+	dl.SetPollJitter(0.5, "north-1")
+	same := &Downloader{}
+	same.SetPollJitter(0.5, "north-1")
+	other := &Downloader{}
+	other.SetPollJitter(0.5, "north-2")
+	var differs bool
+	for i := 0; i < 10; i++ {
+		wait := dl.jitter(time.Hour)
+		assert.True(t, wait >= time.Hour && wait < 90*time.Minute, "wait %v", wait)
+		assert.Equal(t, wait, same.jitter(time.Hour))
+		differs = differs || wait != other.jitter(time.Hour)
+	}
+	assert.True(t, differs)
+}
+
+func TestWatchScheduleAddsThePollJitter(t *testing.T) {
+	dl := &Downloader{store: NewMemoryStore(), api: newScheduleServer(t)}
+	dl.SetPollJitter(0.5, dl.deviceName())
+	interval := watchedPollInterval(t, dl)
+
+	expected := &Downloader{}
+	expected.SetPollJitter(0.5, "device")
+	assert.Equal(t, expected.jitter(schedulePollInterval), interval)
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+const sequencePositionFilename = "sequence-position.json"
+
+// SequenceFile saves the player's position in the schedule's sequence in the store so that it survives
+// a restart.
+type SequenceFile struct {
+	store Store
+}
+
+// LoadSequencePosition reads the saved position.  If nothing has been saved yet the sequence starts
+// from the beginning.
+func (file SequenceFile) LoadSequencePosition() (playlist.SequencePosition, error) {
+	var position playlist.SequencePosition
+	jsonData, err := file.store.Get(sequencePositionFilename)
+	if os.IsNotExist(err) {
+		return position, nil
+	} else if err != nil {
+		return position, err
+	}
+	err = json.Unmarshal(jsonData, &position)
+	return position, err
+}
+
+// SaveSequencePosition writes the position to the store, which replaces it so that a half written
+// position is never read.
+func (file SequenceFile) SaveSequencePosition(position playlist.SequencePosition) error {
+	jsonData, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	return file.store.Put(sequencePositionFilename, jsonData)
+}
@@ -6,36 +6,219 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/TheCacophonyProject/audiobait/playlist"
 	"github.com/godbus/dbus"
 )
 
 type SoundCardPlayer struct {
 	card        int
 	controlName string
+	calibration VolumeCalibration
+	// device is the ALSA device to play on.  If it isn't set the default device is used.
+	device string
+	mixer  *mixerState
+	// mono is set for a device with a single speaker, which plays every sound from the centre.
+	mono bool
+	// ambient is paused while each sound plays, if there is one.
+	ambient *AmbientLoop
 }
 
-func NewSoundCardPlayer(aCard int, aControlName string) SoundCardPlayer {
-	return SoundCardPlayer{card: aCard, controlName: aControlName}
+// mixerState records whether the hardware mixer can be used, shared by the copies of a player.
+type mixerState struct {
+	mu sync.Mutex
+	// unavailable is set once the mixer is found to be missing or not working, after which the volume
+	// is applied by the player instead.
+	unavailable bool
 }
 
-func (p SoundCardPlayer) Play(audioFileName string, volume int) error {
-	if err := p.setVolume(volume); err != nil {
+// lookPath finds a program, and is replaced to test what happens when one is missing.
+var lookPath = exec.LookPath
+
+func NewSoundCardPlayer(aCard int, aControlName string, calibration VolumeCalibration) SoundCardPlayer {
+	mixer := &mixerState{}
+	if _, err := lookPath("amixer"); err != nil {
+		log.Printf("No mixer (%v), setting the volume in the player instead", err)
+		mixer.unavailable = true
+	}
+	return SoundCardPlayer{card: aCard, controlName: aControlName, calibration: calibration, mixer: mixer}
+}
+
+func (p SoundCardPlayer) Play(audioFileName string, volume int, options playlist.PlayOptions) error {
+	p.ambient.Pause()
+	defer p.ambient.Resume()
+	volumeArgs := p.applyVolume(volume)
+	trim, err := p.trimArgs(audioFileName, options)
+	if err != nil {
 		return err
 	}
-	return p.play(audioFileName)
+	effects := append(trim, loudnessArgs(audioFileName, options)...)
+	effects = append(effects, p.panArgs(options.Pan)...)
+	return p.play(audioFileName, append(effects, volumeArgs...)...)
 }
 
+// panArgs works out the sox effects that steer a sound toward the left or right speaker.  The sound is
+// mixed down to one channel and then played louder on one side than the other.  Mono devices have no
+// sides, so they play it as it is.
+func (p SoundCardPlayer) panArgs(pan float64) []string {
+	if pan == 0 || p.mono {
+		return nil
+	}
+	left := math.Min(1, 1-pan)
+	right := math.Min(1, 1+pan)
+	return []string{"channels", "1", "remix", "1v" + strconv.FormatFloat(left, 'f', 2, 64), "1v" + strconv.FormatFloat(right, 'f', 2, 64)}
+}
+
+// PlayChime plays a short rising tone so that someone near the device can hear it is working.
+func (p SoundCardPlayer) PlayChime(volume int) error {
+	p.ambient.Pause()
+	defer p.ambient.Resume()
+	volumeArgs := p.applyVolume(volume)
+	args := append([]string{"-q", "-n", "synth", "0.6", "sine", "660-990", "fade", "0", "0.6", "0.1"}, volumeArgs...)
+	cmd := exec.Command("play", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("chime failed: %v\noutput:\n%s", err, out)
+	}
+	return nil
+}
+
+// trimArgs works out the sox trim effect needed to play just the requested segment of a file.
+func (p *SoundCardPlayer) trimArgs(filename string, options playlist.PlayOptions) ([]string, error) {
+	if options.Offset == 0 && options.Duration == 0 && !options.RandomOffset {
+		return nil, nil
+	}
+
+	length, err := probeDuration(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := options.Offset
+	if options.RandomOffset {
+		offset = 0
+		if latestStart := length - options.Duration; latestStart > 0 {
+			offset = time.Duration(rand.Int63n(int64(latestStart)))
+		}
+	}
+	if offset >= length {
+		return nil, fmt.Errorf("offset %v is past the end of %s (%v long)", offset, filepath.Base(filename), length)
+	}
+
+	args := []string{"trim", formatSeconds(offset)}
+	if options.Duration > 0 {
+		args = append(args, formatSeconds(options.Duration))
+	}
+	return args, nil
+}
+
+// loudnessArgs works out the sox gain effect needed to play a file at the level the server asked for.
+// Without a gain hint the file is measured to bring it to the target loudness.  If that can't be done
+// the file is played as it is.
+func loudnessArgs(filename string, options playlist.PlayOptions) []string {
+	gain := options.GainDB
+	if gain == 0 && options.TargetLUFS != 0 {
+		loudness, err := measureLoudness(filename)
+		if err != nil {
+			log.Printf("Not adjusting loudness of %s: %v", filepath.Base(filename), err)
+			return nil
+		}
+		gain = options.TargetLUFS - loudness
+	}
+	if gain == 0 {
+		return nil
+	}
+	return []string{"gain", strconv.FormatFloat(gain, 'f', 1, 64)}
+}
+
+// measureLoudness uses sox to find the RMS level of an audio file in dB, which is close enough to its
+// loudness in LUFS for evening out the level of lures.
+func measureLoudness(filename string) (float64, error) {
+	out, err := exec.Command("sox", filename, "-n", "stats").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("loudness measurement failed: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "RMS lev dB") {
+			fields := strings.Fields(line)
+			if level, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+				return level, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("loudness measurement failed: no RMS level in sox output")
+}
+
+// probeDuration uses soxi to find how long an audio file is.
+func probeDuration(filename string) (time.Duration, error) {
+	out, err := exec.Command("soxi", "-D", filename).Output()
+	if err != nil {
+		return 0, fmt.Errorf("duration probe failed: %v", err)
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("duration probe failed: %v", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// applyVolume sets the mixer for a schedule volume.  If there is no working mixer it returns the sox
+// effect that sets the volume in the player instead, so that a missing mixer doesn't stop sounds
+// playing.
+func (p SoundCardPlayer) applyVolume(volume int) []string {
+	if p.mixer != nil {
+		p.mixer.mu.Lock()
+		defer p.mixer.mu.Unlock()
+		if p.mixer.unavailable {
+			return p.softwareVolumeArgs(volume)
+		}
+	}
+	err := p.setVolume(volume)
+	if err == nil {
+		return nil
+	}
+	log.Printf("Could not use mixer, setting the volume in the player from now on: %v", err)
+	if p.mixer != nil {
+		p.mixer.unavailable = true
+	}
+	return p.softwareVolumeArgs(volume)
+}
+
+// softwareVolumeArgs gets the sox effect for playing at a schedule volume, using the calibrated gain if
+// there is one.
+func (p SoundCardPlayer) softwareVolumeArgs(volume int) []string {
+	if gain, ok := p.calibration.GainDB(volume); ok {
+		return []string{"vol", strconv.FormatFloat(gain, 'f', 1, 64) + "dB"}
+	}
+	return []string{"vol", strconv.FormatFloat(float64(volume)/10, 'f', 1, 64)}
+}
+
+// setVolume sets the mixer for a schedule volume, using the calibrated gain if there is one.
 func (p *SoundCardPlayer) setVolume(volume int) error {
+	level := fmt.Sprintf("%d%%", volume*10)
+	if gain, ok := p.calibration.GainDB(volume); ok {
+		level = fmt.Sprintf("%.1fdB", gain)
+	}
 	cmd := exec.Command(
 		"amixer",
 		"-c", fmt.Sprint(p.card),
 		"sset",
 		p.controlName,
-		fmt.Sprintf("%d%%", volume*10),
+		level,
 	)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -44,16 +227,65 @@ func (p *SoundCardPlayer) setVolume(volume int) error {
 	return nil
 }
 
-func (p *SoundCardPlayer) play(filename string) error {
-	cmd := exec.Command("play", "-q", filename)
+func (p *SoundCardPlayer) play(filename string, effects ...string) error {
+	if _, err := os.Stat(filename); err != nil {
+		return &PlaybackError{Kind: PlaybackMissingFile, Err: err}
+	}
+	cmd := exec.Command("play", append([]string{"-q", filename}, effects...)...)
+	if p.device != "" {
+		cmd.Env = append(os.Environ(), "AUDIODRIVER=alsa", "AUDIODEV="+p.device)
+	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("play failed: %v\noutput:\n%s", err, out)
+		return &PlaybackError{Kind: playbackErrorKind(string(out)), Output: string(out), Err: err}
 	}
 
 	return nil
 }
 
+// Kinds of PlaybackError.
+const (
+	PlaybackMissingFile = "missingFile"
+	PlaybackDecode      = "decode"
+	PlaybackDeviceBusy  = "deviceBusy"
+	PlaybackStream      = "stream"
+	PlaybackOther       = "other"
+)
+
+// PlaybackError is returned when a sound couldn't be played.
+type PlaybackError struct {
+	// Kind is what went wrong, one of the Playback... constants.
+	Kind string
+	// Output is what the player printed.
+	Output string
+	Err    error
+}
+
+func (e *PlaybackError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("play failed: %v", e.Err)
+	}
+	return fmt.Sprintf("play failed: %v\noutput:\n%s", e.Err, e.Output)
+}
+
+func (e *PlaybackError) Unwrap() error {
+	return e.Err
+}
+
+// playbackErrorKind works out what went wrong from the player's output.
+func playbackErrorKind(output string) string {
+	switch {
+	case strings.Contains(output, "No such file"):
+		return PlaybackMissingFile
+	case strings.Contains(output, "Device or resource busy"):
+		return PlaybackDeviceBusy
+	case strings.Contains(output, "can't open input file"), strings.Contains(output, "no handler for"),
+		strings.Contains(output, "FAIL formats"):
+		return PlaybackDecode
+	}
+	return PlaybackOther
+}
+
 func (p *SoundCardPlayer) queueEvent(ts time.Time, filename string) error {
 	eventDetails := map[string]interface{}{
 		"description": map[string]interface{}{
@@ -0,0 +1,107 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingMixerFallsBackToSoftwareVolume(t *testing.T) {
+	defer func(original func(string) (string, error)) { lookPath = original }(lookPath)
+	lookPath = func(file string) (string, error) {
+		return "", errors.New("executable file not found in $PATH")
+	}
+
+	player := NewSoundCardPlayer(0, "Master", nil)
+	assert.Equal(t, []string{"vol", "0.5"}, player.applyVolume(5))
+	assert.Equal(t, []string{"vol", "1.0"}, player.applyVolume(10))
+
+	calibrated := NewSoundCardPlayer(0, "Master", VolumeCalibration{{Volume: 0, GainDB: -30}, {Volume: 10, GainDB: 0}})
+	assert.Equal(t, []string{"vol", "-15.0dB"}, calibrated.applyVolume(5))
+}
+
+func TestPanSteersTowardOneSpeaker(t *testing.T) {
+	player := SoundCardPlayer{}
+	assert.Nil(t, player.panArgs(0))
+	assert.Equal(t, []string{"channels", "1", "remix", "1v1.00", "1v0.00"}, player.panArgs(-1))
+	assert.Equal(t, []string{"channels", "1", "remix", "1v0.50", "1v1.00"}, player.panArgs(0.5))
+
+	mono := SoundCardPlayer{mono: true}
+	assert.Nil(t, mono.panArgs(-1))
+}
+
+func TestCrossfadeStartsOverlapSoundsLongEnoughToFade(t *testing.T) {
+	lengths := []time.Duration{10 * time.Second, 10 * time.Second, 3 * time.Second, 10 * time.Second}
+	gaps := []time.Duration{0, 5 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	starts, fades := crossfadeStarts(lengths, gaps, 2*time.Second)
+	assert.Equal(t, []bool{true, false, false}, fades)
+	assert.Equal(t, []time.Duration{0, 8 * time.Second, 23 * time.Second, 31 * time.Second}, starts)
+}
+
+func TestAudioDevicesAreReadFromAplay(t *testing.T) {
+	devices := parseAplayList(`**** List of PLAYBACK Hardware Devices ****
+card 0: Headphones [bcm2835 Headphones], device 0: bcm2835 Headphones [bcm2835 Headphones]
+  Subdevices: 8/8
+  Subdevice #0: subdevice #0
+card 1: Device [USB Audio Device], device 0: USB Audio [USB Audio]
+  Subdevices: 1/1
+`)
+	assert.Equal(t, []AudioDevice{
+		{Card: 0, Device: 0, ID: "hw:0,0", CardName: "bcm2835 Headphones", Name: "bcm2835 Headphones"},
+		{Card: 1, Device: 0, ID: "hw:1,0", CardName: "USB Audio Device", Name: "USB Audio"},
+	}, devices)
+
+	conf := &AudioConfig{Card: 1}
+	assert.NoError(t, conf.ValidateOutputDevices(devices))
+	conf.Zones = []ZoneConfig{{Name: "left", Card: 1, Device: "plughw:1,1"}}
+	assert.EqualError(t, conf.ValidateOutputDevices(devices), "zone left: audio device plughw:1,1 not found")
+	conf.Zones = nil
+	conf.Card = 2
+	assert.EqualError(t, conf.ValidateOutputDevices(devices), "sound card 2 has no audio devices")
+}
+
+func TestAmbientSoundPausesWhileLuresPlay(t *testing.T) {
+	started := make(chan []string, 2)
+	defer func(original func(string, ...string) *exec.Cmd) { ambientCommand = original }(ambientCommand)
+	ambientCommand = func(name string, args ...string) *exec.Cmd {
+		started <- args
+		return exec.Command("sleep", "60")
+	}
+
+	player := SoundCardPlayer{mixer: &mixerState{unavailable: true}}
+	ambient := NewAmbientLoop(player, "soundCardPlayer_test.go", 2)
+	ambient.Start()
+	assert.Equal(t, []string{"-q", "soundCardPlayer_test.go", "vol", "0.2", "repeat", "-"}, <-started)
+	for !ambient.playing() {
+		time.Sleep(time.Millisecond)
+	}
+
+	ambient.Pause()
+	assert.False(t, ambient.playing())
+	ambient.Resume()
+	<-started
+	ambient.Pause()
+}
+
+func TestStreamedCombosSoundsAreNotDownloaded(t *testing.T) {
+	streamed := playlist.Combo{Sounds: []string{"4", "5"}, Stream: true}
+	downloaded := playlist.Combo{Sounds: []string{"5", "6"}}
+	schedule := playlist.Schedule{Combos: []playlist.Combo{streamed, downloaded}}
+
+	toDownload, streamedOnly := splitStreamedCombos(schedule, false)
+	assert.Equal(t, []playlist.Combo{downloaded}, toDownload.Combos)
+	assert.Equal(t, []int{4}, streamedOnly)
+
+	toDownload, streamedOnly = splitStreamedCombos(schedule, true)
+	assert.Empty(t, toDownload.Combos)
+	assert.ElementsMatch(t, []int{4, 5, 6}, streamedOnly)
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Store keeps the state audiobait needs across restarts, such as the event spool, the saved schedule and
+// the hash index, as values by key.  Get returns an error for which os.IsNotExist is true when there is
+// no value for the key.  The audio files themselves are always kept in the audio directory.
+type Store interface {
+	Get(key string) ([]byte, error)
+	// Put replaces the value for the key, so that a reader gets either the old value or the new one.
+	Put(key string, data []byte) error
+	// Delete removes the value for the key, if there is one.
+	Delete(key string) error
+	// List gets the keys that have values, in order.
+	List() ([]string, error)
+}
+
+// Appender is a Store that can add to the end of a value without rewriting it, which the event spool
+// does for every event.
+type Appender interface {
+	Append(key string, data []byte) error
+}
+
+// appendToStore adds data to the end of the value for the key, rewriting the value if the store can't
+// append to it.
+func appendToStore(store Store, key string, data []byte) error {
+	if appender, ok := store.(Appender); ok {
+		return appender.Append(key, data)
+	}
+	existing, err := store.Get(key)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return store.Put(key, append(existing, data...))
+}
+
+// FileStore is a Store that keeps each value in a file, named by its key, in a directory.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store kept in the given directory, which must already exist.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (store *FileStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(store.path(key))
+}
+
+// Put writes the value to a temporary file first, and then renames it over the old value.
+func (store *FileStore) Put(key string, data []byte) error {
+	tmpPath := store.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, fileMode(key)); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path(key))
+}
+
+func (store *FileStore) Append(key string, data []byte) error {
+	file, err := os.OpenFile(store.path(key), os.O_APPEND|os.O_CREATE|os.O_WRONLY, fileMode(key))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (store *FileStore) Delete(key string) error {
+	if err := os.Remove(store.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List gets the names of the files in the directory, which include the audio files if the store is kept
+// in the audio directory.
+func (store *FileStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			keys = append(keys, info.Name())
+		}
+	}
+	return keys, nil
+}
+
+// fileMode gets the permissions a value's file is created with.  The audio library is only readable by
+// audiobait's user, as it always has been.
+func fileMode(key string) os.FileMode {
+	if key == libraryFilename {
+		return 0600
+	}
+	return 0644
+}
+
+func (store *FileStore) path(key string) string {
+	return filepath.Join(store.dir, key)
+}
+
+// MemoryStore is a Store that only keeps values in memory, for when nothing needs to survive a restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+// NewMemoryStore creates an empty store in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string][]byte)}
+}
+
+func (store *MemoryStore) Get(key string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	value, exists := store.values[key]
+	if !exists {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (store *MemoryStore) Put(key string, data []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.values[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (store *MemoryStore) Delete(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.values, key)
+	return nil
+}
+
+func (store *MemoryStore) List() ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	keys := make([]string, 0, len(store.values))
+	for key := range store.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore checks that a store keeps, replaces, lists and deletes values, as every Store must.
+func testStore(t *testing.T, store Store) {
+	_, err := store.Get("schedule.json")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, store.Put("schedule.json", []byte("old")))
+	assert.Nil(t, store.Put("schedule.json", []byte("new")))
+	assert.Nil(t, store.Put("events.json", []byte("one\n")))
+	assert.Nil(t, appendToStore(store, "events.json", []byte("two\n")))
+	value, err := store.Get("schedule.json")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(value))
+	value, err = store.Get("events.json")
+	assert.Nil(t, err)
+	assert.Equal(t, "one\ntwo\n", string(value))
+
+	keys, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"events.json", "schedule.json"}, keys)
+
+	assert.Nil(t, store.Delete("schedule.json"))
+	assert.Nil(t, store.Delete("schedule.json"))
+	_, err = store.Get("schedule.json")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStore(t *testing.T) {
+	testStore(t, NewFileStore(t.TempDir()))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestMemoryStoreValuesCantBeChangedFromOutside(t *testing.T) {
+	store := NewMemoryStore()
+	data := []byte("old")
+	assert.Nil(t, store.Put("key", data))
+	data[0] = 'n'
+	value, _ := store.Get("key")
+	value[1] = 'n'
+
+	value, _ = store.Get("key")
+	assert.Equal(t, "old", string(value))
+}
+
+func TestFileStoreKeepsTheLibraryPrivate(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+	assert.Nil(t, appendToStore(store, libraryFilename, []byte("1,howl.mp3\n")))
+	assert.Nil(t, store.Put(scheduleFilename, []byte("{}")))
+
+	info, err := os.Stat(filepath.Join(dir, libraryFilename))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, scheduleFilename))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// Nothing is left over from replacing values.
+	keys, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{libraryFilename, scheduleFilename}, keys)
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// PlayStream plays a sound as it is read, piping it into the player.  If reading it fails part way
+// through the player is stopped.  A random offset or target loudness needs the whole file, so streamed
+// sounds are played from their offset and only adjusted by their gain.
+func (p SoundCardPlayer) PlayStream(stream playlist.SoundStream, volume int, options playlist.PlayOptions) error {
+	if stream.Type == "" {
+		return &PlaybackError{Kind: PlaybackDecode, Err: errors.New("streamed sound has no file type")}
+	}
+	p.ambient.Pause()
+	defer p.ambient.Resume()
+	volumeArgs := p.applyVolume(volume)
+	args := []string{"-q", "-t", stream.Type, "-"}
+	if options.Offset > 0 || options.Duration > 0 {
+		args = append(args, "trim", formatSeconds(options.Offset))
+		if options.Duration > 0 {
+			args = append(args, formatSeconds(options.Duration))
+		}
+	}
+	if options.GainDB != 0 {
+		args = append(args, "gain", strconv.FormatFloat(options.GainDB, 'f', 1, 64))
+	}
+	args = append(args, p.panArgs(options.Pan)...)
+	args = append(args, volumeArgs...)
+
+	cmd := exec.Command("play", args...)
+	input := &streamInput{stream: stream, abort: func() { cmd.Process.Kill() }}
+	cmd.Stdin = input
+	if p.device != "" {
+		cmd.Env = append(os.Environ(), "AUDIODRIVER=alsa", "AUDIODEV="+p.device)
+	}
+	out, err := cmd.CombinedOutput()
+	if readErr := input.failed(); readErr != nil {
+		return &PlaybackError{Kind: PlaybackStream, Err: readErr}
+	}
+	if err != nil {
+		return &PlaybackError{Kind: playbackErrorKind(string(out)), Output: string(out), Err: err}
+	}
+	return nil
+}
+
+// streamInput feeds a stream to the player, stopping the player if reading the stream fails.
+type streamInput struct {
+	stream io.Reader
+	abort  func()
+
+	mu  sync.Mutex
+	err error
+}
+
+func (input *streamInput) Read(p []byte) (int, error) {
+	n, err := input.stream.Read(p)
+	if err != nil && err != io.EOF {
+		input.mu.Lock()
+		input.err = err
+		input.mu.Unlock()
+		input.abort()
+	}
+	return n, err
+}
+
+// failed gets the error reading the stream failed with, if it did.
+func (input *streamInput) failed() error {
+	input.mu.Lock()
+	defer input.mu.Unlock()
+	return input.err
+}
+
+// downloaderStreamer streams sounds from the server with the downloader's connection.
+type downloaderStreamer struct {
+	dl *Downloader
+}
+
+// OpenSoundStream gets a new signed URL for the sound and opens it, connecting to the API first if there
+// is no connection.
+func (streamer downloaderStreamer) OpenSoundStream(fileId int) (playlist.SoundStream, error) {
+	if streamer.dl.api == nil {
+		streamer.dl.api = tryToInitiateAPI(streamer.dl.apiOpts...)
+	}
+	if streamer.dl.api == nil {
+		return playlist.SoundStream{}, errors.New("not connected to API")
+	}
+	fileInfo, err := streamer.dl.api.GetFileDetails(fileId)
+	if err != nil {
+		return playlist.SoundStream{}, err
+	}
+	body, err := streamer.dl.api.StreamFile(context.Background(), fileInfo)
+	if err != nil {
+		return playlist.SoundStream{}, err
+	}
+	fileType := strings.TrimPrefix(filepath.Ext(fileInfo.File.Details.OriginalName), ".")
+	return playlist.SoundStream{ReadCloser: body, Type: strings.ToLower(fileType)}, nil
+}
+
+// streamedFileName is the name a streamed sound that hasn't been downloaded is given in the player's
+// files, where it is only used to show which sound is playing.
+func streamedFileName(fileId int) string {
+	return fmt.Sprintf("%d.stream", fileId)
+}
+
+// splitStreamedCombos separates the combos of the schedule that stream their sounds, returning the
+// schedule with just the combos whose sounds need downloading, and the schedule's sounds that are only
+// streamed.
+func splitStreamedCombos(schedule playlist.Schedule, streamAll bool) (playlist.Schedule, []int) {
+	downloaded := schedule
+	downloaded.Combos = nil
+	streamed := schedule
+	streamed.Combos = nil
+	for _, combo := range schedule.Combos {
+		if combo.Stream || streamAll {
+			streamed.Combos = append(streamed.Combos, combo)
+		} else {
+			downloaded.Combos = append(downloaded.Combos, combo)
+		}
+	}
+	needed := make(map[int]bool)
+	for _, fileId := range downloaded.GetReferencedSounds() {
+		needed[fileId] = true
+	}
+	var streamedOnly []int
+	for _, fileId := range streamed.GetReferencedSounds() {
+		if !needed[fileId] {
+			streamedOnly = append(streamedOnly, fileId)
+		}
+	}
+	return downloaded, streamedOnly
+}
+
+// splitStreamedZoneCombos separates the combos that stream their sounds from each zone's schedule, as
+// splitStreamedCombos does.  A sound is only left to be streamed if no zone needs it downloaded.
+func splitStreamedZoneCombos(schedules []playlist.ZoneSchedule, streamAll bool) ([]playlist.ZoneSchedule, []int) {
+	downloaded := make([]playlist.ZoneSchedule, len(schedules))
+	var streamed []int
+	needed := make(map[int]bool)
+	for i, zoneSchedule := range schedules {
+		schedule, zoneStreamed := splitStreamedCombos(zoneSchedule.Schedule, streamAll)
+		downloaded[i] = playlist.ZoneSchedule{Zone: zoneSchedule.Zone, Schedule: schedule}
+		streamed = append(streamed, zoneStreamed...)
+		for _, fileId := range schedule.GetReferencedSounds() {
+			needed[fileId] = true
+		}
+	}
+	var streamedOnly []int
+	for _, fileId := range uniqueFileIds(streamed) {
+		if !needed[fileId] {
+			streamedOnly = append(streamedOnly, fileId)
+		}
+	}
+	return downloaded, streamedOnly
+}
+
+// addStreamedFiles names the sounds that are only streamed in the player's files.
+func addStreamedFiles(files map[int]string, streamed []int) map[int]string {
+	for _, fileId := range streamed {
+		if files == nil {
+			files = make(map[int]string)
+		}
+		files[fileId] = streamedFileName(fileId)
+	}
+	return files
+}
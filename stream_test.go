@@ -0,0 +1,28 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamedZoneSoundsAreDownloadedIfAnotherZoneNeedsThem(t *testing.T) {
+	streamed := playlist.Combo{Sounds: []string{"1", "2"}, Stream: true}
+	schedules := []playlist.ZoneSchedule{
+		{Zone: "north", Schedule: playlist.Schedule{Combos: []playlist.Combo{streamed}}},
+		{Zone: "south", Schedule: playlist.Schedule{Combos: []playlist.Combo{{Sounds: []string{"2"}}}}},
+	}
+
+	downloaded, streamedOnly := splitStreamedZoneCombos(schedules, false)
+
+	assert.Equal(t, []int{1}, streamedOnly)
+	assert.Len(t, downloaded, 2)
+	assert.Empty(t, downloaded[0].Schedule.Combos)
+	assert.Equal(t, "south", downloaded[1].Zone)
+	assert.Equal(t, []int{2}, downloaded[1].Schedule.GetReferencedSounds())
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// SyncConfig controls checking the schedule's files against the server at startup.
+type SyncConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Prune deletes the files that the schedule doesn't use.
+	Prune bool `yaml:"prune"`
+}
+
+// SyncReport lists what SyncFiles did to each file.
+type SyncReport struct {
+	Downloaded []int
+	Replaced   []int
+	Unchanged  []int
+	Pruned     []int
+	// Failed maps the ID of each file that couldn't be synced to the reason why.
+	Failed map[int]string
+}
+
+// SyncFiles reconciles the audio directory with the files referenced by the schedule.  Every file is
+// checked against the server: missing files are downloaded, and files on disk are downloaded again if
+// the server's ETag for them has changed since they were downloaded.  If prune is set, files that are
+// no longer referenced are deleted.
+//
+// Each file is added to the audio library as soon as it is downloaded, so if ctx is cancelled the files
+// completed so far are kept and calling SyncFiles again carries on from where it stopped.
+func (dl *Downloader) SyncFiles(ctx context.Context, schedule playlist.Schedule, prune bool) (*SyncReport, error) {
+	return dl.syncFiles(ctx, schedule.GetReferencedSounds(), prune)
+}
+
+// SyncFilesForSchedules syncs the files for several schedules at once, as SyncFiles does.
+func (dl *Downloader) SyncFilesForSchedules(ctx context.Context, schedules []playlist.ZoneSchedule, prune bool) (*SyncReport, error) {
+	var fileIds []int
+	for _, zoneSchedule := range schedules {
+		fileIds = append(fileIds, zoneSchedule.Schedule.GetReferencedSounds()...)
+	}
+	return dl.syncFiles(ctx, uniqueFileIds(fileIds), prune)
+}
+
+func (dl *Downloader) syncFiles(ctx context.Context, referencedFiles []int, prune bool) (*SyncReport, error) {
+	if dl.api == nil {
+		return nil, errors.New("not connected to API")
+	}
+
+	audioLibrary := OpenLibrary(dl.stateStore())
+	hashIndex := dl.openHashIndex()
+	defer dl.saveHashIndex(hashIndex)
+
+	localFiles := dl.verifyLocalSounds(audioLibrary, hashIndex, referencedFiles)
+	report := &SyncReport{Failed: make(map[int]string)}
+
+	for _, fileId := range referencedFiles {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		fileInfo, err := dl.api.GetFileDetails(fileId)
+		if err != nil {
+			report.Failed[fileId] = err.Error()
+			continue
+		}
+
+		current, _ := audioLibrary.GetFileNameOnDisk(strconv.Itoa(fileId))
+		_, onDisk := localFiles[fileId]
+		if onDisk && dl.canRefreshInPlace(fileId, current) {
+			written, err := dl.refreshFile(audioLibrary, fileId, fileInfo, current, false)
+			if err != nil {
+				report.Failed[fileId] = err.Error()
+				continue
+			}
+			dl.recordLoudnessHints(fileId, fileInfo)
+			dl.recordVerified(fileId)
+			if written {
+				report.Replaced = append(report.Replaced, fileId)
+			} else {
+				report.Unchanged = append(report.Unchanged, fileId)
+			}
+			continue
+		}
+
+		if _, err := dl.downloadFile(ctx, audioLibrary, fileId, fileInfo); err != nil {
+			report.Failed[fileId] = err.Error()
+			continue
+		}
+		if onDisk {
+			dl.removeAudioFile(current)
+			report.Replaced = append(report.Replaced, fileId)
+		} else {
+			report.Downloaded = append(report.Downloaded, fileId)
+		}
+	}
+
+	if prune {
+		report.Pruned = dl.pruneUnusedFiles(audioLibrary, referencedFiles)
+		if dl.contentHashNames {
+			if _, err := dl.pruneStaleVersions(audioLibrary); err != nil {
+				log.Printf("Could not delete old versions of files: %s", err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// canRefreshInPlace checks whether the file saved as current can be checked against the server's ETag
+// and downloaded again under the same name if it has changed.  A file saved before names by content
+// hash were turned on has to be downloaded again to be saved by its hash.  Any other file is kept
+// under the name it has, even if the server has since renamed it, so that a file is only downloaded
+// again when its contents have changed.
+func (dl *Downloader) canRefreshInPlace(fileId int, current string) bool {
+	return !dl.contentHashNames || isContentHashFileName(current, fileId)
+}
+
+// pruneUnusedFiles deletes the files in the audio library that aren't in fileIds.
+func (dl *Downloader) pruneUnusedFiles(audioLibrary *AudioFileLibrary, fileIds []int) []int {
+	keep := make(map[string]bool)
+	for _, fileId := range fileIds {
+		keep[strconv.Itoa(fileId)] = true
+	}
+
+	var pruned []int
+	for strFileId, filename := range audioLibrary.FilesById {
+		if keep[strFileId] {
+			continue
+		}
+		if err := audioLibrary.RemoveFile(strFileId); err != nil {
+			log.Printf("Could not remove file %s from the audio library: %s", strFileId, err)
+			continue
+		}
+		dl.removeAudioFile(filename)
+		if fileId, err := strconv.Atoi(strFileId); err == nil {
+			pruned = append(pruned, fileId)
+		}
+	}
+	return pruned
+}
+
+// CleanupTempFiles deletes the temporary files left in fileFolder by downloads and compression that were
+// interrupted, such as by a crash or power cut, returning how many were deleted.  Only files named as
+// the downloader names its temporary files are deleted, so other files in the folder are left alone.
+func CleanupTempFiles(fileFolder string) (int, error) {
+	infos, err := ioutil.ReadDir(fileFolder)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !isTempFileName(name) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(fileFolder, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not delete temporary file %s: %s", name, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func isTempFileName(name string) bool {
+	return strings.HasSuffix(name, api.PartialFileExt) || strings.HasSuffix(name, api.PartialFileExt+transcodedExt)
+}
+
+func (dl *Downloader) removeAudioFile(filename string) {
+	if err := os.Remove(filepath.Join(dl.audioDir, filename)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not delete audio file %s: %s", filename, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+	"github.com/TheCacophonyProject/audiobait/playlist"
+	"github.com/stretchr/testify/assert"
+)
+
+// fileServer serves audio files, each named beep on the server, with their versions as their ETags.  Files
+// without a version aren't found.
+type fileServer struct {
+	versions  map[string]string
+	downloads int
+	// downloading, if set, is called as each file starts downloading.
+	downloading func(fileId string)
+}
+
+func newFileServer(t *testing.T, versions map[string]string) (*fileServer, *api.CacophonyAPI) {
+	files := &fileServer{versions: versions}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/signedUrl" {
+			version := files.versions[r.URL.Query().Get("jwt")]
+			w.Header().Set("ETag", `"`+version+`"`)
+			if r.Header.Get("If-None-Match") == `"`+version+`"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			files.downloads++
+			if files.downloading != nil {
+				files.downloading(r.URL.Query().Get("jwt"))
+			}
+			fmt.Fprint(w, version)
+			return
+		}
+		fileId := filepath.Base(r.URL.Path)
+		if _, exists := files.versions[fileId]; !exists {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"jwt": "%s", "file": {"details": {"name": "beep", "originalName": "beep.wav"}}}`, fileId)
+	}))
+	t.Cleanup(server.Close)
+	return files, api.NewUnauthenticatedAPI(server.URL, "north", "device", "secret", api.WithFileCache(OpenETagCache(NewMemoryStore())))
+}
+
+func newSyncDownloader(t *testing.T, cacophonyAPI *api.CacophonyAPI) *Downloader {
+	return &Downloader{audioDir: t.TempDir(), store: NewMemoryStore(), api: cacophonyAPI}
+}
+
+func scheduleOf(sounds ...string) playlist.Schedule {
+	return playlist.Schedule{Combos: []playlist.Combo{{Sounds: sounds}}}
+}
+
+func TestSyncFilesOnlyDownloadsFilesThatHaveChanged(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "2": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1", "2"), false)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int{1, 2}, report.Downloaded)
+	assert.Equal(t, 2, files.downloads)
+
+	files.versions["2"] = "v2"
+	report, err = dl.SyncFiles(context.Background(), scheduleOf("1", "2"), false)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Downloaded)
+	assert.Equal(t, []int{1}, report.Unchanged)
+	assert.Equal(t, []int{2}, report.Replaced)
+	assert.Equal(t, 3, files.downloads)
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dl.audioDir, "beep-2.wav"))
+	assert.Equal(t, "v2", string(contents))
+}
+
+func TestSyncFilesKeepsRenamedFilesThatHaventChanged(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	_, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+
+	// Saving files by their original names changes the name the file would be downloaded as now.
+	dl.SetOriginalFileNames(true)
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, report.Unchanged)
+	assert.Equal(t, 1, files.downloads)
+}
+
+func TestSyncFilesPrunesFilesTheScheduleDoesntUse(t *testing.T) {
+	_, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "2": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	_, err := dl.SyncFiles(context.Background(), scheduleOf("1", "2"), false)
+	assert.Nil(t, err)
+
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Pruned)
+	assert.FileExists(t, filepath.Join(dl.audioDir, "beep-2.wav"))
+
+	report, err = dl.SyncFiles(context.Background(), scheduleOf("1"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, report.Pruned)
+	_, err = os.Stat(filepath.Join(dl.audioDir, "beep-2.wav"))
+	assert.True(t, os.IsNotExist(err))
+	_, exists := OpenLibrary(dl.stateStore()).GetFileNameOnDisk("2")
+	assert.False(t, exists)
+}
+
+func TestSyncFilesStopsWhenCancelled(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := dl.SyncFiles(ctx, scheduleOf("1"), false)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, report.Downloaded)
+	assert.Equal(t, 0, files.downloads)
+}
+
+func TestCancelledDownloadsLeaveOnlyTheFilesCompleted(t *testing.T) {
+	files, cacophonyAPI := newFileServer(t, map[string]string{"1": "v1", "2": "v1", "3": "v1"})
+	dl := newSyncDownloader(t, cacophonyAPI)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Cancel part way through the second download.
+	files.downloading = func(string) {
+		if files.downloads == 2 {
+			cancel()
+		}
+	}
+
+	available, err := dl.GetFilesForSchedule(ctx, scheduleOf("1", "2", "3"))
+	downloadErr, ok := err.(*DownloadError)
+	assert.True(t, ok)
+	assert.Len(t, downloadErr.Completed, 1)
+	completed := fmt.Sprintf("beep-%d.wav", downloadErr.Completed[0])
+	assert.Equal(t, map[int]string{downloadErr.Completed[0]: completed}, available)
+	names, _ := filepath.Glob(filepath.Join(dl.audioDir, "beep-*"))
+	assert.Equal(t, []string{filepath.Join(dl.audioDir, completed)}, names)
+}
+
+func TestCleanupTempFilesOnlyDeletesPartialDownloads(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"beep-1.wav" + api.PartialFileExt, "beep-2.wav" + api.PartialFileExt + transcodedExt, "beep-3.wav", "notes.tmp"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("audio"), 0644))
+	}
+
+	removed, err := CleanupTempFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, removed)
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Equal(t, []string{filepath.Join(dir, "beep-3.wav"), filepath.Join(dir, "notes.tmp")}, names)
+}
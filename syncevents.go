@@ -0,0 +1,83 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// syncEventInterval is the shortest time between sync events of the same type and key, which stops
+// syncing that keeps failing, or a schedule that keeps being fetched, from flooding the server with
+// events.  Each event is a summary of a whole schedule fetch or download run.
+const syncEventInterval = 10 * time.Minute
+
+// SetSyncEvents sets whether the stages of syncing with the server, from getting the schedule to
+// downloading its files, are reported as events so that a device's syncing can be followed remotely.
+func (dl *Downloader) SetSyncEvents(enabled bool) {
+	if !enabled {
+		dl.syncEvents = nil
+	} else if dl.syncEvents == nil {
+		dl.syncEvents = newEventRateLimiter(syncEventInterval)
+	}
+}
+
+// reportScheduleReceived reports an audioBaitScheduleReceived event for a schedule just downloaded.
+func (dl *Downloader) reportScheduleReceived(scheduleID int, combos int, took time.Duration) {
+	dl.reportSyncEvent("audioBaitScheduleReceived", strconv.Itoa(scheduleID), map[string]interface{}{
+		"scheduleId":      scheduleID,
+		"combos":          combos,
+		"durationSeconds": took.Seconds(),
+	})
+}
+
+// reportDownloadStarted reports an audioBaitDownloadStarted event when files need downloading.
+func (dl *Downloader) reportDownloadStarted(files int) {
+	dl.reportSyncEvent("audioBaitDownloadStarted", "", map[string]interface{}{
+		"files": files,
+	})
+}
+
+// reportDownloadFinished reports an audioBaitFilesDownloaded event for the files that were downloaded,
+// and an audioBaitFilesFailed event for those that weren't.
+func (dl *Downloader) reportDownloadFinished(downloaded int, failures map[int]error, took time.Duration) {
+	if downloaded > 0 {
+		dl.reportSyncEvent("audioBaitFilesDownloaded", "", map[string]interface{}{
+			"files":           downloaded,
+			"durationSeconds": took.Seconds(),
+		})
+	}
+	if len(failures) == 0 {
+		return
+	}
+	fileIds := make([]int, 0, len(failures))
+	for fileId := range failures {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Ints(fileIds)
+	errs := make(map[string]string, len(failures))
+	for fileId, err := range failures {
+		errs[strconv.Itoa(fileId)] = err.Error()
+	}
+	dl.reportSyncEvent("audioBaitFilesFailed", "", map[string]interface{}{
+		"files":           len(failures),
+		"fileIds":         fileIds,
+		"errors":          errs,
+		"durationSeconds": took.Seconds(),
+	})
+}
+
+// reportSyncEvent reports a sync event if they are turned on, unless one of the same type and key was
+// reported recently.
+func (dl *Downloader) reportSyncEvent(eventType, key string, details map[string]interface{}) {
+	if dl.syncEvents == nil || !dl.syncEvents.Allow(eventType+"/"+key, time.Now()) {
+		return
+	}
+	if err := dl.reportEvent(eventType, details); err != nil {
+		log.Printf("Could not report %s event: %s", eventType, err)
+	}
+}
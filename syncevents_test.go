@@ -0,0 +1,73 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func eventTypes(transport *testTransport) []string {
+	var types []string
+	for _, event := range transport.events {
+		types = append(types, event["type"].(string))
+	}
+	return types
+}
+
+func TestSyncEventsAreOnlyReportedWhenTurnedOn(t *testing.T) {
+	transport := &testTransport{}
+	dl := newTestDownloader(transport)
+	dl.reportDownloadStarted(2)
+	assert.Empty(t, transport.events)
+
+	dl.SetSyncEvents(true)
+	dl.reportDownloadStarted(2)
+	dl.SetSyncEvents(false)
+	dl.reportDownloadStarted(2)
+
+	assert.Equal(t, []string{"audioBaitDownloadStarted"}, eventTypes(transport))
+	assert.Equal(t, map[string]interface{}{"files": 2.0}, transport.events[0]["details"])
+}
+
+func TestDownloadFinishedReportsTheDownloadsAndFailures(t *testing.T) {
+	transport := &testTransport{}
+	dl := newTestDownloader(transport)
+	dl.SetSyncEvents(true)
+
+	dl.reportDownloadFinished(3, map[int]error{7: errors.New("not found"), 4: errors.New("timeout")}, 2*time.Second)
+
+	assert.Equal(t, []string{"audioBaitFilesDownloaded", "audioBaitFilesFailed"}, eventTypes(transport))
+	assert.Equal(t, map[string]interface{}{"files": 3.0, "durationSeconds": 2.0}, transport.events[0]["details"])
+	assert.Equal(t, map[string]interface{}{
+		"files":           2.0,
+		"fileIds":         []interface{}{4.0, 7.0},
+		"errors":          map[string]interface{}{"4": "timeout", "7": "not found"},
+		"durationSeconds": 2.0,
+	}, transport.events[1]["details"])
+}
+
+func TestSyncEventsAreRateLimitedForEachDownloader(t *testing.T) {
+	transport := &testTransport{}
+	dl := newTestDownloader(transport)
+	dl.SetSyncEvents(true)
+
+	dl.reportScheduleReceived(7, 2, time.Second)
+	dl.reportScheduleReceived(7, 2, time.Second)
+	dl.reportScheduleReceived(8, 1, time.Second)
+	// Turning them on again keeps the limits.
+	dl.SetSyncEvents(true)
+	dl.reportScheduleReceived(8, 1, time.Second)
+	assert.Len(t, transport.events, 2)
+
+	// Another downloader, such as the next day's, has limits of its own.
+	other := newTestDownloader(transport)
+	other.SetSyncEvents(true)
+	other.reportScheduleReceived(7, 2, time.Second)
+	assert.Len(t, transport.events, 3)
+}
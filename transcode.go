@@ -0,0 +1,201 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TheCacophonyProject/audiobait/api"
+)
+
+const transcodedFilename = "transcoded.json"
+
+// transcodedExt is the extension of audio files compressed to Ogg Vorbis.
+const transcodedExt = ".ogg"
+
+// transcodeCommand creates the sox command that compresses a file, and is replaced for testing.
+var transcodeCommand = exec.Command
+
+// TranscodeConfig controls compressing downloaded WAV files to save space on the device.
+type TranscodeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Quality is the Ogg Vorbis quality, from -1 (smallest) to 10 (best).
+	Quality int `yaml:"quality"`
+}
+
+// Validate checks the quality is one sox accepts.
+func (conf TranscodeConfig) Validate() error {
+	if conf.Quality < -1 || conf.Quality > 10 {
+		return fmt.Errorf("transcode quality %d is outside -1 to 10", conf.Quality)
+	}
+	return nil
+}
+
+// TranscodedFiles keeps in the store what each compressed audio file was downloaded as, so the
+// integrity check can report the original file and refreshing can tell whether the original has changed.
+type TranscodedFiles struct {
+	mu    sync.Mutex
+	store Store
+	files map[string]TranscodedFile
+}
+
+// TranscodedFile is an audio file that was compressed after it was downloaded.
+type TranscodedFile struct {
+	// Stored is the name of the compressed file.
+	Stored string `json:"stored"`
+	// Original is the name the file was downloaded as.
+	Original     string `json:"original"`
+	OriginalSize int64  `json:"originalSize"`
+	OriginalHash string `json:"originalHash"`
+}
+
+// OpenTranscodedFiles loads the records kept in the store.  Missing or unreadable records are treated
+// as empty.
+func OpenTranscodedFiles(state Store) *TranscodedFiles {
+	store := &TranscodedFiles{store: state, files: make(map[string]TranscodedFile)}
+
+	jsonData, err := state.Get(transcodedFilename)
+	if os.IsNotExist(err) {
+		return store
+	} else if err != nil {
+		log.Printf("Error loading transcoded files %s", err)
+		return store
+	}
+	if err := json.Unmarshal(jsonData, &store.files); err != nil {
+		log.Printf("Transcoded files are corrupt and will be rebuilt: %s", err)
+		store.files = make(map[string]TranscodedFile)
+	}
+	return store
+}
+
+// Get gets the record of a file that was compressed, if it was.
+func (store *TranscodedFiles) Get(fileId int) (TranscodedFile, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, exists := store.files[strconv.Itoa(fileId)]
+	return file, exists
+}
+
+// Set records that a file has been compressed and saves the records.
+func (store *TranscodedFiles) Set(fileId int, file TranscodedFile) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.files[strconv.Itoa(fileId)] = file
+
+	jsonData, err := json.Marshal(store.files)
+	if err == nil {
+		err = store.store.Put(transcodedFilename, jsonData)
+	}
+	if err != nil {
+		log.Printf("Error saving transcoded files %s", err)
+	}
+}
+
+// SetTranscoding sets whether downloaded WAV files are compressed, replacing the WAV, and at what
+// quality.  The player plays them in the same way.
+func (dl *Downloader) SetTranscoding(conf TranscodeConfig) {
+	dl.transcode = conf
+}
+
+// storedFileName gets the name a download saved as filename ends up with once it has been transcoded.
+func (dl *Downloader) storedFileName(filename string) string {
+	if !dl.transcode.Enabled || !strings.EqualFold(filepath.Ext(filename), ".wav") {
+		return filename
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + transcodedExt
+}
+
+// transcodeFile compresses a downloaded file, if transcoding applies to it, and returns the name of the
+// file to keep.  If it can't be compressed the download is kept as it is.
+func (dl *Downloader) transcodeFile(fileId int, filename string) string {
+	stored := dl.storedFileName(filename)
+	if stored == filename || dl.transcoded == nil {
+		return filename
+	}
+	if err := dl.compressFile(fileId, filename, stored); err != nil {
+		log.Printf("Keeping file with id %d uncompressed: %s", fileId, err)
+		return filename
+	}
+	return stored
+}
+
+// compressFile compresses the downloaded file to stored, recording what the original was and then
+// deleting it.
+func (dl *Downloader) compressFile(fileId int, filename, stored string) error {
+	originalPath := filepath.Join(dl.audioDir, filename)
+	info, err := os.Stat(originalPath)
+	if err != nil {
+		return err
+	}
+	hash, err := hashFile(originalPath)
+	if err != nil {
+		return err
+	}
+	if err := transcode(originalPath, filepath.Join(dl.audioDir, stored), dl.transcode.Quality); err != nil {
+		return err
+	}
+
+	dl.transcoded.Set(fileId, TranscodedFile{
+		Stored:       stored,
+		Original:     filename,
+		OriginalSize: info.Size(),
+		OriginalHash: hash,
+	})
+	dl.removeAudioFile(filename)
+	return nil
+}
+
+// refreshFile makes sure the file saved as filename is the current version, as api.RefreshFile does, or
+// downloads it again whether or not it has changed if force is set.  A compressed file is checked
+// against the original it was made from, and compressed again if that has changed.  A file saved by
+// content hash is downloaded as a new version, which is added to the audio library.
+func (dl *Downloader) refreshFile(audioLibrary *AudioFileLibrary, fileId int, fileInfo *api.FileResponse, filename string, force bool) (bool, error) {
+	if dl.contentHashNames && isContentHashFileName(filename, fileId) {
+		return dl.refreshHashedFile(audioLibrary, fileId, fileInfo, filename, force)
+	}
+	if original, exists := dl.transcodedFile(fileId, filename); exists {
+		written, err := dl.api.RefreshFileAt(fileInfo, filepath.Join(dl.audioDir, original.Original), !force)
+		if err != nil || !written {
+			return written, err
+		}
+		return written, dl.compressFile(fileId, original.Original, filename)
+	}
+	path := filepath.Join(dl.audioDir, filename)
+	return dl.api.RefreshFileAt(fileInfo, path, !force && fileExists(path))
+}
+
+// transcodedFile gets the record of a file if the file saved as filename was compressed.
+func (dl *Downloader) transcodedFile(fileId int, filename string) (TranscodedFile, bool) {
+	if dl.transcoded == nil {
+		return TranscodedFile{}, false
+	}
+	original, exists := dl.transcoded.Get(fileId)
+	return original, exists && original.Stored == filename
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// transcode uses sox to compress an audio file to Ogg Vorbis.  The output is written to a temporary file
+// first so a failure never leaves a partial file.
+func transcode(inPath, outPath string, quality int) error {
+	tmpPath := outPath + api.PartialFileExt + transcodedExt
+	out, err := transcodeCommand("sox", inPath, "-C", strconv.Itoa(quality), tmpPath).CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("transcode failed: %v\noutput:\n%s", err, out)
+	}
+	return os.Rename(tmpPath, outPath)
+}
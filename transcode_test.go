@@ -0,0 +1,124 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTranscoding replaces sox with a command that "compresses" a file by upper-casing it.
+func fakeTranscoding(t *testing.T) {
+	original := transcodeCommand
+	transcodeCommand = func(name string, args ...string) *exec.Cmd {
+		return exec.Command("sh", "-c", `tr a-z A-Z < "$0" > "$1"`, args[0], args[len(args)-1])
+	}
+	t.Cleanup(func() { transcodeCommand = original })
+}
+
+func newTranscodingDownloader(t *testing.T, versions map[string]string) (*fileServer, *Downloader) {
+	files, cacophonyAPI := newFileServer(t, versions)
+	dl := newSyncDownloader(t, cacophonyAPI)
+	dl.transcoded = OpenTranscodedFiles(dl.store)
+	dl.SetTranscoding(TranscodeConfig{Enabled: true, Quality: 3})
+	return files, dl
+}
+
+func TestTranscodeQualityIsValidated(t *testing.T) {
+	assert.Nil(t, TranscodeConfig{Quality: -1}.Validate())
+	assert.Nil(t, TranscodeConfig{Quality: 10}.Validate())
+	assert.EqualError(t, TranscodeConfig{Quality: 11}.Validate(), "transcode quality 11 is outside -1 to 10")
+	assert.EqualError(t, TranscodeConfig{Quality: -2}.Validate(), "transcode quality -2 is outside -1 to 10")
+}
+
+func TestOnlyWAVFilesAreTranscoded(t *testing.T) {
+	dl := &Downloader{}
+	assert.Equal(t, "beep.wav", dl.storedFileName("beep.wav"))
+
+	dl.SetTranscoding(TranscodeConfig{Enabled: true})
+	assert.Equal(t, "beep.ogg", dl.storedFileName("beep.wav"))
+	assert.Equal(t, "BEEP.ogg", dl.storedFileName("BEEP.WAV"))
+	assert.Equal(t, "beep.mp3", dl.storedFileName("beep.mp3"))
+}
+
+func TestDownloadedFilesAreTranscoded(t *testing.T) {
+	fakeTranscoding(t)
+	_, dl := newTranscodingDownloader(t, map[string]string{"1": "v1"})
+
+	available, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.ogg"}, available)
+	contents, _ := ioutil.ReadFile(filepath.Join(dl.audioDir, "beep-1.ogg"))
+	assert.Equal(t, "V1", string(contents))
+	_, err = os.Stat(filepath.Join(dl.audioDir, "beep-1.wav"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The manifest describes the original as well.
+	manifest, err := dl.Manifest(scheduleOf("1"))
+	assert.Nil(t, err)
+	hash, _ := hashFile(filepath.Join(dl.audioDir, "beep-1.ogg"))
+	originalHash := sha256.Sum256([]byte("v1"))
+	assert.Equal(t, []ManifestEntry{{
+		ID: 1, File: "beep-1.ogg", ExpectedSize: 2, ExpectedHash: hash, Size: 2, Hash: hash,
+		OriginalFile: "beep-1.wav", OriginalSize: 2, OriginalHash: hex.EncodeToString(originalHash[:]), Status: ManifestOK,
+	}}, manifest)
+}
+
+func TestChangedOriginalsAreTranscodedAgain(t *testing.T) {
+	fakeTranscoding(t)
+	files, dl := newTranscodingDownloader(t, map[string]string{"1": "v1"})
+	_, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+
+	report, err := dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, report.Unchanged)
+
+	files.versions["1"] = "v2"
+	report, err = dl.SyncFiles(context.Background(), scheduleOf("1"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, report.Replaced)
+	contents, _ := ioutil.ReadFile(filepath.Join(dl.audioDir, "beep-1.ogg"))
+	assert.Equal(t, "V2", string(contents))
+	_, err = os.Stat(filepath.Join(dl.audioDir, "beep-1.wav"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFilesThatCantBeTranscodedAreKept(t *testing.T) {
+	original := transcodeCommand
+	transcodeCommand = func(name string, args ...string) *exec.Cmd { return exec.Command("false") }
+	defer func() { transcodeCommand = original }()
+	_, dl := newTranscodingDownloader(t, map[string]string{"1": "v1"})
+
+	available, err := dl.GetFilesForSchedule(context.Background(), scheduleOf("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]string{1: "beep-1.wav"}, available)
+	_, transcoded := dl.transcoded.Get(1)
+	assert.False(t, transcoded)
+	names, _ := filepath.Glob(filepath.Join(dl.audioDir, "*"))
+	assert.Equal(t, []string{filepath.Join(dl.audioDir, "beep-1.wav")}, names)
+}
+
+func TestTranscodedFilesAreKeptInTheStore(t *testing.T) {
+	store := NewMemoryStore()
+	file := TranscodedFile{Stored: "beep-1.ogg", Original: "beep-1.wav", OriginalSize: 2, OriginalHash: "abc"}
+	OpenTranscodedFiles(store).Set(1, file)
+
+	got, exists := OpenTranscodedFiles(store).Get(1)
+	assert.True(t, exists)
+	assert.Equal(t, file, got)
+
+	assert.Nil(t, store.Put(transcodedFilename, []byte("{")))
+	_, exists = OpenTranscodedFiles(store).Get(1)
+	assert.False(t, exists)
+}
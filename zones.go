@@ -0,0 +1,100 @@
+// Copyright 2018 The Cacophony Project. All rights reserved.
+// Use of this source code is governed by the Apache License Version 2.0;
+// see the LICENSE file for further details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/TheCacophonyProject/audiobait/playlist"
+)
+
+// ZoneConfig is an output, such as a speaker on its own sound card, that plays its own schedule.
+type ZoneConfig struct {
+	Name          string `yaml:"name"`
+	Card          int    `yaml:"card"`
+	VolumeControl string `yaml:"volume-control"`
+	// Device is the ALSA device to play on, e.g. "hw:1,0".
+	Device string `yaml:"device"`
+	// Mono is set if the zone has a single speaker, so sounds can't be panned.
+	Mono bool `yaml:"mono"`
+	// ScheduleFile holds the zone's schedule as JSON.  Zones without one play the schedule from the server.
+	ScheduleFile string `yaml:"schedule-file"`
+}
+
+// validateZones checks the zones have different names and that no two zones share a mixer control, as
+// setting the volume for one would change the volume of the other.
+func validateZones(zones []ZoneConfig) error {
+	names := make(map[string]bool)
+	mixers := make(map[string]string)
+	for _, zone := range zones {
+		if zone.Name == "" {
+			return fmt.Errorf("zone has no name")
+		}
+		if names[zone.Name] {
+			return fmt.Errorf("zone %s is configured more than once", zone.Name)
+		}
+		names[zone.Name] = true
+
+		mixer := fmt.Sprintf("%d/%s", zone.Card, zone.VolumeControl)
+		if other, exists := mixers[mixer]; exists {
+			return fmt.Errorf("zones %s and %s use the same volume control", other, zone.Name)
+		}
+		mixers[mixer] = zone.Name
+	}
+	return nil
+}
+
+// ZoneDevices creates the sound card players for the zones, keyed by zone name.  The ambient sound, if
+// there is one, is paused while any of them plays.
+func (conf *AudioConfig) ZoneDevices(ambient *AmbientLoop) map[string]playlist.AudioDevice {
+	devices := make(map[string]playlist.AudioDevice, len(conf.Zones))
+	for _, zone := range conf.Zones {
+		player := NewSoundCardPlayer(zone.Card, zone.VolumeControl, conf.VolumeCalibration)
+		player.device = zone.Device
+		player.mono = zone.Mono
+		player.ambient = ambient
+		devices[zone.Name] = player
+	}
+	return devices
+}
+
+// ZoneSchedules gets the schedule for each zone, using serverSchedule for the zones without their own.
+func (conf *AudioConfig) ZoneSchedules(serverSchedule playlist.Schedule) ([]playlist.ZoneSchedule, error) {
+	schedules := make([]playlist.ZoneSchedule, 0, len(conf.Zones))
+	for _, zone := range conf.Zones {
+		schedule := serverSchedule
+		if zone.ScheduleFile != "" {
+			var err error
+			if schedule, err = loadScheduleFile(zone.ScheduleFile); err != nil {
+				return nil, fmt.Errorf("zone %s: %v", zone.Name, err)
+			}
+		}
+		schedules = append(schedules, playlist.ZoneSchedule{Zone: zone.Name, Schedule: schedule})
+	}
+	return schedules, nil
+}
+
+func loadScheduleFile(filename string) (playlist.Schedule, error) {
+	var schedule playlist.Schedule
+	jsonData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return schedule, err
+	}
+	if err := playlist.ParseJSONConfigFile(string(jsonData), &schedule); err != nil {
+		return schedule, err
+	}
+	return schedule, schedule.Validate()
+}
+
+// hasSoundsToPlay checks whether any of the zones' schedules has combos.
+func hasSoundsToPlay(schedules []playlist.ZoneSchedule) bool {
+	for _, zoneSchedule := range schedules {
+		if len(zoneSchedule.Schedule.Combos) > 0 {
+			return true
+		}
+	}
+	return false
+}